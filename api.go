@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"net"
+	"net/http"
+
+	"github.com/doody/etcd_file_syncer/backend"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// requestIDHeader carries the request ID, taken from the client when given
+const requestIDHeader = "X-Request-ID"
+
+// requestIDKey is the gin context key of the request ID
+const requestIDKey = "requestID"
+
+// API error codes
+const (
+	codeBadRequest           = "bad_request"
+	codeUnauthorized         = "unauthorized"
+	codeForbidden            = "forbidden"
+	codeNotFound             = "not_found"
+	codeGone                 = "gone"
+	codeConflict             = "conflict"
+	codePreconditionFailed   = "precondition_failed"
+	codePayloadTooLarge      = "payload_too_large"
+	codeUnsupportedMediaType = "unsupported_media_type"
+	codeNotAcceptable        = "not_acceptable"
+	codeUnprocessable        = "unprocessable"
+	codeTooManyRequests      = "too_many_requests"
+	codeNotSupported         = "not_supported"
+	codeETCDError            = "etcd_error"
+	codeUnavailable          = "unavailable"
+	codeInternal             = "internal"
+)
+
+// APIError is the body of every error response
+type APIError struct {
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Details   interface{} `json:"details,omitempty"`
+	RequestID string      `json:"requestId"`
+}
+
+// OKResponse is the body of successful write requests
+type OKResponse struct {
+	Status            string `json:"status"`
+	Revision          int64  `json:"revision,omitempty"`
+	CompactedRevision int64  `json:"compactedRevision,omitempty"`
+}
+
+// requestID will tag every request with an ID, returned in the X-Request-ID header and error bodies
+func requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if id == "" {
+			buf := make([]byte, 8)
+			rand.Read(buf)
+			id = hex.EncodeToString(buf)
+		}
+		c.Set(requestIDKey, id)
+		c.Header(requestIDHeader, id)
+		c.Next()
+	}
+}
+
+// remoteIP will return the address of the peer of c. Unlike gin's ClientIP it ignores X-Forwarded-For,
+// which any client can set.
+func remoteIP(c *gin.Context) string {
+	host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		return c.Request.RemoteAddr
+	}
+	return host
+}
+
+// abortWithError will end the request with an APIError
+func abortWithError(c *gin.Context, statusCode int, code, message string, details interface{}) {
+	c.AbortWithStatusJSON(statusCode, APIError{
+		Code:      code,
+		Message:   message,
+		Details:   details,
+		RequestID: c.GetString(requestIDKey),
+	})
+}
+
+// abortWithBadRequest will end the request with a 400 for a malformed request
+func abortWithBadRequest(c *gin.Context, err error) {
+	abortWithError(c, http.StatusBadRequest, codeBadRequest, err.Error(), nil)
+}
+
+// abortWithErr will end the request with the status and code matching err
+func abortWithErr(c *gin.Context, err error) {
+	statusCode, code := errorStatus(err)
+	if statusCode >= http.StatusInternalServerError {
+		log.WithFields(log.Fields{
+			"path":      c.FullPath(),
+			"requestId": c.GetString(requestIDKey),
+			"err":       err,
+		}).Error("API request failed")
+	}
+	abortWithError(c, statusCode, code, err.Error(), nil)
+}
+
+// errorStatus will map err to an HTTP status and API error code
+func errorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, errKeyNotFound), errors.Is(err, errNotConflicted), errors.Is(err, fs.ErrNotExist),
+		errors.Is(err, errPromotionNotFound), errors.Is(err, errKeyExpired), errors.Is(err, errVersionNotFound):
+		return http.StatusNotFound, codeNotFound
+	case errors.Is(err, errCompacted):
+		return http.StatusGone, codeGone
+	case errors.Is(err, errFutureRevision):
+		return http.StatusBadRequest, codeBadRequest
+	case errors.Is(err, errPatchConflict), errors.Is(err, errNoHorizon), errors.Is(err, errPromotionStale),
+		errors.Is(err, errRemotePaused), errors.Is(err, errRolloutCancelled), errors.Is(err, errRolloutPending),
+		errors.Is(err, errRollbackConflict):
+		return http.StatusConflict, codeConflict
+	case errors.Is(err, errApprovalRequired):
+		return http.StatusForbidden, codeForbidden
+	case errors.Is(err, errRevisionMismatch):
+		return http.StatusPreconditionFailed, codePreconditionFailed
+	case errors.Is(err, errValueTooLarge):
+		return http.StatusRequestEntityTooLarge, codePayloadTooLarge
+	case errors.Is(err, errFiltered), errors.Is(err, errSignatureMissing), errors.Is(err, errSignatureInvalid),
+		errors.Is(err, errChecksumMismatch), errors.Is(err, errPatchFailed):
+		return http.StatusUnprocessableEntity, codeUnprocessable
+	case errors.Is(err, errNotSupported):
+		return http.StatusNotImplemented, codeNotSupported
+	case classifyError(err) != backend.ErrorOther, errors.Is(err, context.DeadlineExceeded):
+		return http.StatusBadGateway, codeETCDError
+	}
+	return http.StatusInternalServerError, codeInternal
+}
+
+// putFileHandler - POST /v1/putFile, uploads a local file to a key
+func putFileHandler(c *gin.Context) {
+	var json FileModel
+	if err := c.ShouldBindJSON(&json); err != nil {
+		abortWithBadRequest(c, err)
+		return
+	}
+	if err := putFileToETCD(c.Request.Context(), json.ETCDKey, json.FilePath); err != nil {
+		abortWithErr(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, OKResponse{Status: "ok"})
+}
+
+// downloadFileHandler - POST /v1/downloadFile, downloads every key under etcdKey into filePath
+func downloadFileHandler(c *gin.Context) {
+	var json FileModel
+	if err := c.ShouldBindJSON(&json); err != nil {
+		abortWithBadRequest(c, err)
+		return
+	}
+	if err := readKeyAndSaveToFolder(c.Request.Context(), json.ETCDKey, json.FilePath); err != nil {
+		abortWithErr(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, OKResponse{Status: "ok"})
+}
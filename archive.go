@@ -0,0 +1,271 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// archiveStagingSuffix and archiveOldSuffix name the directories next to an archive target while it is
+	// extracted and swapped in
+	archiveStagingSuffix = ".extracting"
+	archiveOldSuffix     = ".old"
+)
+
+// archiveExtensions are the archive formats of --archive keys, the target directory is the key without it
+var archiveExtensions = []string{".tar.gz", ".tgz", ".tar", ".zip"}
+
+var (
+	// archiveTargets maps the target directories of archive keys, relative to the folder, to the revision
+	// of the archive extracted in them
+	archiveTargets   = make(map[string]int64)
+	archiveTargetsMu sync.Mutex
+)
+
+// isArchiveKey reports whether etcdKey matches --archive and holds an archive extracted into a directory
+func isArchiveKey(etcdKey string) bool {
+	if archiveExtension(etcdKey) == "" {
+		return false
+	}
+	for _, pattern := range CMDArgs.Archives {
+		if matchPattern(pattern, etcdKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// archiveExtension will return the archive extension of etcdKey, empty when it has none
+func archiveExtension(etcdKey string) string {
+	for _, ext := range archiveExtensions {
+		if strings.HasSuffix(strings.ToLower(etcdKey), ext) && len(etcdKey) > len(ext) {
+			return ext
+		}
+	}
+	return ""
+}
+
+// isArchiveOutput reports whether etcdKey is a file extracted from an archive key, they are not uploaded
+func isArchiveOutput(etcdKey string) bool {
+	archiveTargetsMu.Lock()
+	defer archiveTargetsMu.Unlock()
+	for target := range archiveTargets {
+		for _, dir := range []string{target, target + archiveStagingSuffix, target + archiveOldSuffix} {
+			if strings.HasPrefix(etcdKey, dir+"/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// extractArchive will extract the archive value of etcdKey at revision into its target directory under
+// fileFolder. The archive is extracted next to the target first and swapped in once complete, a broken
+// archive keeps the previous directory.
+func extractArchive(ctx context.Context, etcdKey, fileFolder string, value []byte, revision int64) {
+	target := etcdKey[:len(etcdKey)-len(archiveExtension(etcdKey))]
+	archiveTargetsMu.Lock()
+	extracted, ok := archiveTargets[target]
+	if !ok {
+		archiveTargets[target] = 0
+	}
+	archiveTargetsMu.Unlock()
+	if ok && revision <= extracted {
+		return
+	}
+	if verifyDownload(ctx, etcdKey, value, revision) != nil {
+		return
+	}
+	targetPath := filepath.Join(fileFolder, target)
+	staging := targetPath + archiveStagingSuffix
+	files, err := extractArchiveTo(staging, etcdKey, value)
+	if err == nil {
+		err = swapDir(staging, targetPath)
+	}
+	if err != nil {
+		os.RemoveAll(staging)
+		log.WithFields(log.Fields{
+			"etcdKey":  etcdKey,
+			"revision": revision,
+			"err":      err,
+		}).Error("cannot extract archive, keeping the previous directory")
+		failures.recordFailure(conditionDownloadFailures, err)
+		return
+	}
+	archiveTargetsMu.Lock()
+	archiveTargets[target] = revision
+	archiveTargetsMu.Unlock()
+	failures.recordSuccess(conditionDownloadFailures)
+	publishEvent(eventDownload, etcdKey, targetPath, len(value), revision)
+	log.WithFields(log.Fields{
+		"etcdKey":  etcdKey,
+		"dir":      targetPath,
+		"files":    files,
+		"revision": revision,
+	}).Info("archive extracted")
+}
+
+// removeArchive will delete the directory extracted from the deleted archive key etcdKey
+func removeArchive(etcdKey, fileFolder string, revision int64) {
+	target := etcdKey[:len(etcdKey)-len(archiveExtension(etcdKey))]
+	archiveTargetsMu.Lock()
+	delete(archiveTargets, target)
+	archiveTargetsMu.Unlock()
+	targetPath := filepath.Join(fileFolder, target)
+	if err := os.RemoveAll(targetPath); err != nil {
+		log.WithFields(log.Fields{
+			"dir": targetPath,
+			"err": err,
+		}).Error("cannot delete extracted archive")
+		return
+	}
+	publishEvent(eventDelete, etcdKey, targetPath, 0, revision)
+}
+
+// extractArchiveTo will extract value, an archive in the format of the extension of etcdKey, into the
+// new directory dir and return the number of files written
+func extractArchiveTo(dir, etcdKey string, value []byte) (files int, err error) {
+	if err := os.RemoveAll(dir); err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+	budget := CMDArgs.ArchiveMaxSize
+	if archiveExtension(etcdKey) == ".zip" {
+		return extractZip(dir, value, &budget)
+	}
+	var r io.Reader = bytes.NewReader(value)
+	if ext := archiveExtension(etcdKey); ext == ".tar.gz" || ext == ".tgz" {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return 0, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	return extractTar(dir, r, &budget)
+}
+
+// extractTar will extract the tar stream r into dir
+func extractTar(dir string, r io.Reader, budget *int64) (files int, err error) {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		} else if err != nil {
+			return files, err
+		}
+		filePath, err := archiveEntryPath(dir, header.Name)
+		if err != nil {
+			return files, err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(filePath, 0755)
+		case tar.TypeReg, tar.TypeRegA:
+			err = extractFile(filePath, tr, os.FileMode(header.Mode), budget)
+			files++
+		case tar.TypeXGlobalHeader:
+			// pax headers written by git archive
+		default:
+			err = fmt.Errorf("unsupported entry %q of type %q, only files and directories are extracted", header.Name, header.Typeflag)
+		}
+		if err != nil {
+			return files, err
+		}
+	}
+}
+
+// extractZip will extract the zip archive value into dir
+func extractZip(dir string, value []byte, budget *int64) (files int, err error) {
+	zr, err := zip.NewReader(bytes.NewReader(value), int64(len(value)))
+	if err != nil {
+		return 0, err
+	}
+	for _, f := range zr.File {
+		filePath, err := archiveEntryPath(dir, f.Name)
+		if err != nil {
+			return files, err
+		}
+		switch mode := f.Mode(); {
+		case mode.IsDir():
+			err = os.MkdirAll(filePath, 0755)
+		case mode.IsRegular():
+			var rc io.ReadCloser
+			if rc, err = f.Open(); err == nil {
+				err = extractFile(filePath, rc, mode, budget)
+				rc.Close()
+			}
+			files++
+		default:
+			err = fmt.Errorf("unsupported entry %q of type %v, only files and directories are extracted", f.Name, mode.Type())
+		}
+		if err != nil {
+			return files, err
+		}
+	}
+	return files, nil
+}
+
+// archiveEntryPath will return where the archive entry name goes under dir, refusing names that would
+// end up outside of it
+func archiveEntryPath(dir, name string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(clean) || filepath.VolumeName(clean) != "" || clean == ".." ||
+		strings.HasPrefix(clean, ".."+string(filepath.Separator)) || strings.HasPrefix(name, "/") {
+		return "", fmt.Errorf("unsafe path %q in archive", name)
+	}
+	return filepath.Join(dir, clean), nil
+}
+
+// extractFile will write r to filePath with the permissions of mode, taking its size off budget
+func extractFile(filePath string, r io.Reader, mode os.FileMode, budget *int64) error {
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return err
+	}
+	perm := mode.Perm()
+	if perm == 0 {
+		perm = 0644
+	}
+	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	n, err := io.CopyN(f, r, *budget+1)
+	if cerr := f.Close(); err == nil || err == io.EOF {
+		err = cerr
+	}
+	if *budget -= n; *budget < 0 {
+		return fmt.Errorf("archive expands to more than --archive-max-size %d bytes", CMDArgs.ArchiveMaxSize)
+	}
+	return err
+}
+
+// swapDir will replace the directory target with staging, removing the previous one
+func swapDir(staging, target string) error {
+	old := target + archiveOldSuffix
+	if err := os.RemoveAll(old); err != nil {
+		return err
+	}
+	if err := os.Rename(target, old); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(staging, target); err != nil {
+		os.Rename(old, target)
+		return err
+	}
+	return os.RemoveAll(old)
+}
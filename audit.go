@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Audit log actions
+const (
+	auditSelfHeal = "self-heal"
+	auditCompact  = "compact"
+	auditImport   = "import"
+	auditPatch    = "patch"
+	auditConflict = "conflict"
+	auditResolve  = "resolve"
+	auditPromote  = "promote"
+
+	auditRolloutCancel = "rollout-cancel"
+	auditRemotePause   = "remote-pause"
+	auditRollback      = "rollback"
+	auditChange        = "change"
+	auditVerify        = "verify-failed"
+
+	auditUploadsPaused = "uploads-paused"
+)
+
+// auditEntry is a single JSON line of the audit log
+type auditEntry struct {
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`
+	ETCDKey  string    `json:"etcdKey,omitempty"`
+	FilePath string    `json:"filePath,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+}
+
+var (
+	auditFile *os.File
+	auditMu   sync.Mutex
+)
+
+// openAuditLog will open (or create) the audit log at logPath in append mode
+func openAuditLog(logPath string) (err error) {
+	auditFile, err = os.OpenFile(logPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	return err
+}
+
+// writeAudit will append entry to the audit log, it does nothing when no audit log is configured
+func writeAudit(entry auditEntry) {
+	if auditFile == nil {
+		return
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"action": entry.Action,
+			"err":    err,
+		}).Error("cannot encode audit entry")
+		return
+	}
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if _, err := auditFile.Write(append(line, '\n')); err != nil {
+		log.WithFields(log.Fields{
+			"action": entry.Action,
+			"err":    err,
+		}).Error("cannot write audit log")
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// basicAuthRealm is announced in the WWW-Authenticate header of 401 answers
+const basicAuthRealm = "etcd_file_syncer"
+
+// dummyHash is compared against when the user is unknown, so unknown users take as long as wrong passwords
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.MinCost)
+
+var (
+	// apiUsers maps user names to the bcrypt hash of their password, nil unless --basic-auth-file is given
+	apiUsers map[string][]byte
+	// allowedNets are the networks allowed to call the API, nil unless --allow-cidr is given
+	allowedNets []*net.IPNet
+	// verifiedCredentials caches the credentials already checked, bcrypt is made to be slow
+	verifiedCredentials   = make(map[[sha256.Size]byte]bool)
+	verifiedCredentialsMu sync.Mutex
+)
+
+// loadUsers will read an htpasswd file of user:bcrypt-hash lines, as written by htpasswd -B
+func loadUsers(path string) (map[string][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		i := strings.Index(text, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("line %d: expected user:hash", line)
+		}
+		hash := []byte(text[i+1:])
+		if _, err := bcrypt.Cost(hash); err != nil {
+			return nil, fmt.Errorf("line %d: password of %s is not a bcrypt hash: %v", line, text[:i], err)
+		}
+		users[text[:i]] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, fmt.Errorf("no user in %s", path)
+	}
+	return users, nil
+}
+
+// parseCIDRs will parse --allow-cidr networks, a bare IP allows that address only
+func parseCIDRs(args []string) (nets []*net.IPNet, err error) {
+	for _, cidr := range splitList(args) {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// allowCIDRs will answer 403 to peers outside nets. Peers on a unix socket have no address and are
+// always allowed, the socket permissions protect it.
+func allowCIDRs(nets []*net.IPNet) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		addr := remoteIP(c)
+		ip := net.ParseIP(addr)
+		if ip == nil && unixListener {
+			c.Next()
+			return
+		}
+		for _, ipNet := range nets {
+			if ip != nil && ipNet.Contains(ip) {
+				c.Next()
+				return
+			}
+		}
+		log.WithFields(log.Fields{
+			"clientIP": addr,
+			"path":     c.Request.URL.Path,
+		}).Warn("API request from a network not allowed")
+		abortWithError(c, http.StatusForbidden, codeForbidden, "client address not allowed", nil)
+	}
+}
+
+// basicAuth will answer 401 to requests without the credentials of one of users
+func basicAuth(users map[string][]byte) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, password, ok := c.Request.BasicAuth()
+		if ok && checkCredentials(users, user, password) {
+			c.Set(gin.AuthUserKey, user)
+			c.Next()
+			return
+		}
+		if ok {
+			log.WithFields(log.Fields{
+				"user":     user,
+				"clientIP": remoteIP(c),
+			}).Warn("API request with invalid credentials")
+		}
+		c.Header("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", basicAuthRealm))
+		abortWithError(c, http.StatusUnauthorized, codeUnauthorized, "authentication required", nil)
+	}
+}
+
+// checkCredentials reports whether password is the password of user
+func checkCredentials(users map[string][]byte, user, password string) bool {
+	key := sha256.Sum256([]byte(user + "\x00" + password))
+	verifiedCredentialsMu.Lock()
+	valid, known := verifiedCredentials[key]
+	verifiedCredentialsMu.Unlock()
+	if known {
+		return valid
+	}
+	hash, ok := users[user]
+	if !ok {
+		hash = dummyHash
+	}
+	valid = bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil && ok
+	if valid {
+		// failures are not cached, they would let a client fill the cache
+		verifiedCredentialsMu.Lock()
+		verifiedCredentials[key] = true
+		verifiedCredentialsMu.Unlock()
+	}
+	return valid
+}
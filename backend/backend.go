@@ -0,0 +1,115 @@
+// Package backend defines the key-value stores etcd_file_syncer syncs files with.
+//
+// A store is added by implementing Store and registering it under a name in an init function, the name
+// is then accepted by --backend. Building the syncer with a store of another module only takes a file
+// of package main blank importing it:
+//
+//	import _ "example.com/mystore"
+package backend
+
+import (
+	"context"
+	"errors"
+)
+
+// Event types
+const (
+	EventPut    = "put"
+	EventDelete = "delete"
+)
+
+// ErrNotSupported is returned for operations the store has no equivalent of
+var ErrNotSupported = errors.New("not supported by the backend")
+
+// ErrCompacted and ErrFutureRevision are returned when reading at a revision the store no longer keeps,
+// or hasn't reached yet
+var (
+	ErrCompacted      = errors.New("revision compacted")
+	ErrFutureRevision = errors.New("revision not reached yet")
+)
+
+// KV is a key with its value and the revision it was last modified at. Version counts the modifications
+// of the key since its creation, 0 when the store doesn't track it.
+type KV struct {
+	Key      string
+	Value    []byte
+	Revision int64
+	Version  int64
+}
+
+// Op is one write of a transaction, a put of Value or, with Delete, a delete of Key
+type Op struct {
+	Key    string
+	Value  []byte
+	Delete bool
+}
+
+// Cmp is a condition of a transaction: Key was last modified at Revision, 0 meaning it doesn't exist
+type Cmp struct {
+	Key      string
+	Revision int64
+}
+
+// Event is a change of a key, Revision of a delete event is the revision of the delete
+type Event struct {
+	Type string
+	KV   KV
+}
+
+// WatchResponse is a batch of events, or a progress notification when there are none
+type WatchResponse struct {
+	// Revision is the store revision every change up to has been delivered
+	Revision int64
+	Events   []Event
+	// CompactRevision is set when the requested revision is no longer available, events were lost
+	CompactRevision int64
+	Err             error
+}
+
+// Store is a key-value store files are synced with. Revisions are monotonic across every key of the
+// store, a key's revision is the one it was last modified at. Methods are called concurrently.
+type Store interface {
+	// Get will return key, nil when it doesn't exist, and the store revision of the read
+	Get(ctx context.Context, key string) (kv *KV, revision int64, err error)
+	// List will return every key under prefix in key order and the store revision of the read
+	List(ctx context.Context, prefix string) (kvs []KV, revision int64, err error)
+	// Txn will apply ops atomically when every cmp holds, returning whether it did and the revision of the write
+	Txn(ctx context.Context, cmps []Cmp, ops []Op) (succeeded bool, revision int64, err error)
+	// Watch will stream the changes under prefix after revision, or from now when revision is 0, until ctx
+	// is canceled or the watch fails, closing the channel. Responses without events are sent regularly.
+	Watch(ctx context.Context, prefix string, revision int64) <-chan WatchResponse
+	// Revision will return the current store revision and the last revision a key under prefix changed at
+	Revision(ctx context.Context, prefix string) (head, lastChange int64, err error)
+	// MaxValueSize is the largest key and value a single put can carry, MaxTxnOps the most operations a
+	// transaction can hold, 0 without limit
+	MaxValueSize() int
+	MaxTxnOps() int
+	Close() error
+}
+
+// Compactor is implemented by stores keeping a history that can be compacted
+type Compactor interface {
+	// Compact will drop the history before revision
+	Compact(ctx context.Context, revision int64) error
+}
+
+// RevisionReader is implemented by stores keeping a history that can be read
+type RevisionReader interface {
+	// GetAt will return key as of revision, nil when it didn't exist then
+	GetAt(ctx context.Context, key string, revision int64) (*KV, error)
+}
+
+// ErrorClass tells how the syncer handles an error returned by a store
+type ErrorClass int
+
+// Error classes
+const (
+	// ErrorOther is an error the store doesn't know of
+	ErrorOther ErrorClass = iota
+	// ErrorFailed is a request the store failed, answered with a 502 by the API
+	ErrorFailed
+	// ErrorTransient is a failed request worth retrying
+	ErrorTransient
+	// ErrorAuth is the store rejecting the credentials or permissions, the syncer exits with code 4
+	ErrorAuth
+)
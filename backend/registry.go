@@ -0,0 +1,73 @@
+package backend
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// Options are the settings of the syncer a store is opened with
+type Options struct {
+	// Prefix is the --key synced
+	Prefix string
+	// StartupRetries is how many times connecting should be retried, with exponential backoff
+	StartupRetries int
+	// Params are the name=value pairs of --backend-option
+	Params map[string]string
+}
+
+// Backend is a registered store
+type Backend struct {
+	Name string
+	// Open will connect to the store, failing when it cannot be reached after opts.StartupRetries retries
+	Open func(ctx context.Context, opts Options) (Store, error)
+	// Classify will tell the class of an error returned by the store, every error is ErrorOther when nil
+	Classify func(err error) ErrorClass
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Backend)
+)
+
+// Register will make b available under its name. It panics when the name is empty or already taken.
+func Register(b Backend) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if b.Name == "" || b.Open == nil {
+		panic("backend: Register of a backend without name or Open")
+	}
+	if _, ok := registry[b.Name]; ok {
+		panic("backend: Register called twice for " + b.Name)
+	}
+	registry[b.Name] = b
+}
+
+// Lookup will return the backend registered under name
+func Lookup(name string) (Backend, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	b, ok := registry[name]
+	return b, ok
+}
+
+// Names will return the names of the registered backends in order
+func Names() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Classify will return the class of err for the backend registered under name
+func Classify(name string, err error) ErrorClass {
+	b, ok := Lookup(name)
+	if !ok || b.Classify == nil || err == nil {
+		return ErrorOther
+	}
+	return b.Classify(err)
+}
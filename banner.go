@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// bannerMarker identifies the banner line prepended by --banner, it is stripped again on upload
+const bannerMarker = "managed by etcd-file-syncer, source key "
+
+// bannerRules are the parsed --banner-comment rules, overriding defaultBannerComment
+var bannerRules []patternRule
+
+// bannerComment will return the comment prefix and suffix of the banner of etcdKey, or false when it gets none
+func bannerComment(etcdKey string) (prefix, suffix string, ok bool) {
+	syntax, ok := matchRule(bannerRules, etcdKey)
+	if !ok {
+		syntax, ok = defaultBannerComment(strings.ToLower(path.Ext(etcdKey)))
+	}
+	fields := strings.Fields(syntax)
+	switch {
+	case !ok || len(fields) == 0:
+		return "", "", false
+	case len(fields) == 1:
+		return fields[0], "", true
+	}
+	return fields[0], fields[1], true
+}
+
+// defaultBannerComment will return the comment syntax of the banner of files with extension ext, a prefix
+// and an optional suffix. Files with another extension, ex: .json, get no banner.
+func defaultBannerComment(ext string) (string, bool) {
+	switch ext {
+	case ".sh", ".bash", ".zsh", ".py", ".rb", ".pl", ".r", ".ps1", ".yaml", ".yml", ".toml", ".conf", ".cfg",
+		".properties", ".env", ".tf", ".hcl", ".service", ".timer", ".socket":
+		return "#", true
+	case ".ini":
+		return ";", true
+	case ".go", ".js", ".ts", ".java", ".c", ".h", ".cc", ".cpp", ".rs", ".kt", ".scala", ".swift", ".proto",
+		".jsonnet", ".libsonnet":
+		return "//", true
+	case ".sql", ".lua", ".hs":
+		return "--", true
+	case ".css", ".scss":
+		return "/* */", true
+	case ".xml", ".html", ".htm", ".svg", ".md":
+		return "<!-- -->", true
+	case ".vim":
+		return `"`, true
+	}
+	return "", false
+}
+
+// injectBanner will return value with the banner naming etcdKey and revision prepended, after the shebang
+// or XML declaration when there is one. Binary values and keys without comment syntax are left alone.
+func injectBanner(etcdKey string, value []byte, revision int64) []byte {
+	if !CMDArgs.Banner || !isText(value) {
+		return value
+	}
+	prefix, suffix, ok := bannerComment(etcdKey)
+	if !ok {
+		return value
+	}
+	offset := bannerOffset(value)
+	if offset < 0 {
+		return value
+	}
+	if suffix != "" {
+		suffix = " " + suffix
+	}
+	newline := "\n"
+	if bytes.Contains(value, []byte("\r\n")) {
+		newline = "\r\n"
+	}
+	banner := fmt.Sprintf("%s %s%s, revision %d - do not edit%s%s", prefix, bannerMarker, etcdKey, revision, suffix, newline)
+	content := make([]byte, 0, len(value)+len(banner))
+	content = append(content, value[:offset]...)
+	content = append(content, banner...)
+	return append(content, value[offset:]...)
+}
+
+// stripBanner will return content without the banner added by injectBanner
+func stripBanner(content []byte) []byte {
+	if !CMDArgs.Banner {
+		return content
+	}
+	offset := bannerOffset(content)
+	if offset < 0 {
+		return content
+	}
+	end := bytes.IndexByte(content[offset:], '\n')
+	if end < 0 || !bytes.Contains(content[offset:offset+end], []byte(bannerMarker)) {
+		return content
+	}
+	return append(content[:offset:offset], content[offset+end+1:]...)
+}
+
+// bannerOffset will return where the banner goes in content: after its first line when it is a shebang or
+// an XML declaration, which must stay first, -1 when that line is all there is
+func bannerOffset(content []byte) int {
+	if !bytes.HasPrefix(content, []byte("#!")) && !bytes.HasPrefix(content, []byte("<?xml")) {
+		return 0
+	}
+	i := bytes.IndexByte(content, '\n')
+	if i < 0 {
+		return -1
+	}
+	return i + 1
+}
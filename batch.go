@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// fileUpload is a local file to be written to ETCD
+type fileUpload struct {
+	ETCDKey  string
+	FilePath string
+}
+
+// uploadBatch is one transaction worth of uploads
+type uploadBatch struct {
+	files     []fileUpload
+	hashes    []string
+	revisions []int64
+	sizes     []int
+	compares  []storeCmp
+	// fileOps are the operations of each file, ops all of them
+	fileOps [][]storeOp
+	ops     []storeOp
+	size    int
+}
+
+// putFilesToETCD will upload files in as few transactions as --txn-max-ops and --txn-max-bytes allow,
+// in key order, so consumers see a whole scan cycle as one (or a few) revision jumps. A file's content
+// and metadata always land in the same transaction. A failed batch doesn't stop the following ones.
+// Keys changed in ETCD since their file was last synced are not overwritten, the watch turns them
+// into conflicts; conflicted files are skipped.
+func putFilesToETCD(ctx context.Context, files []fileUpload) {
+	if len(files) == 0 {
+		return
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ETCDKey < files[j].ETCDKey })
+
+	var batches []*uploadBatch
+	current := &uploadBatch{}
+	for _, file := range files {
+		if isConflicted(file.FilePath) {
+			continue
+		}
+		ops, size, hash, err := fileUploadOps(file.ETCDKey, file.FilePath)
+		if err != nil {
+			continue
+		}
+		// a file never synced must not exist in ETCD yet, its revision is 0
+		synced, _ := lastSynced(file.FilePath)
+		if len(current.ops) > 0 && (len(current.ops)+len(ops) > txnMaxOps() || current.size+size > CMDArgs.TxnMaxBytes) {
+			batches = append(batches, current)
+			current = &uploadBatch{}
+		}
+		current.files = append(current.files, file)
+		current.hashes = append(current.hashes, hash)
+		current.revisions = append(current.revisions, synced.Revision)
+		current.sizes = append(current.sizes, len(ops[0].Value))
+		current.compares = append(current.compares, storeCmp{Key: file.ETCDKey, Revision: synced.Revision})
+		current.fileOps = append(current.fileOps, ops)
+		current.ops = append(current.ops, ops...)
+		current.size += size
+	}
+	if len(current.ops) > 0 {
+		batches = append(batches, current)
+	}
+
+	for i, batch := range batches {
+		var (
+			succeeded bool
+			revision  int64
+		)
+		err := withETCDRetry(ctx, func(ctx context.Context) (err error) {
+			succeeded, revision, err = kvStore.Txn(ctx, batch.compares, batch.ops)
+			return err
+		})
+		if err != nil {
+			log.WithFields(log.Fields{
+				"batch": i + 1,
+				"files": len(batch.files),
+				"err":   err,
+			}).Error("error putting batch to ETCD")
+			exitOnFatal(err)
+			failures.recordFailure(conditionUploadFailures, err)
+			continue
+		}
+		if !succeeded {
+			// some keys changed in ETCD, upload the others one by one
+			uploaded := 0
+			for j, file := range batch.files {
+				if uploadIfUnchanged(ctx, file.ETCDKey, file.FilePath, batch.revisions[j]) {
+					uploaded++
+				}
+			}
+			log.WithFields(log.Fields{
+				"batch":    i + 1,
+				"files":    len(batch.files),
+				"uploaded": uploaded,
+			}).Warn("keys changed in ETCD, batch uploaded file by file")
+			continue
+		}
+		for j, file := range batch.files {
+			recordUpload(file.ETCDKey, file.FilePath, batch.hashes[j], batch.sizes[j], revision)
+			verifyUpload(ctx, file.ETCDKey, file.FilePath, batch.fileOps[j], revision)
+		}
+		log.WithFields(log.Fields{
+			"batch":    i + 1,
+			"batches":  len(batches),
+			"files":    len(batch.files),
+			"bytes":    batch.size,
+			"revision": revision,
+		}).Info("uploaded batch")
+	}
+}
+
+// splitOps will split ops into transactions bounded by --txn-max-ops and --txn-max-bytes, keeping their order
+func splitOps(ops []storeOp) (batches [][]storeOp) {
+	var (
+		current []storeOp
+		size    int
+	)
+	for _, op := range ops {
+		if len(current) > 0 && (len(current)+1 > txnMaxOps() || size+opSize(op) > CMDArgs.TxnMaxBytes) {
+			batches = append(batches, current)
+			current, size = nil, 0
+		}
+		current = append(current, op)
+		size += opSize(op)
+	}
+	if len(current) > 0 {
+		batches = append(batches, current)
+	}
+	return batches
+}
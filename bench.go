@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Size distributions of the bench files
+const (
+	benchSizeFixed       = "fixed"
+	benchSizeUniform     = "uniform"
+	benchSizeExponential = "exponential"
+)
+
+// BenchCmd - bench subcommand
+type BenchCmd struct {
+	Prefix      string `arg:"--prefix,required" help:"prefix the generated keys are written under, outside of the --key syncers watch"`
+	Force       bool   `arg:"--force" help:"write under --prefix even when it overlaps --key"`
+	Files       int    `arg:"--files" default:"1000" help:"files generated"`
+	Size        int    `arg:"--size" default:"4096" help:"mean file size in bytes"`
+	SizeDist    string `arg:"--size-dist" default:"fixed" help:"file size distribution, fixed, uniform (0 to twice --size) or exponential"`
+	FilesPerDir int    `arg:"--files-per-dir" default:"100" help:"files per generated directory"`
+	Seed        int64  `arg:"--seed" default:"1" help:"seed of the generated tree"`
+	Keep        bool   `arg:"--keep" help:"keep the keys written instead of deleting them once done"`
+	JSON        bool   `arg:"--json" help:"print the report as JSON"`
+}
+
+// BenchLatency is the latency of a kind of store request
+type BenchLatency struct {
+	Requests int           `json:"requests"`
+	P50      time.Duration `json:"p50"`
+	P90      time.Duration `json:"p90"`
+	P99      time.Duration `json:"p99"`
+	Max      time.Duration `json:"max"`
+}
+
+// BenchPhase is the outcome of pushing or pulling the tree
+type BenchPhase struct {
+	Duration       time.Duration           `json:"duration"`
+	FilesPerSecond float64                 `json:"filesPerSecond"`
+	BytesPerSecond float64                 `json:"bytesPerSecond"`
+	Requests       map[string]BenchLatency `json:"requests"`
+}
+
+// BenchReport is what the bench subcommand prints
+type BenchReport struct {
+	Prefix   string     `json:"prefix"`
+	Files    int        `json:"files"`
+	Bytes    int64      `json:"bytes"`
+	SizeDist string     `json:"sizeDist"`
+	Push     BenchPhase `json:"push"`
+	Pull     BenchPhase `json:"pull"`
+}
+
+// benchStore is a store timing every request, by kind
+type benchStore struct {
+	store
+
+	mu        sync.Mutex
+	latencies map[string][]time.Duration
+}
+
+// record will add the latency of a request of kind started at start
+func (s *benchStore) record(kind string, start time.Time) {
+	s.mu.Lock()
+	s.latencies[kind] = append(s.latencies[kind], time.Since(start))
+	s.mu.Unlock()
+}
+
+// take will return the latencies of every kind of request since the last call
+func (s *benchStore) take() map[string]BenchLatency {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := make(map[string]BenchLatency, len(s.latencies))
+	for kind, latencies := range s.latencies {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		at := func(p float64) time.Duration { return latencies[int(p*float64(len(latencies)-1))] }
+		stats[kind] = BenchLatency{
+			Requests: len(latencies),
+			P50:      at(0.5),
+			P90:      at(0.9),
+			P99:      at(0.99),
+			Max:      latencies[len(latencies)-1],
+		}
+	}
+	s.latencies = make(map[string][]time.Duration)
+	return stats
+}
+
+// Get - store
+func (s *benchStore) Get(ctx context.Context, key string) (*storeKV, int64, error) {
+	defer s.record("get", time.Now())
+	return s.store.Get(ctx, key)
+}
+
+// List - store
+func (s *benchStore) List(ctx context.Context, prefix string) ([]storeKV, int64, error) {
+	defer s.record("list", time.Now())
+	return s.store.List(ctx, prefix)
+}
+
+// Txn - store
+func (s *benchStore) Txn(ctx context.Context, cmps []storeCmp, ops []storeOp) (bool, int64, error) {
+	defer s.record("txn", time.Now())
+	return s.store.Txn(ctx, cmps, ops)
+}
+
+// Revision - store
+func (s *benchStore) Revision(ctx context.Context, prefix string) (int64, int64, error) {
+	defer s.record("revision", time.Now())
+	return s.store.Revision(ctx, prefix)
+}
+
+// runBench will upload a generated tree under a fresh prefix of --key the way the scan does, download it the way
+// a starting syncer does, print the throughput and latency of both, then delete the keys
+func runBench(ctx context.Context, cmd *BenchCmd) int {
+	if cmd.Files <= 0 || cmd.Size < 0 || cmd.FilesPerDir <= 0 {
+		fmt.Fprintln(os.Stderr, "error: --files and --files-per-dir must be positive, --size cannot be negative")
+		return exitConfigError
+	}
+	if cmd.SizeDist != benchSizeFixed && cmd.SizeDist != benchSizeUniform && cmd.SizeDist != benchSizeExponential {
+		fmt.Fprintf(os.Stderr, "error: --size-dist must be %q, %q or %q\n", benchSizeFixed, benchSizeUniform,
+			benchSizeExponential)
+		return exitConfigError
+	}
+	if (strings.HasPrefix(cmd.Prefix, CMDArgs.ConfigKey) || strings.HasPrefix(CMDArgs.ConfigKey, cmd.Prefix)) && !cmd.Force {
+		// the syncers of --key would download the tree and run their hooks for every file
+		fmt.Fprintf(os.Stderr, "error: --prefix %q overlaps --key %q, pick a prefix no syncer watches or pass --force\n",
+			cmd.Prefix, CMDArgs.ConfigKey)
+		return exitConfigError
+	}
+	// the batches and files are logged at info level
+	log.SetLevel(log.WarnLevel)
+	fileChangeMap = make(map[string]time.Time)
+	bench := &benchStore{store: kvStore, latencies: make(map[string][]time.Duration)}
+	kvStore = bench
+
+	workDir, err := os.MkdirTemp("", "etcd_file_syncer-bench-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	defer os.RemoveAll(workDir)
+	prefix := fmt.Sprintf("%sbench-%d/", cmd.Prefix, time.Now().UnixNano())
+	report := BenchReport{Prefix: prefix, Files: cmd.Files, SizeDist: cmd.SizeDist}
+
+	pushFolder := filepath.Join(workDir, "push")
+	uploads, bytes, err := generateBenchTree(cmd, pushFolder, prefix)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "cannot generate the files:", err)
+		return 1
+	}
+	report.Bytes = bytes
+	if !cmd.Keep {
+		defer deletePrefix(context.Background(), prefix)
+	}
+
+	start := time.Now()
+	putFilesToETCD(ctx, uploads)
+	report.Push = benchPhase(time.Since(start), cmd.Files, bytes, bench.take())
+
+	pullFolder := filepath.Join(workDir, "pull")
+	start = time.Now()
+	err = readKeyAndSaveToFolder(ctx, prefix, pullFolder)
+	report.Pull = benchPhase(time.Since(start), cmd.Files, bytes, bench.take())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "cannot download the files:", err)
+		return 1
+	}
+
+	if cmd.JSON {
+		json.NewEncoder(os.Stdout).Encode(report)
+	} else {
+		printBenchReport(os.Stdout, &report)
+	}
+	if pulled := countFiles(pullFolder); pulled != cmd.Files {
+		fmt.Fprintf(os.Stderr, "only %d of the %d files made the round trip, see the log\n", pulled, cmd.Files)
+		return 1
+	}
+	return 0
+}
+
+// generateBenchTree will write cmd.Files files of random text under folder, keyed under prefix, and return them
+// with their total size
+func generateBenchTree(cmd *BenchCmd, folder, prefix string) (uploads []fileUpload, bytes int64, err error) {
+	r := rand.New(rand.NewSource(cmd.Seed))
+	const letters = "abcdefghijklmnopqrstuvwxyz0123456789\n"
+	for i := 0; i < cmd.Files; i++ {
+		size := cmd.Size
+		switch cmd.SizeDist {
+		case benchSizeUniform:
+			size = r.Intn(2*cmd.Size + 1)
+		case benchSizeExponential:
+			size = int(r.ExpFloat64() * float64(cmd.Size))
+		}
+		content := make([]byte, size)
+		for j := range content {
+			content[j] = letters[r.Intn(len(letters))]
+		}
+		etcdKey := fmt.Sprintf("%sdir%04d/file%06d.txt", prefix, i/cmd.FilesPerDir, i)
+		filePath := filepath.Join(folder, filepath.FromSlash(etcdKey))
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			return nil, 0, err
+		}
+		if err := os.WriteFile(filePath, content, 0644); err != nil {
+			return nil, 0, err
+		}
+		uploads = append(uploads, fileUpload{ETCDKey: etcdKey, FilePath: filePath})
+		bytes += int64(size)
+	}
+	return uploads, bytes, nil
+}
+
+// benchPhase will return the throughput of files files of bytes bytes moved in elapsed
+func benchPhase(elapsed time.Duration, files int, bytes int64, requests map[string]BenchLatency) BenchPhase {
+	return BenchPhase{
+		Duration:       elapsed,
+		FilesPerSecond: float64(files) / elapsed.Seconds(),
+		BytesPerSecond: float64(bytes) / elapsed.Seconds(),
+		Requests:       requests,
+	}
+}
+
+// countFiles will return the number of files under folder
+func countFiles(folder string) (n int) {
+	filepath.Walk(folder, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			n++
+		}
+		return nil
+	})
+	return n
+}
+
+// deletePrefix will delete every key under prefix
+func deletePrefix(ctx context.Context, prefix string) {
+	var kvs []storeKV
+	err := withETCDRetry(ctx, func(ctx context.Context) (err error) {
+		kvs, _, err = kvStore.List(ctx, prefix)
+		return err
+	})
+	ops := make([]storeOp, 0, len(kvs))
+	for _, kv := range kvs {
+		ops = append(ops, deleteOp(kv.Key))
+	}
+	for _, batch := range splitOps(ops) {
+		if err != nil {
+			break
+		}
+		err = withETCDRetry(ctx, func(ctx context.Context) error {
+			_, _, err := kvStore.Txn(ctx, nil, batch)
+			return err
+		})
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"prefix": prefix,
+			"err":    err,
+		}).Error("cannot delete the bench keys")
+	}
+}
+
+// printBenchReport will write a human readable report to w
+func printBenchReport(w io.Writer, report *BenchReport) {
+	fmt.Fprintf(w, "%d files, %s (%s sizes) under %s\n\n", report.Files, formatBytes(float64(report.Bytes)),
+		report.SizeDist, report.Prefix)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "\ttime\tfiles/s\tthroughput\trequests\tp50\tp90\tp99\tmax")
+	for _, phase := range []struct {
+		name string
+		BenchPhase
+	}{{"push", report.Push}, {"pull", report.Pull}} {
+		fmt.Fprintf(tw, "%s\t%s\t%.0f\t%s/s\t\n", phase.name, phase.Duration.Round(time.Millisecond),
+			phase.FilesPerSecond, formatBytes(phase.BytesPerSecond))
+		kinds := make([]string, 0, len(phase.Requests))
+		for kind := range phase.Requests {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+		for _, kind := range kinds {
+			l := phase.Requests[kind]
+			fmt.Fprintf(tw, "  %s\t\t\t\t%d\t%s\t%s\t%s\t%s\n", kind, l.Requests, l.P50.Round(time.Microsecond),
+				l.P90.Round(time.Microsecond), l.P99.Round(time.Microsecond), l.Max.Round(time.Microsecond))
+		}
+	}
+	tw.Flush()
+}
+
+// formatBytes will render n bytes with a binary unit
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB"}
+	i := 0
+	for ; n >= 1024 && i < len(units)-1; i++ {
+		n /= 1024
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
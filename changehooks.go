@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// orderRule is a parsed --apply-order entry, keys matching Pattern are applied by increasing Priority
+type orderRule struct {
+	Pattern  string
+	Priority int
+}
+
+// namedHook is a --hook: it runs once per batch of changes when one of its keys changed or a hook it
+// depends on ran, after those hooks, and is skipped when one of them failed
+type namedHook struct {
+	Name     string
+	Command  string
+	Patterns []string
+	After    []string
+}
+
+// fileChange is a file written or deleted from ETCD, waiting for its --on-change hook
+type fileChange struct {
+	Action   string
+	ETCDKey  string
+	FilePath string
+	Revision int64
+}
+
+var (
+	// applyOrderRules are the parsed --apply-order entries
+	applyOrderRules []orderRule
+	// changeHookRules are the parsed --on-change rules
+	changeHookRules []patternRule
+	// namedHooks are the parsed --hook definitions, each after the hooks it depends on
+	namedHooks []*namedHook
+
+	// pendingChanges are the changes applied since the hooks last ran, in apply order
+	pendingChanges   []fileChange
+	pendingChangesMu sync.Mutex
+	// changeHooksMu runs one batch of hooks at a time
+	changeHooksMu sync.Mutex
+)
+
+// parseApplyOrder will parse --apply-order patterns, ordered by position or by an explicit pattern=priority
+func parseApplyOrder(args []string) ([]orderRule, error) {
+	rules := make([]orderRule, 0, len(args))
+	for i, a := range args {
+		rule := orderRule{Pattern: a, Priority: i}
+		if j := strings.LastIndex(a, "="); j > 0 {
+			priority, err := strconv.Atoi(a[j+1:])
+			if err != nil {
+				return nil, fmt.Errorf("%q is not pattern or pattern=priority", a)
+			}
+			rule = orderRule{Pattern: a[:j], Priority: priority}
+		}
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("bad pattern %q: %v", rule.Pattern, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// parseChangeHooks will parse --on-change pattern=command rules, split at the first = as commands may hold some
+func parseChangeHooks(args []string) ([]patternRule, error) {
+	rules := make([]patternRule, 0, len(args))
+	for _, a := range args {
+		pattern, command, err := splitRule(a, "pattern=command")
+		if err != nil {
+			return nil, err
+		}
+		rule := patternRule{Pattern: pattern, Value: command}
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("bad pattern %q: %v", rule.Pattern, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// splitRule will split a name=value argument at the first =
+func splitRule(a, form string) (name, value string, err error) {
+	i := strings.Index(a, "=")
+	if i <= 0 || i == len(a)-1 {
+		return "", "", fmt.Errorf("%q is not %s", a, form)
+	}
+	return a[:i], a[i+1:], nil
+}
+
+// parseNamedHooks will parse the --hook name=command, --hook-keys name=pattern and --hook-after name=other
+// arguments and return the hooks ordered so that each comes after the hooks it depends on
+func parseNamedHooks(hookArgs, keyArgs, afterArgs []string) ([]*namedHook, error) {
+	byName := make(map[string]*namedHook)
+	var defined []*namedHook
+	for _, a := range hookArgs {
+		name, command, err := splitRule(a, "name=command")
+		if err != nil {
+			return nil, err
+		}
+		if byName[name] != nil {
+			return nil, fmt.Errorf("hook %q defined twice", name)
+		}
+		byName[name] = &namedHook{Name: name, Command: command}
+		defined = append(defined, byName[name])
+	}
+	for _, a := range keyArgs {
+		name, pattern, err := splitRule(a, "name=pattern")
+		if err != nil {
+			return nil, err
+		}
+		if byName[name] == nil {
+			return nil, fmt.Errorf("--hook-keys of unknown hook %q", name)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("bad pattern %q: %v", pattern, err)
+		}
+		byName[name].Patterns = append(byName[name].Patterns, pattern)
+	}
+	for _, a := range afterArgs {
+		name, other, err := splitRule(a, "name=other")
+		if err != nil {
+			return nil, err
+		}
+		if byName[name] == nil || byName[other] == nil {
+			return nil, fmt.Errorf("--hook-after %q names an unknown hook", a)
+		}
+		byName[name].After = append(byName[name].After, other)
+	}
+	for _, hook := range defined {
+		if len(hook.Patterns) == 0 && len(hook.After) == 0 {
+			return nil, fmt.Errorf("hook %q has neither --hook-keys nor --hook-after, it would never run", hook.Name)
+		}
+	}
+
+	// dependencies first, in definition order otherwise
+	ordered := make([]*namedHook, 0, len(defined))
+	placed := make(map[string]bool)
+	for len(ordered) < len(defined) {
+		progress := false
+		for _, hook := range defined {
+			if placed[hook.Name] {
+				continue
+			}
+			ready := true
+			for _, dep := range hook.After {
+				ready = ready && placed[dep]
+			}
+			if ready {
+				ordered = append(ordered, hook)
+				placed[hook.Name] = true
+				progress = true
+			}
+		}
+		if !progress {
+			return nil, fmt.Errorf("--hook-after dependencies form a cycle")
+		}
+	}
+	return ordered, nil
+}
+
+// applyPriority will return the priority of etcdKey, or of the key it holds the metadata or signature of,
+// and false when it matches no --apply-order pattern
+func applyPriority(etcdKey string) (int, bool) {
+	etcdKey = subjectKey(etcdKey)
+	for _, rule := range applyOrderRules {
+		if matchPattern(rule.Pattern, etcdKey) {
+			return rule.Priority, true
+		}
+	}
+	return 0, false
+}
+
+// applyBefore reports whether a key, a, is applied before b: by priority, keys matching no pattern last
+func applyBefore(a, b string) bool {
+	pa, oka := applyPriority(a)
+	pb, okb := applyPriority(b)
+	if oka != okb {
+		return oka
+	}
+	return pa < pb
+}
+
+// sortEvents will sort events in --apply-order, events of keys with the same priority keep their order
+func sortEvents(events []storeEvent) {
+	if len(applyOrderRules) > 0 {
+		sort.SliceStable(events, func(i, j int) bool { return applyBefore(events[i].KV.Key, events[j].KV.Key) })
+	}
+}
+
+// sortKVs will sort kvs in --apply-order, keys with the same priority keep their order
+func sortKVs(kvs []storeKV) {
+	if len(applyOrderRules) > 0 {
+		sort.SliceStable(kvs, func(i, j int) bool { return applyBefore(kvs[i].Key, kvs[j].Key) })
+	}
+}
+
+// recordChange will queue a file written or deleted from ETCD for its --on-change hook
+func recordChange(action, etcdKey, filePath string, revision int64) {
+	if len(changeHookRules) == 0 && len(namedHooks) == 0 || action != eventDownload && action != eventDelete {
+		return
+	}
+	pendingChangesMu.Lock()
+	pendingChanges = append(pendingChanges, fileChange{Action: action, ETCDKey: etcdKey, FilePath: filePath, Revision: revision})
+	pendingChangesMu.Unlock()
+}
+
+// runChangeHooks will run the --on-change hook of every change queued since the last run, in the order the
+// changes were applied, one after the other, then the --hook triggered by the batch
+func runChangeHooks(ctx context.Context) {
+	changeHooksMu.Lock()
+	defer changeHooksMu.Unlock()
+	pendingChangesMu.Lock()
+	changes := pendingChanges
+	pendingChanges = nil
+	pendingChangesMu.Unlock()
+	for _, change := range changes {
+		command, ok := matchRule(changeHookRules, change.ETCDKey)
+		if !ok {
+			continue
+		}
+		err := runChangeHook(ctx, command, change)
+		recordDigestHook(command, err)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"etcdKey": change.ETCDKey,
+				"command": command,
+				"err":     err,
+			}).Warn("change hook failed")
+			continue
+		}
+		log.WithFields(log.Fields{
+			"etcdKey": change.ETCDKey,
+			"command": command,
+		}).Info("change hook ran")
+	}
+	if len(changes) > 0 {
+		runNamedHooks(ctx, changes)
+	}
+}
+
+// runNamedHooks will run each --hook triggered by changes once, after the hooks it depends on
+func runNamedHooks(ctx context.Context, changes []fileChange) {
+	ran := make(map[string]bool)
+	failed := make(map[string]bool)
+	for _, hook := range namedHooks {
+		var (
+			keys     []string
+			revision int64
+		)
+		for _, change := range changes {
+			for _, pattern := range hook.Patterns {
+				if matchPattern(pattern, change.ETCDKey) {
+					keys = append(keys, change.ETCDKey)
+					break
+				}
+			}
+			if change.Revision > revision {
+				revision = change.Revision
+			}
+		}
+		triggered, blocked := len(keys) > 0, ""
+		for _, dep := range hook.After {
+			triggered = triggered || ran[dep]
+			if failed[dep] {
+				blocked = dep
+			}
+		}
+		if !triggered {
+			continue
+		}
+		if blocked != "" {
+			log.WithFields(log.Fields{
+				"hook":       hook.Name,
+				"dependency": blocked,
+			}).Warn("hook skipped, a hook it depends on failed")
+			failed[hook.Name] = true
+			continue
+		}
+		env := []string{"ETCD_FILE_SYNCER_HOOK=" + hook.Name, "ETCD_FILE_SYNCER_KEYS=" + strings.Join(keys, " ")}
+		err := runChangeHook(ctx, hook.Command, fileChange{Revision: revision}, env...)
+		recordDigestHook(hook.Name, err)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"hook": hook.Name,
+				"err":  err,
+			}).Warn("hook failed")
+			failed[hook.Name] = true
+			continue
+		}
+		ran[hook.Name] = true
+		log.WithFields(log.Fields{
+			"hook": hook.Name,
+			"keys": len(keys),
+		}).Info("hook ran")
+	}
+}
+
+// runChangeHook will run command with sh -c, the change is passed in ETCD_FILE_SYNCER_* variables along
+// with env
+func runChangeHook(ctx context.Context, command string, change fileChange, env ...string) error {
+	ctx, cancel := context.WithTimeout(ctx, hookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(),
+		"ETCD_FILE_SYNCER_ACTION="+change.Action,
+		"ETCD_FILE_SYNCER_KEY="+change.ETCDKey,
+		"ETCD_FILE_SYNCER_FILE="+change.FilePath,
+		"ETCD_FILE_SYNCER_REVISION="+strconv.FormatInt(change.Revision, 10),
+		"ETCD_FILE_SYNCER_INSTANCE="+instanceName,
+	)
+	cmd.Env = append(cmd.Env, env...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
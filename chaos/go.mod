@@ -0,0 +1,9 @@
+module github.com/doody/etcd_file_syncer/chaos
+
+go 1.16
+
+require (
+	github.com/alexflint/go-arg v1.4.2
+	go.etcd.io/etcd/client/v3 v3.5.0
+	go.etcd.io/etcd/server/v3 v3.5.0
+)
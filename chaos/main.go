@@ -0,0 +1,315 @@
+// Command chaos runs etcd_file_syncer nodes built with -tags chaos against an embedded ETCD under injected
+// faults, writes keys and local files at random, then checks every node converges without losing a write. It is a
+// module of its own so the embedded ETCD server is not a dependency of the syncer.
+//
+//	go build -tags chaos -o etcd_file_syncer . && (cd chaos && go run . --syncer ../etcd_file_syncer)
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alexflint/go-arg"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+// prefix is the key the nodes sync, remote keys are written under remote/ and each node writes its own
+// local files under node<n>/, so that no change is a legitimate conflict. The scan only uploads files it
+// saw before, so the files of the nodes are written in ETCD first and only modified afterwards.
+const prefix = "chaos/"
+
+// args - command line
+var args struct {
+	Syncer   string        `arg:"--syncer,required" help:"etcd_file_syncer binary built with -tags chaos"`
+	Nodes    int           `arg:"--nodes" default:"3" help:"syncers run"`
+	Keys     int           `arg:"--keys" default:"20" help:"keys written in ETCD and files written by each node"`
+	Duration time.Duration `arg:"--duration" default:"30s" help:"how long changes are made"`
+	Settle   time.Duration `arg:"--settle" default:"1m" help:"how long the nodes have to converge once changes stop"`
+	Seed     int64         `arg:"--seed" help:"random seed, the current time by default"`
+	Keep     bool          `arg:"--keep" help:"keep the working directory, with the folders and logs of the nodes"`
+	Faults   []string      `arg:"--fault" help:"faults passed to every node [default: etcd-error=0.05 watch-delay=500ms torn-write=0.05]"`
+}
+
+func main() {
+	arg.MustParse(&args)
+	if args.Seed == 0 {
+		args.Seed = time.Now().UnixNano()
+	}
+	rand.Seed(args.Seed)
+	if len(args.Faults) == 0 {
+		args.Faults = []string{"etcd-error=0.05", "watch-delay=500ms", "torn-write=0.05"}
+	}
+	os.Exit(run())
+}
+
+// run will set up ETCD and the nodes, make changes and check convergence, returning the exit code
+func run() int {
+	workDir, err := os.MkdirTemp("", "etcd_file_syncer-chaos-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if args.Keep {
+		fmt.Println("working directory", workDir)
+	} else {
+		defer os.RemoveAll(workDir)
+	}
+	fmt.Println("seed", args.Seed)
+
+	etcd, endpoint, err := startETCD(filepath.Join(workDir, "etcd"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "cannot start ETCD:", err)
+		return 2
+	}
+	defer etcd.Close()
+	cli, err := clientv3.New(clientv3.Config{Endpoints: []string{endpoint}, DialTimeout: 5 * time.Second})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "cannot connect to ETCD:", err)
+		return 2
+	}
+	defer cli.Close()
+
+	want, err := seedKeys(cli)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "cannot write keys:", err)
+		return 2
+	}
+	folders := make([]string, args.Nodes)
+	for n := range folders {
+		folders[n] = filepath.Join(workDir, fmt.Sprintf("node%d", n))
+		node, err := startNode(n, endpoint, folders[n])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "cannot start node:", err)
+			return 2
+		}
+		defer func() {
+			node.Process.Signal(os.Interrupt)
+			node.Wait()
+		}()
+	}
+	if problems, _ := waitConverged(cli, folders, want); len(problems) > 0 {
+		fmt.Println("keys not downloaded:")
+		printList(problems)
+		return 1
+	}
+	// let every node scan the files once
+	time.Sleep(2 * time.Second)
+
+	if err := makeChanges(cli, folders, want); err != nil {
+		fmt.Fprintln(os.Stderr, "cannot make changes:", err)
+		return 2
+	}
+	fmt.Printf("%d keys written, waiting up to %s for the nodes to converge\n", len(want), args.Settle)
+	start := time.Now()
+	problems, conflicts := waitConverged(cli, folders, want)
+	if len(conflicts) > 0 {
+		fmt.Println("conflicts, both versions kept:")
+		printList(conflicts)
+	}
+	if len(problems) > 0 {
+		fmt.Println("not converged:")
+		printList(problems)
+		return 1
+	}
+	fmt.Printf("converged after %s\n", time.Since(start).Round(time.Second))
+	return 0
+}
+
+// printList will print lines indented
+func printList(lines []string) {
+	for _, line := range lines {
+		fmt.Println(" ", line)
+	}
+}
+
+// waitConverged will check the values of want until they are everywhere or --settle elapses
+func waitConverged(cli *clientv3.Client, folders []string, want map[string][]byte) (problems, conflicts []string) {
+	for start := time.Now(); time.Since(start) < args.Settle; time.Sleep(time.Second) {
+		if problems, conflicts = check(cli, folders, want); len(problems) == 0 {
+			break
+		}
+	}
+	return problems, conflicts
+}
+
+// startETCD will start a single member ETCD in dir on free ports
+func startETCD(dir string) (*embed.Etcd, string, error) {
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	cfg.LogLevel = "error"
+	clientURL, peerURL := freeURL(), freeURL()
+	cfg.LCUrls, cfg.ACUrls = []url.URL{clientURL}, []url.URL{clientURL}
+	cfg.LPUrls, cfg.APUrls = []url.URL{peerURL}, []url.URL{peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+	etcd, err := embed.StartEtcd(cfg)
+	if err != nil {
+		return nil, "", err
+	}
+	select {
+	case <-etcd.Server.ReadyNotify():
+	case <-time.After(time.Minute):
+		etcd.Close()
+		return nil, "", fmt.Errorf("not ready after a minute")
+	}
+	return etcd, clientURL.Host, nil
+}
+
+// freeURL will return an http URL on a free local port
+func freeURL() url.URL {
+	return url.URL{Scheme: "http", Host: "127.0.0.1:" + strconv.Itoa(freePort())}
+}
+
+// freePort will return a local port nothing listens on
+func freePort() int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// startNode will run the syncer n on folder, with every fault, logging to folder.log
+func startNode(n int, endpoint, folder string) (*exec.Cmd, error) {
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		return nil, err
+	}
+	logFile, err := os.Create(folder + ".log")
+	if err != nil {
+		return nil, err
+	}
+	cmdArgs := []string{
+		"--etcd", endpoint, "--key", prefix, "--folder", folder, "--port", strconv.Itoa(freePort()),
+		"--instance-name", fmt.Sprintf("node%d", n), "--scan-interval", "1s", "--deep-reconcile-interval", "5s",
+		"--fault",
+	}
+	cmd := exec.Command(args.Syncer, append(cmdArgs, args.Faults...)...)
+	cmd.Stdout, cmd.Stderr = logFile, logFile
+	return cmd, cmd.Start()
+}
+
+// seedKeys will write the keys of the files of every node and return their values
+func seedKeys(cli *clientv3.Client) (map[string][]byte, error) {
+	want := make(map[string][]byte)
+	for n := 0; n < args.Nodes; n++ {
+		for k := 0; k < args.Keys; k++ {
+			key, value := fmt.Sprintf("%snode%d/k%d", prefix, n, k), randomValue()
+			if _, err := cli.Put(context.Background(), key, string(value)); err != nil {
+				return nil, err
+			}
+			want[key] = value
+		}
+	}
+	return want, nil
+}
+
+// randomValue will return a few random lines
+func randomValue() []byte {
+	return []byte(fmt.Sprintf("%d\n%s", rand.Int63(), strings.Repeat("line\n", rand.Intn(50))))
+}
+
+// makeChanges will write and delete keys in ETCD and modify the files of every node at random for
+// --duration, recording in want the value every key must end with, nil for deleted keys
+func makeChanges(cli *clientv3.Client, folders []string, want map[string][]byte) error {
+	ctx := context.Background()
+	for end := time.Now().Add(args.Duration); time.Now().Before(end); {
+		value := randomValue()
+		node := rand.Intn(len(folders) + 1)
+		if node == len(folders) {
+			// a change in ETCD
+			key := fmt.Sprintf("%sremote/k%d", prefix, rand.Intn(args.Keys))
+			if rand.Intn(10) == 0 {
+				if _, err := cli.Delete(ctx, key); err != nil {
+					return err
+				}
+				want[key] = nil
+			} else {
+				if _, err := cli.Put(ctx, key, string(value)); err != nil {
+					return err
+				}
+				want[key] = value
+			}
+		} else {
+			// a change of a local file, uploaded by the next scan
+			key := fmt.Sprintf("%snode%d/k%d", prefix, node, rand.Intn(args.Keys))
+			filePath := filepath.Join(folders[node], key)
+			if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+				return err
+			}
+			if err := os.WriteFile(filePath, value, 0644); err != nil {
+				return err
+			}
+			want[key] = value
+		}
+		time.Sleep(time.Duration(10+rand.Intn(90)) * time.Millisecond)
+	}
+	return nil
+}
+
+// check will return what keeps ETCD and the folders from holding the values of want, and the keys in conflict
+// in a node. Conflicts keep both versions, a write lost nowhere, their keys are not compared.
+func check(cli *clientv3.Client, folders []string, want map[string][]byte) (problems, conflicts []string) {
+	resp, err := cli.Get(context.Background(), prefix, clientv3.WithPrefix())
+	if err != nil {
+		return []string{fmt.Sprintf("cannot read ETCD: %v", err)}, nil
+	}
+	stored := make(map[string][]byte, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		stored[string(kv.Key)] = kv.Value
+	}
+	keys := make([]string, 0, len(want))
+	for key := range want {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if n, ok := conflicted(folders, key); ok {
+			conflicts = append(conflicts, fmt.Sprintf("%s: in conflict in node%d", key, n))
+			continue
+		}
+		value, ok := stored[key]
+		switch {
+		case want[key] == nil && ok:
+			problems = append(problems, fmt.Sprintf("%s: deleted but still in ETCD", key))
+		case want[key] != nil && !ok:
+			problems = append(problems, fmt.Sprintf("%s: missing from ETCD", key))
+		case want[key] != nil && string(value) != string(want[key]):
+			problems = append(problems, fmt.Sprintf("%s: ETCD holds %d bytes rather than the %d written", key,
+				len(value), len(want[key])))
+		}
+		for n, folder := range folders {
+			content, err := os.ReadFile(filepath.Join(folder, key))
+			switch {
+			case want[key] == nil && err == nil:
+				problems = append(problems, fmt.Sprintf("%s: deleted but still in node%d", key, n))
+			case want[key] != nil && err != nil:
+				problems = append(problems, fmt.Sprintf("%s: missing from node%d", key, n))
+			case want[key] != nil && string(content) != string(want[key]):
+				problems = append(problems, fmt.Sprintf("%s: node%d holds %d bytes rather than %d", key, n,
+					len(content), len(want[key])))
+			}
+		}
+	}
+	return problems, conflicts
+}
+
+// conflicted will return the first node holding a conflict file for key
+func conflicted(folders []string, key string) (int, bool) {
+	for n, folder := range folders {
+		if _, err := os.Stat(filepath.Join(folder, key) + ".remote-conflict"); err == nil {
+			return n, true
+		}
+	}
+	return 0, false
+}
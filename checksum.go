@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// errChecksumMismatch is returned for values not matching their stored checksum
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// verifyDownload will run every configured check on value, downloaded from etcdKey at revision,
+// before it is written to disk
+func verifyDownload(ctx context.Context, etcdKey string, value []byte, revision int64) error {
+	if err := verifySignature(ctx, etcdKey, value); err != nil {
+		return err
+	}
+	return verifyChecksum(ctx, etcdKey, value, revision)
+}
+
+// verifiedKVs will return the keys of kvs that are not reserved and pass verifyDownload, the values rendered
+// into templates and confd resources
+func verifiedKVs(ctx context.Context, kvs []storeKV) []storeKV {
+	verified := make([]storeKV, 0, len(kvs))
+	for _, kv := range kvs {
+		if !isReservedKey(kv.Key) && verifyDownload(ctx, kv.Key, kv.Value, kv.Revision) == nil {
+			verified = append(verified, kv)
+		}
+	}
+	return verified
+}
+
+// verifyChecksum will compare value, downloaded from etcdKey at revision, with the SHA-256 stored in its
+// metadata key when --checksum is set. Values without a checksum, written by other tools, are accepted;
+// a checksum newer than the value belongs to a newer version that will be checked on its own.
+func verifyChecksum(ctx context.Context, etcdKey string, value []byte, revision int64) error {
+	if !CMDArgs.Checksum {
+		return nil
+	}
+	var kv *storeKV
+	err := withETCDRetry(ctx, func(ctx context.Context) (err error) {
+		kv, _, err = kvStore.Get(ctx, metaKey(etcdKey))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if kv == nil || kv.Revision > revision {
+		return nil
+	}
+	var meta fileMeta
+	if err := json.Unmarshal(kv.Value, &meta); err != nil || meta.SHA256 == "" {
+		return nil
+	}
+	if hash := contentHash(value); hash != meta.SHA256 {
+		checksumMismatches.Inc()
+		log.WithFields(log.Fields{
+			"etcdKey":  etcdKey,
+			"revision": revision,
+			"expected": meta.SHA256,
+			"actual":   hash,
+		}).Error("checksum mismatch, refusing download")
+		return fmt.Errorf("%w for %s at revision %d", errChecksumMismatch, etcdKey, revision)
+	}
+	return nil
+}
+
+// checksumMetaOps will return the ETCD operation updating the checksum in the metadata key of etcdKey to
+// the one of value, keeping the rest of the metadata, or nothing when --checksum is not set
+func checksumMetaOps(ctx context.Context, etcdKey string, value []byte) ([]storeOp, error) {
+	if !CMDArgs.Checksum {
+		return nil, nil
+	}
+	var kv *storeKV
+	err := withETCDRetry(ctx, func(ctx context.Context) (err error) {
+		kv, _, err = kvStore.Get(ctx, metaKey(etcdKey))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var meta fileMeta
+	if kv != nil {
+		if err := json.Unmarshal(kv.Value, &meta); err != nil {
+			return nil, err
+		}
+	}
+	meta.SHA256 = contentHash(value)
+	metaValue, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	return signedPutOps(metaKey(etcdKey), metaValue)
+}
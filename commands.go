@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// statusRequestTimeout bounds the status subcommand's request to the daemon
+const statusRequestTimeout = 5 * time.Second
+
+// StatusCmd - status subcommand
+type StatusCmd struct {
+	Addr string `arg:"--addr" help:"API address of the running syncer, host:port or unix:///path/to.sock [default: --listen, or localhost:--port]"`
+	JSON bool   `arg:"--json" help:"print the raw status document"`
+}
+
+// runSubcommand will connect to the store and run the subcommand given on the command line, returning the
+// process exit code
+func runSubcommand(ctx context.Context) int {
+	kv := mustConnectStore(ctx)
+	defer kv.Close()
+
+	switch {
+	case CMDArgs.Export != nil:
+		return runExport(ctx, CMDArgs.Export)
+	case CMDArgs.Import != nil:
+		return runImport(ctx, CMDArgs.Import)
+	case CMDArgs.Diff != nil:
+		return runDiff(ctx, CMDArgs.Diff)
+	case CMDArgs.Watch != nil:
+		return runWatch(ctx, CMDArgs.Watch)
+	case CMDArgs.Mirror != nil:
+		return runMirror(ctx, CMDArgs.Mirror)
+	case CMDArgs.MigrateV2 != nil:
+		return runMigrateV2(ctx, CMDArgs.MigrateV2)
+	case CMDArgs.Bench != nil:
+		return runBench(ctx, CMDArgs.Bench)
+	}
+	return exitConfigError
+}
+
+// apiClient will return an HTTP client for the API at addr, with the base URL to use
+func apiClient(addr string) (*http.Client, string) {
+	if addr == "" {
+		addr = CMDArgs.Listen
+	}
+	if addr == "" {
+		addr = fmt.Sprintf("localhost:%d", CMDArgs.ServerPort)
+	}
+	if !strings.HasPrefix(addr, unixListenPrefix) {
+		if !strings.Contains(addr, "://") {
+			addr = "http://" + addr
+		}
+		return &http.Client{}, strings.TrimSuffix(addr, "/")
+	}
+	socketPath := strings.TrimPrefix(addr, unixListenPrefix)
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socketPath)
+		},
+	}
+	return &http.Client{Transport: transport}, "http://unix"
+}
+
+// runStatus will print the status of the running syncer. It exits with 1 when the syncer cannot be
+// reached or is not healthy: ETCD unreachable, uploads paused or unresolved conflicts.
+func runStatus(ctx context.Context, cmd *StatusCmd) int {
+	client, baseURL := apiClient(cmd.Addr)
+	ctx, cancel := context.WithTimeout(ctx, statusRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+apiPrefix+"/status", nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return exitConfigError
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "cannot reach the syncer:", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "unexpected answer from the syncer: %s %s\n", resp.Status, body)
+		return 1
+	}
+	var status StatusResponse
+	if err := json.Unmarshal(body, &status); err != nil {
+		fmt.Fprintln(os.Stderr, "cannot decode status:", err)
+		return 1
+	}
+	if cmd.JSON {
+		os.Stdout.Write(body)
+		fmt.Println()
+	} else {
+		printStatus(os.Stdout, &status)
+	}
+	if !status.Connected || status.UploadsPaused || len(status.Conflicts) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// printStatus will write a human readable summary of status to w
+func printStatus(w io.Writer, status *StatusResponse) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	if status.Connected {
+		fmt.Fprintf(tw, "ETCD\tconnected, revision %d\n", status.Revision)
+	} else {
+		fmt.Fprintf(tw, "ETCD\tUNREACHABLE: %s\n", status.ETCDError)
+	}
+	watch := "no response yet"
+	if status.WatchLastResponse != nil {
+		watch = fmt.Sprintf("at revision %d, last response %s ago", status.WatchRevision,
+			time.Since(*status.WatchLastResponse).Round(time.Second))
+	}
+	if status.Connected && status.WatchRevision > 0 && status.Revision > status.WatchRevision {
+		watch += fmt.Sprintf(", %d revisions behind", status.Revision-status.WatchRevision)
+	}
+	fmt.Fprintf(tw, "Watch\t%s\n", watch)
+	fmt.Fprintf(tw, "Sync\t%s <-> key %q\n", status.FileFolder, status.ETCDKey)
+	if status.UploadsPaused {
+		fmt.Fprintf(tw, "Pending\t%d uploads, PAUSED by guard rails\n", status.Pending)
+	} else {
+		fmt.Fprintf(tw, "Pending\t%d uploads\n", status.Pending)
+	}
+	fmt.Fprintf(tw, "Conflicts\t%d\n", len(status.Conflicts))
+	tw.Flush()
+	for _, conflict := range status.Conflicts {
+		fmt.Fprintf(w, "  %s\tremote revision %d since %s, see %s\n", conflict.ETCDKey, conflict.Revision,
+			conflict.DetectedAt.Local().Format(time.RFC3339), conflict.ConflictPath)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// revisionSampleInterval is how often the cluster revision is sampled to map times to revisions
+	revisionSampleInterval = time.Minute
+	// compactSampleRetention is how long samples are kept when no --compact-retention is set, bounding
+	// the retention POST /compact can be asked for
+	compactSampleRetention = 7 * 24 * time.Hour
+)
+
+// revisionSample is the cluster revision observed at a point in time
+type revisionSample struct {
+	Time     time.Time
+	Revision int64
+}
+
+var (
+	revisionSamples   []revisionSample
+	revisionSamplesMu sync.Mutex
+	// compactedRevision is the last revision compacted by this syncer, history before it is gone
+	compactedRevision int64
+)
+
+// errNoHorizon is returned when the syncer hasn't been running long enough to honor a retention
+var errNoHorizon = errors.New("no revision sampled")
+
+// CompactModel - POST /v1/compact
+type CompactModel struct {
+	Retention string `json:"retention"`
+}
+
+// sampleRevisions will record the cluster revision every revisionSampleInterval, keeping samples
+// for maxAge so any retention up to maxAge can be mapped to a revision
+func sampleRevisions(ctx context.Context, maxAge time.Duration) {
+	sample := func(ctx context.Context) {
+		var head int64
+		err := withETCDRetry(ctx, func(ctx context.Context) (err error) {
+			head, _, err = kvStore.Revision(ctx, CMDArgs.ConfigKey)
+			return err
+		})
+		if err != nil {
+			return
+		}
+		now := time.Now()
+		revisionSamplesMu.Lock()
+		revisionSamples = append(revisionSamples, revisionSample{Time: now, Revision: head})
+		// keep one sample older than maxAge so the horizon is always resolvable
+		for len(revisionSamples) > 2 && now.Sub(revisionSamples[1].Time) > maxAge {
+			revisionSamples = revisionSamples[1:]
+		}
+		revisionSamplesMu.Unlock()
+	}
+	sample(ctx)
+	runPeriodically(ctx, revisionSampleInterval, sample)
+}
+
+// horizonRevision will return the newest sampled revision at least retention old
+func horizonRevision(retention time.Duration) (int64, error) {
+	horizon := time.Now().Add(-retention)
+	revisionSamplesMu.Lock()
+	defer revisionSamplesMu.Unlock()
+	var rev int64
+	for _, s := range revisionSamples {
+		if s.Time.After(horizon) {
+			break
+		}
+		rev = s.Revision
+	}
+	if rev == 0 {
+		return 0, fmt.Errorf("%w before %s yet", errNoHorizon, horizon.Format(time.RFC3339))
+	}
+	return rev, nil
+}
+
+// checkRetrievable will return errCompacted when the history of revision was compacted by this syncer
+func checkRetrievable(revision int64) error {
+	if compacted := atomic.LoadInt64(&compactedRevision); revision != 0 && revision < compacted {
+		return fmt.Errorf("%w: revision %d is before the compacted revision %d and no longer retrievable",
+			errCompacted, revision, compacted)
+	}
+	return nil
+}
+
+// compactToRetention will compact the ETCD history so at least retention of it is kept. ETCD compaction
+// is cluster wide: the history of every key, not only the synced prefix, is dropped before the horizon.
+func compactToRetention(ctx context.Context, retention time.Duration) (int64, error) {
+	c, ok := kvStore.(compactor)
+	if !ok {
+		return 0, fmt.Errorf("compaction %w", errNotSupported)
+	}
+	rev, err := horizonRevision(retention)
+	if err != nil {
+		return 0, err
+	}
+	if rev <= atomic.LoadInt64(&compactedRevision) {
+		return atomic.LoadInt64(&compactedRevision), nil
+	}
+	err = withETCDRetry(ctx, func(ctx context.Context) error {
+		return c.Compact(ctx, rev)
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"revision": rev,
+			"err":      err,
+		}).Error("cannot compact ETCD")
+		return 0, err
+	}
+	atomic.StoreInt64(&compactedRevision, rev)
+	compactedRevisionGauge.Set(float64(rev))
+	log.WithFields(log.Fields{
+		"revision":  rev,
+		"retention": retention,
+	}).Info("compacted ETCD history")
+	writeAudit(auditEntry{
+		Action: auditCompact,
+		Detail: fmt.Sprintf("compacted up to revision %d (retention %s)", rev, retention),
+	})
+	return rev, nil
+}
+
+// compactHandler - POST /v1/compact, compacts with the retention in the body or --compact-retention
+func compactHandler(c *gin.Context) {
+	var json CompactModel
+	if err := c.ShouldBindJSON(&json); err != nil && c.Request.ContentLength > 0 {
+		abortWithBadRequest(c, err)
+		return
+	}
+	retention := CMDArgs.CompactRetention
+	if json.Retention != "" {
+		var err error
+		if retention, err = time.ParseDuration(json.Retention); err != nil {
+			abortWithBadRequest(c, err)
+			return
+		}
+	}
+	if retention <= 0 {
+		abortWithError(c, http.StatusBadRequest, codeBadRequest, "retention is required", nil)
+		return
+	}
+	rev, err := compactToRetention(c.Request.Context(), retention)
+	if err != nil {
+		abortWithErr(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, OKResponse{Status: "ok", CompactedRevision: rev})
+}
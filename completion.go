@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// programName is the name of the binary in completions and man pages
+const programName = "etcd_file_syncer"
+
+// CompletionCmd - completion subcommand
+type CompletionCmd struct {
+	Shell string `arg:"positional,required" help:"bash, zsh or fish"`
+}
+
+// cliOption is a flag or positional argument of a command
+type cliOption struct {
+	Long, Short string
+	Help        string
+	Default     string
+	Env         string
+	// Value is the placeholder of the value, empty for booleans
+	Value      string
+	Positional bool
+	Required   bool
+	Repeated   bool
+}
+
+// cliCommand is the program or one of its subcommands, described from the go-arg tags of its struct
+type cliCommand struct {
+	Name        string
+	Help        string
+	Options     []cliOption
+	Subcommands []cliCommand
+}
+
+// describeCLI will return the description of the command line parsed into CMDArgs
+func describeCLI() cliCommand {
+	return describeCommand(programName, "", reflect.TypeOf(CMDArgs))
+}
+
+// describeCommand will describe the command name parsed into a struct of type t
+func describeCommand(name, help string, t reflect.Type) cliCommand {
+	cmd := cliCommand{Name: name, Help: help}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag, ok := field.Tag.Lookup("arg")
+		if !ok || tag == "-" {
+			continue
+		}
+		option := cliOption{Help: field.Tag.Get("help"), Default: field.Tag.Get("default")}
+		subcommand := ""
+		for _, part := range strings.Split(tag, ",") {
+			switch {
+			case strings.HasPrefix(part, "--"):
+				option.Long = part[2:]
+			case strings.HasPrefix(part, "-"):
+				option.Short = part[1:]
+			case part == "positional":
+				option.Positional = true
+			case part == "required":
+				option.Required = true
+			case strings.HasPrefix(part, "env:"):
+				option.Env = strings.TrimPrefix(part, "env:")
+			case strings.HasPrefix(part, "subcommand:"):
+				subcommand = strings.TrimPrefix(part, "subcommand:")
+			}
+		}
+		if subcommand != "" {
+			cmd.Subcommands = append(cmd.Subcommands, describeCommand(subcommand, option.Help, field.Type.Elem()))
+			continue
+		}
+		if option.Long == "" {
+			option.Long = strings.ToLower(field.Name)
+		}
+		kind := field.Type.Kind()
+		option.Repeated = kind == reflect.Slice
+		if kind != reflect.Bool {
+			option.Value = strings.ToUpper(option.Long)
+		}
+		cmd.Options = append(cmd.Options, option)
+	}
+	sort.Slice(cmd.Subcommands, func(i, j int) bool { return cmd.Subcommands[i].Name < cmd.Subcommands[j].Name })
+	return cmd
+}
+
+// flags will return the flags of cmd, positional arguments left out
+func (cmd cliCommand) flags() (flags []cliOption) {
+	for _, option := range cmd.Options {
+		if !option.Positional {
+			flags = append(flags, option)
+		}
+	}
+	return flags
+}
+
+// runCompletion will print the completion script of the shell
+func runCompletion(cmd *CompletionCmd) int {
+	if err := writeCompletion(os.Stdout, cmd.Shell, describeCLI()); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return exitConfigError
+	}
+	return 0
+}
+
+// writeCompletion will write the completion script of shell for root to w
+func writeCompletion(w io.Writer, shell string, root cliCommand) error {
+	switch shell {
+	case "bash":
+		writeBashCompletion(w, root)
+	case "zsh":
+		writeZshCompletion(w, root)
+	case "fish":
+		writeFishCompletion(w, root)
+	default:
+		return fmt.Errorf("unknown shell %q, bash, zsh or fish", shell)
+	}
+	return nil
+}
+
+// writeBashCompletion will write a bash completion function, complete -F, for root
+func writeBashCompletion(w io.Writer, root cliCommand) {
+	fn := "_" + programName
+	fmt.Fprintf(w, "# bash completion for %s, generated by %s completion bash\n", root.Name, root.Name)
+	fmt.Fprintf(w, "%s() {\n", fn)
+	fmt.Fprintln(w, `    local cur prev cmd i words
+    cur="${COMP_WORDS[COMP_CWORD]}"
+    prev="${COMP_WORDS[COMP_CWORD-1]}"
+    cmd=""
+    for ((i = 1; i < COMP_CWORD; i++)); do
+        case "${COMP_WORDS[i]}" in`)
+	names := make([]string, 0, len(root.Subcommands))
+	for _, sub := range root.Subcommands {
+		names = append(names, sub.Name)
+	}
+	fmt.Fprintf(w, "            %s) cmd=\"${COMP_WORDS[i]}\" ;;\n", strings.Join(names, "|"))
+	fmt.Fprintln(w, `        esac
+    done
+    case "$prev" in`)
+	valued := bashValuedFlags(root)
+	for _, sub := range root.Subcommands {
+		valued = append(valued, bashValuedFlags(sub)...)
+	}
+	sort.Strings(valued)
+	fmt.Fprintf(w, "        %s)\n", strings.Join(dedupe(valued), "|"))
+	fmt.Fprintln(w, `            COMPREPLY=($(compgen -f -- "$cur"))
+            return ;;
+    esac
+    case "$cmd" in`)
+	for _, sub := range root.Subcommands {
+		fmt.Fprintf(w, "        %s) words=%q ;;\n", sub.Name, strings.Join(append(bashFlags(sub), bashFlags(root)...), " "))
+	}
+	fmt.Fprintf(w, "        *) words=%q ;;\n", strings.Join(append(bashFlags(root), names...), " "))
+	fmt.Fprintln(w, `    esac
+    if [[ "$cur" == -* || -z "$cmd" ]]; then
+        COMPREPLY=($(compgen -W "$words" -- "$cur"))
+    else
+        COMPREPLY=($(compgen -f -- "$cur"))
+    fi
+}`)
+	fmt.Fprintf(w, "complete -o filenames -F %s %s\n", fn, root.Name)
+}
+
+// bashFlags will return the flags of cmd as typed on the command line
+func bashFlags(cmd cliCommand) (words []string) {
+	for _, flag := range cmd.flags() {
+		words = append(words, "--"+flag.Long)
+		if flag.Short != "" {
+			words = append(words, "-"+flag.Short)
+		}
+	}
+	return words
+}
+
+// bashValuedFlags will return the flags of cmd taking a value
+func bashValuedFlags(cmd cliCommand) (words []string) {
+	for _, flag := range cmd.flags() {
+		if flag.Value != "" {
+			words = append(words, "--"+flag.Long)
+			if flag.Short != "" {
+				words = append(words, "-"+flag.Short)
+			}
+		}
+	}
+	return words
+}
+
+// dedupe will remove the repeated strings of sorted words
+func dedupe(words []string) []string {
+	out := words[:0]
+	for i, word := range words {
+		if i == 0 || word != words[i-1] {
+			out = append(out, word)
+		}
+	}
+	return out
+}
+
+// writeZshCompletion will write a zsh completion function, for a directory of fpath, for root
+func writeZshCompletion(w io.Writer, root cliCommand) {
+	fmt.Fprintf(w, "#compdef %s\n# zsh completion for %s, generated by %s completion zsh\n\n", root.Name, root.Name,
+		root.Name)
+	fmt.Fprintf(w, "_%s() {\n    local curcontext=\"$curcontext\" state line\n    _arguments -C \\\n", programName)
+	for _, spec := range zshSpecs(root) {
+		fmt.Fprintf(w, "        %s \\\n", spec)
+	}
+	fmt.Fprintln(w, `        '1: :->command' \
+        '*:: :->args'
+    case $state in
+    command)
+        local -a commands
+        commands=(`)
+	for _, sub := range root.Subcommands {
+		fmt.Fprintf(w, "            %s\n", zshQuote(sub.Name+":"+sub.Help))
+	}
+	fmt.Fprintln(w, `        )
+        _describe command commands ;;
+    args)
+        case $line[1] in`)
+	for _, sub := range root.Subcommands {
+		fmt.Fprintf(w, "        %s)\n            _arguments \\\n", sub.Name)
+		for _, spec := range zshSpecs(sub) {
+			fmt.Fprintf(w, "                %s \\\n", spec)
+		}
+		fmt.Fprintln(w, "                '*:file:_files' ;;")
+	}
+	fmt.Fprintln(w, `        esac ;;
+    esac
+}`)
+	fmt.Fprintf(w, "\n_%s \"$@\"\n", programName)
+}
+
+// zshSpecs will return the _arguments specs of the flags of cmd
+func zshSpecs(cmd cliCommand) (specs []string) {
+	escape := strings.NewReplacer("[", `\[`, "]", `\]`, ":", `\:`)
+	for _, flag := range cmd.flags() {
+		spec := "[" + escape.Replace(flag.Help) + "]"
+		if flag.Value != "" {
+			spec += ":" + strings.ToLower(flag.Value) + ":_files"
+		}
+		switch {
+		case flag.Short == "" && flag.Repeated:
+			specs = append(specs, zshQuote("*--"+flag.Long+spec))
+		case flag.Short == "":
+			specs = append(specs, zshQuote("--"+flag.Long+spec))
+		case flag.Repeated:
+			specs = append(specs, fmt.Sprintf("'*'{-%s,--%s}%s", flag.Short, flag.Long, zshQuote(spec)))
+		default:
+			specs = append(specs, fmt.Sprintf("'(-%s --%s)'{-%s,--%s}%s", flag.Short, flag.Long, flag.Short,
+				flag.Long, zshQuote(spec)))
+		}
+	}
+	return specs
+}
+
+// zshQuote will single quote s for zsh
+func zshQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// writeFishCompletion will write fish complete commands for root
+func writeFishCompletion(w io.Writer, root cliCommand) {
+	fmt.Fprintf(w, "# fish completion for %s, generated by %s completion fish\n", root.Name, root.Name)
+	names := make([]string, 0, len(root.Subcommands))
+	for _, sub := range root.Subcommands {
+		names = append(names, sub.Name)
+	}
+	for _, sub := range root.Subcommands {
+		fmt.Fprintf(w, "complete -c %s -f -n __fish_use_subcommand -a %s -d %s\n", root.Name, sub.Name,
+			fishQuote(sub.Help))
+	}
+	for _, flag := range root.flags() {
+		fmt.Fprintf(w, "complete -c %s%s\n", root.Name, fishFlag(flag))
+	}
+	for _, sub := range root.Subcommands {
+		for _, flag := range sub.flags() {
+			fmt.Fprintf(w, "complete -c %s -n '__fish_seen_subcommand_from %s'%s\n", root.Name, sub.Name,
+				fishFlag(flag))
+		}
+	}
+}
+
+// fishFlag will return the complete options of flag
+func fishFlag(flag cliOption) string {
+	s := " -l " + flag.Long
+	if flag.Short != "" {
+		s += " -s " + flag.Short
+	}
+	if flag.Value != "" {
+		s += " -r"
+	}
+	return s + " -d " + fishQuote(flag.Help)
+}
+
+// fishQuote will single quote s for fish
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	log "github.com/sirupsen/logrus"
+)
+
+// confdResource is a confd template resource, a conf.d/*.toml file of --confd-dir
+type confdResource struct {
+	Src       string   `toml:"src"`
+	Dest      string   `toml:"dest"`
+	Keys      []string `toml:"keys"`
+	Prefix    string   `toml:"prefix"`
+	Mode      string   `toml:"mode"`
+	UID       *int     `toml:"uid"`
+	GID       *int     `toml:"gid"`
+	CheckCmd  string   `toml:"check_cmd"`
+	ReloadCmd string   `toml:"reload_cmd"`
+
+	// name is the resource file, text the template read from templates/src
+	name string
+	text string
+	mode os.FileMode
+}
+
+// confdKV is a key and value returned by the get and gets confd template functions
+type confdKV struct {
+	Key   string
+	Value string
+}
+
+var (
+	// confdResources are the template resources of --confd-dir
+	confdResources []*confdResource
+	// confdMu serializes the rendering of confd resources
+	confdMu sync.Mutex
+)
+
+// loadConfdResources will read the template resources of the confd configuration directory dir and
+// their templates, which must parse
+func loadConfdResources(dir string) ([]*confdResource, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "conf.d", "*.toml"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no template resource in %s", filepath.Join(dir, "conf.d"))
+	}
+	sort.Strings(files)
+	resources := make([]*confdResource, 0, len(files))
+	for _, file := range files {
+		var doc struct {
+			Template *confdResource `toml:"template"`
+		}
+		if _, err := toml.DecodeFile(file, &doc); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		r := doc.Template
+		switch {
+		case r == nil:
+			return nil, fmt.Errorf("%s: no [template] table", file)
+		case r.Src == "" || r.Dest == "":
+			return nil, fmt.Errorf("%s: src and dest are required", file)
+		case len(r.Keys) == 0:
+			return nil, fmt.Errorf("%s: keys are required", file)
+		}
+		r.name = filepath.Base(file)
+		text, err := os.ReadFile(filepath.Join(dir, "templates", r.Src))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		r.text = string(text)
+		if _, err := template.New(r.Src).Funcs(confdFuncs(nil)).Parse(r.text); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		if r.Mode != "" {
+			mode, err := strconv.ParseUint(r.Mode, 8, 32)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid mode %q", file, r.Mode)
+			}
+			r.mode = os.FileMode(mode)
+		}
+		resources = append(resources, r)
+	}
+	return resources, nil
+}
+
+// renderConfdResources will render every confd resource whose output changed, with the keys under prefix
+func renderConfdResources(ctx context.Context, prefix string) {
+	confdMu.Lock()
+	defer confdMu.Unlock()
+	var (
+		kvs      []storeKV
+		revision int64
+	)
+	err := withETCDRetry(ctx, func(ctx context.Context) (err error) {
+		kvs, revision, err = kvStore.List(ctx, prefix)
+		return err
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"etcdKey": prefix,
+			"err":     err,
+		}).Error("cannot read keys to render confd resources")
+		return
+	}
+	// confd keys are absolute paths, /app/db/url being <prefix>app/db/url
+	values := make(map[string]string, len(kvs))
+	for _, kv := range verifiedKVs(ctx, kvs) {
+		values["/"+strings.TrimPrefix(strings.TrimPrefix(kv.Key, prefix), "/")] = string(kv.Value)
+	}
+	for _, r := range confdResources {
+		if err := r.render(ctx, values, revision); err != nil {
+			log.WithFields(log.Fields{
+				"resource": r.name,
+				"dest":     r.Dest,
+				"err":      err,
+			}).Error("cannot render confd resource")
+		}
+	}
+}
+
+// render will render the template with the keys of the resource, then check, install and reload the
+// result when it differs from dest
+func (r *confdResource) render(ctx context.Context, values map[string]string, revision int64) error {
+	// like confd, only the keys of the resource are visible, without its prefix
+	resourcePrefix := path.Join("/", r.Prefix)
+	visible := make(map[string]string)
+	for key, value := range values {
+		for _, k := range r.Keys {
+			if strings.HasPrefix(key, path.Join(resourcePrefix, k)) {
+				visible["/"+strings.TrimPrefix(strings.TrimPrefix(key, resourcePrefix), "/")] = value
+				break
+			}
+		}
+	}
+	tmpl, err := template.New(r.Src).Funcs(confdFuncs(visible)).Parse(r.text)
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, nil); err != nil {
+		return err
+	}
+
+	mode := r.mode
+	current, statErr := os.Stat(r.Dest)
+	if mode == 0 {
+		mode = 0644
+		if statErr == nil {
+			mode = current.Mode().Perm()
+		}
+	}
+	if content, err := os.ReadFile(r.Dest); err == nil && bytes.Equal(content, out.Bytes()) && current.Mode().Perm() == mode {
+		return nil
+	}
+	if err := ensureDir(filepath.Dir(r.Dest)); err != nil {
+		return err
+	}
+	stage, err := os.CreateTemp(filepath.Dir(r.Dest), "."+filepath.Base(r.Dest))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(stage.Name())
+	_, err = stage.Write(out.Bytes())
+	if closeErr := stage.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(stage.Name(), mode); err != nil {
+		return err
+	}
+	if r.UID != nil || r.GID != nil {
+		uid, gid := -1, -1
+		if r.UID != nil {
+			uid = *r.UID
+		}
+		if r.GID != nil {
+			gid = *r.GID
+		}
+		if err := os.Lchown(stage.Name(), uid, gid); err != nil {
+			return err
+		}
+	}
+	if r.CheckCmd != "" {
+		if err := r.runCommand(ctx, r.CheckCmd, stage.Name()); err != nil {
+			return fmt.Errorf("check_cmd failed, %s left unchanged: %v", r.Dest, err)
+		}
+	}
+	if err := os.Rename(stage.Name(), r.Dest); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"resource": r.name,
+		"dest":     r.Dest,
+		"revision": revision,
+	}).Info("confd resource rendered")
+	publishEvent(eventDownload, r.name, r.Dest, out.Len(), revision)
+	if r.ReloadCmd != "" {
+		if err := r.runCommand(ctx, r.ReloadCmd, r.Dest); err != nil {
+			return fmt.Errorf("reload_cmd failed: %v", err)
+		}
+	}
+	return nil
+}
+
+// runCommand will run command with sh -c once {{.src}}, the staged or installed file, and {{.dest}} are
+// replaced
+func (r *confdResource) runCommand(ctx context.Context, command, src string) error {
+	tmpl, err := template.New("cmd").Parse(command)
+	if err != nil {
+		return err
+	}
+	var cmdline strings.Builder
+	if err := tmpl.Execute(&cmdline, map[string]string{"src": src, "dest": r.Dest}); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, hookTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "sh", "-c", cmdline.String()).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// confdFuncs will return the template functions of confd, with its argument order, reading values
+func confdFuncs(values map[string]string) template.FuncMap {
+	matching := func(pattern string) ([]string, error) {
+		var keys []string
+		for key := range values {
+			ok, err := path.Match(pattern, key)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		return keys, nil
+	}
+	return template.FuncMap{
+		"get": func(key string) (confdKV, error) {
+			value, ok := values[path.Join("/", key)]
+			if !ok {
+				return confdKV{}, fmt.Errorf("key does not exist: %s", key)
+			}
+			return confdKV{Key: path.Join("/", key), Value: value}, nil
+		},
+		"gets": func(pattern string) ([]confdKV, error) {
+			keys, err := matching(pattern)
+			kvs := make([]confdKV, len(keys))
+			for i, key := range keys {
+				kvs[i] = confdKV{Key: key, Value: values[key]}
+			}
+			return kvs, err
+		},
+		"getv": func(key string, defaultValue ...string) (string, error) {
+			if value, ok := values[path.Join("/", key)]; ok {
+				return value, nil
+			}
+			if len(defaultValue) > 0 {
+				return defaultValue[0], nil
+			}
+			return "", fmt.Errorf("key does not exist: %s", key)
+		},
+		"getvs": func(pattern string) ([]string, error) {
+			keys, err := matching(pattern)
+			vs := make([]string, len(keys))
+			for i, key := range keys {
+				vs[i] = values[key]
+			}
+			return vs, err
+		},
+		"exists": func(key string) bool {
+			_, ok := values[path.Join("/", key)]
+			return ok
+		},
+		"ls": func(dir string) []string {
+			return listChildren(values, strings.TrimSuffix(path.Join("/", dir), "/")+"/", false)
+		},
+		"lsdir": func(dir string) []string {
+			return listChildren(values, strings.TrimSuffix(path.Join("/", dir), "/")+"/", true)
+		},
+		"base":       path.Base,
+		"dir":        path.Dir,
+		"split":      strings.Split,
+		"join":       strings.Join,
+		"toUpper":    strings.ToUpper,
+		"toLower":    strings.ToLower,
+		"contains":   strings.Contains,
+		"replace":    strings.Replace,
+		"trimSuffix": strings.TrimSuffix,
+		"datetime":   time.Now,
+		"getenv": func(key string, defaultValue ...string) string {
+			if value := os.Getenv(key); value != "" || len(defaultValue) == 0 {
+				return value
+			}
+			return defaultValue[0]
+		},
+		"fileExists": func(fileName string) bool {
+			_, err := os.Stat(fileName)
+			return err == nil
+		},
+		"lookupIP": func(host string) []string {
+			ips, _ := net.LookupIP(host)
+			addrs := make([]string, len(ips))
+			for i, ip := range ips {
+				addrs[i] = ip.String()
+			}
+			sort.Strings(addrs)
+			return addrs
+		},
+		"lookupSRV": func(service, proto, name string) []*net.SRV {
+			_, srvs, _ := net.LookupSRV(service, proto, name)
+			return srvs
+		},
+		"base64Encode": func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+		"base64Decode": func(s string) (string, error) {
+			b, err := base64.StdEncoding.DecodeString(s)
+			return string(b), err
+		},
+		"parseBool": strconv.ParseBool,
+		"atoi":      strconv.Atoi,
+		"json": func(s string) (map[string]interface{}, error) {
+			var m map[string]interface{}
+			err := json.Unmarshal([]byte(s), &m)
+			return m, err
+		},
+		"jsonArray": func(s string) ([]interface{}, error) {
+			var a []interface{}
+			err := json.Unmarshal([]byte(s), &a)
+			return a, err
+		},
+		"map": func(pairs ...interface{}) (map[string]interface{}, error) {
+			if len(pairs)%2 != 0 {
+				return nil, fmt.Errorf("map takes key and value pairs")
+			}
+			m := make(map[string]interface{}, len(pairs)/2)
+			for i := 0; i < len(pairs); i += 2 {
+				m[fmt.Sprint(pairs[i])] = pairs[i+1]
+			}
+			return m, nil
+		},
+		"reverse": func(list interface{}) []string {
+			s := toStrings(list)
+			reversed := make([]string, len(s))
+			for i, v := range s {
+				reversed[len(s)-1-i] = v
+			}
+			return reversed
+		},
+		"sortByLength": func(list []string) []string {
+			sorted := append([]string(nil), list...)
+			sort.SliceStable(sorted, func(i, j int) bool { return len(sorted[i]) < len(sorted[j]) })
+			return sorted
+		},
+		"sortKVByLength": func(kvs []confdKV) []confdKV {
+			sorted := append([]confdKV(nil), kvs...)
+			sort.SliceStable(sorted, func(i, j int) bool { return len(sorted[i].Key) < len(sorted[j].Key) })
+			return sorted
+		},
+		"seq": func(first, last int) []int {
+			var s []int
+			for i := first; i <= last; i++ {
+				s = append(s, i)
+			}
+			return s
+		},
+		"add": func(a, b int) int { return a + b },
+		"sub": func(a, b int) int { return a - b },
+		"mul": func(a, b int) int { return a * b },
+		"div": func(a, b int) int { return a / b },
+		"mod": func(a, b int) int { return a % b },
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// conflictSuffix is appended to a file to hold the ETCD version it conflicts with
+const conflictSuffix = ".remote-conflict"
+
+// Conflict resolutions
+const (
+	resolveLocal  = "local"
+	resolveRemote = "remote"
+)
+
+// fileConflict is a file changed both locally and in ETCD since it was last synced
+type fileConflict struct {
+	ETCDKey      string    `json:"etcdKey"`
+	FilePath     string    `json:"filePath"`
+	ConflictPath string    `json:"conflictPath"`
+	Revision     int64     `json:"revision"`
+	DetectedAt   time.Time `json:"detectedAt"`
+}
+
+var (
+	// conflicts maps file paths to their unresolved conflict
+	conflicts   = make(map[string]fileConflict)
+	conflictsMu sync.Mutex
+)
+
+// errNotConflicted is returned when resolving a file without conflict
+var errNotConflicted = errors.New("file is not conflicted")
+
+// ResolveModel - POST /v1/conflicts/resolve
+type ResolveModel struct {
+	ETCDKey string `json:"etcdKey" binding:"required"`
+	Keep    string `json:"keep" binding:"required,oneof=local remote"`
+}
+
+// isConflicted reports whether filePath has an unresolved conflict
+func isConflicted(filePath string) bool {
+	conflictsMu.Lock()
+	defer conflictsMu.Unlock()
+	_, ok := conflicts[filePath]
+	return ok
+}
+
+// listConflicts will return every unresolved conflict, sorted by key
+func listConflicts() []fileConflict {
+	conflictsMu.Lock()
+	list := make([]fileConflict, 0, len(conflicts))
+	for _, conflict := range conflicts {
+		list = append(list, conflict)
+	}
+	conflictsMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ETCDKey < list[j].ETCDKey })
+	return list
+}
+
+// localChangedSinceSync reports whether the content of filePath differs from the version last synced
+func localChangedSinceSync(etcdKey, filePath string) bool {
+	synced, ok := lastSynced(filePath)
+	if !ok {
+		return false
+	}
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return false
+	}
+	return fileSyncHash(etcdKey, content) != synced.Hash
+}
+
+// markConflict will keep the local filePath and write the remote value next to it as <file>.remote-conflict.
+// The file is neither uploaded nor downloaded again until the conflict is resolved.
+func markConflict(etcdKey, filePath string, value []byte, revision int64) {
+	conflictPath := filePath + conflictSuffix
+	if err := os.WriteFile(conflictPath, value, 0644); err != nil {
+		log.WithFields(log.Fields{
+			"filePath": conflictPath,
+			"err":      err,
+		}).Error("cannot write conflict file")
+		return
+	}
+	conflictsMu.Lock()
+	_, known := conflicts[filePath]
+	conflicts[filePath] = fileConflict{
+		ETCDKey:      etcdKey,
+		FilePath:     filePath,
+		ConflictPath: conflictPath,
+		Revision:     revision,
+		DetectedAt:   time.Now(),
+	}
+	conflictsMu.Unlock()
+	if known {
+		return
+	}
+	publishEvent(eventConflict, etcdKey, filePath, len(value), revision)
+	log.WithFields(log.Fields{
+		"etcdKey":  etcdKey,
+		"filePath": filePath,
+		"revision": revision,
+	}).Warn("file changed locally and in ETCD, remote version written to conflict file")
+	writeAudit(auditEntry{
+		Action:   auditConflict,
+		ETCDKey:  etcdKey,
+		FilePath: filePath,
+		Detail:   fmt.Sprintf("remote revision %d written to %s", revision, conflictPath),
+	})
+}
+
+// applyRemoteContent will write value of etcdKey at revision to filePath, unless the file is already at
+// that revision, the value is not properly signed or the file was changed locally since it was last
+// synced, which makes it a conflict
+func applyRemoteContent(ctx context.Context, etcdKey, filePath string, value []byte, revision int64) {
+	if synced, ok := lastSynced(filePath); ok && revision <= synced.Revision {
+		// our own upload, or an event older than what we already have
+		return
+	}
+	if verifyDownload(ctx, etcdKey, value, revision) != nil {
+		return
+	}
+	if isConflicted(filePath) || localChangedSinceSync(etcdKey, filePath) {
+		content, err := os.ReadFile(filePath)
+		if hash := syncHash(etcdKey, value); err == nil && fileSyncHash(etcdKey, content) == hash {
+			// both sides made the same change
+			clearConflict(filePath)
+			recordSynced(filePath, hash, revision)
+			return
+		}
+		markConflict(etcdKey, filePath, value, revision)
+		return
+	}
+	before := snapshotForDiff(filePath)
+	if saveKeyToFolder(etcdKey, filePath, value, revision) != nil {
+		return
+	}
+	publishDiffEvent(eventDownload, etcdKey, filePath, len(value), revision, before.diff(etcdKey, filePath, revision))
+}
+
+// clearConflict will forget the conflict of filePath and remove its conflict file
+func clearConflict(filePath string) {
+	conflictsMu.Lock()
+	delete(conflicts, filePath)
+	conflictsMu.Unlock()
+	if err := os.Remove(filePath + conflictSuffix); err != nil && !os.IsNotExist(err) {
+		log.WithFields(log.Fields{
+			"filePath": filePath + conflictSuffix,
+			"err":      err,
+		}).Error("cannot remove conflict file")
+	}
+}
+
+// resolveConflict will end the conflict of etcdKey by uploading the local file (keep local) or
+// downloading the current ETCD value (keep remote)
+func resolveConflict(ctx context.Context, etcdKey, fileFolder, keep string) error {
+	filePath := filepath.Join(fileFolder, etcdKey)
+	if !isConflicted(filePath) {
+		return fmt.Errorf("%w: %s", errNotConflicted, etcdKey)
+	}
+	switch keep {
+	case resolveLocal:
+		if err := putFileToETCD(ctx, etcdKey, filePath); err != nil {
+			return err
+		}
+	case resolveRemote:
+		var kv *storeKV
+		err := withETCDRetry(ctx, func(ctx context.Context) (err error) {
+			kv, _, err = kvStore.Get(ctx, etcdKey)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if kv == nil {
+			return fmt.Errorf("%w: %s", errKeyNotFound, etcdKey)
+		}
+		if err := verifyDownload(ctx, etcdKey, kv.Value, kv.Revision); err != nil {
+			return err
+		}
+		if err := saveKeyToFolder(etcdKey, filePath, kv.Value, kv.Revision); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("keep must be %q or %q", resolveLocal, resolveRemote)
+	}
+	clearConflict(filePath)
+	log.WithFields(log.Fields{
+		"etcdKey":  etcdKey,
+		"filePath": filePath,
+		"keep":     keep,
+	}).Info("conflict resolved")
+	writeAudit(auditEntry{
+		Action:   auditResolve,
+		ETCDKey:  etcdKey,
+		FilePath: filePath,
+		Detail:   "kept " + keep,
+	})
+	return nil
+}
+
+// resolveHandler - POST /v1/conflicts/resolve
+func resolveHandler(c *gin.Context) {
+	var json ResolveModel
+	if err := c.ShouldBindJSON(&json); err != nil {
+		abortWithBadRequest(c, err)
+		return
+	}
+	if err := resolveConflict(c.Request.Context(), json.ETCDKey, CMDArgs.ConfigFolder, json.Keep); err != nil {
+		abortWithErr(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, OKResponse{Status: "ok"})
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/doody/etcd_file_syncer/backend"
+)
+
+const (
+	// consulMaxValueSize is Consul's default kv_max_value_size
+	consulMaxValueSize = 512 * 1024
+	// consulMaxTxnOps is the most operations Consul accepts in one transaction
+	consulMaxTxnOps = 64
+	// consulMaxWait is the longest blocking query Consul serves
+	consulMaxWait = 5 * time.Minute
+)
+
+func init() {
+	backend.Register(backend.Backend{
+		Name: backendConsul,
+		Open: func(ctx context.Context, opts backend.Options) (store, error) {
+			return connectConsul(ctx, CMDArgs.ConsulAddr, opts.StartupRetries)
+		},
+		Classify: classifyConsulError,
+	})
+}
+
+// consulError is a non 2xx answer of the Consul HTTP API
+type consulError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *consulError) Error() string {
+	return fmt.Sprintf("consul: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// classifyConsulError will classify consulErrors by status code
+func classifyConsulError(err error) backend.ErrorClass {
+	var consulErr *consulError
+	if !errors.As(err, &consulErr) {
+		return backend.ErrorOther
+	}
+	switch {
+	case consulErr.StatusCode == http.StatusUnauthorized, consulErr.StatusCode == http.StatusForbidden:
+		return backend.ErrorAuth
+	case consulErr.StatusCode >= http.StatusInternalServerError, consulErr.StatusCode == http.StatusTooManyRequests:
+		return backend.ErrorTransient
+	}
+	return backend.ErrorFailed
+}
+
+// consulKV is an entry of the Consul KV API, Value is base64 encoded in JSON
+type consulKV struct {
+	Key         string
+	Value       []byte
+	ModifyIndex int64
+}
+
+// consulTxnOp is an operation of PUT /v1/txn
+type consulTxnOp struct {
+	KV consulTxnKV
+}
+
+type consulTxnKV struct {
+	Verb  string
+	Key   string
+	Value []byte `json:",omitempty"`
+	Index int64  `json:",omitempty"`
+}
+
+// consulTxnResponse is the answer of PUT /v1/txn, Errors are set when it was rolled back
+type consulTxnResponse struct {
+	Results []struct {
+		KV *consulKV
+	}
+	Errors []struct {
+		OpIndex int
+		What    string
+	}
+}
+
+// consulStore is the store of a Consul agent's KV API. The Raft index of the KV store plays the part of
+// the ETCD revision, a key's revision is its ModifyIndex.
+type consulStore struct {
+	addr       string
+	token      string
+	datacenter string
+	client     *http.Client
+}
+
+// connectConsul will create the Consul store and make sure the agent knows a leader, retrying up to
+// retries times with exponential backoff
+func connectConsul(ctx context.Context, addr string, retries int) (store, error) {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	s := &consulStore{
+		addr:       strings.TrimSuffix(addr, "/"),
+		token:      CMDArgs.ConsulToken,
+		datacenter: CMDArgs.ConsulDatacenter,
+		client:     &http.Client{},
+	}
+	err := retryStartup(ctx, retries, "Consul", func() error {
+		ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+		defer cancel()
+		var leader string
+		if _, err := s.do(ctx, http.MethodGet, "/v1/status/leader", nil, nil, &leader); err != nil {
+			return err
+		}
+		if leader == "" {
+			return &consulError{StatusCode: http.StatusServiceUnavailable, Message: "no cluster leader"}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// do will send a request to the Consul API and decode the JSON answer into out, returning the
+// X-Consul-Index of the answer. A 404 is not an error, out is left untouched.
+func (s *consulStore) do(ctx context.Context, method, path string, query url.Values, body, out interface{}) (int64, error) {
+	if query == nil {
+		query = url.Values{}
+	}
+	if s.datacenter != "" {
+		query.Set("dc", s.datacenter)
+	}
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reader = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, s.addr+path+"?"+query.Encode(), reader)
+	if err != nil {
+		return 0, err
+	}
+	if s.token != "" {
+		req.Header.Set("X-Consul-Token", s.token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	index, _ := strconv.ParseInt(resp.Header.Get("X-Consul-Index"), 10, 64)
+	payload, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return index, nil
+	case resp.StatusCode == http.StatusConflict && path == "/v1/txn":
+		// a rolled back transaction, the errors are in the body
+	case resp.StatusCode/100 != 2:
+		return 0, &consulError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(payload))}
+	}
+	if out == nil || len(payload) == 0 {
+		return index, nil
+	}
+	return index, json.Unmarshal(payload, out)
+}
+
+// kvPath will return the API path of key, escaping each segment
+func kvPath(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return "/v1/kv/" + strings.Join(segments, "/")
+}
+
+// list will read every key under prefix, waiting for a change after index when index is not 0
+func (s *consulStore) list(ctx context.Context, prefix string, index int64, wait time.Duration) ([]storeKV, int64, error) {
+	query := url.Values{"recurse": {"true"}}
+	if index > 0 {
+		query.Set("index", strconv.FormatInt(index, 10))
+		query.Set("wait", fmt.Sprintf("%ds", int(wait.Seconds())))
+	}
+	var entries []consulKV
+	revision, err := s.do(ctx, http.MethodGet, kvPath(prefix), query, nil, &entries)
+	if err != nil {
+		return nil, 0, err
+	}
+	kvs := make([]storeKV, 0, len(entries))
+	for _, entry := range entries {
+		kvs = append(kvs, storeKV{Key: entry.Key, Value: entry.Value, Revision: entry.ModifyIndex})
+	}
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+	return kvs, revision, nil
+}
+
+// Get - store
+func (s *consulStore) Get(ctx context.Context, key string) (*storeKV, int64, error) {
+	var entries []consulKV
+	revision, err := s.do(ctx, http.MethodGet, kvPath(key), nil, nil, &entries)
+	if err != nil || len(entries) == 0 {
+		return nil, revision, err
+	}
+	return &storeKV{Key: entries[0].Key, Value: entries[0].Value, Revision: entries[0].ModifyIndex}, revision, nil
+}
+
+// List - store
+func (s *consulStore) List(ctx context.Context, prefix string) ([]storeKV, int64, error) {
+	return s.list(ctx, prefix, 0, 0)
+}
+
+// Txn - store. Consul doesn't return the index of a transaction, the revision is the highest ModifyIndex
+// of the keys it set, 0 when it only deleted keys.
+func (s *consulStore) Txn(ctx context.Context, cmps []storeCmp, ops []storeOp) (bool, int64, error) {
+	txn := make([]consulTxnOp, 0, len(cmps)+len(ops))
+	for _, cmp := range cmps {
+		if cmp.Revision == 0 {
+			txn = append(txn, consulTxnOp{KV: consulTxnKV{Verb: "check-not-exists", Key: cmp.Key}})
+		} else {
+			txn = append(txn, consulTxnOp{KV: consulTxnKV{Verb: "check-index", Key: cmp.Key, Index: cmp.Revision}})
+		}
+	}
+	for _, op := range ops {
+		if op.Delete {
+			txn = append(txn, consulTxnOp{KV: consulTxnKV{Verb: "delete", Key: op.Key}})
+		} else {
+			txn = append(txn, consulTxnOp{KV: consulTxnKV{Verb: "set", Key: op.Key, Value: op.Value}})
+		}
+	}
+	var resp consulTxnResponse
+	if _, err := s.do(ctx, http.MethodPut, "/v1/txn", nil, txn, &resp); err != nil {
+		return false, 0, err
+	}
+	if len(resp.Errors) > 0 {
+		for _, txnErr := range resp.Errors {
+			if txnErr.OpIndex >= len(cmps) {
+				return false, 0, &consulError{StatusCode: http.StatusConflict, Message: txnErr.What}
+			}
+		}
+		return false, 0, nil
+	}
+	var revision int64
+	for _, result := range resp.Results {
+		if result.KV != nil && result.KV.ModifyIndex > revision {
+			revision = result.KV.ModifyIndex
+		}
+	}
+	return true, revision, nil
+}
+
+// Watch - store. Consul has no watch API, blocking queries on the prefix return its whole content on
+// every change, events are the difference with the previous answer. A blocking query timing out is the
+// progress notification.
+func (s *consulStore) Watch(ctx context.Context, prefix string, revision int64) <-chan storeWatchResponse {
+	out := make(chan storeWatchResponse)
+	wait := CMDArgs.WatchStallTimeout / 2
+	if wait > consulMaxWait || wait < time.Second {
+		wait = consulMaxWait
+	}
+	go func() {
+		defer close(out)
+		send := func(resp storeWatchResponse) bool {
+			select {
+			case out <- resp:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		kvs, index, err := s.list(ctx, prefix, 0, 0)
+		if err != nil {
+			send(storeWatchResponse{Err: err})
+			return
+		}
+		known := make(map[string]int64, len(kvs))
+		resp := storeWatchResponse{Revision: index}
+		for _, kv := range kvs {
+			known[kv.Key] = kv.Revision
+			if revision > 0 && kv.Revision > revision {
+				resp.Events = append(resp.Events, storeEvent{Type: storeEventPut, KV: kv})
+			}
+		}
+		if revision > index {
+			// the index went backwards, the cluster lost its state since revision
+			resp.CompactRevision = index
+		}
+		if !send(resp) || resp.CompactRevision > 0 {
+			return
+		}
+		for {
+			kvs, next, err := s.list(ctx, prefix, index, wait)
+			if err != nil {
+				if ctx.Err() == nil {
+					send(storeWatchResponse{Err: err})
+				}
+				return
+			}
+			if next < index {
+				send(storeWatchResponse{Revision: next, CompactRevision: next})
+				return
+			}
+			resp := storeWatchResponse{Revision: next}
+			current := make(map[string]int64, len(kvs))
+			for _, kv := range kvs {
+				current[kv.Key] = kv.Revision
+				if rev, ok := known[kv.Key]; !ok || kv.Revision > rev {
+					resp.Events = append(resp.Events, storeEvent{Type: storeEventPut, KV: kv})
+				}
+			}
+			for key := range known {
+				if _, ok := current[key]; !ok {
+					resp.Events = append(resp.Events, storeEvent{Type: storeEventDelete, KV: storeKV{Key: key, Revision: next}})
+				}
+			}
+			sort.SliceStable(resp.Events, func(i, j int) bool { return resp.Events[i].KV.Revision < resp.Events[j].KV.Revision })
+			known, index = current, next
+			if !send(resp) {
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// Revision - store
+func (s *consulStore) Revision(ctx context.Context, prefix string) (int64, int64, error) {
+	var keys []string
+	head, err := s.do(ctx, http.MethodGet, kvPath(prefix), url.Values{"keys": {"true"}}, nil, &keys)
+	if err != nil {
+		return 0, 0, err
+	}
+	// the index of a keys query is the last change under prefix, the head needs a query of the whole store
+	lastChange := head
+	if len(keys) == 0 {
+		lastChange = 0
+	}
+	if head, err = s.do(ctx, http.MethodGet, kvPath(""), url.Values{"keys": {"true"}, "separator": {"/"}}, nil, nil); err != nil {
+		return 0, 0, err
+	}
+	return head, lastChange, nil
+}
+
+// MaxValueSize - store
+func (s *consulStore) MaxValueSize() int {
+	return consulMaxValueSize
+}
+
+// MaxTxnOps - store
+func (s *consulStore) MaxTxnOps() int {
+	return consulMaxTxnOps
+}
+
+// Close - store
+func (s *consulStore) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
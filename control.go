@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// controlDir is the directory under --key of the keys controlling every syncer of the key, they are not
+// synced as files
+const controlDir = ".control/"
+
+// errRemotePaused is returned when saving a key while the paused control key is set
+var errRemotePaused = errors.New("changes of ETCD paused by control key")
+
+var (
+	// pausedBy is the value of the paused control key, empty while changes are applied
+	pausedBy string
+	// paused is set while the paused control key exists
+	paused bool
+	// pausedEvents maps keys to their latest change seen while paused
+	pausedEvents = make(map[string]storeEvent)
+	controlMu    sync.Mutex
+)
+
+// pausedControlKey will return the key that pauses the application of changes fleet-wide while it exists
+func pausedControlKey() string {
+	return CMDArgs.ConfigKey + controlDir + "paused"
+}
+
+// isControlKey reports whether etcdKey is under the control directory of --key
+func isControlKey(etcdKey string) bool {
+	return strings.HasPrefix(etcdKey, CMDArgs.ConfigKey+controlDir)
+}
+
+// remotePaused reports whether the paused control key is set
+func remotePaused() bool {
+	controlMu.Lock()
+	defer controlMu.Unlock()
+	return paused
+}
+
+// loadControl will read the control keys at startup and report whether changes are paused
+func loadControl(ctx context.Context) bool {
+	var kv *storeKV
+	err := withETCDRetry(ctx, func(ctx context.Context) (err error) {
+		kv, _, err = kvStore.Get(ctx, pausedControlKey())
+		return err
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"controlKey": pausedControlKey(),
+			"err":        err,
+		}).Error("cannot read control key")
+		return false
+	}
+	if kv != nil {
+		setPaused(true, string(kv.Value))
+	}
+	return kv != nil
+}
+
+// setPaused will pause or resume the application of changes, reason is the value of the control key
+func setPaused(pause bool, reason string) (changed bool) {
+	controlMu.Lock()
+	changed, paused, pausedBy = paused != pause, pause, reason
+	controlMu.Unlock()
+	if !changed {
+		return false
+	}
+	if pause {
+		log.WithFields(log.Fields{
+			"controlKey": pausedControlKey(),
+			"reason":     reason,
+		}).Warn("changes of ETCD paused by control key")
+	} else {
+		log.WithFields(log.Fields{
+			"controlKey": pausedControlKey(),
+		}).Info("control key cleared, resuming")
+	}
+	writeAudit(auditEntry{Action: auditRemotePause, ETCDKey: pausedControlKey(), Detail: strings.TrimSpace(reason)})
+	return true
+}
+
+// applyControlEvents will apply the events of control and remote configuration keys, drop those of history
+// keys, and return the others.
+// Clearing the paused
+// key applies the changes seen meanwhile, then resyncs and reconciles the folder.
+func applyControlEvents(ctx context.Context, events []storeEvent, etcdKey, fileFolder string) []storeEvent {
+	if etcdKey != CMDArgs.ConfigKey {
+		return events
+	}
+	others := make([]storeEvent, 0, len(events))
+	resume := false
+	for _, ev := range events {
+		switch {
+		case ev.KV.Key == pausedControlKey():
+			if ev.Type == storeEventPut {
+				setPaused(true, string(ev.KV.Value))
+			} else {
+				resume = setPaused(false, "")
+			}
+		case isRemoteConfigKey(ev.KV.Key):
+			applyRemoteSetting(ev.KV.Key, ev.KV.Value, ev.Type == storeEventDelete)
+		case isControlKey(ev.KV.Key), isHistoryKey(ev.KV.Key):
+		default:
+			others = append(others, ev)
+		}
+	}
+	if resume {
+		resumeChanges(ctx, etcdKey, fileFolder)
+	}
+	return others
+}
+
+// pauseEvents will keep events until the paused control key is cleared
+func pauseEvents(events []storeEvent) {
+	controlMu.Lock()
+	defer controlMu.Unlock()
+	for _, ev := range events {
+		pausedEvents[ev.KV.Key] = ev
+	}
+}
+
+// resumeChanges will apply the changes seen while paused, held again when changes are delayed, then
+// resync and reconcile fileFolder with ETCD for the changes made before the pause was seen
+func resumeChanges(ctx context.Context, etcdKey, fileFolder string) {
+	controlMu.Lock()
+	events := make([]storeEvent, 0, len(pausedEvents))
+	for _, ev := range pausedEvents {
+		events = append(events, ev)
+	}
+	pausedEvents = make(map[string]storeEvent)
+	controlMu.Unlock()
+	sort.Slice(events, func(i, j int) bool { return events[i].KV.Revision < events[j].KV.Revision })
+	if holdingChanges() {
+		holdEvents(events)
+	} else if len(events) > 0 {
+		applyEvents(ctx, events, etcdKey, fileFolder)
+	}
+	readKeyAndSaveToFolder(ctx, etcdKey, fileFolder)
+	markHydrated()
+	deepReconcile(ctx, etcdKey, fileFolder)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// defaultCORSMethods and defaultCORSHeaders cover every endpoint of the API
+	defaultCORSMethods = []string{http.MethodGet, http.MethodPost, http.MethodPatch}
+	defaultCORSHeaders = []string{"Authorization", "Content-Type", "If-Match", requestIDHeader}
+	// corsExposedHeaders are the response headers browsers let scripts read
+	corsExposedHeaders = []string{"ETag", requestIDHeader}
+	// corsConfig is nil unless --cors-origin is given
+	corsConfig *corsPolicy
+)
+
+// corsPolicy is the CORS configuration of the API
+type corsPolicy struct {
+	origins []string
+	methods string
+	headers string
+	maxAge  string
+}
+
+// newCORSPolicy will build the CORS policy from the --cors-* flags, nil when no origin is allowed
+func newCORSPolicy(origins, methods, headers []string, maxAge time.Duration) (*corsPolicy, error) {
+	origins = splitList(origins)
+	if len(origins) == 0 {
+		return nil, nil
+	}
+	for _, origin := range origins {
+		if _, err := path.Match(origin, ""); err != nil {
+			return nil, err
+		}
+	}
+	if methods = splitList(methods); len(methods) == 0 {
+		methods = defaultCORSMethods
+	}
+	if headers = splitList(headers); len(headers) == 0 {
+		headers = defaultCORSHeaders
+	}
+	for i, method := range methods {
+		methods[i] = strings.ToUpper(method)
+	}
+	return &corsPolicy{
+		origins: origins,
+		methods: strings.Join(methods, ", "),
+		headers: strings.Join(headers, ", "),
+		maxAge:  strconv.Itoa(int(maxAge.Seconds())),
+	}, nil
+}
+
+// allowsOrigin reports whether origin matches one of the allowed origin patterns, ex: https://*.example.com
+func (p *corsPolicy) allowsOrigin(origin string) bool {
+	for _, pattern := range p.origins {
+		if ok, _ := path.Match(pattern, origin); ok || pattern == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// cors will add the CORS headers of policy to responses to allowed origins and answer their preflight
+// requests. Requests from other origins are served without CORS headers, the browser blocks them.
+func cors(policy *corsPolicy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin == "" {
+			c.Next()
+			return
+		}
+		c.Writer.Header().Add("Vary", "Origin")
+		if !policy.allowsOrigin(origin) {
+			c.Next()
+			return
+		}
+		c.Header("Access-Control-Allow-Origin", origin)
+		if c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != "" {
+			c.Header("Access-Control-Allow-Methods", policy.methods)
+			c.Header("Access-Control-Allow-Headers", policy.headers)
+			c.Header("Access-Control-Max-Age", policy.maxAge)
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+		c.Header("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+		c.Next()
+	}
+}
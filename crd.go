@@ -0,0 +1,479 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// FileSync custom resource, see contrib/kubernetes/filesync-crd.yaml
+const (
+	fileSyncGroup    = "etcdfilesyncer.io"
+	fileSyncVersion  = "v1alpha1"
+	fileSyncResource = "filesyncs"
+)
+
+// Restart backoff of a mapping's syncer that exited on its own
+const (
+	crdRestartMinBackoff = time.Second
+	crdRestartMaxBackoff = time.Minute
+)
+
+// crdSupervisorFlags are the flags of the supervisor that are not passed to the syncer of a mapping, and
+// whether they take a value
+var crdSupervisorFlags = map[string]bool{
+	"--crd-mode":        false,
+	"--crd-namespace":   true,
+	"--crd-resync":      true,
+	"--crd-socket-dir":  true,
+	"--crd-folder-root": true,
+	"--kube-api":        true,
+	"--node-name":       true,
+	"-k":                true,
+	"--key":             true,
+	"-f":                true,
+	"--folder":          true,
+	"-p":                true,
+	"--port":            true,
+	"--listen":          true,
+}
+
+// Values taken by the flags of crdArgFlags
+const (
+	crdNoValue = iota
+	crdOneValue
+	crdValues
+)
+
+// crdArgFlags are the only flags spec.args can set, with the values they take: the ones changing how the mapping
+// is synced. Flags running commands, signalling processes, changing owners, reading or writing files outside of
+// spec.folder or changing the store connection are left to the DaemonSet.
+var crdArgFlags = map[string]int{
+	"--verify-writes":              crdNoValue,
+	"--self-heal":                  crdNoValue,
+	"--preserve-xattrs":            crdNoValue,
+	"--preserve-acls":              crdNoValue,
+	"--checksum":                   crdNoValue,
+	"--require-signature":          crdNoValue,
+	"--render-templates":           crdNoValue,
+	"--banner":                     crdNoValue,
+	"--normalize-uploads":          crdNoValue,
+	"--swagger-ui":                 crdNoValue,
+	"--promotion-require-approval": crdNoValue,
+	"--scan-interval":              crdOneValue,
+	"--scan-workers":               crdOneValue,
+	"--large-file-size":            crdOneValue,
+	"--deep-reconcile-interval":    crdOneValue,
+	"--drift-check-interval":       crdOneValue,
+	"--self-heal-direction":        crdOneValue,
+	"--diff-max-size":              crdOneValue,
+	"--history":                    crdOneValue,
+	"--max-files":                  crdOneValue,
+	"--max-total-bytes":            crdOneValue,
+	"--archive-max-size":           crdOneValue,
+	"--cohort":                     crdOneValue,
+	"--manifest":                   crdOneValue,
+	"--rate-limit":                 crdOneValue,
+	"--rate-limit-burst":           crdOneValue,
+	"--promotion-ttl":              crdOneValue,
+	"--watch-stall-timeout":        crdOneValue,
+	"--xattr-prefix":               crdValues,
+	"--only-ext":                   crdValues,
+	"--only-mime":                  crdValues,
+	"--banner-comment":             crdValues,
+	"--line-endings":               crdValues,
+	"--archive":                    crdValues,
+	"--apply-order":                crdValues,
+	"--apply-delay":                crdValues,
+	"--sync-window":                crdValues,
+	"--ttl":                        crdValues,
+	"--pack":                       crdValues,
+	"--encoding":                   crdValues,
+	"--fragment":                   crdValues,
+	"--merge-strategy":             crdValues,
+}
+
+// FileSyncSpec - spec of a FileSync resource, one --key/--folder mapping
+type FileSyncSpec struct {
+	Key          string            `json:"key"`
+	Folder       string            `json:"folder"`
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	Listen       string            `json:"listen,omitempty"`
+	Args         []string          `json:"args,omitempty"`
+}
+
+// fileSync is a FileSync resource
+type fileSync struct {
+	Metadata kubeObjectMeta `json:"metadata"`
+	Spec     FileSyncSpec   `json:"spec"`
+}
+
+// fileSyncList is the answer to a list of FileSync resources
+type fileSyncList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []fileSync `json:"items"`
+}
+
+// crdChild is the syncer process running one mapping
+type crdChild struct {
+	args   []string
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// crdSupervisor runs a syncer process per FileSync resource selecting this node
+type crdSupervisor struct {
+	kube       *kubeClient
+	path       string
+	executable string
+	resources  map[string]fileSync
+	children   map[string]*crdChild
+}
+
+// runCRDMode will run the syncers of the FileSync resources selecting this node until ctx is canceled,
+// restarting them when their resource changes
+func runCRDMode(ctx context.Context) int {
+	kube, err := newKubeClient(CMDArgs.KubeAPI)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"kubeAPI": CMDArgs.KubeAPI,
+			"err":     err,
+		}).Error("cannot reach the Kubernetes API")
+		return exitConfigError
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		log.WithField("err", err).Error("cannot find the syncer executable")
+		return exitConfigError
+	}
+	namespace := CMDArgs.CRDNamespace
+	if namespace == "" {
+		namespace = kubeNamespace()
+	}
+	path := fmt.Sprintf("/apis/%s/%s/%s", fileSyncGroup, fileSyncVersion, fileSyncResource)
+	switch namespace {
+	case "":
+		log.Error("--crd-namespace is required outside of a pod")
+		return exitConfigError
+	case "*":
+	default:
+		path = fmt.Sprintf("/apis/%s/%s/namespaces/%s/%s", fileSyncGroup, fileSyncVersion,
+			url.PathEscape(namespace), fileSyncResource)
+	}
+	if err := os.MkdirAll(CMDArgs.CRDSocketDir, 0755); err != nil {
+		log.WithFields(log.Fields{
+			"socketDir": CMDArgs.CRDSocketDir,
+			"err":       err,
+		}).Error("cannot create the socket directory")
+		return exitConfigError
+	}
+	s := &crdSupervisor{
+		kube:       kube,
+		path:       path,
+		executable: executable,
+		children:   make(map[string]*crdChild),
+	}
+	log.WithFields(log.Fields{
+		"namespace": namespace,
+		"node":      CMDArgs.NodeName,
+	}).Info("watching FileSync resources")
+	for ctx.Err() == nil {
+		if err := s.sync(ctx); err != nil && ctx.Err() == nil {
+			log.WithFields(log.Fields{
+				"path": s.path,
+				"err":  err,
+			}).Error("cannot watch FileSync resources")
+			select {
+			case <-ctx.Done():
+			case <-time.After(5 * time.Second):
+			}
+		}
+	}
+	s.stopAll()
+	return 0
+}
+
+// sync will list the FileSync resources, start and stop syncers to match them, then follow their changes
+// until the watch ends or --crd-resync elapses
+func (s *crdSupervisor) sync(ctx context.Context) error {
+	var list fileSyncList
+	if err := s.kube.get(ctx, s.path, &list); err != nil {
+		return err
+	}
+	s.resources = make(map[string]fileSync, len(list.Items))
+	for _, item := range list.Items {
+		s.resources[item.Metadata.Namespace+"/"+item.Metadata.Name] = item
+	}
+	// node labels are reread on every list, their changes are not watched
+	labels, err := s.nodeLabels(ctx)
+	if err != nil {
+		return err
+	}
+	s.reconcile(ctx, labels)
+
+	watchCtx, cancel := context.WithTimeout(ctx, CMDArgs.CRDResync)
+	defer cancel()
+	err = s.kube.watch(watchCtx, s.path, list.Metadata.ResourceVersion, func(ev kubeWatchEvent) error {
+		var item fileSync
+		if err := json.Unmarshal(ev.Object, &item); err != nil {
+			return err
+		}
+		name := item.Metadata.Namespace + "/" + item.Metadata.Name
+		switch ev.Type {
+		case "ADDED", "MODIFIED":
+			s.resources[name] = item
+			if labels == nil && len(item.Spec.NodeSelector) > 0 {
+				if labels, err = s.nodeLabels(ctx); err != nil {
+					return err
+				}
+			}
+		case "DELETED":
+			delete(s.resources, name)
+		default:
+			return nil
+		}
+		s.reconcile(ctx, labels)
+		return nil
+	})
+	var statusErr *kubeStatusError
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &statusErr) && statusErr.Code == 410 {
+		return nil
+	}
+	return err
+}
+
+// nodeLabels will return the labels of --node-name, nil when no FileSync has a node selector
+func (s *crdSupervisor) nodeLabels(ctx context.Context) (map[string]string, error) {
+	needed := false
+	for _, item := range s.resources {
+		needed = needed || len(item.Spec.NodeSelector) > 0
+	}
+	if !needed {
+		return nil, nil
+	}
+	if CMDArgs.NodeName == "" {
+		return nil, fmt.Errorf("FileSync resources select nodes, set --node-name or NODE_NAME")
+	}
+	var node struct {
+		Metadata kubeObjectMeta `json:"metadata"`
+	}
+	if err := s.kube.get(ctx, "/api/v1/nodes/"+url.PathEscape(CMDArgs.NodeName), &node); err != nil {
+		return nil, err
+	}
+	return node.Metadata.Labels, nil
+}
+
+// reconcile will stop the syncers of resources gone, changed or not selecting this node anymore, and start
+// the missing ones
+func (s *crdSupervisor) reconcile(ctx context.Context, labels map[string]string) {
+	names := make([]string, 0, len(s.resources))
+	for name := range s.resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	wanted := make(map[string][]string, len(names))
+	folders := make(map[string]string, len(names))
+	for _, name := range names {
+		item := s.resources[name]
+		if !selectsNode(item.Spec.NodeSelector, labels) {
+			continue
+		}
+		if err := validateFileSync(item.Spec); err != nil {
+			log.WithFields(log.Fields{
+				"fileSync": name,
+				"err":      err,
+			}).Error("invalid FileSync, ignored")
+			continue
+		}
+		folder := filepath.Clean(item.Spec.Folder)
+		if other, ok := folders[folder]; ok {
+			log.WithFields(log.Fields{
+				"fileSync": name,
+				"folder":   folder,
+				"syncedBy": other,
+			}).Error("folder already synced by another FileSync, ignored")
+			continue
+		}
+		folders[folder] = name
+		wanted[name] = s.childArgs(name, item.Spec)
+	}
+
+	for name, child := range s.children {
+		if args, ok := wanted[name]; ok && strings.Join(args, "\x00") == strings.Join(child.args, "\x00") {
+			continue
+		}
+		log.WithField("fileSync", name).Info("stopping the syncer of a FileSync changed or removed")
+		child.cancel()
+		<-child.done
+		delete(s.children, name)
+	}
+	for _, name := range names {
+		args, ok := wanted[name]
+		if _, running := s.children[name]; !ok || running {
+			continue
+		}
+		childCtx, cancel := context.WithCancel(ctx)
+		child := &crdChild{args: args, cancel: cancel, done: make(chan struct{})}
+		s.children[name] = child
+		go s.run(childCtx, name, child)
+	}
+}
+
+// run will run the syncer of name until ctx is canceled, restarting it when it exits
+func (s *crdSupervisor) run(ctx context.Context, name string, child *crdChild) {
+	defer close(child.done)
+	backoff := crdRestartMinBackoff
+	for {
+		cmd := exec.Command(s.executable, child.args...)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		started := time.Now()
+		if err := cmd.Start(); err != nil {
+			log.WithFields(log.Fields{
+				"fileSync": name,
+				"err":      err,
+			}).Error("cannot start the syncer of a FileSync")
+		} else {
+			log.WithFields(log.Fields{
+				"fileSync": name,
+				"pid":      cmd.Process.Pid,
+			}).Info("started the syncer of a FileSync")
+			exited := make(chan error, 1)
+			go func() { exited <- cmd.Wait() }()
+			select {
+			case <-ctx.Done():
+				cmd.Process.Signal(syscall.SIGTERM)
+				select {
+				case <-exited:
+				case <-time.After(CMDArgs.ShutdownTimeout + 5*time.Second):
+					cmd.Process.Kill()
+					<-exited
+				}
+				return
+			case err := <-exited:
+				log.WithFields(log.Fields{
+					"fileSync": name,
+					"err":      err,
+				}).Error("the syncer of a FileSync exited, restarting")
+			}
+		}
+		if time.Since(started) > crdRestartMaxBackoff {
+			backoff = crdRestartMinBackoff
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > crdRestartMaxBackoff {
+			backoff = crdRestartMaxBackoff
+		}
+	}
+}
+
+// stopAll will stop every syncer and wait for them to exit
+func (s *crdSupervisor) stopAll() {
+	for name, child := range s.children {
+		child.cancel()
+		<-child.done
+		delete(s.children, name)
+	}
+}
+
+// childArgs will return the command line of the syncer of a mapping: the supervisor's own flags, the
+// mapping's key, folder and listener, then its extra args which win over the supervisor's
+func (s *crdSupervisor) childArgs(name string, spec FileSyncSpec) []string {
+	var args []string
+	osArgs := os.Args[1:]
+	for i := 0; i < len(osArgs); i++ {
+		flag, inline := osArgs[i], false
+		if j := strings.Index(flag, "="); j > 0 && strings.HasPrefix(flag, "-") {
+			flag, inline = flag[:j], true
+		}
+		takesValue, ok := crdSupervisorFlags[flag]
+		if !ok {
+			args = append(args, osArgs[i])
+		} else if takesValue && !inline {
+			i++
+		}
+	}
+	listen := spec.Listen
+	if listen == "" {
+		listen = unixListenPrefix + filepath.Join(CMDArgs.CRDSocketDir, strings.Replace(name, "/", "_", 1)+".sock")
+	}
+	instance := CMDArgs.InstanceName
+	if instance == "" {
+		instance, _ = os.Hostname()
+	}
+	args = append(args, "--key", spec.Key, "--folder", spec.Folder, "--listen", listen,
+		"--instance-name", instance+"/"+name)
+	return append(args, spec.Args...)
+}
+
+// selectsNode reports whether a node with labels matches selector, an empty selector matches every node
+func selectsNode(selector, labels map[string]string) bool {
+	for name, value := range selector {
+		if v, ok := labels[name]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// validateFileSync will check the settings of a mapping the supervisor relies on: a folder under
+// --crd-folder-root and args setting crdArgFlags only
+func validateFileSync(spec FileSyncSpec) error {
+	switch {
+	case spec.Key == "":
+		return fmt.Errorf("spec.key is required")
+	case !filepath.IsAbs(spec.Folder):
+		return fmt.Errorf("spec.folder must be an absolute path")
+	}
+	root := filepath.Clean(CMDArgs.CRDFolderRoot)
+	if rel, err := filepath.Rel(root, filepath.Clean(spec.Folder)); err != nil || rel == ".." ||
+		strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("spec.folder must be under %s", root)
+	}
+	// pending is what the last flag still takes: nothing, one value or any number of them
+	pending := crdNoValue
+	for _, arg := range spec.Args {
+		if !strings.HasPrefix(arg, "-") {
+			if pending == crdNoValue {
+				return fmt.Errorf("spec.args: unexpected argument %q", arg)
+			}
+			if pending == crdOneValue {
+				pending = crdNoValue
+			}
+			continue
+		}
+		if pending == crdOneValue {
+			return fmt.Errorf("spec.args: missing value before %s", arg)
+		}
+		flag := strings.SplitN(arg, "=", 2)[0]
+		takes, ok := crdArgFlags[flag]
+		if !ok {
+			return fmt.Errorf("spec.args cannot set %s", flag)
+		}
+		pending = takes
+		if flag != arg && takes == crdOneValue {
+			// --flag=value
+			pending = crdNoValue
+		}
+	}
+	if pending == crdOneValue {
+		return fmt.Errorf("spec.args: missing value at the end")
+	}
+	return nil
+}
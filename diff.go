@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pmezard/go-difflib/difflib"
+	log "github.com/sirupsen/logrus"
+)
+
+// DiffCmd - diff subcommand
+type DiffCmd struct {
+	Addr    string `arg:"--addr" help:"compare through the API of a running syncer, host:port or unix:///path/to.sock, instead of reading ETCD"`
+	Unified bool   `arg:"-u,--unified" help:"print a unified diff of every modified file"`
+	Context int    `arg:"--context" default:"3" help:"lines of context of unified diffs"`
+}
+
+// DriftResponse - GET /v1/drift
+type DriftResponse struct {
+	Drifts []fileDrift `json:"drifts"`
+}
+
+// driftHandler - GET /v1/drift, compares the folder with ETCD
+func driftHandler(c *gin.Context) {
+	drifts, err := detectDrift(c.Request.Context(), CMDArgs.ConfigKey, CMDArgs.ConfigFolder)
+	if err != nil {
+		abortWithErr(c, err)
+		return
+	}
+	if drifts == nil {
+		drifts = []fileDrift{}
+	}
+	c.JSON(http.StatusOK, DriftResponse{Drifts: drifts})
+}
+
+// runDiff will print every file of --folder that differs from ETCD, read directly or through the API of
+// the syncer at cmd.Addr. It exits with 1 when there is drift.
+func runDiff(ctx context.Context, cmd *DiffCmd) int {
+	var (
+		drifts []fileDrift
+		err    error
+	)
+	if cmd.Addr != "" {
+		drifts, err = fetchDrift(ctx, cmd.Addr)
+	} else {
+		drifts, err = detectDrift(ctx, CMDArgs.ConfigKey, CMDArgs.ConfigFolder)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "cannot compare the folder with ETCD:", err)
+		return exitETCDUnreachable
+	}
+	sort.Slice(drifts, func(i, j int) bool { return drifts[i].ETCDKey < drifts[j].ETCDKey })
+	for _, drift := range drifts {
+		fmt.Printf("%-15s %s\n", drift.Kind, drift.ETCDKey)
+		if cmd.Unified {
+			printUnifiedDiff(os.Stdout, drift, cmd.Context)
+		}
+	}
+	if len(drifts) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// fetchDrift will read the drift found by the syncer at addr
+func fetchDrift(ctx context.Context, addr string) ([]fileDrift, error) {
+	client, baseURL := apiClient(addr)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+apiPrefix+"/drift", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, body)
+	}
+	var drift DriftResponse
+	if err := json.Unmarshal(body, &drift); err != nil {
+		return nil, err
+	}
+	return drift.Drifts, nil
+}
+
+// printUnifiedDiff will write the unified diff from the ETCD value to the local file of drift to w
+func printUnifiedDiff(w io.Writer, drift fileDrift, contextLines int) {
+	var local []byte
+	if drift.Kind != driftMissingLocal {
+		var err error
+		if local, err = os.ReadFile(drift.FilePath); err != nil {
+			fmt.Fprintf(w, "cannot read %s: %v\n", drift.FilePath, err)
+			return
+		}
+		local, _ = fileValueOf(drift.ETCDKey, local)
+	}
+	if bytes.IndexByte(local, 0) >= 0 || bytes.IndexByte(drift.Value, 0) >= 0 {
+		fmt.Fprintf(w, "Binary files etcd:%s and %s differ\n", drift.ETCDKey, drift.FilePath)
+		return
+	}
+	fromFile, toFile := fmt.Sprintf("etcd:%s@%d", drift.ETCDKey, drift.Revision), drift.FilePath
+	if drift.Kind == driftMissingRemote {
+		fromFile = "/dev/null"
+	}
+	if drift.Kind == driftMissingLocal {
+		toFile = "/dev/null"
+	}
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        diffLines(drift.Value),
+		B:        diffLines(local),
+		FromFile: fromFile,
+		ToFile:   toFile,
+		Context:  contextLines,
+	})
+	if err != nil {
+		fmt.Fprintf(w, "cannot diff %s: %v\n", drift.ETCDKey, err)
+		return
+	}
+	fmt.Fprint(w, diff)
+}
+
+// diffLines will split content into newline terminated lines
+func diffLines(content []byte) []string {
+	lines := strings.SplitAfter(string(content), "\n")
+	if lines[len(lines)-1] == "" {
+		return lines[:len(lines)-1]
+	}
+	lines[len(lines)-1] += "\n"
+	return lines
+}
+
+// diffSnapshot is the content of a file before a change from ETCD is applied to it, nil when it didn't exist
+type diffSnapshot struct {
+	content []byte
+	// revision is the revision of the key the file was last synced at
+	revision int64
+	// ok is false when diffs are disabled or the file is over --diff-max-size
+	ok bool
+}
+
+// snapshotForDiff will read filePath before a change is applied to it, when --diff-max-size is set
+func snapshotForDiff(filePath string) diffSnapshot {
+	if CMDArgs.DiffMaxSize <= 0 {
+		return diffSnapshot{}
+	}
+	info, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return diffSnapshot{ok: true}
+	}
+	if err != nil || info.Size() > CMDArgs.DiffMaxSize {
+		return diffSnapshot{}
+	}
+	content, err := os.ReadFile(filePath)
+	synced, _ := lastSynced(filePath)
+	return diffSnapshot{content: content, revision: synced.Revision, ok: err == nil}
+}
+
+// diff will log and audit the unified diff from the snapshot to filePath, just written from or deleted as
+// etcdKey at revision, and return it. It is empty for binary files and files over --diff-max-size.
+func (s diffSnapshot) diff(etcdKey, filePath string, revision int64) string {
+	if !s.ok {
+		return ""
+	}
+	after := snapshotForDiff(filePath)
+	if !after.ok || bytes.Equal(s.content, after.content) ||
+		bytes.IndexByte(s.content, 0) >= 0 || bytes.IndexByte(after.content, 0) >= 0 {
+		return ""
+	}
+	fromFile, toFile := fmt.Sprintf("%s@%d", etcdKey, s.revision), fmt.Sprintf("%s@%d", etcdKey, revision)
+	var a, b []string
+	if s.content == nil {
+		fromFile = "/dev/null"
+	} else {
+		a = diffLines(s.content)
+	}
+	if after.content == nil {
+		toFile = "/dev/null"
+	} else {
+		b = diffLines(after.content)
+	}
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{A: a, B: b, FromFile: fromFile, ToFile: toFile, Context: 3})
+	if err != nil || diff == "" {
+		return ""
+	}
+	log.WithFields(log.Fields{
+		"etcdKey":  etcdKey,
+		"filePath": filePath,
+		"revision": revision,
+		"diff":     diff,
+	}).Info("change applied")
+	writeAudit(auditEntry{Action: auditChange, ETCDKey: etcdKey, FilePath: filePath, Detail: diff})
+	return diff
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// digestFile is what happened to a key since the last digest
+type digestFile struct {
+	ETCDKey string `json:"etcdKey"`
+	// Action is the last change applied, Changes how many were
+	Action   string `json:"action"`
+	Changes  int    `json:"changes"`
+	Revision int64  `json:"revision,omitempty"`
+	// Added and Removed are the lines of the diffs, with --diff-max-size
+	Added   int `json:"added"`
+	Removed int `json:"removed"`
+
+	// first is the revision of the first change
+	first int64
+}
+
+// digestHook is how often a change hook ran since the last digest
+type digestHook struct {
+	Name     string `json:"name"`
+	Runs     int    `json:"runs"`
+	Failures int    `json:"failures"`
+}
+
+// changeDigest is the JSON body posted to --digest-url, a summary of the changes applied over --digest-interval
+type changeDigest struct {
+	Since        time.Time    `json:"since"`
+	Until        time.Time    `json:"until"`
+	Instance     string       `json:"instance"`
+	ETCDKey      string       `json:"etcdKey"`
+	FromRevision int64        `json:"fromRevision,omitempty"`
+	ToRevision   int64        `json:"toRevision,omitempty"`
+	Files        []digestFile `json:"files"`
+	Hooks        []digestHook `json:"hooks,omitempty"`
+	// Text is the summary rendered for chat webhooks, which post it as the message
+	Text string `json:"text"`
+}
+
+var (
+	digestFiles = make(map[string]*digestFile)
+	digestHooks = make(map[string]*digestHook)
+	digestSince = time.Now()
+	digestMu    sync.Mutex
+)
+
+// digestEnabled reports whether change digests are sent
+func digestEnabled() bool {
+	return CMDArgs.DigestCommand != "" || CMDArgs.DigestURL != ""
+}
+
+// recordDigestChange will add a change applied to etcdKey at revision to the next digest
+func recordDigestChange(action, etcdKey string, revision int64, diff string) {
+	if !digestEnabled() {
+		return
+	}
+	digestMu.Lock()
+	defer digestMu.Unlock()
+	f, ok := digestFiles[etcdKey]
+	if !ok {
+		f = &digestFile{ETCDKey: etcdKey}
+		digestFiles[etcdKey] = f
+	}
+	f.Action = action
+	f.Changes++
+	if revision > f.Revision {
+		f.Revision = revision
+	}
+	if f.first == 0 {
+		f.first = revision
+	}
+	added, removed := diffStat(diff)
+	f.Added += added
+	f.Removed += removed
+}
+
+// recordDigestHook will add a run of the change hook name to the next digest
+func recordDigestHook(name string, err error) {
+	if !digestEnabled() {
+		return
+	}
+	digestMu.Lock()
+	defer digestMu.Unlock()
+	h, ok := digestHooks[name]
+	if !ok {
+		h = &digestHook{Name: name}
+		digestHooks[name] = h
+	}
+	h.Runs++
+	if err != nil {
+		h.Failures++
+	}
+}
+
+// diffStat will count the lines a unified diff adds and removes
+func diffStat(diff string) (added, removed int) {
+	for _, line := range strings.Split(diff, "\n") {
+		switch {
+		case strings.HasPrefix(line, "+++"), strings.HasPrefix(line, "---"):
+		case strings.HasPrefix(line, "+"):
+			added++
+		case strings.HasPrefix(line, "-"):
+			removed++
+		}
+	}
+	return added, removed
+}
+
+// takeDigest will return the changes recorded since the last digest and start a new one, false without changes
+func takeDigest() (changeDigest, bool) {
+	digestMu.Lock()
+	defer digestMu.Unlock()
+	now := time.Now()
+	d := changeDigest{
+		Since:    digestSince.UTC(),
+		Until:    now.UTC(),
+		Instance: instanceName,
+		ETCDKey:  CMDArgs.ConfigKey,
+		Files:    make([]digestFile, 0, len(digestFiles)),
+	}
+	digestSince = now
+	if len(digestFiles) == 0 && len(digestHooks) == 0 {
+		return d, false
+	}
+	for _, f := range digestFiles {
+		d.Files = append(d.Files, *f)
+		if f.Revision > d.ToRevision {
+			d.ToRevision = f.Revision
+		}
+		if f.first > 0 && (d.FromRevision == 0 || f.first < d.FromRevision) {
+			d.FromRevision = f.first
+		}
+	}
+	for _, h := range digestHooks {
+		d.Hooks = append(d.Hooks, *h)
+	}
+	digestFiles = make(map[string]*digestFile)
+	digestHooks = make(map[string]*digestHook)
+	sort.Slice(d.Files, func(i, j int) bool { return d.Files[i].ETCDKey < d.Files[j].ETCDKey })
+	sort.Slice(d.Hooks, func(i, j int) bool { return d.Hooks[i].Name < d.Hooks[j].Name })
+	d.Text = digestText(d)
+	return d, true
+}
+
+// digestText will render d as a few lines of plain text
+func digestText(d changeDigest) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %d file(s) changed under %s", d.Instance, len(d.Files), d.ETCDKey)
+	switch {
+	case d.FromRevision > 0 && d.FromRevision < d.ToRevision:
+		fmt.Fprintf(&b, ", revisions %d-%d", d.FromRevision, d.ToRevision)
+	case d.ToRevision > 0:
+		fmt.Fprintf(&b, ", revision %d", d.ToRevision)
+	}
+	fmt.Fprintf(&b, " in the last %s\n", d.Until.Sub(d.Since).Round(time.Second))
+	for _, f := range d.Files {
+		fmt.Fprintf(&b, "%s %s +%d -%d", f.Action, f.ETCDKey, f.Added, f.Removed)
+		if f.Changes > 1 {
+			fmt.Fprintf(&b, " (%d changes)", f.Changes)
+		}
+		b.WriteString("\n")
+	}
+	for _, h := range d.Hooks {
+		fmt.Fprintf(&b, "hook %s ran %d time(s)", h.Name, h.Runs)
+		if h.Failures > 0 {
+			fmt.Fprintf(&b, ", %d failed", h.Failures)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// runDigests will send a digest of the changes every --digest-interval until ctx is canceled
+func runDigests(ctx context.Context) {
+	runPeriodically(ctx, CMDArgs.DigestInterval, func(ctx context.Context) {
+		sendDigest(ctx)
+	})
+}
+
+// sendDigest will run --digest-command and post to --digest-url the changes since the last digest, if any
+func sendDigest(ctx context.Context) {
+	d, ok := takeDigest()
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, hookTimeout)
+	defer cancel()
+	if CMDArgs.DigestCommand != "" {
+		if err := runDigestCommand(ctx, CMDArgs.DigestCommand, d); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Warn("digest command failed")
+		}
+	}
+	if CMDArgs.DigestURL != "" {
+		if err := postJSON(ctx, CMDArgs.DigestURL, d); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Warn("digest webhook failed")
+		}
+	}
+	log.WithFields(log.Fields{
+		"files": len(d.Files),
+		"hooks": len(d.Hooks),
+	}).Info("change digest sent")
+}
+
+// runDigestCommand will run command with sh -c, d is passed as JSON on stdin and as text in
+// ETCD_FILE_SYNCER_DIGEST
+func runDigestCommand(ctx context.Context, command string, d changeDigest) error {
+	body, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(),
+		"ETCD_FILE_SYNCER_DIGEST="+d.Text,
+		"ETCD_FILE_SYNCER_INSTANCE="+d.Instance,
+		"ETCD_FILE_SYNCER_KEY="+d.ETCDKey,
+	)
+	cmd.Stdin = bytes.NewReader(body)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Self-heal directions
+const (
+	healDownload = "download"
+	healUpload   = "upload"
+)
+
+// Drift kinds
+const (
+	driftModified      = "modified"
+	driftMissingLocal  = "missing-local"
+	driftMissingRemote = "missing-remote"
+)
+
+// fileDrift describes a single file whose local content differs from ETCD
+type fileDrift struct {
+	ETCDKey  string `json:"etcdKey"`
+	FilePath string `json:"filePath"`
+	Kind     string `json:"kind"`
+	// Value is the content stored in ETCD and Revision its ModRevision, empty for driftMissingRemote
+	Value    []byte `json:"value,omitempty"`
+	Revision int64  `json:"revision,omitempty"`
+}
+
+// detectDrift will compare every file under fileFolder with the keys under etcdKey prefix and return
+// all divergent files. Files modified locally but not uploaded yet are not reported, the folder
+// walker will take care of them.
+func detectDrift(ctx context.Context, etcdKey, fileFolder string) (drifts []fileDrift, err error) {
+	var kvs []storeKV
+	kvs, _, err = listKeys(ctx, etcdKey)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"etcdKey": etcdKey,
+			"err":     err,
+		}).Error("cannot read keys for drift check")
+		return nil, err
+	}
+	remote := make(map[string]storeKV, len(kvs))
+	for _, kv := range kvs {
+		if !isReservedKey(kv.Key) {
+			remote[kv.Key] = kv
+		}
+	}
+
+	// the walker calls back concurrently
+	var mu sync.Mutex
+	err = walkFolder(fileFolder, CMDArgs.ScanWorkers, func(filePath string, info os.FileInfo) error {
+		key, err := filepath.Rel(fileFolder, filePath)
+		if err != nil {
+			return err
+		}
+		key = filepath.ToSlash(key)
+		if !strings.HasPrefix(key, etcdKey) || isReservedKey(key) || !inManifest(key) {
+			return nil
+		}
+		if !isUploadable(filePath) {
+			mu.Lock()
+			delete(remote, key)
+			mu.Unlock()
+			return nil
+		}
+		fileChangeMu.Lock()
+		lastMod, known := fileChangeMap[filePath]
+		fileChangeMu.Unlock()
+		mu.Lock()
+		kv, ok := remote[key]
+		delete(remote, key)
+		mu.Unlock()
+		if known && info.ModTime().After(lastMod) {
+			// pending upload
+			return nil
+		}
+		if !ok {
+			mu.Lock()
+			drifts = append(drifts, fileDrift{ETCDKey: key, FilePath: filePath, Kind: driftMissingRemote})
+			mu.Unlock()
+			return nil
+		}
+		localHash, err := localFileHash(key, filePath, info)
+		if err != nil {
+			return err
+		}
+		if localHash != syncHash(key, kv.Value) {
+			mu.Lock()
+			drifts = append(drifts, fileDrift{
+				ETCDKey:  key,
+				FilePath: filePath,
+				Kind:     driftModified,
+				Value:    kv.Value,
+				Revision: kv.Revision,
+			})
+			mu.Unlock()
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		log.WithFields(log.Fields{
+			"fileFolder": fileFolder,
+			"err":        err,
+		}).Error("drift check walker error")
+		return nil, err
+	}
+	for key, kv := range remote {
+		drifts = append(drifts, fileDrift{
+			ETCDKey:  key,
+			FilePath: filepath.Join(fileFolder, key),
+			Kind:     driftMissingLocal,
+			Value:    kv.Value,
+			Revision: kv.Revision,
+		})
+	}
+	return drifts, nil
+}
+
+// checkDrift will log every drifted file and repair it when self-heal is enabled
+func checkDrift(ctx context.Context, etcdKey, fileFolder string) {
+	drifts, err := detectDrift(ctx, etcdKey, fileFolder)
+	if err != nil {
+		return
+	}
+	handleDrifts(ctx, drifts)
+}
+
+// handleDrifts will log every drifted file and repair it when self-heal is enabled
+func handleDrifts(ctx context.Context, drifts []fileDrift) {
+	for _, drift := range drifts {
+		log.WithFields(log.Fields{
+			"etcdKey":  drift.ETCDKey,
+			"filePath": drift.FilePath,
+			"kind":     drift.Kind,
+		}).Warn("drift detected")
+		if !CMDArgs.SelfHeal {
+			continue
+		}
+		if err := healDrift(ctx, drift, CMDArgs.SelfHealDirection); err != nil {
+			log.WithFields(log.Fields{
+				"etcdKey":  drift.ETCDKey,
+				"filePath": drift.FilePath,
+				"err":      err,
+			}).Error("self-heal failed")
+		}
+	}
+}
+
+// healDrift will repair drift in the given direction and record the repair in the audit log.
+// Nothing is ever deleted: a file missing on the winning side is left alone.
+func healDrift(ctx context.Context, drift fileDrift, direction string) error {
+	switch {
+	case direction == healDownload && drift.Kind != driftMissingRemote:
+		if err := verifyDownload(ctx, drift.ETCDKey, drift.Value, drift.Revision); err != nil {
+			return err
+		}
+		if err := saveKeyToFolder(drift.ETCDKey, drift.FilePath, drift.Value, drift.Revision); err != nil {
+			return err
+		}
+	case direction == healUpload && drift.Kind != driftMissingLocal:
+		if err := putFileToETCD(ctx, drift.ETCDKey, drift.FilePath); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+	log.WithFields(log.Fields{
+		"etcdKey":   drift.ETCDKey,
+		"filePath":  drift.FilePath,
+		"kind":      drift.Kind,
+		"direction": direction,
+	}).Info("drift repaired")
+	writeAudit(auditEntry{
+		Action:   auditSelfHeal,
+		ETCDKey:  drift.ETCDKey,
+		FilePath: drift.FilePath,
+		Detail:   fmt.Sprintf("%s repaired by %s", drift.Kind, direction),
+	})
+	return nil
+}
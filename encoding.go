@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/ianaindex"
+)
+
+// encodingRule is a parsed --encoding rule: values of keys matching Pattern are stored in ETCD encoded in
+// Source and written to files encoded in Target
+type encodingRule struct {
+	Pattern    string
+	Source     encoding.Encoding
+	Target     encoding.Encoding
+	SourceName string
+	TargetName string
+}
+
+// encodingRules are the parsed --encoding rules
+var encodingRules []encodingRule
+
+// parseEncodingRules will parse pattern=[source:]target arguments, the source defaults to UTF-8
+func parseEncodingRules(args []string) ([]encodingRule, error) {
+	patterns, err := parsePatternRules(args)
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]encodingRule, 0, len(patterns))
+	for _, p := range patterns {
+		rule := encodingRule{Pattern: p.Pattern, SourceName: "utf-8", TargetName: p.Value}
+		if i := strings.Index(p.Value, ":"); i >= 0 {
+			rule.SourceName, rule.TargetName = p.Value[:i], p.Value[i+1:]
+		}
+		if rule.Source, err = lookupEncoding(rule.SourceName); err != nil {
+			return nil, err
+		}
+		if rule.Target, err = lookupEncoding(rule.TargetName); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// lookupEncoding will return the encoding called name, an IANA or WHATWG name such as latin1 or shift_jis
+func lookupEncoding(name string) (encoding.Encoding, error) {
+	if e, err := ianaindex.IANA.Encoding(name); err == nil && e != nil {
+		return e, nil
+	}
+	if e, err := htmlindex.Get(name); err == nil {
+		return e, nil
+	}
+	return nil, fmt.Errorf("unknown encoding %q", name)
+}
+
+// matchEncoding will return the first --encoding rule matching etcdKey
+func matchEncoding(etcdKey string) (encodingRule, bool) {
+	for _, rule := range encodingRules {
+		if matchPattern(rule.Pattern, etcdKey) {
+			return rule, true
+		}
+	}
+	return encodingRule{}, false
+}
+
+// decodeText will convert text from e, called name, to UTF-8. Bytes that are not valid in e are an error.
+func decodeText(text []byte, e encoding.Encoding, name string) ([]byte, error) {
+	decoded, err := e.NewDecoder().Bytes(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s text: %v", name, err)
+	}
+	if i := bytes.IndexRune(decoded, utf8.RuneError); i >= 0 && !bytes.Contains(text, []byte(string(utf8.RuneError))) {
+		return nil, fmt.Errorf("invalid %s text: bad byte sequence at line %d", name, bytes.Count(decoded[:i], []byte("\n"))+1)
+	}
+	return decoded, nil
+}
+
+// encodeText will convert UTF-8 text to e, called name. Characters e cannot represent are an error.
+func encodeText(text []byte, e encoding.Encoding, name string) ([]byte, error) {
+	encoded, err := e.NewEncoder().Bytes(text)
+	if err == nil {
+		return encoded, nil
+	}
+	line := 1
+	for _, r := range string(text) {
+		if r == '\n' {
+			line++
+		}
+		if _, err := e.NewEncoder().String(string(r)); err != nil {
+			return nil, fmt.Errorf("character %q at line %d cannot be encoded in %s", r, line, name)
+		}
+	}
+	return nil, fmt.Errorf("cannot encode in %s: %v", name, err)
+}
+
+// valueToUTF8 will decode value of etcdKey from the source encoding of its --encoding rule
+func valueToUTF8(etcdKey string, value []byte) ([]byte, error) {
+	rule, ok := matchEncoding(etcdKey)
+	if !ok {
+		return value, nil
+	}
+	return decodeText(value, rule.Source, rule.SourceName)
+}
+
+// valueFromUTF8 will encode the UTF-8 text of etcdKey in the source encoding of its --encoding rule
+func valueFromUTF8(etcdKey string, text []byte) ([]byte, error) {
+	rule, ok := matchEncoding(etcdKey)
+	if !ok {
+		return text, nil
+	}
+	return encodeText(text, rule.Source, rule.SourceName)
+}
+
+// fileToUTF8 will decode the file content of etcdKey from the target encoding of its --encoding rule
+func fileToUTF8(etcdKey string, content []byte) ([]byte, error) {
+	rule, ok := matchEncoding(etcdKey)
+	if !ok {
+		return content, nil
+	}
+	return decodeText(content, rule.Target, rule.TargetName)
+}
+
+// fileFromUTF8 will encode the UTF-8 text of etcdKey in the target encoding of its --encoding rule
+func fileFromUTF8(etcdKey string, text []byte) ([]byte, error) {
+	rule, ok := matchEncoding(etcdKey)
+	if !ok {
+		return text, nil
+	}
+	return encodeText(text, rule.Target, rule.TargetName)
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/doody/etcd_file_syncer/backend"
+	log "github.com/sirupsen/logrus"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc"
+)
+
+// Endpoint orders
+const (
+	endpointOrderGiven   = "given"
+	endpointOrderShuffle = "shuffle"
+)
+
+const maxStartupBackoff = 30 * time.Second
+
+// defaultETCDPort is the client port of --etcd endpoints given without one
+const defaultETCDPort = "2379"
+
+// defaultMaxCallSendSize is the client's own request limit when --etcd-max-call-send-size is 0
+const defaultMaxCallSendSize = 2 * 1024 * 1024
+
+// requestOverhead is a conservative allowance for the framing of a put request around its key and value
+const requestOverhead = 512
+
+// errValueTooLarge is returned for values ETCD would refuse
+var errValueTooLarge = errors.New("file too large for etcd (use chunking)")
+
+// connectETCD will create the ETCD client and make sure at least one endpoint answers a Status
+// request, retrying up to retries times with exponential backoff
+func connectETCD(ctx context.Context, endpoints []string, retries int) (cli *clientv3.Client, err error) {
+	cfg, err := etcdConfig(endpoints)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Context = ctx
+	cli, err = clientv3.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err = retryStartup(ctx, retries, "ETCD", func() error { return probeETCD(ctx, cli, endpoints) }); err != nil {
+		cli.Close()
+		return nil, err
+	}
+	return cli, nil
+}
+
+// retryStartup will call probe until it succeeds, retrying up to retries times with exponential backoff.
+// name is the backend named in the logs.
+func retryStartup(ctx context.Context, retries int, name string, probe func() error) (err error) {
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		if err = probe(); err == nil {
+			return nil
+		}
+		if attempt >= retries {
+			return err
+		}
+		log.WithFields(log.Fields{
+			"attempt": attempt + 1,
+			"retries": retries,
+			"backoff": backoff,
+			"err":     err,
+		}).Warn(name + " not reachable yet, retrying")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxStartupBackoff {
+			backoff = maxStartupBackoff
+		}
+	}
+}
+
+// mustConnectStore will connect kvStore to --backend, exiting with exitAuthFailure or exitETCDUnreachable
+// when that fails
+func mustConnectStore(ctx context.Context) store {
+	kv, err := connectStore(ctx, CMDArgs.Backend)
+	if err != nil {
+		fields := log.Fields{
+			"backend": CMDArgs.Backend,
+			"err":     err,
+		}
+		switch CMDArgs.Backend {
+		case backendETCD:
+			fields["endpoints"] = CMDArgs.ETCDEndpoints
+		case backendConsul:
+			fields["addr"] = CMDArgs.ConsulAddr
+		case backendZooKeeper:
+			fields["servers"] = CMDArgs.ZooKeeperServers
+		case backendRedis:
+			fields["addr"] = CMDArgs.RedisAddr
+		}
+		log.WithFields(fields).Error("error connecting to the store")
+		if isAuthError(err) {
+			os.Exit(exitAuthFailure)
+		}
+		os.Exit(exitETCDUnreachable)
+	}
+	kv = injectFaults(kv)
+	kvStore = kv
+	return kv
+}
+
+// probeETCD will return nil as soon as one of endpoints answers a Status request
+func probeETCD(ctx context.Context, cli *clientv3.Client, endpoints []string) (err error) {
+	if len(endpoints) == 0 {
+		return errors.New("no ETCD endpoint configured")
+	}
+	for _, endpoint := range endpoints {
+		ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+		_, err = cli.Status(ctx, endpoint)
+		cancel()
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// etcdConfig will build the ETCD client configuration from the command line
+func etcdConfig(endpoints []string) (clientv3.Config, error) {
+	ordered := append([]string(nil), endpoints...)
+	if CMDArgs.ETCDEndpointOrder == endpointOrderShuffle {
+		// spread a fleet of syncers over all members instead of everyone pinning the first one
+		rand.Shuffle(len(ordered), func(i, j int) { ordered[i], ordered[j] = ordered[j], ordered[i] })
+	}
+	cfg := clientv3.Config{
+		Endpoints:            ordered,
+		DialTimeout:          dialTimeout,
+		AutoSyncInterval:     CMDArgs.ETCDAutoSyncInterval,
+		DialKeepAliveTime:    CMDArgs.ETCDKeepAliveTime,
+		DialKeepAliveTimeout: CMDArgs.ETCDKeepAliveTimeout,
+		RejectOldCluster:     CMDArgs.ETCDRejectOldCluster,
+		MaxCallSendMsgSize:   CMDArgs.ETCDMaxCallSendSize,
+	}
+	if CMDArgs.ETCDProxy != "" {
+		dialer, err := newProxyDialer(CMDArgs.ETCDProxy)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.DialOptions = append(cfg.DialOptions, grpc.WithContextDialer(bypassForUnix(dialer)))
+	}
+	return cfg, nil
+}
+
+// normalizeEndpoint will check an --etcd endpoint and add the default port to those without one. Besides
+// host:port and http(s):// URLs, IPv6 literals in brackets, [::1]:2379, and unix://, unixs:// and unix: socket
+// paths are accepted.
+func normalizeEndpoint(endpoint string) (string, error) {
+	for _, scheme := range []string{"unix://", "unixs://", "unix:", "unixs:"} {
+		if strings.HasPrefix(endpoint, scheme) {
+			if strings.TrimPrefix(endpoint, scheme) == "" {
+				return "", errors.New("missing socket path")
+			}
+			return endpoint, nil
+		}
+	}
+	if strings.Contains(endpoint, "://") {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return "", err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return "", fmt.Errorf("unsupported scheme %q, http, https, unix or unixs", u.Scheme)
+		}
+		host, err := normalizeHostPort(u.Host)
+		if err != nil {
+			return "", err
+		}
+		u.Host = host
+		return u.String(), nil
+	}
+	return normalizeHostPort(endpoint)
+}
+
+// normalizeHostPort will return hostPort with defaultETCDPort when it has no port, IPv6 literals must be
+// bracketed so their colons are not taken for a port
+func normalizeHostPort(hostPort string) (string, error) {
+	if hostPort == "" {
+		return "", errors.New("missing host")
+	}
+	if strings.HasPrefix(hostPort, "[") && strings.HasSuffix(hostPort, "]") {
+		hostPort += ":" + defaultETCDPort
+	} else if strings.Count(hostPort, ":") > 1 && !strings.HasPrefix(hostPort, "[") {
+		return "", fmt.Errorf("IPv6 addresses must be bracketed, [%s]:%s", hostPort, defaultETCDPort)
+	} else if !strings.Contains(hostPort, ":") {
+		hostPort += ":" + defaultETCDPort
+	}
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return "", err
+	}
+	if host == "" {
+		return "", errors.New("missing host")
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return "", fmt.Errorf("invalid port %q", port)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// bypassForUnix will return a dialer connecting to unix socket addresses itself and leaving the others to dialer,
+// a proxy only carries TCP connections
+func bypassForUnix(dialer contextDialer) contextDialer {
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		if !strings.HasPrefix(addr, "unix:") {
+			return dialer(ctx, addr)
+		}
+		path := strings.TrimPrefix(addr, "unix:")
+		if strings.HasPrefix(path, "//") {
+			path = strings.TrimPrefix(path, "//")
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", path)
+	}
+}
+
+// maxValueSize will return the largest key and value a single put to kvStore can carry
+func maxValueSize() int {
+	return kvStore.MaxValueSize()
+}
+
+// checkValueSize will return errValueTooLarge when etcdKey and a value of valueSize bytes cannot be put
+func checkValueSize(etcdKey string, valueSize int) error {
+	if size := len(etcdKey) + valueSize; size > maxValueSize() {
+		return fmt.Errorf("%w: %s is %d bytes, the limit is %d", errValueTooLarge, etcdKey, size, maxValueSize())
+	}
+	return nil
+}
+
+// isRetryableError reports whether err is a transient store error worth retrying
+func isRetryableError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || classifyError(err) == backend.ErrorTransient {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// withETCDRetry will run op with a requestTimeout context derived from ctx, retrying transient failures
+// up to --etcd-retries times with --etcd-retry-backoff between attempts
+func withETCDRetry(ctx context.Context, op func(ctx context.Context) error) (err error) {
+	for attempt := 0; ; attempt++ {
+		opCtx, cancel := context.WithTimeout(ctx, requestTimeout)
+		err = op(opCtx)
+		cancel()
+		if err == nil || attempt >= CMDArgs.ETCDRetries || !isRetryableError(err) || ctx.Err() != nil {
+			return err
+		}
+		log.WithFields(log.Fields{
+			"attempt": attempt + 1,
+			"err":     err,
+		}).Warn("ETCD request failed, retrying")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(CMDArgs.ETCDRetryBackoff):
+		}
+	}
+}
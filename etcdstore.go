@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/doody/etcd_file_syncer/backend"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func init() {
+	backend.Register(backend.Backend{
+		Name: backendETCD,
+		Open: func(ctx context.Context, opts backend.Options) (store, error) {
+			cli, err := connectETCD(ctx, CMDArgs.ETCDEndpoints, opts.StartupRetries)
+			if err != nil {
+				return nil, err
+			}
+			return &etcdStore{cli: cli}, nil
+		},
+		Classify: classifyETCDError,
+	})
+}
+
+// classifyETCDError will tell rejected credentials, transient failures and other gRPC errors apart
+func classifyETCDError(err error) backend.ErrorClass {
+	switch {
+	case errors.Is(err, rpctypes.ErrUserEmpty),
+		errors.Is(err, rpctypes.ErrAuthFailed),
+		errors.Is(err, rpctypes.ErrPermissionDenied),
+		errors.Is(err, rpctypes.ErrInvalidAuthToken):
+		return backend.ErrorAuth
+	}
+	switch status.Code(err) {
+	case codes.Unauthenticated, codes.PermissionDenied:
+		return backend.ErrorAuth
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+		return backend.ErrorTransient
+	}
+	var etcdErr rpctypes.EtcdError
+	if errors.As(err, &etcdErr) {
+		return backend.ErrorFailed
+	}
+	if _, ok := status.FromError(err); ok {
+		return backend.ErrorFailed
+	}
+	return backend.ErrorOther
+}
+
+// etcdStore is the store of an ETCD v3 cluster
+type etcdStore struct {
+	cli *clientv3.Client
+}
+
+// Get - store
+func (s *etcdStore) Get(ctx context.Context, key string) (*storeKV, int64, error) {
+	resp, err := s.cli.Get(ctx, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, resp.Header.Revision, nil
+	}
+	kv := resp.Kvs[0]
+	return &storeKV{Key: string(kv.Key), Value: kv.Value, Revision: kv.ModRevision, Version: kv.Version}, resp.Header.Revision, nil
+}
+
+// List - store
+func (s *etcdStore) List(ctx context.Context, prefix string) ([]storeKV, int64, error) {
+	resp, err := s.cli.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, 0, err
+	}
+	kvs := make([]storeKV, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		kvs = append(kvs, storeKV{Key: string(kv.Key), Value: kv.Value, Revision: kv.ModRevision, Version: kv.Version})
+	}
+	return kvs, resp.Header.Revision, nil
+}
+
+// Txn - store
+func (s *etcdStore) Txn(ctx context.Context, cmps []storeCmp, ops []storeOp) (bool, int64, error) {
+	compares := make([]clientv3.Cmp, 0, len(cmps))
+	for _, cmp := range cmps {
+		compares = append(compares, clientv3.Compare(clientv3.ModRevision(cmp.Key), "=", cmp.Revision))
+	}
+	etcdOps := make([]clientv3.Op, 0, len(ops))
+	for _, op := range ops {
+		if op.Delete {
+			etcdOps = append(etcdOps, clientv3.OpDelete(op.Key))
+		} else {
+			etcdOps = append(etcdOps, clientv3.OpPut(op.Key, string(op.Value)))
+		}
+	}
+	resp, err := s.cli.Txn(ctx).If(compares...).Then(etcdOps...).Commit()
+	if err != nil {
+		return false, 0, err
+	}
+	return resp.Succeeded, resp.Header.Revision, nil
+}
+
+// Watch - store. Progress notifications are requested so an idle watch still gets responses.
+func (s *etcdStore) Watch(ctx context.Context, prefix string, revision int64) <-chan storeWatchResponse {
+	opts := []clientv3.OpOption{clientv3.WithPrefix(), clientv3.WithProgressNotify()}
+	if revision > 0 {
+		opts = append(opts, clientv3.WithRev(revision+1))
+	}
+	rch := s.cli.Watch(clientv3.WithRequireLeader(ctx), prefix, opts...)
+	if revision > 0 {
+		// a progress notification tells early whether the new watch works
+		s.cli.RequestProgress(ctx)
+	}
+	out := make(chan storeWatchResponse)
+	go func() {
+		defer close(out)
+		for wresp := range rch {
+			resp := storeWatchResponse{
+				Revision:        wresp.Header.Revision,
+				CompactRevision: wresp.CompactRevision,
+				Err:             wresp.Err(),
+			}
+			for _, ev := range wresp.Events {
+				event := storeEvent{
+					Type: storeEventPut,
+					KV:   storeKV{Key: string(ev.Kv.Key), Value: ev.Kv.Value, Revision: ev.Kv.ModRevision, Version: ev.Kv.Version},
+				}
+				if ev.Type == clientv3.EventTypeDelete {
+					event.Type = storeEventDelete
+				}
+				resp.Events = append(resp.Events, event)
+			}
+			select {
+			case out <- resp:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// Revision - store
+func (s *etcdStore) Revision(ctx context.Context, prefix string) (int64, int64, error) {
+	opts := append(clientv3.WithLastRev(), clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	resp, err := s.cli.Get(ctx, prefix, opts...)
+	if err != nil {
+		return 0, 0, err
+	}
+	var lastChange int64
+	if len(resp.Kvs) > 0 {
+		lastChange = resp.Kvs[0].ModRevision
+	}
+	return resp.Header.Revision, lastChange, nil
+}
+
+// MaxValueSize - store, bounded by both the server's --etcd-max-request-bytes and the client's send limit
+func (s *etcdStore) MaxValueSize() int {
+	limit, sendLimit := CMDArgs.ETCDMaxRequestBytes, CMDArgs.ETCDMaxCallSendSize
+	if sendLimit == 0 {
+		sendLimit = defaultMaxCallSendSize
+	}
+	if sendLimit < limit {
+		limit = sendLimit
+	}
+	return limit - requestOverhead
+}
+
+// MaxTxnOps - store, ETCD's own limit is a server flag, --txn-max-ops is expected to honor it
+func (s *etcdStore) MaxTxnOps() int {
+	return 0
+}
+
+// Compact - compactor
+func (s *etcdStore) Compact(ctx context.Context, revision int64) error {
+	_, err := s.cli.Compact(ctx, revision)
+	return err
+}
+
+// GetAt - revisionReader
+func (s *etcdStore) GetAt(ctx context.Context, key string, revision int64) (*storeKV, error) {
+	resp, err := s.cli.Get(ctx, key, clientv3.WithRev(revision))
+	switch {
+	case errors.Is(err, rpctypes.ErrCompacted):
+		return nil, errCompacted
+	case errors.Is(err, rpctypes.ErrFutureRev):
+		return nil, errFutureRevision
+	case err != nil:
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	kv := resp.Kvs[0]
+	return &storeKV{Key: string(kv.Key), Value: kv.Value, Revision: kv.ModRevision, Version: kv.Version}, nil
+}
+
+// Close - store
+func (s *etcdStore) Close() error {
+	return s.cli.Close()
+}
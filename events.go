@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// Sync event actions
+const (
+	eventUpload   = "upload"
+	eventDownload = "download"
+	eventDelete   = "delete"
+	eventConflict = "conflict"
+)
+
+const (
+	// mimeEventStream is the content type of server-sent events
+	mimeEventStream = "text/event-stream"
+	// eventStreamBuffer is the number of events a slow subscriber may lag behind before missing some
+	eventStreamBuffer = 64
+	// eventStreamKeepAlive is the interval of comments sent to keep idle streams open through proxies
+	eventStreamKeepAlive = 30 * time.Second
+)
+
+// SyncEvent is a change applied by the syncer, streamed by GET /v1/events
+type SyncEvent struct {
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`
+	ETCDKey  string    `json:"etcdKey"`
+	FilePath string    `json:"filePath,omitempty"`
+	Size     int       `json:"size"`
+	Revision int64     `json:"revision,omitempty"`
+	Instance string    `json:"instance"`
+	// Diff is the unified diff of the change, with --diff-max-size
+	Diff string `json:"diff,omitempty"`
+}
+
+// WatchCmd - watch subcommand
+type WatchCmd struct {
+	Addr string `arg:"--addr" help:"follow the events of a running syncer, host:port or unix:///path/to.sock, instead of watching ETCD"`
+}
+
+var (
+	// instanceName identifies this syncer in events
+	instanceName string
+	// eventSubscribers are the channels of the open event streams, nil once the API is draining
+	eventSubscribers   = make(map[chan SyncEvent]struct{})
+	eventSubscribersMu sync.Mutex
+)
+
+// publishEvent will send a change applied by this syncer to every open event stream. Subscribers that
+// are too slow miss events rather than delay the sync.
+func publishEvent(action, etcdKey, filePath string, size int, revision int64) {
+	publishDiffEvent(action, etcdKey, filePath, size, revision, "")
+}
+
+// publishDiffEvent will publish an event along with the unified diff of the change
+func publishDiffEvent(action, etcdKey, filePath string, size int, revision int64, diff string) {
+	recordChange(action, etcdKey, filePath, revision)
+	recordDigestChange(action, etcdKey, revision, diff)
+	ev := SyncEvent{
+		Time:     time.Now().UTC(),
+		Action:   action,
+		ETCDKey:  etcdKey,
+		FilePath: filePath,
+		Size:     size,
+		Revision: revision,
+		Instance: instanceName,
+		Diff:     diff,
+	}
+	eventSubscribersMu.Lock()
+	defer eventSubscribersMu.Unlock()
+	for ch := range eventSubscribers {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// subscribeEvents will register a new event stream, ok is false once the API is draining
+func subscribeEvents() (ch chan SyncEvent, ok bool) {
+	eventSubscribersMu.Lock()
+	defer eventSubscribersMu.Unlock()
+	if eventSubscribers == nil {
+		return nil, false
+	}
+	ch = make(chan SyncEvent, eventStreamBuffer)
+	eventSubscribers[ch] = struct{}{}
+	return ch, true
+}
+
+// unsubscribeEvents will remove the event stream of ch
+func unsubscribeEvents(ch chan SyncEvent) {
+	eventSubscribersMu.Lock()
+	defer eventSubscribersMu.Unlock()
+	if _, ok := eventSubscribers[ch]; ok {
+		delete(eventSubscribers, ch)
+		close(ch)
+	}
+}
+
+// closeEventStreams will end every event stream, they would otherwise hold the API drain until its timeout
+func closeEventStreams() {
+	eventSubscribersMu.Lock()
+	defer eventSubscribersMu.Unlock()
+	for ch := range eventSubscribers {
+		close(ch)
+	}
+	eventSubscribers = nil
+}
+
+// eventsHandler - GET /v1/events, streams the changes applied by this syncer as server-sent events
+func eventsHandler(c *gin.Context) {
+	ch, ok := subscribeEvents()
+	if !ok {
+		abortWithError(c, http.StatusServiceUnavailable, codeUnavailable, "shutting down", nil)
+		return
+	}
+	defer unsubscribeEvents(ch)
+	keepAlive := time.NewTicker(eventStreamKeepAlive)
+	defer keepAlive.Stop()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return false
+			}
+			c.SSEvent("sync", ev)
+		case <-keepAlive.C:
+			io.WriteString(w, ": keep-alive\n\n")
+		case <-c.Request.Context().Done():
+			return false
+		}
+		return true
+	})
+}
+
+// runWatch will print changes as they happen, as applied by the syncer at cmd.Addr or as written to ETCD
+// under --key, until interrupted
+func runWatch(ctx context.Context, cmd *WatchCmd) int {
+	var err error
+	if cmd.Addr != "" {
+		err = followEvents(ctx, cmd.Addr)
+	} else {
+		err = watchETCDEvents(ctx, CMDArgs.ConfigKey)
+	}
+	if ctx.Err() != nil {
+		return 0
+	}
+	fmt.Fprintln(os.Stderr, "watch ended:", err)
+	return 1
+}
+
+// followEvents will print the events streamed by the syncer at addr
+func followEvents(ctx context.Context, addr string) error {
+	client, baseURL := apiClient(addr)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+apiPrefix+"/events", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", mimeEventStream)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, body)
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	var data strings.Builder
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "data:"):
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		case line == "" && data.Len() > 0:
+			var ev SyncEvent
+			if err := json.Unmarshal([]byte(data.String()), &ev); err == nil {
+				printEvent(os.Stdout, ev)
+			}
+			data.Reset()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("stream closed by the syncer")
+}
+
+// watchETCDEvents will print every change of the files under etcdKey, as written to ETCD
+func watchETCDEvents(ctx context.Context, etcdKey string) error {
+	for wresp := range kvStore.Watch(ctx, etcdKey, 0) {
+		if err := wresp.Err; err != nil {
+			log.WithFields(log.Fields{
+				"etcdKey": etcdKey,
+				"err":     err,
+			}).Error("ETCD watch failed")
+			return err
+		}
+		for _, ev := range wresp.Events {
+			if isReservedKey(ev.KV.Key) {
+				continue
+			}
+			action := storeEventPut
+			if ev.Type == storeEventDelete {
+				action = eventDelete
+			}
+			printEvent(os.Stdout, SyncEvent{
+				Time:     time.Now().UTC(),
+				Action:   action,
+				ETCDKey:  ev.KV.Key,
+				Size:     len(ev.KV.Value),
+				Revision: ev.KV.Revision,
+			})
+		}
+	}
+	return ctx.Err()
+}
+
+// printEvent will write ev to w as a single line, followed by its diff when it has one
+func printEvent(w io.Writer, ev SyncEvent) {
+	instance := ev.Instance
+	if instance == "" {
+		instance = "-"
+	}
+	fmt.Fprintf(w, "%s  %-8s  %-40s  %8d B  rev %-8d  %s\n", ev.Time.Local().Format("15:04:05"), ev.Action,
+		ev.ETCDKey, ev.Size, ev.Revision, instance)
+	fmt.Fprint(w, ev.Diff)
+}
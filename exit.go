@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"syscall"
+
+	arg "github.com/alexflint/go-arg"
+	"github.com/doody/etcd_file_syncer/backend"
+	log "github.com/sirupsen/logrus"
+)
+
+// Process exit codes, so supervisors can tell failure causes apart
+const (
+	exitConfigError       = 2
+	exitETCDUnreachable   = 3
+	exitAuthFailure       = 4
+	exitFolderNotWritable = 5
+)
+
+// failConfig will print usage and msg to stderr and exit with exitConfigError
+func failConfig(p *arg.Parser, msg string) {
+	p.WriteUsage(os.Stderr)
+	fmt.Fprintln(os.Stderr, "error:", msg)
+	os.Exit(exitConfigError)
+}
+
+// isAuthError reports whether err was caused by the store rejecting our credentials or permissions
+func isAuthError(err error) bool {
+	return classifyError(err) == backend.ErrorAuth
+}
+
+// isNotWritableError reports whether err was caused by the local folder not accepting writes
+func isNotWritableError(err error) bool {
+	return errors.Is(err, fs.ErrPermission) || errors.Is(err, syscall.EROFS)
+}
+
+// fatalExitCode will return the exit code for an unrecoverable runtime error, or 0 when err is recoverable
+func fatalExitCode(err error) int {
+	switch {
+	case err == nil:
+		return 0
+	case isAuthError(err):
+		return exitAuthFailure
+	case isNotWritableError(err):
+		return exitFolderNotWritable
+	}
+	return 0
+}
+
+// exitOnFatal will terminate the process when --exit-on-fatal is set and err is unrecoverable,
+// instead of leaving a process that is alive but can no longer sync anything
+func exitOnFatal(err error) {
+	if !CMDArgs.ExitOnFatal {
+		return
+	}
+	if code := fatalExitCode(err); code != 0 {
+		log.WithFields(log.Fields{
+			"exitCode": code,
+			"err":      err,
+		}).Error("unrecoverable error, exiting")
+		os.Exit(code)
+	}
+}
+
+// checkFolderWritable will make sure fileFolder exists and files can be created in it
+func checkFolderWritable(fileFolder string) error {
+	if err := ensureDir(fileFolder); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(fileFolder, ".etcd_file_syncer-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// Document formats
+const (
+	formatJSON = "json"
+	formatYAML = "yaml"
+)
+
+// ExportCmd - export subcommand
+type ExportCmd struct {
+	Output string `arg:"-o,--output" help:"write to this file instead of stdout"`
+	Format string `arg:"--format" default:"json" help:"json or yaml"`
+}
+
+// ImportCmd - import subcommand
+type ImportCmd struct {
+	Input  string `arg:"positional,required" help:"document to import, - for stdin"`
+	Format string `arg:"--format" help:"json or yaml, guessed from the file extension by default"`
+	Prune  bool   `arg:"--prune" help:"delete keys under --key that are missing from the document"`
+	DryRun bool   `arg:"--dry-run" help:"print what would change without writing"`
+}
+
+// keyspaceDocument maps every key to its base64 encoded value
+type keyspaceDocument map[string]string
+
+// runExport will write every key under --key, metadata keys included, to the export document
+func runExport(ctx context.Context, cmd *ExportCmd) int {
+	var (
+		kvs      []storeKV
+		revision int64
+	)
+	err := withETCDRetry(ctx, func(ctx context.Context) (err error) {
+		kvs, revision, err = kvStore.List(ctx, CMDArgs.ConfigKey)
+		return err
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"etcdKey": CMDArgs.ConfigKey,
+			"err":     err,
+		}).Error("cannot read keys to export")
+		return exitETCDUnreachable
+	}
+	doc := make(keyspaceDocument, len(kvs))
+	for _, kv := range kvs {
+		doc[kv.Key] = base64.StdEncoding.EncodeToString(kv.Value)
+	}
+	out, err := encodeDocument(doc, cmd.Format)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"format": cmd.Format,
+			"err":    err,
+		}).Error("cannot encode export")
+		return exitConfigError
+	}
+
+	if cmd.Output == "" {
+		os.Stdout.Write(out)
+	} else if err := os.WriteFile(cmd.Output, out, 0644); err != nil {
+		log.WithFields(log.Fields{
+			"output": cmd.Output,
+			"err":    err,
+		}).Error("cannot write export")
+		return exitFolderNotWritable
+	}
+	log.WithFields(log.Fields{
+		"keys":     len(doc),
+		"revision": revision,
+	}).Info("exported keys")
+	return 0
+}
+
+// runImport will write every key of the import document to ETCD in bounded transactions
+func runImport(ctx context.Context, cmd *ImportCmd) int {
+	var (
+		in  []byte
+		err error
+	)
+	if cmd.Input == "-" {
+		in, err = io.ReadAll(os.Stdin)
+	} else {
+		in, err = os.ReadFile(cmd.Input)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"input": cmd.Input,
+			"err":   err,
+		}).Error("cannot read import document")
+		return exitConfigError
+	}
+	format := cmd.Format
+	if format == "" {
+		format = formatFromExtension(cmd.Input)
+	}
+	doc, err := decodeDocument(in, format)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"input": cmd.Input,
+			"err":   err,
+		}).Error("cannot decode import document")
+		return exitConfigError
+	}
+
+	keys := make([]string, 0, len(doc))
+	for key := range doc {
+		if !strings.HasPrefix(key, CMDArgs.ConfigKey) {
+			log.WithFields(log.Fields{
+				"etcdKey": key,
+				"prefix":  CMDArgs.ConfigKey,
+			}).Error("key outside of --key prefix")
+			return exitConfigError
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var ops []storeOp
+	for _, key := range keys {
+		value, err := base64.StdEncoding.DecodeString(doc[key])
+		if err != nil {
+			log.WithFields(log.Fields{
+				"etcdKey": key,
+				"err":     err,
+			}).Error("value is not base64")
+			return exitConfigError
+		}
+		if err := checkValueSize(key, len(value)); err != nil {
+			log.WithFields(log.Fields{
+				"etcdKey": key,
+				"err":     err,
+			}).Error("cannot import key")
+			return exitConfigError
+		}
+		ops = append(ops, putOp(key, value))
+	}
+	if cmd.Prune {
+		var kvs []storeKV
+		err := withETCDRetry(ctx, func(ctx context.Context) (err error) {
+			kvs, _, err = kvStore.List(ctx, CMDArgs.ConfigKey)
+			return err
+		})
+		if err != nil {
+			return exitETCDUnreachable
+		}
+		for _, kv := range kvs {
+			if _, ok := doc[kv.Key]; !ok {
+				ops = append(ops, deleteOp(kv.Key))
+			}
+		}
+	}
+
+	if cmd.DryRun {
+		for _, op := range ops {
+			if op.Delete {
+				fmt.Printf("delete %s\n", op.Key)
+			} else {
+				fmt.Printf("put    %s (%d bytes)\n", op.Key, len(op.Value))
+			}
+		}
+		return 0
+	}
+	for i, batch := range splitOps(ops) {
+		err := withETCDRetry(ctx, func(ctx context.Context) error {
+			_, _, err := kvStore.Txn(ctx, nil, batch)
+			return err
+		})
+		if err != nil {
+			log.WithFields(log.Fields{
+				"batch": i + 1,
+				"err":   err,
+			}).Error("cannot import batch")
+			if isAuthError(err) {
+				return exitAuthFailure
+			}
+			return exitETCDUnreachable
+		}
+	}
+	log.WithFields(log.Fields{
+		"operations": len(ops),
+	}).Info("imported keys")
+	writeAudit(auditEntry{
+		Action:  auditImport,
+		ETCDKey: CMDArgs.ConfigKey,
+		Detail:  fmt.Sprintf("%d operations from %s", len(ops), cmd.Input),
+	})
+	return 0
+}
+
+// formatFromExtension will guess the document format of fileName
+func formatFromExtension(fileName string) string {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".yaml", ".yml":
+		return formatYAML
+	}
+	return formatJSON
+}
+
+// encodeDocument will encode doc as format
+func encodeDocument(doc keyspaceDocument, format string) ([]byte, error) {
+	switch format {
+	case formatJSON:
+		out, err := json.MarshalIndent(doc, "", "  ")
+		return append(out, '\n'), err
+	case formatYAML:
+		return yaml.Marshal(doc)
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+// decodeDocument will decode a format encoded document
+func decodeDocument(in []byte, format string) (doc keyspaceDocument, err error) {
+	switch format {
+	case formatJSON:
+		err = json.Unmarshal(in, &doc)
+	case formatYAML:
+		err = yaml.Unmarshal(in, &doc)
+	default:
+		err = fmt.Errorf("unknown format %q", format)
+	}
+	return doc, err
+}
@@ -0,0 +1,209 @@
+//go:build chaos
+// +build chaos
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// faultsAvailable reports whether --fault is compiled in, only with -tags chaos
+const faultsAvailable = true
+
+// faultConfig are the faults injected, from --fault
+type faultConfig struct {
+	// etcdError is the probability of a store request failing, tornWrite of a file write stopping halfway
+	etcdError float64
+	tornWrite float64
+	// watchDelay is the most a watch response is held back
+	watchDelay time.Duration
+}
+
+var faults faultConfig
+
+// parseFaults will parse --fault etcd-error=probability, watch-delay=duration and torn-write=probability
+func parseFaults(args []string) error {
+	if len(args) == 0 {
+		return nil
+	}
+	for _, a := range args {
+		name, value, err := splitRule(a, "fault=value")
+		if err != nil {
+			return err
+		}
+		switch name {
+		case "etcd-error":
+			faults.etcdError, err = parseProbability(value)
+		case "torn-write":
+			faults.tornWrite, err = parseProbability(value)
+		case "watch-delay":
+			faults.watchDelay, err = time.ParseDuration(value)
+		default:
+			return fmt.Errorf("unknown fault %q, etcd-error, watch-delay or torn-write", name)
+		}
+		if err != nil {
+			return fmt.Errorf("%q: %v", a, err)
+		}
+	}
+	log.WithFields(log.Fields{
+		"etcdError":  faults.etcdError,
+		"watchDelay": faults.watchDelay,
+		"tornWrite":  faults.tornWrite,
+	}).Warn("fault injection enabled")
+	return nil
+}
+
+// parseProbability will parse a probability between 0 and 1
+func parseProbability(value string) (float64, error) {
+	p, err := strconv.ParseFloat(value, 64)
+	if err != nil || p < 0 || p > 1 {
+		return 0, fmt.Errorf("%q is not a probability between 0 and 1", value)
+	}
+	return p, nil
+}
+
+// injectFaults will wrap s to fail requests and delay watch responses as --fault says
+func injectFaults(s store) store {
+	if faults.etcdError == 0 && faults.watchDelay == 0 {
+		return s
+	}
+	return &faultyStore{store: s}
+}
+
+// faultyStore is a store failing requests and delaying watch responses at random
+type faultyStore struct {
+	store
+}
+
+// fault will return an injected transient error with the --fault etcd-error probability
+func (s *faultyStore) fault(op string) error {
+	if rand.Float64() < faults.etcdError {
+		return status.Error(codes.Unavailable, "injected fault: "+op)
+	}
+	return nil
+}
+
+// Get - store
+func (s *faultyStore) Get(ctx context.Context, key string) (*storeKV, int64, error) {
+	if err := s.fault("get"); err != nil {
+		return nil, 0, err
+	}
+	return s.store.Get(ctx, key)
+}
+
+// List - store
+func (s *faultyStore) List(ctx context.Context, prefix string) ([]storeKV, int64, error) {
+	if err := s.fault("list"); err != nil {
+		return nil, 0, err
+	}
+	return s.store.List(ctx, prefix)
+}
+
+// Txn - store, half the faults are injected once the transaction is applied, as a response lost on the way back
+func (s *faultyStore) Txn(ctx context.Context, cmps []storeCmp, ops []storeOp) (bool, int64, error) {
+	if rand.Intn(2) == 0 {
+		if err := s.fault("txn"); err != nil {
+			return false, 0, err
+		}
+		return s.store.Txn(ctx, cmps, ops)
+	}
+	succeeded, revision, err := s.store.Txn(ctx, cmps, ops)
+	if err == nil {
+		err = s.fault("txn response")
+	}
+	return succeeded, revision, err
+}
+
+// Revision - store
+func (s *faultyStore) Revision(ctx context.Context, prefix string) (int64, int64, error) {
+	if err := s.fault("revision"); err != nil {
+		return 0, 0, err
+	}
+	return s.store.Revision(ctx, prefix)
+}
+
+// Watch - store, every response is held back up to the --fault watch-delay after it arrives, in order
+func (s *faultyStore) Watch(ctx context.Context, prefix string, revision int64) <-chan storeWatchResponse {
+	in := s.store.Watch(ctx, prefix, revision)
+	if faults.watchDelay == 0 {
+		return in
+	}
+	type delayed struct {
+		wresp storeWatchResponse
+		due   time.Time
+	}
+	queue := make(chan delayed, 1024)
+	go func() {
+		defer close(queue)
+		for wresp := range in {
+			due := time.Now().Add(time.Duration(rand.Int63n(int64(faults.watchDelay))))
+			select {
+			case queue <- delayed{wresp, due}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	out := make(chan storeWatchResponse)
+	go func() {
+		defer close(out)
+		for d := range queue {
+			select {
+			case <-time.After(time.Until(d.due)):
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case out <- d.wresp:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// Compact - compactor
+func (s *faultyStore) Compact(ctx context.Context, revision int64) error {
+	c, ok := s.store.(compactor)
+	if !ok {
+		return errNotSupported
+	}
+	if err := s.fault("compact"); err != nil {
+		return err
+	}
+	return c.Compact(ctx, revision)
+}
+
+// GetAt - revisionReader
+func (s *faultyStore) GetAt(ctx context.Context, key string, revision int64) (*storeKV, error) {
+	r, ok := s.store.(revisionReader)
+	if !ok {
+		return nil, errNotSupported
+	}
+	if err := s.fault("get"); err != nil {
+		return nil, err
+	}
+	return r.GetAt(ctx, key, revision)
+}
+
+// writeFileContent will write content to filePath, or with the --fault torn-write probability only part of
+// it before failing, as a crash or full disk halfway through would
+func writeFileContent(filePath string, content []byte) error {
+	if len(content) == 0 || rand.Float64() >= faults.tornWrite {
+		return os.WriteFile(filePath, content, 0644)
+	}
+	if err := os.WriteFile(filePath, content[:rand.Intn(len(content))], 0644); err != nil {
+		return err
+	}
+	return fmt.Errorf("injected fault: torn write of %s", filePath)
+}
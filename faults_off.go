@@ -0,0 +1,24 @@
+//go:build !chaos
+// +build !chaos
+
+package main
+
+import "os"
+
+// faultsAvailable reports whether --fault is compiled in, only with -tags chaos
+const faultsAvailable = false
+
+// parseFaults will parse --fault, never given without -tags chaos
+func parseFaults(args []string) error {
+	return nil
+}
+
+// injectFaults will return s, faults are only injected with -tags chaos
+func injectFaults(s store) store {
+	return s
+}
+
+// writeFileContent will write content to filePath
+func writeFileContent(filePath string, content []byte) error {
+	return os.WriteFile(filePath, content, 0644)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Representations offered by the read endpoints
+const (
+	mimeOctetStream = "application/octet-stream"
+	mimeJSON        = gin.MIMEJSON
+	mimeYAML        = gin.MIMEYAML
+	mimeTextYAML    = "text/yaml"
+)
+
+// FileView is the JSON or YAML representation of a key
+type FileView struct {
+	Key         string `json:"key" yaml:"key"`
+	Value       string `json:"value,omitempty" yaml:"value,omitempty"`
+	Size        int    `json:"size" yaml:"size"`
+	Revision    int64  `json:"revision" yaml:"revision"`
+	Version     int64  `json:"version" yaml:"version"`
+	ContentType string `json:"contentType" yaml:"contentType"`
+	SHA256      string `json:"sha256,omitempty" yaml:"sha256,omitempty"`
+	Owner       string `json:"owner,omitempty" yaml:"owner,omitempty"`
+	Group       string `json:"group,omitempty" yaml:"group,omitempty"`
+}
+
+// FilesResponse - GET /v1/files
+type FilesResponse struct {
+	Revision int64      `json:"revision" yaml:"revision"`
+	Files    []FileView `json:"files" yaml:"files"`
+}
+
+// detectContentType will guess the MIME type of the value of etcdKey from its extension, or its first bytes
+func detectContentType(etcdKey string, content []byte) string {
+	if contentType := mime.TypeByExtension(path.Ext(etcdKey)); contentType != "" {
+		return contentType
+	}
+	if len(content) > sniffLength {
+		content = content[:sniffLength]
+	}
+	return http.DetectContentType(content)
+}
+
+// newFileView will describe kv, meta may be nil. The value is only included when withValue is set.
+func newFileView(kv storeKV, meta *fileMeta, withValue bool) FileView {
+	view := FileView{
+		Key:      kv.Key,
+		Size:     len(kv.Value),
+		Revision: kv.Revision,
+		Version:  kv.Version,
+	}
+	if meta != nil {
+		view.ContentType, view.SHA256 = meta.ContentType, meta.SHA256
+		view.Owner, view.Group = meta.Owner, meta.Group
+	}
+	if view.ContentType == "" {
+		view.ContentType = detectContentType(view.Key, kv.Value)
+	}
+	if withValue {
+		view.Value = base64.StdEncoding.EncodeToString(kv.Value)
+	}
+	return view
+}
+
+// decodeMeta will decode the metadata key value, nil when it doesn't decode
+func decodeMeta(value []byte) *fileMeta {
+	var meta fileMeta
+	if err := json.Unmarshal(value, &meta); err != nil {
+		return nil
+	}
+	return &meta
+}
+
+// inConfigKey will answer 403 and return false when etcdKey, a key or a prefix, is outside of --key, the read
+// endpoints do not expose the rest of the cluster
+func inConfigKey(c *gin.Context, etcdKey string) bool {
+	if strings.HasPrefix(etcdKey, CMDArgs.ConfigKey) {
+		return true
+	}
+	abortWithError(c, http.StatusForbidden, codeForbidden, "key outside of --key", CMDArgs.ConfigKey)
+	return false
+}
+
+// getFileHandler - GET /v1/getFile?key=, returns the raw value with its stored Content-Type, or a JSON
+// or YAML wrapping with the base64 encoded value, depending on the Accept header
+func getFileHandler(c *gin.Context) {
+	etcdKey := c.Query("key")
+	if etcdKey == "" {
+		abortWithError(c, http.StatusBadRequest, codeBadRequest, "key is required", nil)
+		return
+	}
+	if !inConfigKey(c, etcdKey) {
+		return
+	}
+	var kv, metaKV *storeKV
+	err := withETCDRetry(c.Request.Context(), func(ctx context.Context) (err error) {
+		if kv, _, err = kvStore.Get(ctx, etcdKey); err != nil || kv == nil {
+			return err
+		}
+		metaKV, _, err = kvStore.Get(ctx, metaKey(etcdKey))
+		return err
+	})
+	if err != nil {
+		abortWithErr(c, err)
+		return
+	}
+	if kv == nil {
+		abortWithErr(c, fmt.Errorf("%w: %s", errKeyNotFound, etcdKey))
+		return
+	}
+	var meta *fileMeta
+	if metaKV != nil {
+		meta = decodeMeta(metaKV.Value)
+	}
+	view := newFileView(*kv, meta, true)
+	c.Header("ETag", fmt.Sprintf("%q", fmt.Sprint(view.Revision)))
+
+	switch c.NegotiateFormat(mimeOctetStream, view.ContentType, mimeJSON, mimeYAML, mimeTextYAML) {
+	case mimeJSON:
+		c.JSON(http.StatusOK, view)
+	case mimeYAML, mimeTextYAML:
+		c.YAML(http.StatusOK, view)
+	case "":
+		abortWithError(c, http.StatusNotAcceptable, codeNotAcceptable, "no acceptable representation",
+			[]string{mimeOctetStream, view.ContentType, mimeJSON, mimeYAML})
+	default:
+		c.Data(http.StatusOK, view.ContentType, kv.Value)
+	}
+}
+
+// filesHandler - GET /v1/files?prefix=, lists the keys under prefix (--key by default, within it) with
+// their metadata, as JSON or YAML depending on the Accept header
+func filesHandler(c *gin.Context) {
+	prefix := c.DefaultQuery("prefix", CMDArgs.ConfigKey)
+	if !inConfigKey(c, prefix) {
+		return
+	}
+	var (
+		kvs      []storeKV
+		revision int64
+	)
+	err := withETCDRetry(c.Request.Context(), func(ctx context.Context) (err error) {
+		kvs, revision, err = kvStore.List(ctx, prefix)
+		return err
+	})
+	if err != nil {
+		abortWithErr(c, err)
+		return
+	}
+	metas := make(map[string]*fileMeta)
+	for _, kv := range kvs {
+		if strings.HasSuffix(kv.Key, metaSuffix) {
+			metas[strings.TrimSuffix(kv.Key, metaSuffix)] = decodeMeta(kv.Value)
+		}
+	}
+	views := make([]FileView, 0, len(kvs))
+	for _, kv := range kvs {
+		if !isReservedKey(kv.Key) {
+			views = append(views, newFileView(kv, metas[kv.Key], false))
+		}
+	}
+
+	list := FilesResponse{Revision: revision, Files: views}
+	switch c.NegotiateFormat(mimeJSON, mimeYAML, mimeTextYAML) {
+	case mimeJSON:
+		c.JSON(http.StatusOK, list)
+	case mimeYAML, mimeTextYAML:
+		c.YAML(http.StatusOK, list)
+	default:
+		abortWithError(c, http.StatusNotAcceptable, codeNotAcceptable, "no acceptable representation",
+			[]string{mimeJSON, mimeYAML})
+	}
+}
+
+// kvHandler - GET /v1/kv/*key, reads a key under --key straight from the store, as of ?rev= with one. The
+// raw value is returned with its stored Content-Type and the revisions in headers.
+func kvHandler(c *gin.Context) {
+	etcdKey := strings.TrimPrefix(c.Param("key"), "/")
+	if !inConfigKey(c, etcdKey) {
+		return
+	}
+	var pinned int64
+	if rev := c.Query("rev"); rev != "" {
+		n, err := strconv.ParseInt(rev, 10, 64)
+		if err != nil || n <= 0 {
+			abortWithError(c, http.StatusBadRequest, codeBadRequest, "rev must be a positive revision", nil)
+			return
+		}
+		pinned = n
+	}
+	reader, canPin := kvStore.(revisionReader)
+	if pinned != 0 && !canPin {
+		abortWithErr(c, fmt.Errorf("%w: reading a past revision", errNotSupported))
+		return
+	}
+	var (
+		kv, metaKV *storeKV
+		revision   = pinned
+	)
+	err := withETCDRetry(c.Request.Context(), func(ctx context.Context) (err error) {
+		if pinned != 0 {
+			if kv, err = reader.GetAt(ctx, etcdKey, pinned); err != nil || kv == nil {
+				return err
+			}
+			metaKV, err = reader.GetAt(ctx, metaKey(etcdKey), pinned)
+			return err
+		}
+		if kv, revision, err = kvStore.Get(ctx, etcdKey); err != nil || kv == nil {
+			return err
+		}
+		metaKV, _, err = kvStore.Get(ctx, metaKey(etcdKey))
+		return err
+	})
+	if err != nil {
+		abortWithErr(c, err)
+		return
+	}
+	c.Header("X-Etcd-Revision", strconv.FormatInt(revision, 10))
+	if kv == nil {
+		abortWithErr(c, fmt.Errorf("%w: %s", errKeyNotFound, etcdKey))
+		return
+	}
+	var meta *fileMeta
+	if metaKV != nil {
+		meta = decodeMeta(metaKV.Value)
+	}
+	view := newFileView(*kv, meta, false)
+	etag := fmt.Sprintf("%q", fmt.Sprint(view.Revision))
+	c.Header("ETag", etag)
+	c.Header("X-Etcd-Mod-Revision", strconv.FormatInt(kv.Revision, 10))
+	c.Header("X-Etcd-Version", strconv.FormatInt(kv.Version, 10))
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Data(http.StatusOK, view.ContentType, kv.Value)
+}
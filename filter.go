@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// sniffLength is how many bytes are read to detect the MIME type of a file
+const sniffLength = 512
+
+// errFiltered is returned for files excluded from uploads
+var errFiltered = errors.New("file filtered out")
+
+// onlyExtensions and onlyMIMETypes are guarded by settingsMu, they can be changed under .syncer-config/
+var (
+	// onlyExtensions are the lower case file extensions allowed to be uploaded, empty allows all
+	onlyExtensions []string
+	// onlyMIMETypes are the MIME type patterns, ex: text/*, allowed to be uploaded, empty disables sniffing
+	onlyMIMETypes []string
+)
+
+// splitList will split comma separated values of every argument, so both --flag a,b and --flag a b work
+func splitList(args []string) (values []string) {
+	for _, a := range args {
+		for _, v := range strings.Split(a, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+	}
+	return values
+}
+
+// parseExtensions will normalize --only-ext values to lower case extensions with a leading dot
+func parseExtensions(args []string) (exts []string) {
+	for _, ext := range splitList(args) {
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		exts = append(exts, strings.ToLower(ext))
+	}
+	return exts
+}
+
+// parseMIMETypes will validate --only-mime patterns
+func parseMIMETypes(args []string) ([]string, error) {
+	patterns := splitList(args)
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil || !strings.Contains(pattern, "/") {
+			return nil, fmt.Errorf("%q is not a MIME type pattern", pattern)
+		}
+	}
+	return patterns, nil
+}
+
+// sniffMIMEType will detect the MIME type of filePath from its first bytes, without parameters
+func sniffMIMEType(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	buf := make([]byte, sniffLength)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	mediaType, _, err := mime.ParseMediaType(http.DetectContentType(buf[:n]))
+	return mediaType, err
+}
+
+// checkUploadable will return an error when filePath is excluded from uploads by --only-ext or --only-mime
+func checkUploadable(filePath string) error {
+	settingsMu.Lock()
+	onlyExtensions, onlyMIMETypes := onlyExtensions, onlyMIMETypes
+	settingsMu.Unlock()
+	if len(onlyExtensions) > 0 {
+		ext := strings.ToLower(filepath.Ext(filePath))
+		allowed := false
+		for _, e := range onlyExtensions {
+			if e == ext {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("%w: extension %q is not allowed by --only-ext", errFiltered, ext)
+		}
+	}
+	if len(onlyMIMETypes) > 0 {
+		mediaType, err := sniffMIMEType(filePath)
+		if err != nil {
+			return err
+		}
+		for _, pattern := range onlyMIMETypes {
+			if ok, _ := path.Match(pattern, mediaType); ok {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: MIME type %q is not allowed by --only-mime", errFiltered, mediaType)
+	}
+	return nil
+}
+
+// isUploadable reports whether filePath may be uploaded, logging why it may not
+func isUploadable(filePath string) bool {
+	if err := checkUploadable(filePath); err != nil {
+		log.WithFields(log.Fields{
+			"filePath": filePath,
+			"err":      err,
+		}).Debug("file filtered out")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// GenDocsCmd - gen-docs subcommand
+type GenDocsCmd struct {
+	Output string `arg:"-o,--output" default:"." help:"directory the man pages are written to"`
+}
+
+// programSummary is the NAME line of the man pages
+const programSummary = "keep a folder in sync with keys of ETCD"
+
+// runGenDocs will write a man page for the program and one per subcommand
+func runGenDocs(cmd *GenDocsCmd) int {
+	if err := os.MkdirAll(cmd.Output, 0755); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	root := describeCLI()
+	pages := map[string]*bytes.Buffer{root.Name: new(bytes.Buffer)}
+	writeManPage(pages[root.Name], root, nil)
+	for _, sub := range root.Subcommands {
+		name := root.Name + "-" + sub.Name
+		pages[name] = new(bytes.Buffer)
+		writeManPage(pages[name], sub, &root)
+	}
+	for name, page := range pages {
+		path := filepath.Join(cmd.Output, name+".1")
+		if err := os.WriteFile(path, page.Bytes(), 0644); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			return 1
+		}
+		fmt.Println(path)
+	}
+	return 0
+}
+
+// writeManPage will write the man page of cmd, a subcommand of parent unless parent is nil, to w
+func writeManPage(w io.Writer, cmd cliCommand, parent *cliCommand) {
+	title, usage, summary := cmd.Name, cmd.Name, programSummary
+	if parent != nil {
+		title, usage, summary = parent.Name+"-"+cmd.Name, parent.Name+" [OPTIONS] "+cmd.Name, cmd.Help
+	}
+	fmt.Fprintf(w, ".TH %s 1 \"\" \"%s\" \"User Commands\"\n", strings.ToUpper(roffEscape(title)), programName)
+	fmt.Fprintf(w, ".SH NAME\n%s \\- %s\n", roffEscape(title), roffEscape(summary))
+	fmt.Fprintf(w, ".SH SYNOPSIS\n.B %s\n", roffEscape(usage))
+	for _, option := range cmd.Options {
+		switch {
+		case option.Positional && option.Required:
+			fmt.Fprintf(w, "\\fI%s\\fR\n", roffEscape(strings.ToUpper(option.Long)))
+		case option.Positional:
+			fmt.Fprintf(w, "[\\fI%s\\fR]\n", roffEscape(strings.ToUpper(option.Long)))
+		case option.Required:
+			fmt.Fprintf(w, "\\fB\\-\\-%s\\fR \\fI%s\\fR\n", roffEscape(option.Long), roffEscape(option.Value))
+		}
+	}
+	if len(cmd.flags()) > 0 {
+		fmt.Fprintln(w, "[\\fIOPTIONS\\fR]")
+	}
+	if len(cmd.Subcommands) > 0 {
+		fmt.Fprintln(w, "[\\fICOMMAND\\fR]")
+		fmt.Fprintln(w, ".SH DESCRIPTION\nWithout a command the folder and the keys are synced until the process is stopped.")
+	}
+	if positionals := len(cmd.Options) - len(cmd.flags()); positionals > 0 {
+		fmt.Fprintln(w, ".SH ARGUMENTS")
+		for _, option := range cmd.Options {
+			if option.Positional {
+				fmt.Fprintf(w, ".TP\n\\fI%s\\fR\n%s\n", roffEscape(strings.ToUpper(option.Long)), roffEscape(option.Help))
+			}
+		}
+	}
+	if flags := cmd.flags(); len(flags) > 0 {
+		fmt.Fprintln(w, ".SH OPTIONS")
+		for _, flag := range flags {
+			fmt.Fprintln(w, ".TP")
+			if flag.Short != "" {
+				fmt.Fprintf(w, "\\fB\\-%s\\fR, ", roffEscape(flag.Short))
+			}
+			fmt.Fprintf(w, "\\fB\\-\\-%s\\fR", roffEscape(flag.Long))
+			if flag.Value != "" {
+				fmt.Fprintf(w, " \\fI%s\\fR", roffEscape(flag.Value))
+			}
+			fmt.Fprintln(w)
+			help := flag.Help
+			if flag.Default != "" {
+				help += fmt.Sprintf(" [default: %s]", flag.Default)
+			}
+			if flag.Env != "" {
+				help += fmt.Sprintf(" [env: %s]", flag.Env)
+			}
+			if flag.Repeated {
+				help += ", can be given several times"
+			}
+			fmt.Fprintln(w, roffEscape(strings.TrimSpace(help)))
+		}
+	}
+	if len(cmd.Subcommands) > 0 {
+		fmt.Fprintln(w, ".SH COMMANDS")
+		for _, sub := range cmd.Subcommands {
+			fmt.Fprintf(w, ".TP\n\\fB%s\\fR\n%s, see \\fB%s\\-%s\\fR(1)\n", roffEscape(sub.Name), roffEscape(sub.Help),
+				roffEscape(cmd.Name), roffEscape(sub.Name))
+		}
+	}
+	if parent != nil {
+		fmt.Fprintf(w, ".SH SEE ALSO\n\\fB%s\\fR(1) for the options of every command\n", roffEscape(parent.Name))
+	}
+}
+
+// roffEscape will escape s for a roff text line
+func roffEscape(s string) string {
+	s = strings.NewReplacer(`\`, `\e`, "-", `\-`).Replace(s)
+	if strings.HasPrefix(s, ".") || strings.HasPrefix(s, "'") {
+		s = `\&` + s
+	}
+	return s
+}
@@ -3,8 +3,21 @@ module github.com/doody/etcd_file_syncer
 go 1.16
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/alexflint/go-arg v1.4.2
+	github.com/coreos/go-systemd/v22 v22.3.2
+	github.com/evanphx/json-patch v4.12.0+incompatible
 	github.com/gin-gonic/gin v1.7.4
+	github.com/pmezard/go-difflib v1.0.0
+	github.com/prometheus/client_golang v1.11.0
 	github.com/sirupsen/logrus v1.6.0
+	go.etcd.io/etcd/api/v3 v3.5.0
 	go.etcd.io/etcd/client/v3 v3.5.0
+	golang.org/x/crypto v0.0.0-20201002170205-7f63de1d35b0
+	golang.org/x/net v0.0.0-20210405180319-a5a99cb37ef4
+	golang.org/x/sys v0.0.0-20210603081109-ebe580a85c40
+	golang.org/x/text v0.3.5
+	golang.org/x/time v0.0.0-20210220033141-f8bda1e9f3ba
+	google.golang.org/grpc v1.38.0
+	gopkg.in/yaml.v2 v2.3.0
 )
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// pausedUploads holds the uploads held back while a guard rail is exceeded, by key
+	pausedUploads   = make(map[string]fileUpload)
+	pausedUploadsMu sync.Mutex
+)
+
+// guardRailsEnabled reports whether a file count or size limit is configured
+func guardRailsEnabled() bool {
+	maxFiles, maxTotalBytes := guardLimits()
+	return maxFiles > 0 || maxTotalBytes > 0
+}
+
+// checkGuardRails will return an error when uploading files would leave more than --max-files keys or
+// more than --max-total-bytes of values under etcdKey
+func checkGuardRails(ctx context.Context, etcdKey string, files []fileUpload) error {
+	var kvs []storeKV
+	err := withETCDRetry(ctx, func(ctx context.Context) (err error) {
+		kvs, _, err = kvStore.List(ctx, etcdKey)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	sizes := make(map[string]int64, len(kvs))
+	for _, kv := range kvs {
+		if !isReservedKey(kv.Key) {
+			sizes[kv.Key] = int64(len(kv.Value))
+		}
+	}
+	for _, file := range files {
+		if info, err := os.Stat(file.FilePath); err == nil {
+			sizes[file.ETCDKey] = info.Size()
+		}
+	}
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+	managedFilesGauge.Set(float64(len(sizes)))
+	managedBytesGauge.Set(float64(total))
+
+	maxFiles, maxTotalBytes := guardLimits()
+	switch {
+	case maxFiles > 0 && len(sizes) > maxFiles:
+		return fmt.Errorf("%d files would exceed --max-files %d", len(sizes), maxFiles)
+	case maxTotalBytes > 0 && total > maxTotalBytes:
+		return fmt.Errorf("%d bytes would exceed --max-total-bytes %d", total, maxTotalBytes)
+	}
+	return nil
+}
+
+// guardUploads will return the uploads allowed by the guard rails, along with the ones held back by a
+// previous cycle. When a limit is exceeded nothing is returned, uploads are paused until the next cycle
+// fits again.
+func guardUploads(ctx context.Context, etcdKey string, files []fileUpload) []fileUpload {
+	if !guardRailsEnabled() {
+		return files
+	}
+	pausedUploadsMu.Lock()
+	defer pausedUploadsMu.Unlock()
+	wasPaused := len(pausedUploads) > 0
+	for _, file := range files {
+		pausedUploads[file.ETCDKey] = file
+	}
+	if len(pausedUploads) == 0 {
+		return nil
+	}
+	files = files[:0]
+	for _, file := range pausedUploads {
+		files = append(files, file)
+	}
+
+	if err := checkGuardRails(ctx, etcdKey, files); err != nil {
+		uploadsPausedGauge.Set(1)
+		if !wasPaused {
+			writeAudit(auditEntry{
+				Action:  auditUploadsPaused,
+				ETCDKey: etcdKey,
+				Detail:  err.Error(),
+			})
+		}
+		log.WithFields(log.Fields{
+			"etcdKey": etcdKey,
+			"pending": len(files),
+			"err":     err,
+		}).Error("guard rail exceeded, uploads paused")
+		return nil
+	}
+	if wasPaused {
+		log.WithFields(log.Fields{
+			"etcdKey": etcdKey,
+			"pending": len(files),
+		}).Info("guard rails satisfied, uploads resumed")
+	}
+	uploadsPausedGauge.Set(0)
+	pausedUploads = make(map[string]fileUpload)
+	return files
+}
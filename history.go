@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// historyDir is the directory under --key keeping the last --history values of every key, a key per value named
+// after the key and the revision it was written at, so they survive ETCD compaction
+const historyDir = ".history/"
+
+var (
+	errVersionNotFound  = errors.New("version not found in history")
+	errRollbackConflict = errors.New("key changed while rolling back")
+)
+
+// HistoryVersion is a value of a key kept in history
+type HistoryVersion struct {
+	Revision int64 `json:"revision"`
+	Size     int   `json:"size"`
+	// Current is set on the version the key holds
+	Current bool `json:"current,omitempty"`
+}
+
+// HistoryResponse - GET /v1/history?key=
+type HistoryResponse struct {
+	Key      string           `json:"key"`
+	Versions []HistoryVersion `json:"versions"`
+	// CompactedRevision is the last revision compacted by the syncer, versions before it are only in history
+	CompactedRevision int64 `json:"compactedRevision,omitempty"`
+}
+
+// RollbackModel - POST /v1/rollback
+type RollbackModel struct {
+	Key string `json:"key" binding:"required"`
+	// Revision is the version to restore, the one before the current value without it
+	Revision int64 `json:"revision"`
+}
+
+// historyPrefix will return the prefix of the history keys of etcdKey
+func historyPrefix(etcdKey string) string {
+	return CMDArgs.ConfigKey + historyDir + strings.TrimPrefix(etcdKey, CMDArgs.ConfigKey) + "@"
+}
+
+// historyKey will return the key keeping the value etcdKey had at revision
+func historyKey(etcdKey string, revision int64) string {
+	return fmt.Sprintf("%s%020d", historyPrefix(etcdKey), revision)
+}
+
+// isHistoryKey reports whether etcdKey is under the history directory of --key
+func isHistoryKey(etcdKey string) bool {
+	return strings.HasPrefix(etcdKey, CMDArgs.ConfigKey+historyDir)
+}
+
+// historyEntry will return the revision of the history key of etcdKey, false for keys of other keys
+func historyEntry(etcdKey, key string) (int64, bool) {
+	rest := strings.TrimPrefix(key, historyPrefix(etcdKey))
+	if len(rest) != 20 || rest == key {
+		return 0, false
+	}
+	revision, err := strconv.ParseInt(rest, 10, 64)
+	return revision, err == nil
+}
+
+// historyTracked reports whether the values of etcdKey are kept in history
+func historyTracked(etcdKey string) bool {
+	return CMDArgs.History > 0 && strings.HasPrefix(etcdKey, CMDArgs.ConfigKey) && !isReservedKey(etcdKey)
+}
+
+// listHistory will return the history keys of etcdKey, oldest first
+func listHistory(ctx context.Context, etcdKey string) ([]storeKV, error) {
+	var kvs []storeKV
+	err := withETCDRetry(ctx, func(ctx context.Context) (err error) {
+		kvs, _, err = kvStore.List(ctx, historyPrefix(etcdKey))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	versions := kvs[:0]
+	for _, kv := range kvs {
+		if _, ok := historyEntry(etcdKey, kv.Key); ok {
+			versions = append(versions, kv)
+		}
+	}
+	return versions, nil
+}
+
+// recordHistory will keep the values of the events put in history. Every syncer of the key sees the same
+// events, the first to write a version prunes the history of its key.
+func recordHistory(ctx context.Context, events []storeEvent) {
+	for _, ev := range events {
+		if ev.Type == storeEventPut && historyTracked(ev.KV.Key) {
+			recordVersion(ctx, ev.KV)
+		}
+	}
+}
+
+// recordVersion will write the value of kv to history unless it is already there, then prune its history
+func recordVersion(ctx context.Context, kv storeKV) {
+	key := historyKey(kv.Key, kv.Revision)
+	var succeeded bool
+	err := withETCDRetry(ctx, func(ctx context.Context) (err error) {
+		succeeded, _, err = kvStore.Txn(ctx, []storeCmp{{Key: key, Revision: 0}}, []storeOp{putOp(key, kv.Value)})
+		return err
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"etcdKey":  kv.Key,
+			"revision": kv.Revision,
+			"err":      err,
+		}).Warn("cannot keep value in history")
+		return
+	}
+	if succeeded {
+		pruneHistory(ctx, kv.Key)
+	}
+}
+
+// seedHistory will keep the current values of kvs missing from history, the first version of keys written
+// before --history was set or while no syncer ran
+func seedHistory(ctx context.Context, kvs []storeKV) {
+	if CMDArgs.History == 0 {
+		return
+	}
+	var history []storeKV
+	err := withETCDRetry(ctx, func(ctx context.Context) (err error) {
+		history, _, err = kvStore.List(ctx, CMDArgs.ConfigKey+historyDir)
+		return err
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"prefix": CMDArgs.ConfigKey + historyDir,
+			"err":    err,
+		}).Warn("cannot read history")
+		return
+	}
+	kept := make(map[string]bool, len(history))
+	for _, kv := range history {
+		kept[kv.Key] = true
+	}
+	for _, kv := range kvs {
+		if historyTracked(kv.Key) && !kept[historyKey(kv.Key, kv.Revision)] {
+			recordVersion(ctx, kv)
+		}
+	}
+}
+
+// pruneHistory will delete the versions of etcdKey older than the last --history
+func pruneHistory(ctx context.Context, etcdKey string) {
+	versions, err := listHistory(ctx, etcdKey)
+	if err != nil || len(versions) <= CMDArgs.History {
+		return
+	}
+	stale := versions[:len(versions)-CMDArgs.History]
+	for len(stale) > 0 {
+		n := len(stale)
+		if n > txnMaxOps() {
+			n = txnMaxOps()
+		}
+		ops := make([]storeOp, 0, n)
+		for _, kv := range stale[:n] {
+			ops = append(ops, deleteOp(kv.Key))
+		}
+		err := withETCDRetry(ctx, func(ctx context.Context) error {
+			_, _, err := kvStore.Txn(ctx, nil, ops)
+			return err
+		})
+		if err != nil {
+			log.WithFields(log.Fields{
+				"etcdKey": etcdKey,
+				"err":     err,
+			}).Warn("cannot prune history")
+			return
+		}
+		stale = stale[n:]
+	}
+	log.WithFields(log.Fields{
+		"etcdKey": etcdKey,
+		"pruned":  len(versions) - CMDArgs.History,
+	}).Debug("history pruned")
+}
+
+// rollbackKey will write back the value etcdKey had at revision, the value before the current one when
+// revision is 0, and return the revision of the write and the one restored. A revision missing from history
+// and before the compacted revision returns errCompacted.
+func rollbackKey(ctx context.Context, etcdKey string, revision int64) (int64, int64, error) {
+	var current *storeKV
+	err := withETCDRetry(ctx, func(ctx context.Context) (err error) {
+		current, _, err = kvStore.Get(ctx, etcdKey)
+		return err
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	versions, err := listHistory(ctx, etcdKey)
+	if err != nil {
+		return 0, 0, err
+	}
+	var restored *storeKV
+	for i := len(versions) - 1; i >= 0 && restored == nil; i-- {
+		rev, _ := historyEntry(etcdKey, versions[i].Key)
+		switch {
+		case revision != 0 && rev == revision:
+			restored = &versions[i]
+		case revision == 0 && (current == nil || rev < current.Revision):
+			restored, revision = &versions[i], rev
+		}
+	}
+	if restored == nil {
+		if err := checkRetrievable(revision); err != nil {
+			return 0, 0, err
+		}
+		return 0, 0, errVersionNotFound
+	}
+	if err := checkValueSize(etcdKey, len(restored.Value)); err != nil {
+		return 0, 0, err
+	}
+	ops, err := signatureOps(etcdKey, restored.Value)
+	if err != nil {
+		return 0, 0, err
+	}
+	checksumOps, err := checksumMetaOps(ctx, etcdKey, restored.Value)
+	if err != nil {
+		return 0, 0, err
+	}
+	ops = append([]storeOp{putOp(etcdKey, restored.Value)}, append(ops, checksumOps...)...)
+	cmps := []storeCmp{{Key: etcdKey}}
+	if current != nil {
+		cmps[0].Revision = current.Revision
+	}
+	var (
+		succeeded  bool
+		writtenRev int64
+	)
+	err = withETCDRetry(ctx, func(ctx context.Context) (err error) {
+		succeeded, writtenRev, err = kvStore.Txn(ctx, cmps, ops)
+		return err
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if !succeeded {
+		return 0, 0, errRollbackConflict
+	}
+	return writtenRev, revision, nil
+}
+
+// historyHandler - GET /v1/history?key=, the versions of a key kept in history
+func historyHandler(c *gin.Context) {
+	etcdKey := c.Query("key")
+	if etcdKey == "" {
+		abortWithError(c, http.StatusBadRequest, codeBadRequest, "key is required", nil)
+		return
+	}
+	if !inConfigKey(c, etcdKey) {
+		return
+	}
+	ctx := c.Request.Context()
+	var current *storeKV
+	err := withETCDRetry(ctx, func(ctx context.Context) (err error) {
+		current, _, err = kvStore.Get(ctx, etcdKey)
+		return err
+	})
+	if err != nil {
+		abortWithErr(c, err)
+		return
+	}
+	versions, err := listHistory(ctx, etcdKey)
+	if err != nil {
+		abortWithErr(c, err)
+		return
+	}
+	response := HistoryResponse{
+		Key:               etcdKey,
+		Versions:          make([]HistoryVersion, 0, len(versions)),
+		CompactedRevision: atomic.LoadInt64(&compactedRevision),
+	}
+	for i := len(versions) - 1; i >= 0; i-- {
+		rev, _ := historyEntry(etcdKey, versions[i].Key)
+		response.Versions = append(response.Versions, HistoryVersion{
+			Revision: rev,
+			Size:     len(versions[i].Value),
+			Current:  current != nil && current.Revision == rev,
+		})
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// rollbackHandler - POST /v1/rollback, writes back a version of a key kept in history
+func rollbackHandler(c *gin.Context) {
+	var json RollbackModel
+	if err := c.ShouldBindJSON(&json); err != nil {
+		abortWithBadRequest(c, err)
+		return
+	}
+	rev, restored, err := rollbackKey(c.Request.Context(), json.Key, json.Revision)
+	if err != nil {
+		abortWithErr(c, err)
+		return
+	}
+	log.WithFields(log.Fields{
+		"etcdKey":  json.Key,
+		"restored": restored,
+		"revision": rev,
+	}).Info("key rolled back")
+	writeAudit(auditEntry{
+		Action:  auditRollback,
+		ETCDKey: json.Key,
+		Detail:  fmt.Sprintf("value of revision %d written back at revision %d", restored, rev),
+	})
+	c.JSON(http.StatusOK, OKResponse{Status: "ok", Revision: rev})
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Failure hook conditions
+const (
+	conditionUploadFailures   = "upload_failures"
+	conditionDownloadFailures = "download_failures"
+	conditionWatchDown        = "watch_down"
+)
+
+// Failure hook states
+const (
+	hookFailing   = "failing"
+	hookRecovered = "recovered"
+)
+
+const (
+	// hookTimeout bounds the failure hook command and webhook
+	hookTimeout = 30 * time.Second
+	// watchDownCheckInterval is how often the watch state is compared with --failure-hook-watch-down
+	watchDownCheckInterval = 10 * time.Second
+)
+
+// hookEvent is the JSON body posted to --failure-hook-url
+type hookEvent struct {
+	Time      time.Time `json:"time"`
+	Condition string    `json:"condition"`
+	State     string    `json:"state"`
+	Detail    string    `json:"detail"`
+	Instance  string    `json:"instance"`
+	ETCDKey   string    `json:"etcdKey"`
+}
+
+// failureTracker counts consecutive failures and fires the hooks when a threshold is crossed, and again
+// once the condition recovers
+type failureTracker struct {
+	mu sync.Mutex
+	// consecutive failures by condition, and conditions whose hook fired
+	failures map[string]int
+	failing  map[string]bool
+	// watchDownSince is when the watch failed, zero while it is healthy
+	watchDownSince time.Time
+}
+
+var failures = &failureTracker{failures: make(map[string]int), failing: make(map[string]bool)}
+
+// hooksEnabled reports whether a failure hook is configured
+func hooksEnabled() bool {
+	return CMDArgs.FailureHookCommand != "" || CMDArgs.FailureHookURL != ""
+}
+
+// threshold will return the number of consecutive failures of condition that fire the hooks, 0 if disabled
+func threshold(condition string) int {
+	switch condition {
+	case conditionUploadFailures:
+		return CMDArgs.FailureHookUploads
+	case conditionDownloadFailures:
+		return CMDArgs.FailureHookDownloads
+	}
+	return 0
+}
+
+// recordFailure will count a failure of condition, firing the hooks when it reaches its threshold
+func (t *failureTracker) recordFailure(condition string, err error) {
+	limit := threshold(condition)
+	if limit <= 0 || !hooksEnabled() {
+		return
+	}
+	t.mu.Lock()
+	t.failures[condition]++
+	count := t.failures[condition]
+	fire := count >= limit && !t.failing[condition]
+	if fire {
+		t.failing[condition] = true
+	}
+	t.mu.Unlock()
+	if fire {
+		fireHooks(condition, hookFailing, fmt.Sprintf("%d consecutive failures, last: %v", count, err))
+	}
+}
+
+// recordSuccess will reset the failures of condition, firing the hooks if it had crossed its threshold
+func (t *failureTracker) recordSuccess(condition string) {
+	t.mu.Lock()
+	t.failures[condition] = 0
+	recovered := t.failing[condition]
+	t.failing[condition] = false
+	t.mu.Unlock()
+	if recovered {
+		fireHooks(condition, hookRecovered, "succeeded again")
+	}
+}
+
+// watchDown will record that the watch failed and is being re-established
+func (t *failureTracker) watchDown() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.watchDownSince.IsZero() {
+		t.watchDownSince = time.Now()
+	}
+}
+
+// watchUp will record that the watch received a response
+func (t *failureTracker) watchUp() {
+	t.mu.Lock()
+	t.watchDownSince = time.Time{}
+	recovered := t.failing[conditionWatchDown]
+	t.failing[conditionWatchDown] = false
+	t.mu.Unlock()
+	if recovered {
+		fireHooks(conditionWatchDown, hookRecovered, "watch receiving responses again")
+	}
+}
+
+// checkWatchDown will fire the hooks once the watch has been down for --failure-hook-watch-down
+func (t *failureTracker) checkWatchDown() {
+	t.mu.Lock()
+	down := !t.watchDownSince.IsZero() && time.Since(t.watchDownSince) >= CMDArgs.FailureHookWatchDown
+	fire := down && !t.failing[conditionWatchDown]
+	if fire {
+		t.failing[conditionWatchDown] = true
+	}
+	since := t.watchDownSince
+	t.mu.Unlock()
+	if fire {
+		fireHooks(conditionWatchDown, hookFailing, fmt.Sprintf("watch down since %s", since.UTC().Format(time.RFC3339)))
+	}
+}
+
+// monitorWatch will check the watch state until ctx is canceled
+func monitorWatch(ctx context.Context) {
+	runPeriodically(ctx, watchDownCheckInterval, func(ctx context.Context) {
+		failures.checkWatchDown()
+	})
+}
+
+// fireHooks will run --failure-hook-command and post to --failure-hook-url in the background
+func fireHooks(condition, state, detail string) {
+	event := hookEvent{
+		Time:      time.Now().UTC(),
+		Condition: condition,
+		State:     state,
+		Detail:    detail,
+		Instance:  instanceName,
+		ETCDKey:   CMDArgs.ConfigKey,
+	}
+	log.WithFields(log.Fields{
+		"condition": condition,
+		"state":     state,
+		"detail":    detail,
+	}).Warn("failure threshold crossed, running hooks")
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+		defer cancel()
+		if CMDArgs.FailureHookCommand != "" {
+			if err := runHookCommand(ctx, CMDArgs.FailureHookCommand, event); err != nil {
+				log.WithFields(log.Fields{
+					"condition": condition,
+					"err":       err,
+				}).Warn("failure hook command failed")
+			}
+		}
+		if CMDArgs.FailureHookURL != "" {
+			if err := postJSON(ctx, CMDArgs.FailureHookURL, event); err != nil {
+				log.WithFields(log.Fields{
+					"condition": condition,
+					"err":       err,
+				}).Warn("failure webhook failed")
+			}
+		}
+	}()
+}
+
+// runHookCommand will run command with sh -c, the event is passed in ETCD_FILE_SYNCER_* variables
+func runHookCommand(ctx context.Context, command string, event hookEvent) error {
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(),
+		"ETCD_FILE_SYNCER_CONDITION="+event.Condition,
+		"ETCD_FILE_SYNCER_STATE="+event.State,
+		"ETCD_FILE_SYNCER_DETAIL="+event.Detail,
+		"ETCD_FILE_SYNCER_INSTANCE="+event.Instance,
+		"ETCD_FILE_SYNCER_KEY="+event.ETCDKey,
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// postJSON will post v as JSON to url
+func postJSON(ctx context.Context, url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
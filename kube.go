@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Files mounted in every pod for its service account
+const (
+	kubeServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	kubeTokenFile         = kubeServiceAccountDir + "/token"
+	kubeCAFile            = kubeServiceAccountDir + "/ca.crt"
+	kubeNamespaceFile     = kubeServiceAccountDir + "/namespace"
+)
+
+// kubeWatchTimeout is how long the API server keeps a watch open before we list again
+const kubeWatchTimeout = 5 * time.Minute
+
+// kubeClient is a minimal client of the Kubernetes API, enough to list and watch resources
+type kubeClient struct {
+	baseURL string
+	client  *http.Client
+}
+
+// kubeStatusError is a non 2xx answer of the API server
+type kubeStatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *kubeStatusError) Error() string {
+	return fmt.Sprintf("kubernetes API answered %d: %s", e.Code, e.Message)
+}
+
+// kubeObjectMeta holds the metadata fields the syncer reads
+type kubeObjectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace"`
+	UID             string            `json:"uid"`
+	Generation      int64             `json:"generation"`
+	ResourceVersion string            `json:"resourceVersion"`
+	Labels          map[string]string `json:"labels"`
+}
+
+// kubeWatchEvent is one line of a watch stream
+type kubeWatchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// newKubeClient will return a client of apiURL, or of the API server of the cluster the pod runs in when
+// apiURL is empty. The service account token is sent when the pod has one, and reread on every request
+// since it is rotated.
+func newKubeClient(apiURL string) (*kubeClient, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if apiURL == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, fmt.Errorf("not running in a Kubernetes pod, set --kube-api")
+		}
+		apiURL = "https://" + net.JoinHostPort(host, port)
+		ca, err := os.ReadFile(kubeCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate in %s", kubeCAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &kubeClient{
+		baseURL: strings.TrimSuffix(apiURL, "/"),
+		client:  &http.Client{Transport: transport},
+	}, nil
+}
+
+// kubeNamespace will return the namespace of the pod, empty outside of a pod
+func kubeNamespace() string {
+	ns, _ := os.ReadFile(kubeNamespaceFile)
+	return strings.TrimSpace(string(ns))
+}
+
+// request will send a GET of path and return the answer when it is a 2xx
+func (c *kubeClient) request(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if token, err := os.ReadFile(kubeTokenFile); err == nil {
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		var status struct {
+			Message string `json:"message"`
+		}
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if json.Unmarshal(body, &status) != nil || status.Message == "" {
+			status.Message = strings.TrimSpace(string(body))
+		}
+		return nil, &kubeStatusError{Code: resp.StatusCode, Message: status.Message}
+	}
+	return resp, nil
+}
+
+// get will decode the resource at path into out
+func (c *kubeClient) get(ctx context.Context, path string, out interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	resp, err := c.request(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// watch will call fn with every event of the collection at path after resourceVersion, until the API
+// server ends the watch, ctx is done or fn fails. An ERROR event is returned as a *kubeStatusError, 410
+// meaning resourceVersion is too old and the collection must be listed again.
+func (c *kubeClient) watch(ctx context.Context, path, resourceVersion string, fn func(kubeWatchEvent) error) error {
+	query := fmt.Sprintf("?watch=true&allowWatchBookmarks=true&resourceVersion=%s&timeoutSeconds=%d",
+		resourceVersion, int(kubeWatchTimeout/time.Second))
+	resp, err := c.request(ctx, path+query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64<<10), 16<<20)
+	for scanner.Scan() {
+		var ev kubeWatchEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			return err
+		}
+		if ev.Type == "ERROR" {
+			var status struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			}
+			json.Unmarshal(ev.Object, &status)
+			return &kubeStatusError{Code: status.Code, Message: status.Message}
+		}
+		if err := fn(ev); err != nil {
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"unicode/utf8"
+)
+
+const (
+	// lineEndingLF and lineEndingCRLF are the values of --line-endings rules
+	lineEndingLF   = "lf"
+	lineEndingCRLF = "crlf"
+)
+
+// lineEndingRules are the parsed --line-endings rules
+var lineEndingRules []patternRule
+
+// isText reports whether content looks like text: valid UTF-8 without NUL bytes
+func isText(content []byte) bool {
+	return utf8.Valid(content) && bytes.IndexByte(content, 0) < 0
+}
+
+// convertLineEndings will return value with the line endings of the --line-endings rule matching etcdKey.
+// Values matching no rule and binary values are returned as is.
+func convertLineEndings(etcdKey string, value []byte) []byte {
+	ending, ok := matchRule(lineEndingRules, etcdKey)
+	if !ok || !isText(value) {
+		return value
+	}
+	lf := bytes.ReplaceAll(value, []byte("\r\n"), []byte("\n"))
+	if ending == lineEndingCRLF {
+		return bytes.ReplaceAll(lf, []byte("\n"), []byte("\r\n"))
+	}
+	return lf
+}
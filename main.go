@@ -4,15 +4,21 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	arg "github.com/alexflint/go-arg"
+	"github.com/doody/etcd_file_syncer/backend"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
-	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
 const (
@@ -21,100 +27,702 @@ const (
 )
 
 var (
-	etcdClient    *clientv3.Client
 	fileChangeMap map[string]time.Time
+	// fileChangeMu guards fileChangeMap, which is shared by the watcher, the folder walker and the drift checker
+	fileChangeMu sync.Mutex
 )
 
 // HTTP POST Model - /putFile
 type FileModel struct {
-	ETCDKey  string `json:"etcdKey"`
-	FilePath string `json:"filePath"`
+	ETCDKey  string `json:"etcdKey" binding:"required"`
+	FilePath string `json:"filePath" binding:"required"`
 }
 
 // CMD ARGS
 var CMDArgs struct {
-	ConfigFolder  string   `arg:"-f,--folder,required"`
-	ConfigKey     string   `arg:"-k,--key,required"`
-	ServerPort    int      `arg:"-p,--port" default:"3000"`
-	ETCDEndpoints []string `arg:"--etcd,required"`
+	ConfigFolder    string        `arg:"-f,--folder" help:"local folder the keys are synced to"`
+	ConfigKey       string        `arg:"-k,--key" help:"prefix of the synced ETCD keys"`
+	ServerPort      int           `arg:"-p,--port" default:"3000" help:"port of the HTTP API"`
+	ShutdownTimeout time.Duration `arg:"--shutdown-timeout" default:"30s" help:"how long in-flight API requests may take to complete on shutdown"`
+	Listen          string        `arg:"--listen" help:"API address, host:port or unix:///path/to.sock, overrides --port"`
+	ListenMode      string        `arg:"--listen-mode" default:"0660" help:"octal permissions of the unix socket"`
+	ETCDEndpoints   []string      `arg:"--etcd" help:"ETCD endpoint, host:port, [ipv6]:port, http(s)://host:port or unix:///path/to.sock"`
+	Backend         string        `arg:"--backend" default:"etcd" help:"store the files are synced with, etcd, consul, zookeeper, redis or a registered third party store"`
+	BackendOptions  []string      `arg:"--backend-option" help:"name=value settings passed to a third party store"`
+	AuditLog        string        `arg:"--audit-log" help:"append a JSON line per automatic repair to this file"`
+	Faults          []string      `arg:"--fault" help:"inject faults, etcd-error=probability, watch-delay=duration or torn-write=probability, in binaries built with -tags chaos"`
+	VerifyWrites    bool          `arg:"--verify-writes" help:"read back the keys of every upload and compare their hashes with what was written"`
+	DiffMaxSize     int64         `arg:"--diff-max-size" default:"0" help:"log a unified diff of the changes applied to text files up to this many bytes, also sent to the event stream and the audit log, 0 disables"`
+
+	ScanInterval          time.Duration `arg:"--scan-interval" default:"15s" help:"how often the folder is scanned for modified files (by modified time)"`
+	ScanWorkers           int           `arg:"--scan-workers" default:"8" help:"directories every walk of the folder reads in parallel"`
+	LargeFileSize         int64         `arg:"--large-file-size" default:"8388608" help:"files from this many bytes are hashed streaming by the deep reconciliation and the drift check, and only rehashed when their size or modified time changed, 0 disables"`
+	DeepReconcileInterval time.Duration `arg:"--deep-reconcile-interval" default:"0" help:"how often every file is hashed and compared with ETCD, 0 disables"`
+
+	DriftCheckInterval time.Duration `arg:"--drift-check-interval" default:"0" help:"compare the local folder against ETCD at this interval, 0 disables"`
+	SelfHeal           bool          `arg:"--self-heal" help:"repair drifted files automatically"`
+	SelfHealDirection  string        `arg:"--self-heal-direction" default:"download" help:"download (ETCD wins) or upload (local folder wins)"`
+
+	ETCDAutoSyncInterval time.Duration `arg:"--etcd-auto-sync-interval" default:"0" help:"refresh the endpoint list from the cluster member list at this interval, 0 disables"`
+	ETCDEndpointOrder    string        `arg:"--etcd-endpoint-order" default:"given" help:"given or shuffle"`
+	ETCDKeepAliveTime    time.Duration `arg:"--etcd-keepalive-time" default:"0" help:"gRPC keepalive ping interval, 0 disables"`
+	ETCDKeepAliveTimeout time.Duration `arg:"--etcd-keepalive-timeout" default:"0" help:"gRPC keepalive ping timeout"`
+	ETCDRejectOldCluster bool          `arg:"--etcd-reject-old-cluster" help:"refuse to connect to an outdated cluster"`
+	ETCDProxy            string        `arg:"--etcd-proxy" help:"reach ETCD through this http://, https:// or socks5:// proxy"`
+	ETCDMaxRequestBytes  int           `arg:"--etcd-max-request-bytes" default:"1572864" help:"the server's --max-request-bytes, larger files are refused before being sent"`
+	ETCDMaxCallSendSize  int           `arg:"--etcd-max-call-send-size" default:"0" help:"client side limit of a request in bytes, 0 keeps the client default of 2MiB"`
+	ETCDRetries          int           `arg:"--etcd-retries" default:"0" help:"retry transient ETCD request failures this many times"`
+	ETCDRetryBackoff     time.Duration `arg:"--etcd-retry-backoff" default:"500ms" help:"wait between ETCD request retries"`
+
+	ConsulAddr       string `arg:"--consul-addr" default:"http://127.0.0.1:8500" help:"Consul agent of --backend=consul"`
+	ConsulToken      string `arg:"--consul-token,env:CONSUL_HTTP_TOKEN" help:"Consul ACL token"`
+	ConsulDatacenter string `arg:"--consul-datacenter" help:"Consul datacenter, the agent's own by default"`
+
+	ZooKeeperServers        []string      `arg:"--zk" help:"ZooKeeper servers of --backend=zookeeper, host:port"`
+	ZooKeeperRoot           string        `arg:"--zk-root" help:"node keys are stored under [default: /]"`
+	ZooKeeperSessionTimeout time.Duration `arg:"--zk-session-timeout" default:"10s" help:"ZooKeeper session timeout"`
+	ZooKeeperAuth           string        `arg:"--zk-auth" help:"user:password digest credentials, nodes created are only accessible to them"`
+
+	RedisAddr         string `arg:"--redis-addr" default:"127.0.0.1:6379" help:"Redis server of --backend=redis, host:port or a unix socket path"`
+	RedisUsername     string `arg:"--redis-username" help:"Redis ACL user, the default user when unset"`
+	RedisPassword     string `arg:"--redis-password,env:REDIS_PASSWORD" help:"Redis password"`
+	RedisDB           int    `arg:"--redis-db" default:"0" help:"Redis database number"`
+	RedisNamespace    string `arg:"--redis-namespace" default:"etcd_file_syncer" help:"prefix of the keys holding the revisions and the change stream"`
+	RedisStreamLength int    `arg:"--redis-stream-length" default:"10000" help:"changes kept in the change stream, a watch resuming from an older revision resyncs"`
+
+	CompactRetention time.Duration `arg:"--compact-retention" default:"0" help:"periodically compact ETCD history older than this, 0 disables (compaction is cluster wide)"`
+	CompactInterval  time.Duration `arg:"--compact-interval" default:"1h" help:"how often --compact-retention is enforced"`
+	History          int           `arg:"--history" default:"0" help:"keep the last N values of every key under <key>.history/ for POST /v1/rollback, whatever the ETCD compaction, 0 disables"`
+
+	Exec       string `arg:"--exec" help:"command run with sh -c once the folder is hydrated, reloaded when downloaded files change; the syncer exits with it"`
+	ExecReload string `arg:"--exec-reload" default:"restart" help:"restart the --exec process on change, or send it this signal, ex: HUP"`
+
+	Sidecar            bool   `arg:"--sidecar" help:"derive --key from the pod the syncer runs in with --sidecar-key-template"`
+	SidecarKeyTemplate string `arg:"--sidecar-key-template" default:"{{.Namespace}}/{{.Labels.app}}/" help:"Go template of the key, fields: .Namespace, .Name, .Labels, .Annotations"`
+	PodInfoDir         string `arg:"--pod-info-dir" default:"/etc/podinfo" help:"downward API volume holding the pod's namespace, name, labels and annotations files"`
+
+	ReloadProcess string        `arg:"--reload-process" help:"signal the processes with this name once downloaded files change, ex: nginx"`
+	ReloadSignal  string        `arg:"--reload-signal" default:"HUP" help:"signal sent to --reload-process"`
+	ReloadDelay   time.Duration `arg:"--reload-delay" default:"2s" help:"how long downloads must settle before --reload-process is signaled"`
+
+	CRDMode       bool          `arg:"--crd-mode" help:"run a syncer per FileSync resource selecting this node instead of a single --key/--folder mapping"`
+	CRDNamespace  string        `arg:"--crd-namespace" help:"namespace of the FileSync resources, * for every namespace [default: the pod's namespace]"`
+	CRDResync     time.Duration `arg:"--crd-resync" default:"5m" help:"how often FileSync resources and the node labels are listed again"`
+	CRDSocketDir  string        `arg:"--crd-socket-dir" default:"/run/etcd_file_syncer" help:"directory of the API sockets of mappings without spec.listen"`
+	CRDFolderRoot string        `arg:"--crd-folder-root" help:"directory the spec.folder of every FileSync must be under, required with --crd-mode"`
+	KubeAPI       string        `arg:"--kube-api" help:"Kubernetes API URL, ex: http://127.0.0.1:8001 for kubectl proxy [default: the API server of the pod's cluster]"`
+	NodeName      string        `arg:"--node-name,env:NODE_NAME" help:"node matched against the nodeSelector of FileSync resources"`
+
+	PromotionRequireApproval bool          `arg:"--promotion-require-approval" help:"promotions are only applied by POST /v1/promotions/approve, from another user than the requester with --basic-auth-file"`
+	PromotionTTL             time.Duration `arg:"--promotion-ttl" default:"24h" help:"how long a planned promotion can be approved"`
+
+	MaxFiles      int   `arg:"--max-files" default:"0" help:"pause uploads that would leave more keys than this under --key, 0 disables"`
+	MaxTotalBytes int64 `arg:"--max-total-bytes" default:"0" help:"pause uploads that would leave more bytes than this under --key, 0 disables"`
+
+	TxnMaxOps   int `arg:"--txn-max-ops" default:"128" help:"maximum operations per upload transaction, keep at or below the server's --max-txn-ops"`
+	TxnMaxBytes int `arg:"--txn-max-bytes" default:"1048576" help:"maximum payload per upload transaction, keep below the server's --max-request-bytes"`
+
+	StartupRetries    int           `arg:"--startup-retries" default:"0" help:"retry the initial ETCD connection this many times before giving up"`
+	WatchStallTimeout time.Duration `arg:"--watch-stall-timeout" default:"15m" help:"re-establish the ETCD watch when no event or progress notification arrives within this duration"`
+	ExitOnFatal       bool          `arg:"--exit-on-fatal" help:"exit when ETCD rejects our credentials or the folder stops accepting writes"`
+
+	PreserveXattrs bool     `arg:"--preserve-xattrs" help:"store extended attributes in metadata keys and restore them on download"`
+	XattrPrefixes  []string `arg:"--xattr-prefix" help:"extended attribute name prefixes to preserve [default: user., security.selinux]"`
+
+	PreserveOwnership  bool     `arg:"--preserve-ownership" help:"store owner and group in metadata keys and restore them on download when running as root"`
+	PreserveACLs       bool     `arg:"--preserve-acls" help:"store POSIX ACLs in metadata keys and restore them on download"`
+	OwnershipOverrides []string `arg:"--ownership-override" help:"pattern=user:group owner for downloaded files matching pattern, wins over stored metadata"`
+	Owner              string   `arg:"--owner" help:"user owning downloaded files, name or id, when running as root"`
+	Group              string   `arg:"--group" help:"group owning downloaded files, name or id, when running as root"`
+
+	SwaggerUI    bool   `arg:"--swagger-ui" help:"serve Swagger UI for /openapi.json at /docs, loaded from a CDN"`
+	InstanceName string `arg:"--instance-name" help:"name of this syncer in GET /v1/events [default: hostname]"`
+
+	CORSOrigins []string      `arg:"--cors-origin" help:"origins allowed to call the API from a browser, * or patterns like https://*.example.com"`
+	CORSMethods []string      `arg:"--cors-method" help:"methods allowed to cross-origin requests [default: GET, POST, PATCH]"`
+	CORSHeaders []string      `arg:"--cors-header" help:"request headers allowed to cross-origin requests [default: Authorization, Content-Type, If-Match, X-Request-ID]"`
+	CORSMaxAge  time.Duration `arg:"--cors-max-age" default:"10m" help:"how long browsers may cache preflight answers"`
+
+	RateLimit      float64 `arg:"--rate-limit" help:"mutating API requests per second allowed to each client, 0 for no limit"`
+	RateLimitBurst int     `arg:"--rate-limit-burst" default:"10" help:"mutating API requests a client may send at once above --rate-limit"`
+
+	BasicAuthFile string   `arg:"--basic-auth-file" help:"htpasswd file of user:bcrypt-hash lines, every API request must authenticate as one of them"`
+	AllowCIDRs    []string `arg:"--allow-cidr" help:"networks allowed to call the API, ex: 10.0.0.0/8,127.0.0.1"`
+
+	ReportFile     string        `arg:"--report-file" help:"write a JSON report of the synced files, conflicts and recent errors to this path"`
+	ReportInterval time.Duration `arg:"--report-interval" default:"5m" help:"how often --report-file is rewritten"`
+
+	FailureHookCommand   string        `arg:"--failure-hook-command" help:"command run with sh -c when a failure threshold is crossed and when it recovers"`
+	FailureHookURL       string        `arg:"--failure-hook-url" help:"URL a JSON event is posted to when a failure threshold is crossed and when it recovers"`
+	FailureHookUploads   int           `arg:"--failure-hook-upload-failures" help:"consecutive upload failures that fire the failure hooks, 0 disables"`
+	FailureHookDownloads int           `arg:"--failure-hook-download-failures" help:"consecutive download failures that fire the failure hooks, 0 disables"`
+	FailureHookWatchDown time.Duration `arg:"--failure-hook-watch-down" help:"how long the ETCD watch may be down before the failure hooks fire, 0 disables"`
+
+	DigestCommand  string        `arg:"--digest-command" help:"command run with sh -c every --digest-interval with a summary of the changes applied, as JSON on stdin"`
+	DigestURL      string        `arg:"--digest-url" help:"URL a JSON summary of the changes applied is posted to every --digest-interval"`
+	DigestInterval time.Duration `arg:"--digest-interval" default:"5m" help:"how often the change digest is sent, digests without changes are skipped"`
+
+	RunAsUser  string `arg:"--run-as-user" help:"switch to this user once the listener and ETCD connection are set up"`
+	RunAsGroup string `arg:"--run-as-group" help:"switch to this group, defaults to the primary group of --run-as-user"`
+
+	OnlyExtensions []string `arg:"--only-ext" help:"only upload files with these extensions, ex: .conf,.json,.yaml"`
+	OnlyMIMETypes  []string `arg:"--only-mime" help:"only upload files whose sniffed MIME type matches one of these patterns, ex: text/*"`
+
+	Checksum bool `arg:"--checksum" help:"store the SHA-256 of each value in its metadata key and refuse downloads that don't match it"`
+
+	RequireSignature bool     `arg:"--require-signature" help:"only write downloads whose detached OpenPGP signature, stored under <key>.sig, verifies against --signature-keyring"`
+	SignatureKeyring []string `arg:"--signature-keyring" help:"armored or binary OpenPGP public key files trusted for --require-signature"`
+	SigningKey       string   `arg:"--signing-key" help:"armored or binary OpenPGP private key file, uploads are signed with it into <key>.sig"`
+	SigningKeyPass   string   `arg:"--signing-key-passphrase-file" help:"file holding the passphrase of an encrypted --signing-key"`
+
+	ConfdDir        string `arg:"--confd-dir" help:"confd configuration directory, its conf.d/*.toml template resources are rendered from templates/ with the keys under --key"`
+	RenderTemplates bool   `arg:"--render-templates" help:"render keys ending in .tmpl with Go templates into the file without the suffix"`
+
+	Banner         bool     `arg:"--banner" help:"prepend a do not edit comment naming the source key and revision to downloaded text files, stripped again on upload"`
+	BannerComments []string `arg:"--banner-comment" help:"pattern=syntax comment syntax of the banner of files matching pattern, ex: '*.j2=#' or '*.xml=<!-- -->', empty for no banner"`
+
+	LineEndings      []string `arg:"--line-endings" help:"pattern=lf|crlf line endings of downloaded text files matching pattern"`
+	NormalizeUploads bool     `arg:"--normalize-uploads" help:"convert the line endings of uploaded files matching a --line-endings pattern too"`
+
+	Archives       []string `arg:"--archive" help:"patterns of .tar, .tar.gz, .tgz or .zip keys extracted into the directory named after the key without its extension"`
+	ArchiveMaxSize int64    `arg:"--archive-max-size" default:"1073741824" help:"maximum bytes extracted from one archive"`
+	ApplyOrder     []string `arg:"--apply-order" help:"patterns of keys applied first when several change at once, in order or as pattern=priority, ex: 'upstreams/*' 'vhosts/*'"`
+	ChangeHooks    []string `arg:"--on-change" help:"pattern=command run with sh -c after a file matching pattern is written or deleted from ETCD"`
+	ApplyDelay     []string `arg:"--apply-delay" help:"hold changes of ETCD for a duration before applying them, or cohort=duration for the nodes of a --cohort, ex: canary=0s 10m"`
+	Cohort         string   `arg:"--cohort,env:ETCD_FILE_SYNCER_COHORT" help:"cohort of this node, selects its --apply-delay"`
+	SyncWindows    []string `arg:"--sync-window" help:"cron expression and duration of a window in which changes of ETCD are applied, they are staged outside of it, ex: '0 2 * * 6 2h'"`
+	Hooks          []string `arg:"--hook" help:"name=command run with sh -c once per batch of changes to its --hook-keys"`
+	HookKeys       []string `arg:"--hook-keys" help:"name=pattern keys whose changes trigger the hook name"`
+	HookAfter      []string `arg:"--hook-after" help:"name=other the hook name runs after other, whenever other runs, and is skipped when it fails"`
+
+	TTLs []string `arg:"--ttl" help:"pattern=duration keys matching pattern expire duration after they are written, their files are removed everywhere"`
+
+	Manifest string   `arg:"--manifest" help:"key listing the keys and directories, relative to --key, this node syncs instead of the whole of --key"`
+	Pack     []string `arg:"--pack" help:"directories of --folder uploaded as a single <dir>.tar.gz key, regenerated when one of their files changes"`
+
+	Encodings []string `arg:"--encoding" help:"pattern=[source:]target encoding of files matching pattern, ex: '*.ini=latin1', values are UTF-8 unless source is given"`
+
+	Fragments       []string `arg:"--fragment" help:"pattern=target keys matching pattern are deep-merged into the JSON or YAML file target instead of being written as files"`
+	MergeStrategies []string `arg:"--merge-strategy" help:"pattern=override|append how lists of fragments matching pattern are merged [default: override]"`
+
+	// Subcommands, the syncer runs as a daemon when none is given
+	Export *ExportCmd `arg:"subcommand:export" help:"dump every key under --key to a JSON or YAML document"`
+	Import *ImportCmd `arg:"subcommand:import" help:"load a document written by export into ETCD"`
+	Status *StatusCmd `arg:"subcommand:status" help:"print the status of the syncer running on this host"`
+	Diff   *DiffCmd   `arg:"subcommand:diff" help:"print the files of --folder that differ from ETCD"`
+	Watch  *WatchCmd  `arg:"subcommand:watch" help:"print changes to the files under --key as they happen"`
+	Mirror *MirrorCmd `arg:"subcommand:mirror" help:"copy the keys under --key to another prefix or ETCD cluster and keep them in sync"`
+	Bench  *BenchCmd  `arg:"subcommand:bench" help:"measure upload and download throughput with a generated tree under --key"`
+
+	Completion *CompletionCmd `arg:"subcommand:completion" help:"print the bash, zsh or fish completion script"`
+	GenDocs    *GenDocsCmd    `arg:"subcommand:gen-docs" help:"write the man pages of the program and its commands"`
+
+	MigrateV2 *MigrateV2Cmd `arg:"subcommand:migrate-v2" help:"copy an etcd v2 keyspace or v2 JSON dump under --key"`
+}
+
+// flagGiven reports whether one of names is on the command line args, with or without an inline value
+func flagGiven(args []string, names ...string) bool {
+	for _, arg := range args {
+		if arg == "--" {
+			return false
+		}
+		for _, name := range names {
+			if arg == name || strings.HasPrefix(arg, name+"=") {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 func main() {
 	// Preparing ARGS
-	arg.MustParse(&CMDArgs)
+	p, err := arg.NewParser(arg.Config{}, &CMDArgs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitConfigError)
+	}
+	switch err := p.Parse(os.Args[1:]); {
+	case err == arg.ErrHelp:
+		p.WriteHelp(os.Stdout)
+		os.Exit(0)
+	case err != nil:
+		failConfig(p, err.Error())
+	}
+	// an empty --key syncs the whole keyspace, only a missing one is an error
+	keyGiven := flagGiven(os.Args[1:], "-k", "--key")
+	if CMDArgs.SelfHeal && CMDArgs.DriftCheckInterval <= 0 {
+		failConfig(p, "--self-heal requires --drift-check-interval")
+	}
+	if CMDArgs.SelfHealDirection != healDownload && CMDArgs.SelfHealDirection != healUpload {
+		failConfig(p, fmt.Sprintf("--self-heal-direction must be %q or %q", healDownload, healUpload))
+	}
+	if CMDArgs.Owner != "" {
+		if defaultUID, err = lookupUID(CMDArgs.Owner); err != nil {
+			failConfig(p, fmt.Sprintf("unknown --owner %q: %v", CMDArgs.Owner, err))
+		}
+	}
+	if CMDArgs.Group != "" {
+		if defaultGID, err = lookupGID(CMDArgs.Group); err != nil {
+			failConfig(p, fmt.Sprintf("unknown --group %q: %v", CMDArgs.Group, err))
+		}
+	}
+	if ownershipOverrides, err = parsePatternRules(CMDArgs.OwnershipOverrides); err != nil {
+		failConfig(p, fmt.Sprintf("invalid --ownership-override: %v", err))
+	}
+	for _, rule := range ownershipOverrides {
+		if _, _, err := parseOwnerSpec(rule.Value); err != nil {
+			failConfig(p, fmt.Sprintf("invalid --ownership-override: %v", err))
+		}
+	}
+	onlyExtensions = parseExtensions(CMDArgs.OnlyExtensions)
+	if onlyMIMETypes, err = parseMIMETypes(CMDArgs.OnlyMIMETypes); err != nil {
+		failConfig(p, fmt.Sprintf("invalid --only-mime: %v", err))
+	}
+	if CMDArgs.RequireSignature {
+		if len(CMDArgs.SignatureKeyring) == 0 {
+			failConfig(p, "--require-signature requires --signature-keyring")
+		}
+		if signatureKeyring, err = loadKeyring(CMDArgs.SignatureKeyring); err != nil {
+			failConfig(p, fmt.Sprintf("invalid --signature-keyring: %v", err))
+		}
+	}
+	if CMDArgs.SigningKey != "" {
+		if signingEntity, err = loadSigningKey(CMDArgs.SigningKey, CMDArgs.SigningKeyPass); err != nil {
+			failConfig(p, fmt.Sprintf("invalid --signing-key: %v", err))
+		}
+	}
+	if bannerRules, err = parsePatternRules(CMDArgs.BannerComments); err != nil {
+		failConfig(p, fmt.Sprintf("invalid --banner-comment: %v", err))
+	}
+	if lineEndingRules, err = parsePatternRules(CMDArgs.LineEndings); err != nil {
+		failConfig(p, fmt.Sprintf("invalid --line-endings: %v", err))
+	}
+	for _, rule := range lineEndingRules {
+		if rule.Value != lineEndingLF && rule.Value != lineEndingCRLF {
+			failConfig(p, fmt.Sprintf("--line-endings must be %q or %q", lineEndingLF, lineEndingCRLF))
+		}
+	}
+	for i, dir := range CMDArgs.Pack {
+		dir = strings.Trim(filepath.ToSlash(filepath.Clean(dir)), "/")
+		if dir == "." || dir == ".." || strings.HasPrefix(dir, "../") || !strings.HasPrefix(dir+packSuffix, CMDArgs.ConfigKey) {
+			failConfig(p, fmt.Sprintf("--pack %q must be a directory of --folder under --key", CMDArgs.Pack[i]))
+		}
+		CMDArgs.Pack[i] = dir
+	}
+	if applyOrderRules, err = parseApplyOrder(CMDArgs.ApplyOrder); err != nil {
+		failConfig(p, fmt.Sprintf("invalid --apply-order: %v", err))
+	}
+	if changeHookRules, err = parseChangeHooks(CMDArgs.ChangeHooks); err != nil {
+		failConfig(p, fmt.Sprintf("invalid --on-change: %v", err))
+	}
+	if applyDelay, err = parseApplyDelay(CMDArgs.ApplyDelay, CMDArgs.Cohort); err != nil {
+		failConfig(p, fmt.Sprintf("invalid --apply-delay: %v", err))
+	}
+	if ttlRules, err = parseTTLRules(CMDArgs.TTLs); err != nil {
+		failConfig(p, fmt.Sprintf("invalid --ttl: %v", err))
+	}
+	if syncWindows, err = parseSyncWindows(CMDArgs.SyncWindows); err != nil {
+		failConfig(p, fmt.Sprintf("invalid --sync-window: %v", err))
+	}
+	if len(syncWindows) > 0 && nextSyncWindow(time.Now()).IsZero() {
+		failConfig(p, "--sync-window never opens")
+	}
+	if namedHooks, err = parseNamedHooks(CMDArgs.Hooks, CMDArgs.HookKeys, CMDArgs.HookAfter); err != nil {
+		failConfig(p, fmt.Sprintf("invalid --hook: %v", err))
+	}
+	if encodingRules, err = parseEncodingRules(CMDArgs.Encodings); err != nil {
+		failConfig(p, fmt.Sprintf("invalid --encoding: %v", err))
+	}
+	if fragmentRules, err = parsePatternRules(CMDArgs.Fragments); err != nil {
+		failConfig(p, fmt.Sprintf("invalid --fragment: %v", err))
+	}
+	if mergeStrategies, err = parsePatternRules(CMDArgs.MergeStrategies); err != nil {
+		failConfig(p, fmt.Sprintf("invalid --merge-strategy: %v", err))
+	}
+	for _, rule := range mergeStrategies {
+		if rule.Value != mergeOverride && rule.Value != mergeAppend {
+			failConfig(p, fmt.Sprintf("--merge-strategy must be %q or %q", mergeOverride, mergeAppend))
+		}
+	}
+	if corsConfig, err = newCORSPolicy(CMDArgs.CORSOrigins, CMDArgs.CORSMethods, CMDArgs.CORSHeaders, CMDArgs.CORSMaxAge); err != nil {
+		failConfig(p, fmt.Sprintf("invalid --cors-origin: %v", err))
+	}
+	if CMDArgs.RateLimit < 0 || CMDArgs.RateLimitBurst < 1 {
+		failConfig(p, "--rate-limit must be positive and --rate-limit-burst at least 1")
+	}
+	writeLimiter = newRateLimiter(CMDArgs.RateLimit, CMDArgs.RateLimitBurst)
+	initSettings()
+	if CMDArgs.BasicAuthFile != "" {
+		if apiUsers, err = loadUsers(CMDArgs.BasicAuthFile); err != nil {
+			failConfig(p, fmt.Sprintf("invalid --basic-auth-file: %v", err))
+		}
+	}
+	if allowedNets, err = parseCIDRs(CMDArgs.AllowCIDRs); err != nil {
+		failConfig(p, fmt.Sprintf("invalid --allow-cidr: %v", err))
+	}
+	if CMDArgs.ReportFile != "" {
+		if CMDArgs.ReportInterval <= 0 {
+			failConfig(p, "--report-interval must be positive")
+		}
+		log.AddHook(recentErrors)
+	}
+	if instanceName = CMDArgs.InstanceName; instanceName == "" {
+		instanceName, _ = os.Hostname()
+	}
+	if CMDArgs.AuditLog != "" {
+		if err := openAuditLog(CMDArgs.AuditLog); err != nil {
+			failConfig(p, fmt.Sprintf("cannot open audit log: %v", err))
+		}
+	}
+	if _, ok := backend.Lookup(CMDArgs.Backend); !ok {
+		failConfig(p, "--backend must be one of "+strings.Join(backend.Names(), ", "))
+	}
+	switch CMDArgs.Backend {
+	case backendRedis:
+		if CMDArgs.RedisDB < 0 || CMDArgs.RedisStreamLength <= 0 || CMDArgs.RedisNamespace == "" {
+			failConfig(p, "--redis-db cannot be negative, --redis-stream-length must be positive and --redis-namespace set")
+		}
+	case backendZooKeeper:
+		if CMDArgs.ZooKeeperRoot != "" && !strings.HasPrefix(CMDArgs.ZooKeeperRoot, "/") {
+			failConfig(p, "--zk-root must be an absolute node path")
+		}
+	}
+	if CMDArgs.Backend != backendETCD && CMDArgs.Backend != backendRedis && CMDArgs.CompactRetention > 0 {
+		failConfig(p, "--compact-retention requires --backend=etcd or redis")
+	}
+	if CMDArgs.ScanWorkers < 1 {
+		failConfig(p, "--scan-workers must be at least 1")
+	}
+	if CMDArgs.LargeFileSize < 0 {
+		failConfig(p, "--large-file-size cannot be negative")
+	}
+	if CMDArgs.ETCDEndpointOrder != endpointOrderGiven && CMDArgs.ETCDEndpointOrder != endpointOrderShuffle {
+		failConfig(p, fmt.Sprintf("--etcd-endpoint-order must be %q or %q", endpointOrderGiven, endpointOrderShuffle))
+	}
+	for i, endpoint := range CMDArgs.ETCDEndpoints {
+		normalized, err := normalizeEndpoint(endpoint)
+		if err != nil {
+			failConfig(p, fmt.Sprintf("invalid --etcd %q: %v", endpoint, err))
+		}
+		CMDArgs.ETCDEndpoints[i] = normalized
+	}
+	if CMDArgs.ETCDProxy != "" {
+		if _, err := newProxyDialer(CMDArgs.ETCDProxy); err != nil {
+			failConfig(p, fmt.Sprintf("invalid --etcd-proxy: %v", err))
+		}
+	}
+
+	// Root context, canceled on shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if CMDArgs.FailureHookUploads < 0 || CMDArgs.FailureHookDownloads < 0 || CMDArgs.FailureHookWatchDown < 0 {
+		failConfig(p, "--failure-hook-* thresholds cannot be negative")
+	}
+	if !hooksEnabled() && (CMDArgs.FailureHookUploads > 0 || CMDArgs.FailureHookDownloads > 0 || CMDArgs.FailureHookWatchDown > 0) {
+		failConfig(p, "--failure-hook-* thresholds require --failure-hook-command or --failure-hook-url")
+	}
+	if len(CMDArgs.Faults) > 0 && !faultsAvailable {
+		failConfig(p, "--fault requires a binary built with -tags chaos")
+	}
+	if err := parseFaults(CMDArgs.Faults); err != nil {
+		failConfig(p, err.Error())
+	}
+	if digestEnabled() && CMDArgs.DigestInterval <= 0 {
+		failConfig(p, "--digest-interval must be positive")
+	}
+
+	// Queries the API of a running syncer or describes the command line, ETCD settings are not needed
+	switch {
+	case CMDArgs.Completion != nil:
+		os.Exit(runCompletion(CMDArgs.Completion))
+	case CMDArgs.GenDocs != nil:
+		os.Exit(runGenDocs(CMDArgs.GenDocs))
+	case CMDArgs.Status != nil:
+		os.Exit(runStatus(ctx, CMDArgs.Status))
+	case CMDArgs.Diff != nil && CMDArgs.Diff.Addr != "":
+		os.Exit(runDiff(ctx, CMDArgs.Diff))
+	case CMDArgs.Watch != nil && CMDArgs.Watch.Addr != "":
+		os.Exit(runWatch(ctx, CMDArgs.Watch))
+	}
+	if CMDArgs.Sidecar && !keyGiven {
+		if CMDArgs.ConfigKey, err = sidecarKey(); err != nil {
+			failConfig(p, fmt.Sprintf("cannot derive --key from the pod: %v", err))
+		}
+		log.WithFields(log.Fields{
+			"etcdKey": CMDArgs.ConfigKey,
+		}).Info("derived key from the pod")
+	}
+	if CMDArgs.ConfdDir != "" {
+		if confdResources, err = loadConfdResources(CMDArgs.ConfdDir); err != nil {
+			failConfig(p, fmt.Sprintf("invalid --confd-dir: %v", err))
+		}
+	}
+	if CMDArgs.Exec != "" && CMDArgs.ExecReload != execRestart {
+		if execReloadSignal, err = parseSignal(CMDArgs.ExecReload); err != nil {
+			failConfig(p, fmt.Sprintf("invalid --exec-reload: %v", err))
+		}
+	}
+	if CMDArgs.ReloadProcess != "" {
+		if reloadSignal, err = parseSignal(CMDArgs.ReloadSignal); err != nil {
+			failConfig(p, fmt.Sprintf("invalid --reload-signal: %v", err))
+		}
+	}
+	if CMDArgs.CRDMode {
+		if p.Subcommand() != nil || keyGiven || CMDArgs.ConfigFolder != "" {
+			failConfig(p, "--crd-mode takes --key and --folder from FileSync resources and runs no subcommand")
+		}
+		if CMDArgs.CRDResync <= 0 {
+			failConfig(p, "--crd-resync must be positive")
+		}
+		if !filepath.IsAbs(CMDArgs.CRDFolderRoot) {
+			failConfig(p, "--crd-mode requires --crd-folder-root, an absolute path")
+		}
+		os.Exit(runCRDMode(ctx))
+	}
+	if !keyGiven && !CMDArgs.Sidecar {
+		failConfig(p, "--key is required")
+	}
+	if CMDArgs.Backend == backendETCD && len(CMDArgs.ETCDEndpoints) == 0 {
+		failConfig(p, "--etcd is required")
+	}
+	if CMDArgs.Backend == backendZooKeeper && len(CMDArgs.ZooKeeperServers) == 0 {
+		failConfig(p, "--zk is required")
+	}
+
+	if CMDArgs.Diff != nil && CMDArgs.ConfigFolder == "" {
+		failConfig(p, "diff requires --folder or --addr")
+	}
+
+	// One-shot commands
+	if p.Subcommand() != nil {
+		os.Exit(runSubcommand(ctx))
+	}
+	if CMDArgs.ConfigFolder == "" {
+		failConfig(p, "--folder is required")
+	}
+
+	// Canceled when the --exec process exits on its own
+	ctx, cancelDaemon := context.WithCancel(ctx)
+	defer cancelDaemon()
 
 	// Init map
 	fileChangeMap = make(map[string]time.Time)
 
-	// ETCD Connection
-	cli, err := clientv3.New(clientv3.Config{
-		Endpoints:   CMDArgs.ETCDEndpoints,
-		DialTimeout: dialTimeout,
-	})
+	// Opened before dropping privileges so a low port can be bound
+	listener, err := newListener(CMDArgs.Listen, CMDArgs.ServerPort)
 	if err != nil {
 		log.WithFields(log.Fields{
-			"err": err,
-		}).Error("error connecting to ETCD")
+			"listen": CMDArgs.Listen,
+			"port":   CMDArgs.ServerPort,
+			"err":    err,
+		}).Error("cannot listen")
+		os.Exit(exitConfigError)
+	}
+	unixListener = listener.Addr().Network() == "unix"
+
+	// Store Connection
+	kv := mustConnectStore(ctx)
+	defer kv.Close()
+
+	if CMDArgs.RunAsUser != "" || CMDArgs.RunAsGroup != "" {
+		if err := dropPrivileges(CMDArgs.RunAsUser, CMDArgs.RunAsGroup); err != nil {
+			log.WithFields(log.Fields{
+				"user":  CMDArgs.RunAsUser,
+				"group": CMDArgs.RunAsGroup,
+				"err":   err,
+			}).Error("cannot drop privileges")
+			os.Exit(exitConfigError)
+		}
+	}
+	if (defaultUID != -1 || defaultGID != -1) && os.Geteuid() != 0 {
+		log.WithFields(log.Fields{
+			"owner": CMDArgs.Owner,
+			"group": CMDArgs.Group,
+		}).Warn("not running as root, --owner and --group are ignored")
+	}
+	if err := checkFolderWritable(CMDArgs.ConfigFolder); err != nil {
+		log.WithFields(log.Fields{
+			"folder": CMDArgs.ConfigFolder,
+			"err":    err,
+		}).Error("config folder is not writable")
+		os.Exit(exitFolderNotWritable)
+	}
 
+	registerSyncMetrics(CMDArgs.ConfigKey, CMDArgs.ConfigFolder)
+
+	if CMDArgs.Manifest != "" {
+		manifestRev, _ := loadManifest(ctx)
+		go watchManifest(ctx, CMDArgs.ConfigFolder, manifestRev)
 	}
-	etcdClient = cli
-	defer cli.Close()
 
 	// ETCD Testing
-	readKeyAndSaveToFolder(CMDArgs.ConfigKey, CMDArgs.ConfigFolder)
-	go watchKeyAndSaveToFile(CMDArgs.ConfigKey, CMDArgs.ConfigFolder)
+	loadRemoteConfig(ctx)
+	if loadControl(ctx) {
+		log.WithFields(log.Fields{
+			"controlKey": pausedControlKey(),
+		}).Warn("paused, the folder is synced once the control key is cleared")
+	} else {
+		readKeyAndSaveToFolder(ctx, CMDArgs.ConfigKey, CMDArgs.ConfigFolder)
+		markHydrated()
+	}
+	go watchKeyAndSaveToFile(ctx, CMDArgs.ConfigKey, CMDArgs.ConfigFolder)
+	if holdingChanges() {
+		go runRollout(ctx, CMDArgs.ConfigKey, CMDArgs.ConfigFolder)
+	}
+	if CMDArgs.ReloadProcess != "" {
+		go runReloader(ctx)
+	}
+	execExit := make(chan int, 1)
+	if CMDArgs.Exec != "" {
+		go func() { execExit <- runExec(ctx, cancelDaemon) }()
+	}
 
 	// Periodic folder check
-	go func() {
-		for range time.Tick(15 * time.Second) {
-			fileToUpload, err := walkConfigFolder(CMDArgs.ConfigFolder)
+	go runEvery(ctx, scanInterval, func(ctx context.Context) {
+		fileToUpload, err := walkConfigFolder(CMDArgs.ConfigFolder)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("config folder walker failed")
+		}
+		uploads := make([]fileUpload, 0, len(fileToUpload))
+		for _, filePath := range fileToUpload {
+			etcdKey, err := filepath.Rel(CMDArgs.ConfigFolder, filePath)
 			if err != nil {
 				log.WithFields(log.Fields{
-					"err": err,
-				}).Error("config folder walker failed")
+					"filePath": filePath,
+					"err":      err,
+				}).Error("cannot extract etcdkey from filepath")
+				continue
 			}
-			for _, filePath := range fileToUpload {
-				etcdKey, err := filepath.Rel(CMDArgs.ConfigFolder, filePath)
-				if err != nil {
-					log.WithFields(log.Fields{
-						"filePath": filePath,
-						"err":      err,
-					}).Error("cannot extract etcdkey from filepath")
-				}
-				putFileToETCD(etcdKey, filePath)
+			uploads = append(uploads, fileUpload{ETCDKey: filepath.ToSlash(etcdKey), FilePath: filePath})
+		}
+		putFilesToETCD(ctx, guardUploads(ctx, CMDArgs.ConfigKey, uploads))
+		packDirectories(ctx, CMDArgs.ConfigFolder)
+	})
+
+	// Expired keys
+	go runPeriodically(ctx, time.Second, func(ctx context.Context) {
+		sweepExpiredKeys(ctx, CMDArgs.ConfigFolder)
+	})
+
+	// Periodic deep reconciliation
+	if CMDArgs.DeepReconcileInterval > 0 {
+		go runPeriodically(ctx, CMDArgs.DeepReconcileInterval, func(ctx context.Context) {
+			deepReconcile(ctx, CMDArgs.ConfigKey, CMDArgs.ConfigFolder)
+		})
+	}
+
+	// Revision sampling and compaction
+	go sampleRevisions(ctx, maxDuration(CMDArgs.CompactRetention, compactSampleRetention))
+	if CMDArgs.CompactRetention > 0 {
+		go runPeriodically(ctx, CMDArgs.CompactInterval, func(ctx context.Context) {
+			compactToRetention(ctx, CMDArgs.CompactRetention)
+		})
+	}
+
+	// Periodic drift check
+	if CMDArgs.DriftCheckInterval > 0 {
+		go runPeriodically(ctx, CMDArgs.DriftCheckInterval, func(ctx context.Context) {
+			checkDrift(ctx, CMDArgs.ConfigKey, CMDArgs.ConfigFolder)
+		})
+	}
+
+	// Failure hooks
+	if hooksEnabled() && CMDArgs.FailureHookWatchDown > 0 {
+		go monitorWatch(ctx)
+	}
+
+	// Change digests
+	if digestEnabled() {
+		go runDigests(ctx)
+	}
+
+	// Periodic report
+	if CMDArgs.ReportFile != "" {
+		report := func(ctx context.Context) {
+			if err := writeReport(CMDArgs.ReportFile, CMDArgs.ConfigKey, CMDArgs.ConfigFolder); err != nil {
+				log.WithFields(log.Fields{
+					"reportFile": CMDArgs.ReportFile,
+					"err":        err,
+				}).Error("cannot write report")
 			}
 		}
-	}()
+		report(ctx)
+		go runPeriodically(ctx, CMDArgs.ReportInterval, report)
+	}
 
 	// HTTP server
 	r := gin.Default()
-	// Manual update file
-	r.POST("/putFile", func(c *gin.Context) {
-		var json FileModel
-		if err := c.ShouldBindJSON(&json); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		}
-		if err := putFileToETCD(json.ETCDKey, json.FilePath); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		}
-		c.JSON(http.StatusOK, gin.H{"status": "ok"})
-	})
-	// Manual download files
-	r.POST("/downloadFile", func(c *gin.Context) {
-		var json FileModel
-		if err := c.ShouldBindJSON(&json); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		}
-		if err := readKeyAndSaveToFolder(json.ETCDKey, json.FilePath); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		}
-		c.JSON(http.StatusOK, gin.H{"status": "ok"})
-	})
-	r.Run(fmt.Sprintf(":%d", CMDArgs.ServerPort)) // listen and serve on 0.0.0.0:3000
+	r.Use(requestID())
+	if allowedNets != nil {
+		r.Use(allowCIDRs(allowedNets))
+	}
+	// preflight requests carry no credentials
+	if corsConfig != nil {
+		r.Use(cors(corsConfig))
+	}
+	if apiUsers != nil {
+		r.Use(basicAuth(apiUsers))
+	}
+	r.Use(refuseDuringShutdown())
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	r.GET("/openapi.json", openAPIHandler)
+	if CMDArgs.SwaggerUI {
+		r.GET("/docs", swaggerUIHandler)
+	}
+	// Versioned endpoints, see apiRoutes
+	registerRoutes(r.Group(apiPrefix))
+	log.WithFields(log.Fields{
+		"addr": listener.Addr().String(),
+	}).Info("API listening")
+	if err := serveAPI(ctx, listener, r, CMDArgs.ShutdownTimeout); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("API server stopped")
+	}
+	if digestEnabled() {
+		// the changes since the last digest
+		sendDigest(context.Background())
+	}
+	if CMDArgs.Exec != "" {
+		os.Exit(<-execExit)
+	}
 }
 
 // putFileToETCD will read filePath into string and write into ETCD using etcdKey
-func putFileToETCD(etcdKey, filePath string) (err error) {
+func putFileToETCD(ctx context.Context, etcdKey, filePath string) (err error) {
+	ops, _, hash, err := fileUploadOps(etcdKey, filePath)
+	if err != nil {
+		return err
+	}
+
+	// Write to ETCD, metadata in the same transaction
+	var revision int64
+	err = withETCDRetry(ctx, func(ctx context.Context) (err error) {
+		_, revision, err = kvStore.Txn(ctx, nil, ops)
+		return err
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"etcdKey":  etcdKey,
+			"filePath": filePath,
+			"err":      err,
+		}).Error("error putting data to ETCD")
+		exitOnFatal(err)
+		failures.recordFailure(conditionUploadFailures, err)
+		return err
+	}
+	recordUpload(etcdKey, filePath, hash, len(ops[0].Value), revision)
+	verifyUpload(ctx, etcdKey, filePath, ops, revision)
+	return nil
+}
+
+// fileUploadOps will read filePath and return the ETCD operations storing it under etcdKey, along
+// with the number of bytes they carry and the hash of the content
+func fileUploadOps(etcdKey, filePath string) (ops []storeOp, size int, hash string, err error) {
 	// Reading file
 	fileContent, err := os.ReadFile(filePath)
 	if err != nil {
@@ -122,84 +730,285 @@ func putFileToETCD(etcdKey, filePath string) (err error) {
 			"filePath": filePath,
 			"err":      err,
 		}).Error("error loading file")
-		return err
+		return nil, 0, "", err
+	}
+	if fileContent, err = fileValueOf(etcdKey, fileContent); err != nil {
+		log.WithFields(log.Fields{
+			"filePath": filePath,
+			"err":      err,
+		}).Error("cannot convert file")
+		return nil, 0, "", err
 	}
+	if err := checkUploadable(filePath); err != nil {
+		log.WithFields(log.Fields{
+			"filePath": filePath,
+			"err":      err,
+		}).Error("refusing to upload file")
+		return nil, 0, "", err
+	}
+	if err := checkValueSize(etcdKey, len(fileContent)); err != nil {
+		log.WithFields(log.Fields{
+			"filePath": filePath,
+			"err":      err,
+		}).Error("cannot upload file")
+		return nil, 0, "", err
+	}
+	ops = []storeOp{putOp(etcdKey, fileContent)}
+	size = len(etcdKey) + len(fileContent)
 
-	// Write to ETCD
-	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
-	_, err = etcdClient.Put(ctx, etcdKey, string(fileContent))
-	cancel()
+	metaOps, err := metaPutOps(etcdKey, filePath, fileContent)
 	if err != nil {
 		log.WithFields(log.Fields{
-			"etcdKey":     etcdKey,
-			"err":         err,
-			"fileContent": string(fileContent),
-		}).Error("error putting data to ETCD")
-		return err
+			"filePath": filePath,
+			"err":      err,
+		}).Error("cannot read file metadata")
+		return nil, 0, "", err
 	}
-	return nil
+	sigOps, err := signatureOps(etcdKey, fileContent)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"filePath": filePath,
+			"err":      err,
+		}).Error("cannot sign file")
+		return nil, 0, "", err
+	}
+	metaOps = append(metaOps, sigOps...)
+	for _, op := range metaOps {
+		size += opSize(op)
+	}
+	return append(ops, metaOps...), size, syncHash(etcdKey, fileContent), nil
 }
 
-// watchKeyAndSaveToFile will keep watching keys in ETCD and save relative file to fileFolder
-func watchKeyAndSaveToFile(etcdKey, fileFolder string) (err error) {
-	rch := etcdClient.Watch(context.Background(), etcdKey, clientv3.WithPrefix())
-	for wresp := range rch {
-		for _, ev := range wresp.Events {
-			log.WithFields(log.Fields{
-				"eventType": ev.Type,
-				"etcdKey":   string(ev.Kv.Key),
-			}).Info("ETCD file changed")
-			filePath := filepath.Join(fileFolder, string(ev.Kv.Key))
-			switch ev.Type {
-			case clientv3.EventTypeDelete:
-				if err := os.Remove(filePath); err != nil {
-					log.WithFields(log.Fields{
-						"filePath": filePath,
-						"err":      err,
-					}).Error("cannot delete file")
-					return err
-				}
-			case clientv3.EventTypePut:
-				fileInfo, err := saveToFolder(filePath, ev.Kv.Value)
-				if err != nil {
-					log.WithFields(log.Fields{
-						"fileName": fileInfo.Name(),
-						"err":      err,
-					}).Error("cannot get file info")
-				}
-				fileChangeMap[filePath] = fileInfo.ModTime()
+// watchKeyAndSaveToFile will keep watching keys in ETCD and save relative file to fileFolder.
+// The watch requests progress notifications, when neither events nor notifications arrive within
+// --watch-stall-timeout the watch is considered dead and re-established from the last seen revision.
+func watchKeyAndSaveToFile(ctx context.Context, etcdKey, fileFolder string) (err error) {
+	var lastRev int64
+	for {
+		reason := watchUntilStalled(ctx, etcdKey, fileFolder, &lastRev)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		watchRestarts.WithLabelValues(reason).Inc()
+		if reason != watchRestartCompacted {
+			failures.watchDown()
+		}
+		log.WithFields(log.Fields{
+			"etcdKey": etcdKey,
+			"lastRev": lastRev,
+			"reason":  reason,
+		}).Warn("re-establishing ETCD watch")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// watchUntilStalled will run a single watch on etcdKey until it closes, fails or stalls, returning
+// the reason. lastRev is updated with every response so the next watch resumes without gaps.
+func watchUntilStalled(ctx context.Context, etcdKey, fileFolder string, lastRev *int64) (reason string) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	rch := kvStore.Watch(ctx, etcdKey, *lastRev)
+	stallTimer := time.NewTimer(CMDArgs.WatchStallTimeout)
+	defer stallTimer.Stop()
+	for {
+		select {
+		case <-stallTimer.C:
+			return watchRestartStalled
+		case wresp, ok := <-rch:
+			if !ok {
+				return watchRestartClosed
 			}
+			if !stallTimer.Stop() {
+				<-stallTimer.C
+			}
+			stallTimer.Reset(CMDArgs.WatchStallTimeout)
+			watchLastResponse.SetToCurrentTime()
+			failures.watchUp()
+			atomic.StoreInt64(&watchLastResponseAt, time.Now().UnixNano())
+			if wresp.CompactRevision != 0 {
+				// events between lastRev and the compaction are lost, read everything again
+				log.WithFields(log.Fields{
+					"etcdKey":         etcdKey,
+					"compactRevision": wresp.CompactRevision,
+				}).Warn("watch revision compacted, reloading keys")
+				*lastRev = 0
+				readKeyAndSaveToFolder(ctx, etcdKey, fileFolder)
+				return watchRestartCompacted
+			}
+			if err := wresp.Err; err != nil {
+				log.WithFields(log.Fields{
+					"etcdKey": etcdKey,
+					"err":     err,
+				}).Error("ETCD watch failed")
+				exitOnFatal(err)
+				return watchRestartError
+			}
+			if wresp.Revision > *lastRev {
+				*lastRev = wresp.Revision
+				atomic.StoreInt64(&watchRevision, *lastRev)
+			}
+			events := applyControlEvents(ctx, wresp.Events, etcdKey, fileFolder)
+			recordHistory(ctx, events)
+			switch {
+			case remotePaused():
+				// applied once the control key is cleared
+				pauseEvents(events)
+				continue
+			case holdingChanges():
+				// applied by runRollout once due
+				holdEvents(events)
+				continue
+			}
+			applyEvents(ctx, events, etcdKey, fileFolder)
+			recordAppliedRevision(wresp.Revision)
 		}
 	}
-	return nil
+}
+
+// applyEvents will apply events in --apply-order, then render templates and run the change hooks
+func applyEvents(ctx context.Context, events []storeEvent, etcdKey, fileFolder string) {
+	trackEventExpiries(events)
+	sortEvents(events)
+	for _, ev := range events {
+		applyWatchEvent(ctx, ev, etcdKey, fileFolder)
+	}
+	if CMDArgs.RenderTemplates && len(events) > 0 {
+		renderTemplates(ctx, etcdKey, fileFolder)
+	}
+	if len(confdResources) > 0 && len(events) > 0 {
+		renderConfdResources(ctx, etcdKey)
+	}
+	runChangeHooks(ctx)
+}
+
+// applyWatchEvent will save or delete the local file of a single watch event
+func applyWatchEvent(ctx context.Context, ev storeEvent, etcdKey, fileFolder string) {
+	log.WithFields(log.Fields{
+		"eventType": ev.Type,
+		"etcdKey":   ev.KV.Key,
+	}).Info("ETCD file changed")
+	if !inManifest(ev.KV.Key) {
+		return
+	}
+	if isFragmentKey(ev.KV.Key) {
+		applyFragmentKey(ctx, ev.KV.Key, etcdKey, fileFolder)
+		return
+	}
+	if isTemplateKey(ev.KV.Key) {
+		// rendered once the whole watch response is applied
+		if ev.Type == storeEventDelete {
+			removeTemplateOutput(ev.KV.Key, fileFolder, ev.KV.Revision)
+		}
+		return
+	}
+	if isArchiveKey(ev.KV.Key) {
+		if ev.Type == storeEventPut {
+			extractArchive(ctx, ev.KV.Key, fileFolder, ev.KV.Value, ev.KV.Revision)
+		} else {
+			removeArchive(ev.KV.Key, fileFolder, ev.KV.Revision)
+		}
+		return
+	}
+	if isSignatureKey(ev.KV.Key) {
+		if ev.Type == storeEventPut {
+			applySignatureKey(ctx, ev.KV.Key, fileFolder)
+		}
+		return
+	}
+	if isReservedKey(ev.KV.Key) {
+		if ev.Type == storeEventPut {
+			applyMetaKey(ctx, ev.KV.Key, ev.KV.Value, ev.KV.Revision, fileFolder)
+		}
+		return
+	}
+	filePath := filepath.Join(fileFolder, ev.KV.Key)
+	switch ev.Type {
+	case storeEventDelete:
+		if synced, ok := lastSynced(filePath); ok && ev.KV.Revision <= synced.Revision {
+			// a lagging watch, the file was already synced with a later revision
+			return
+		}
+		if localChangedSinceSync(ev.KV.Key, filePath) {
+			log.WithFields(log.Fields{
+				"filePath": filePath,
+			}).Warn("key deleted but file changed locally, keeping it")
+			return
+		}
+		before := snapshotForDiff(filePath)
+		if err := os.Remove(filePath); os.IsNotExist(err) {
+			// removed on expiry
+			return
+		} else if err != nil {
+			log.WithFields(log.Fields{
+				"filePath": filePath,
+				"err":      err,
+			}).Error("cannot delete file")
+			return
+		}
+		publishDiffEvent(eventDelete, ev.KV.Key, filePath, 0, ev.KV.Revision, before.diff(ev.KV.Key, filePath, ev.KV.Revision))
+	case storeEventPut:
+		applyRemoteContent(ctx, ev.KV.Key, filePath, ev.KV.Value, ev.KV.Revision)
+	}
 }
 
 // readKeyAndSaveToFolder will read file from ETCD and save into fileFolder
-func readKeyAndSaveToFolder(etcdKey, fileFolder string) (err error) {
-	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
-	resp, err := etcdClient.Get(ctx, etcdKey, clientv3.WithPrefix())
-	cancel()
+func readKeyAndSaveToFolder(ctx context.Context, etcdKey, fileFolder string) (err error) {
+	var (
+		kvs      []storeKV
+		revision int64
+	)
+	kvs, revision, err = listKeys(ctx, etcdKey)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"etceKey":    etcdKey,
 			"fileFolder": fileFolder,
 			"err":        err,
 		}).Error("cannot read key ans save to folder")
+		exitOnFatal(err)
+		failures.recordFailure(conditionDownloadFailures, err)
 		return err
 	}
-	for _, ev := range resp.Kvs {
+	trackExpiries(kvs, nil)
+	if etcdKey == CMDArgs.ConfigKey {
+		seedHistory(ctx, kvs)
+	}
+	sortKVs(kvs)
+	for _, kv := range kvs {
 		log.WithFields(log.Fields{
-			"etcdKey": string(ev.Key),
+			"etcdKey": kv.Key,
 		}).Info("read key")
-		filePath := filepath.Join(fileFolder, string(ev.Key))
-		fileInfo, err := saveToFolder(filePath, ev.Value)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"fileName": fileInfo.Name(),
-				"err":      err,
-			}).Error("cannot get file info")
+		if isControlKey(kv.Key) || isRemoteConfigKey(kv.Key) || isHistoryKey(kv.Key) {
+			continue
+		}
+		if isFragmentKey(kv.Key) || isTemplateKey(kv.Key) {
+			// rendered once all keys are read
+			continue
+		}
+		if isArchiveKey(kv.Key) {
+			extractArchive(ctx, kv.Key, fileFolder, kv.Value, kv.Revision)
+			continue
 		}
-		fileChangeMap[filePath] = fileInfo.ModTime()
+		if isReservedKey(kv.Key) {
+			// keys are sorted, the file is already written
+			applyMetaKey(ctx, kv.Key, kv.Value, kv.Revision, fileFolder)
+			continue
+		}
+		applyRemoteContent(ctx, kv.Key, filepath.Join(fileFolder, kv.Key), kv.Value, kv.Revision)
+	}
+	renderFragmentTargets(ctx, etcdKey, fileFolder)
+	if CMDArgs.RenderTemplates {
+		renderTemplates(ctx, etcdKey, fileFolder)
+	}
+	if len(confdResources) > 0 {
+		renderConfdResources(ctx, etcdKey)
+	}
+	runChangeHooks(ctx)
+	if etcdKey == CMDArgs.ConfigKey && fileFolder == CMDArgs.ConfigFolder {
+		recordAppliedRevision(revision)
 	}
 	return nil
 }
@@ -214,13 +1023,21 @@ func saveToFolder(filePath string, fileContent []byte) (fileInfo os.FileInfo, er
 		}).Error("cannot create folder")
 		return nil, err
 	}
-	if err := os.WriteFile(filePath, fileContent, 0644); err != nil {
+	if err := writeFileContent(filePath, fileContent); err != nil {
 		log.WithFields(log.Fields{
 			"filePath": filePath,
 			"err":      err,
 		}).Error("cannot write file")
+		exitOnFatal(err)
+		failures.recordFailure(conditionDownloadFailures, err)
 		return nil, err
 	}
+	if err := applyOwnership(filePath, nil); err != nil {
+		log.WithFields(log.Fields{
+			"filePath": filePath,
+			"err":      err,
+		}).Error("cannot change file owner")
+	}
 	fileInfo, err = os.Stat(filePath)
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -232,6 +1049,86 @@ func saveToFolder(filePath string, fileContent []byte) (fileInfo os.FileInfo, er
 	return fileInfo, nil
 }
 
+// saveKeyToFolder will save value of etcdKey at revision to filePath and record the download
+func saveKeyToFolder(etcdKey, filePath string, value []byte, revision int64) error {
+	err := rolloutHeld(etcdKey, revision)
+	if err == nil && remotePaused() {
+		err = errRemotePaused
+	}
+	if err == nil && keyExpired(etcdKey) {
+		err = errKeyExpired
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"etcdKey":  etcdKey,
+			"revision": revision,
+			"err":      err,
+		}).Debug("keeping the previous file")
+		return err
+	}
+	content, err := fileContentOf(etcdKey, value, revision)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"etcdKey":  etcdKey,
+			"filePath": filePath,
+			"revision": revision,
+			"err":      err,
+		}).Error("cannot convert value, keeping the previous file")
+		failures.recordFailure(conditionDownloadFailures, err)
+		return err
+	}
+	fileInfo, err := saveToFolder(filePath, content)
+	if err != nil {
+		recordFailedDownload(etcdKey, filePath, revision)
+		return err
+	}
+	recordDownload(filePath, fileInfo, syncHash(etcdKey, value), revision)
+	return nil
+}
+
+// fileContentOf will return the content of the file holding value of etcdKey at revision
+func fileContentOf(etcdKey string, value []byte, revision int64) ([]byte, error) {
+	text, err := valueToUTF8(etcdKey, value)
+	if err != nil {
+		return nil, err
+	}
+	return fileFromUTF8(etcdKey, injectBanner(etcdKey, convertLineEndings(etcdKey, text), revision))
+}
+
+// fileValueOf will return the value of etcdKey uploaded for a file of content, content itself along with
+// the error when it cannot be converted
+func fileValueOf(etcdKey string, content []byte) ([]byte, error) {
+	text, err := fileToUTF8(etcdKey, content)
+	if err != nil {
+		return content, err
+	}
+	text = stripBanner(text)
+	if CMDArgs.NormalizeUploads {
+		text = convertLineEndings(etcdKey, text)
+	}
+	value, err := valueFromUTF8(etcdKey, text)
+	if err != nil {
+		return content, err
+	}
+	return value, nil
+}
+
+// syncHash will return the hash comparing value of etcdKey with the other side, values differing only by
+// line endings normalized by --line-endings are in sync
+func syncHash(etcdKey string, value []byte) string {
+	text, err := valueToUTF8(etcdKey, value)
+	if err != nil {
+		return contentHash(value)
+	}
+	return contentHash(convertLineEndings(etcdKey, text))
+}
+
+// fileSyncHash will return the hash comparing the file content of etcdKey with the other side
+func fileSyncHash(etcdKey string, content []byte) string {
+	value, _ := fileValueOf(etcdKey, content)
+	return syncHash(etcdKey, value)
+}
+
 // ensureDir will create folder if not exist
 func ensureDir(dirName string) error {
 	err := os.MkdirAll(dirName, os.ModePerm)
@@ -254,29 +1151,36 @@ func ensureDir(dirName string) error {
 
 // File change monitoring
 
-// walkConfigFolder will walk through configFolder and record last time changed to fileChangeMap
-// and also return filePath string list which current modified time > last modified time recorded in fileChangeMap
+// walkConfigFolder will walk through configFolder with --scan-workers directories read in parallel and record
+// last time changed to fileChangeMap, and also return filePath string list which current modified time > last
+// modified time recorded in fileChangeMap
 func walkConfigFolder(configFolder string) (fileToUpload []string, err error) {
-	err = filepath.Walk(configFolder,
-		func(filePath string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if !info.IsDir() {
-				if val, ok := fileChangeMap[filePath]; ok {
-					if info.ModTime().After(val) {
-						log.WithFields(log.Fields{
-							"filePath":   filePath,
-							"lastMod":    val.Local(),
-							"currentMod": info.ModTime().Local(),
-						}).Info("find modified local file")
-						fileToUpload = append(fileToUpload, filePath)
-					}
-				}
-				fileChangeMap[filePath] = info.ModTime()
-			}
+	var (
+		mu    sync.Mutex
+		files int64
+	)
+	start := time.Now()
+	err = walkFolder(configFolder, CMDArgs.ScanWorkers, func(filePath string, info os.FileInfo) error {
+		if isReservedKey(etcdKeyOf(filePath)) || !inManifest(etcdKeyOf(filePath)) {
 			return nil
-		})
+		}
+		atomic.AddInt64(&files, 1)
+		fileChangeMu.Lock()
+		val, ok := fileChangeMap[filePath]
+		fileChangeMap[filePath] = info.ModTime()
+		fileChangeMu.Unlock()
+		if ok && info.ModTime().After(val) && isUploadable(filePath) {
+			log.WithFields(log.Fields{
+				"filePath":   filePath,
+				"lastMod":    val.Local(),
+				"currentMod": info.ModTime().Local(),
+			}).Info("find modified local file")
+			mu.Lock()
+			fileToUpload = append(fileToUpload, filePath)
+			mu.Unlock()
+		}
+		return nil
+	})
 	if err != nil {
 		log.WithFields(log.Fields{
 			"configFolder": configFolder,
@@ -284,5 +1188,59 @@ func walkConfigFolder(configFolder string) (fileToUpload []string, err error) {
 		}).Error("config walker error")
 		return nil, err
 	}
+	if elapsed := time.Since(start); elapsed > scanInterval() {
+		log.WithFields(log.Fields{
+			"files":        files,
+			"duration":     elapsed,
+			"scanInterval": scanInterval(),
+			"scanWorkers":  CMDArgs.ScanWorkers,
+		}).Warn("folder scan took longer than --scan-interval, consider raising --scan-workers or --scan-interval")
+	}
+	// the walk order is not deterministic
+	sort.Strings(fileToUpload)
 	return fileToUpload, nil
 }
+
+// setFileChangeTime records modTime as the last known modified time of filePath
+func setFileChangeTime(filePath string, modTime time.Time) {
+	fileChangeMu.Lock()
+	fileChangeMap[filePath] = modTime
+	fileChangeMu.Unlock()
+}
+
+// runPeriodically will call fn every interval until ctx is canceled
+func runPeriodically(ctx context.Context, interval time.Duration, fn func(ctx context.Context)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fn(ctx)
+		}
+	}
+}
+
+// runEvery will call fn every interval(), read again after each call, until ctx is done
+func runEvery(ctx context.Context, interval func() time.Duration, fn func(ctx context.Context)) {
+	timer := time.NewTimer(interval())
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			fn(ctx)
+			timer.Reset(interval())
+		}
+	}
+}
+
+// maxDuration will return the longest of a and b
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
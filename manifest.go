@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// syncManifest is the parsed --manifest key: the keys and the directories, ending in /, to sync
+type syncManifest struct {
+	keys map[string]bool
+	dirs []string
+}
+
+var (
+	// manifest is the current --manifest, nil until it is read
+	manifest   *syncManifest
+	manifestMu sync.Mutex
+)
+
+// parseManifest will parse value, one key or directory relative to --key per line, # starting comments
+func parseManifest(value []byte) *syncManifest {
+	m := &syncManifest{keys: make(map[string]bool)}
+	scanner := bufio.NewScanner(bytes.NewReader(value))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entry := CMDArgs.ConfigKey + strings.TrimPrefix(line, "/")
+		if strings.HasSuffix(entry, "/") {
+			m.dirs = append(m.dirs, entry)
+		} else {
+			m.keys[entry] = true
+		}
+	}
+	return m
+}
+
+// inManifest reports whether etcdKey, or the key it holds the metadata or signature of, is listed by
+// --manifest, always true without one
+func inManifest(etcdKey string) bool {
+	if CMDArgs.Manifest == "" {
+		return true
+	}
+	etcdKey = subjectKey(etcdKey)
+	manifestMu.Lock()
+	m := manifest
+	manifestMu.Unlock()
+	if m == nil {
+		return false
+	}
+	if m.keys[etcdKey] {
+		return true
+	}
+	for _, dir := range m.dirs {
+		if strings.HasPrefix(etcdKey, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadManifest will read --manifest and return the revision of the read, a missing key syncs nothing
+func loadManifest(ctx context.Context) (int64, error) {
+	var (
+		kv       *storeKV
+		revision int64
+	)
+	err := withETCDRetry(ctx, func(ctx context.Context) (err error) {
+		kv, revision, err = kvStore.Get(ctx, CMDArgs.Manifest)
+		return err
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"manifest": CMDArgs.Manifest,
+			"err":      err,
+		}).Error("cannot read manifest")
+		return 0, err
+	}
+	var value []byte
+	if kv != nil {
+		value = kv.Value
+	} else {
+		log.WithFields(log.Fields{
+			"manifest": CMDArgs.Manifest,
+		}).Warn("manifest key does not exist, nothing is synced")
+	}
+	setManifest(value)
+	return revision, nil
+}
+
+// setManifest will replace the current manifest with the parsed value
+func setManifest(value []byte) {
+	m := parseManifest(value)
+	manifestMu.Lock()
+	manifest = m
+	manifestMu.Unlock()
+	log.WithFields(log.Fields{
+		"manifest": CMDArgs.Manifest,
+		"keys":     len(m.keys),
+		"dirs":     len(m.dirs),
+	}).Info("manifest loaded")
+}
+
+// listKeys will list the keys under etcdKey, only those listed by --manifest when it is the synced --key
+func listKeys(ctx context.Context, etcdKey string) (kvs []storeKV, revision int64, err error) {
+	if CMDArgs.Manifest != "" && etcdKey == CMDArgs.ConfigKey {
+		return listManifest(ctx)
+	}
+	err = withETCDRetry(ctx, func(ctx context.Context) (err error) {
+		kvs, revision, err = kvStore.List(ctx, etcdKey)
+		return err
+	})
+	return kvs, revision, err
+}
+
+// listManifest will read the keys listed by the manifest, with their metadata and signature keys, in key
+// order, without listing the whole of --key
+func listManifest(ctx context.Context) (kvs []storeKV, revision int64, err error) {
+	manifestMu.Lock()
+	m := manifest
+	manifestMu.Unlock()
+	if m == nil {
+		return nil, 0, nil
+	}
+	prefixes := append([]string(nil), m.dirs...)
+	for key := range m.keys {
+		prefixes = append(prefixes, key)
+	}
+	seen := make(map[string]bool)
+	for _, prefix := range prefixes {
+		var (
+			list []storeKV
+			rev  int64
+		)
+		err = withETCDRetry(ctx, func(ctx context.Context) (err error) {
+			list, rev, err = kvStore.List(ctx, prefix)
+			return err
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+		if rev > revision {
+			revision = rev
+		}
+		for _, kv := range list {
+			if !seen[kv.Key] && inManifest(kv.Key) {
+				seen[kv.Key] = true
+				kvs = append(kvs, kv)
+			}
+		}
+	}
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+	return kvs, revision, nil
+}
+
+// watchManifest will apply the changes of --manifest after revision to fileFolder until ctx is canceled:
+// newly listed keys are downloaded and the files of keys no longer listed deleted
+func watchManifest(ctx context.Context, fileFolder string, revision int64) {
+	for ctx.Err() == nil {
+		for wresp := range kvStore.Watch(ctx, CMDArgs.Manifest, revision) {
+			if wresp.Err != nil || wresp.CompactRevision != 0 {
+				break
+			}
+			for _, ev := range wresp.Events {
+				if ev.KV.Key != CMDArgs.Manifest {
+					continue
+				}
+				var value []byte
+				if ev.Type == storeEventPut {
+					value = ev.KV.Value
+				}
+				setManifest(value)
+				applyManifest(ctx, fileFolder, ev.KV.Revision)
+			}
+			revision = wresp.Revision
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+		// changes may have been lost while the watch was down
+		if rev, err := loadManifest(ctx); err == nil {
+			revision = rev
+			applyManifest(ctx, fileFolder, rev)
+		}
+	}
+}
+
+// applyManifest will download the keys listed by the current manifest and delete the synced files it
+// no longer lists, unless they changed locally
+func applyManifest(ctx context.Context, fileFolder string, revision int64) {
+	readKeyAndSaveToFolder(ctx, CMDArgs.ConfigKey, fileFolder)
+	err := walkFolder(fileFolder, CMDArgs.ScanWorkers, func(filePath string, _ os.FileInfo) error {
+		key := etcdKeyOf(filePath)
+		if _, synced := lastSynced(filePath); !synced || inManifest(key) || isReservedKey(key) {
+			return nil
+		}
+		if localChangedSinceSync(key, filePath) {
+			log.WithFields(log.Fields{
+				"filePath": filePath,
+			}).Warn("key no longer in the manifest but file changed locally, keeping it")
+			return nil
+		}
+		if err := os.Remove(filePath); err != nil {
+			log.WithFields(log.Fields{
+				"filePath": filePath,
+				"err":      err,
+			}).Error("cannot delete file")
+			return nil
+		}
+		publishEvent(eventDelete, key, filePath, 0, revision)
+		return nil
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"fileFolder": fileFolder,
+			"err":        err,
+		}).Error("cannot apply manifest")
+	}
+	runChangeHooks(ctx)
+}
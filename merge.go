@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// Fragment merge strategies
+const (
+	mergeOverride = "override"
+	mergeAppend   = "append"
+)
+
+var (
+	// fragmentRules map fragment key patterns to the file they are merged into
+	fragmentRules []patternRule
+	// mergeStrategies map fragment key patterns to their merge strategy
+	mergeStrategies []patternRule
+)
+
+// fragmentTargetOf will return the target key of fragment key etcdKey
+func fragmentTargetOf(etcdKey string) (target string, ok bool) {
+	target, ok = matchRule(fragmentRules, etcdKey)
+	return target, ok && target != etcdKey
+}
+
+// isFragmentTarget reports whether etcdKey is the target file of a fragment rule
+func isFragmentTarget(etcdKey string) bool {
+	for _, rule := range fragmentRules {
+		if rule.Value == etcdKey {
+			return true
+		}
+	}
+	return false
+}
+
+// isFragmentKey reports whether etcdKey is merged into another file, or a file fragments are merged into.
+// Neither is synced as a plain file.
+func isFragmentKey(etcdKey string) bool {
+	_, ok := fragmentTargetOf(etcdKey)
+	return ok || isFragmentTarget(etcdKey)
+}
+
+// mergeStrategyOf will return the merge strategy of fragment key etcdKey
+func mergeStrategyOf(etcdKey string) string {
+	if strategy, ok := matchRule(mergeStrategies, etcdKey); ok {
+		return strategy
+	}
+	return mergeOverride
+}
+
+// applyFragmentKey will render the file etcdKey belongs to, etcdKey being a fragment or a fragment target
+func applyFragmentKey(ctx context.Context, etcdKey, prefix, fileFolder string) {
+	target, ok := fragmentTargetOf(etcdKey)
+	if !ok {
+		target = etcdKey
+	}
+	renderFragmentTarget(ctx, target, prefix, fileFolder)
+}
+
+// renderFragmentTarget will deep-merge every fragment of target, in key order, into the content of
+// the target key and save the result. Without a target key fragments are merged into an empty document:
+// the local file is the output of the previous merge, using it as the base would keep the values of
+// deleted fragments forever.
+func renderFragmentTarget(ctx context.Context, target, prefix, fileFolder string) error {
+	var kvs []storeKV
+	err := withETCDRetry(ctx, func(ctx context.Context) (err error) {
+		kvs, _, err = kvStore.List(ctx, prefix)
+		return err
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"target": target,
+			"err":    err,
+		}).Error("cannot read fragments")
+		return err
+	}
+	filePath := filepath.Join(fileFolder, target)
+	format := formatFromExtension(target)
+
+	var (
+		base     []byte
+		revision int64
+	)
+	for _, kv := range kvs {
+		if kv.Key == target && verifyDownload(ctx, target, kv.Value, kv.Revision) == nil {
+			base, revision = kv.Value, kv.Revision
+		}
+	}
+	doc, err := decodeMergeDocument(base, format)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"target": target,
+			"err":    err,
+		}).Error("cannot decode fragment target")
+		return err
+	}
+	for _, kv := range kvs {
+		if t, ok := fragmentTargetOf(kv.Key); !ok || t != target || verifyDownload(ctx, kv.Key, kv.Value, kv.Revision) != nil {
+			continue
+		}
+		fragment, err := decodeMergeDocument(kv.Value, formatFromExtension(kv.Key))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"etcdKey": kv.Key,
+				"err":     err,
+			}).Error("cannot decode fragment, skipped")
+			continue
+		}
+		doc = deepMerge(doc, fragment, mergeStrategyOf(kv.Key))
+		if kv.Revision > revision {
+			revision = kv.Revision
+		}
+	}
+
+	var content []byte
+	if format == formatYAML {
+		content, err = yaml.Marshal(doc)
+	} else {
+		content, err = json.MarshalIndent(doc, "", "  ")
+		content = append(content, '\n')
+	}
+	if err != nil {
+		return err
+	}
+	fileInfo, err := saveToFolder(filePath, content)
+	if err != nil {
+		return err
+	}
+	recordDownload(filePath, fileInfo, contentHash(content), revision)
+	log.WithFields(log.Fields{
+		"target":   target,
+		"revision": revision,
+	}).Info("fragments merged")
+	return nil
+}
+
+// renderFragmentTargets will render every fragment target
+func renderFragmentTargets(ctx context.Context, prefix, fileFolder string) {
+	rendered := make(map[string]bool)
+	for _, rule := range fragmentRules {
+		if !rendered[rule.Value] {
+			rendered[rule.Value] = true
+			renderFragmentTarget(ctx, rule.Value, prefix, fileFolder)
+		}
+	}
+}
+
+// decodeMergeDocument will decode a JSON or YAML document with string map keys, an empty document
+// decodes to an empty map
+func decodeMergeDocument(content []byte, format string) (doc interface{}, err error) {
+	if len(content) == 0 {
+		return map[string]interface{}{}, nil
+	}
+	if format == formatYAML {
+		err = yaml.Unmarshal(content, &doc)
+	} else {
+		// numbers are kept as written, float64 cannot hold integers above 2^53
+		dec := json.NewDecoder(bytes.NewReader(content))
+		dec.UseNumber()
+		if err = dec.Decode(&doc); err == nil {
+			if _, trailing := dec.Token(); trailing != io.EOF {
+				err = errors.New("invalid character after top-level value")
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return normalizeYAML(doc)
+}
+
+// normalizeYAML will convert the map[interface{}]interface{} decoded by yaml into map[string]interface{},
+// and JSON numbers into int64 or float64 so they are written as numbers into YAML targets too. Integers
+// beyond int64 stay json.Number, written as is into JSON targets.
+func normalizeYAML(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i, nil
+		}
+		if strings.ContainsAny(v.String(), ".eE") {
+			return v.Float64()
+		}
+		return v, nil
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			value, err := normalizeYAML(value)
+			if err != nil {
+				return nil, err
+			}
+			m[fmt.Sprint(key)] = value
+		}
+		return m, nil
+	case map[string]interface{}:
+		for key, value := range v {
+			value, err := normalizeYAML(value)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = value
+		}
+		return v, nil
+	case []interface{}:
+		for i, value := range v {
+			value, err := normalizeYAML(value)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = value
+		}
+		return v, nil
+	}
+	return v, nil
+}
+
+// deepMerge will merge fragment into base: maps are merged key by key, other values are replaced by the
+// fragment. With mergeAppend lists are concatenated, skipping items base already has, so merging the
+// same fragment twice changes nothing.
+func deepMerge(base, fragment interface{}, strategy string) interface{} {
+	switch f := fragment.(type) {
+	case map[string]interface{}:
+		b, ok := base.(map[string]interface{})
+		if !ok {
+			return f
+		}
+		for key, value := range f {
+			if existing, ok := b[key]; ok {
+				b[key] = deepMerge(existing, value, strategy)
+			} else {
+				b[key] = value
+			}
+		}
+		return b
+	case []interface{}:
+		b, ok := base.([]interface{})
+		if !ok || strategy != mergeAppend {
+			return f
+		}
+		for _, item := range f {
+			if !containsValue(b, item) {
+				b = append(b, item)
+			}
+		}
+		return b
+	}
+	return fragment
+}
+
+// containsValue reports whether list contains a value deeply equal to item
+func containsValue(list []interface{}, item interface{}) bool {
+	for _, v := range list {
+		if reflect.DeepEqual(v, item) {
+			return true
+		}
+	}
+	return false
+}
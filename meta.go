@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// metaSuffix marks the sibling key holding the metadata of a file key, ex: test/config.json.syncmeta
+const metaSuffix = ".syncmeta"
+
+// fileMeta is the JSON document stored under metaKey(etcdKey)
+type fileMeta struct {
+	// Xattrs are the extended attributes of the file, values are base64 encoded in JSON
+	Xattrs map[string][]byte `json:"xattrs,omitempty"`
+	// Owner and Group are names, or numeric ids when the name didn't resolve on the uploading host
+	Owner string `json:"owner,omitempty"`
+	Group string `json:"group,omitempty"`
+	// ACL is the raw system.posix_acl_access attribute
+	ACL []byte `json:"acl,omitempty"`
+	// SHA256 is the hex encoded checksum of the content
+	SHA256 string `json:"sha256,omitempty"`
+	// ContentType is the MIME type of the content, served by the read endpoints
+	ContentType string `json:"contentType,omitempty"`
+	// Expires is when the key and its file are deleted, set from --ttl on upload
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// metaKey will return the metadata key of etcdKey
+func metaKey(etcdKey string) string {
+	return etcdKey + metaSuffix
+}
+
+// isReservedKey reports whether etcdKey is used by the syncer itself, merged from fragments or rendered
+// from a template, and must not be synced as a plain file
+func isReservedKey(etcdKey string) bool {
+	return strings.HasSuffix(etcdKey, metaSuffix) || strings.HasSuffix(etcdKey, conflictSuffix) ||
+		isSignatureKey(etcdKey) || isFragmentKey(etcdKey) || isMirrorKey(etcdKey) ||
+		isTemplateKey(etcdKey) || isTemplateOutput(etcdKey) || isArchiveKey(etcdKey) || isArchiveOutput(etcdKey) ||
+		isPackKey(etcdKey) || isPackedFile(etcdKey) || isControlKey(etcdKey) ||
+		isRemoteConfigKey(etcdKey) || isHistoryKey(etcdKey)
+}
+
+// subjectKey will return the key etcdKey holds the metadata, signature or conflict of, etcdKey otherwise
+func subjectKey(etcdKey string) string {
+	for _, suffix := range []string{metaSuffix, sigSuffix, conflictSuffix} {
+		etcdKey = strings.TrimSuffix(etcdKey, suffix)
+	}
+	return etcdKey
+}
+
+// metadataEnabled reports whether any metadata needs to be stored along with file contents
+func metadataEnabled() bool {
+	return CMDArgs.PreserveXattrs || CMDArgs.PreserveOwnership || CMDArgs.PreserveACLs
+}
+
+// xattrPrefixes will return the configured extended attribute prefixes
+func xattrPrefixes() []string {
+	if len(CMDArgs.XattrPrefixes) == 0 {
+		return []string{"user.", "security.selinux"}
+	}
+	return CMDArgs.XattrPrefixes
+}
+
+// readFileMeta will collect the metadata of filePath
+func readFileMeta(filePath string) (*fileMeta, error) {
+	meta := &fileMeta{}
+	if CMDArgs.PreserveXattrs {
+		xattrs, err := readXattrs(filePath, xattrPrefixes())
+		if err != nil {
+			return nil, err
+		}
+		meta.Xattrs = xattrs
+	}
+	if CMDArgs.PreserveOwnership {
+		info, err := os.Lstat(filePath)
+		if err != nil {
+			return nil, err
+		}
+		if uid, gid, ok := fileOwnerIDs(info); ok {
+			meta.Owner, meta.Group = userName(uid), groupName(gid)
+		}
+	}
+	if CMDArgs.PreserveACLs {
+		acl, err := readXattrs(filePath, []string{aclXattr})
+		if err != nil {
+			return nil, err
+		}
+		meta.ACL = acl[aclXattr]
+	}
+	return meta, nil
+}
+
+// metaPutOps will return the ETCD operations storing the metadata of filePath, whose content is
+// content, under etcdKey, or nothing when no metadata is configured
+func metaPutOps(etcdKey, filePath string, content []byte) ([]storeOp, error) {
+	ttl := keyTTL(etcdKey)
+	if !metadataEnabled() && !CMDArgs.Checksum && ttl == 0 {
+		return nil, nil
+	}
+	meta, err := readFileMeta(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if CMDArgs.Checksum {
+		meta.SHA256 = contentHash(content)
+	}
+	meta.ContentType = detectContentType(etcdKey, content)
+	if ttl > 0 {
+		expires := time.Now().Add(ttl).UTC()
+		meta.Expires = &expires
+	}
+	value, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	return signedPutOps(metaKey(etcdKey), value)
+}
+
+// applyMetaKey will apply the metadata stored under metadata key etcdKey at revision to its file in fileFolder.
+// A missing file is skipped, the metadata is applied again after the content is written. Metadata failing
+// verifyDownload is not applied.
+func applyMetaKey(ctx context.Context, etcdKey string, value []byte, revision int64, fileFolder string) {
+	if !metadataEnabled() || !strings.HasSuffix(etcdKey, metaSuffix) {
+		return
+	}
+	if verifyDownload(ctx, etcdKey, value, revision) != nil {
+		return
+	}
+	filePath := filepath.Join(fileFolder, strings.TrimSuffix(etcdKey, metaSuffix))
+	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		return
+	}
+	var meta fileMeta
+	if err := json.Unmarshal(value, &meta); err != nil {
+		log.WithFields(log.Fields{
+			"etcdKey": etcdKey,
+			"err":     err,
+		}).Error("cannot decode file metadata")
+		return
+	}
+	if err := applyFileMeta(filePath, &meta); err != nil {
+		log.WithFields(log.Fields{
+			"filePath": filePath,
+			"err":      err,
+		}).Error("cannot apply file metadata")
+	}
+}
+
+// applyFileMeta will restore meta on filePath
+func applyFileMeta(filePath string, meta *fileMeta) error {
+	if CMDArgs.PreserveXattrs {
+		if err := writeXattrs(filePath, meta.Xattrs); err != nil {
+			return err
+		}
+	}
+	if err := applyOwnership(filePath, meta); err != nil {
+		return err
+	}
+	if CMDArgs.PreserveACLs && len(meta.ACL) > 0 {
+		if err := writeXattrs(filePath, map[string][]byte{aclXattr: meta.ACL}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
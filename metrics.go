@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "etcd_file_syncer"
+
+// Watch restart reasons
+const (
+	watchRestartClosed    = "closed"
+	watchRestartStalled   = "stalled"
+	watchRestartCompacted = "compacted"
+	watchRestartError     = "error"
+)
+
+var (
+	watchRestarts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "watch_restarts_total",
+		Help:      "Number of times the ETCD watch was re-established, by reason.",
+	}, []string{"reason"})
+	compactedRevisionGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "compacted_revision",
+		Help:      "Last ETCD revision compacted by this syncer, history before it is no longer retrievable.",
+	})
+	watchLastResponse = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "watch_last_response_timestamp_seconds",
+		Help:      "Unix time of the last event or progress notification received on the ETCD watch.",
+	})
+	signatureRejections = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "signature_rejections_total",
+		Help:      "Number of downloads not written because their signature was missing or invalid.",
+	})
+	uploadsPausedGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "uploads_paused",
+		Help:      "1 while uploads are paused because --max-files or --max-total-bytes would be exceeded.",
+	})
+	managedFilesGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "managed_files",
+		Help:      "Number of keys under the synced prefix as of the last guard rail check.",
+	})
+	managedBytesGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "managed_bytes",
+		Help:      "Total size of the values under the synced prefix as of the last guard rail check.",
+	})
+	checksumMismatches = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "checksum_mismatches_total",
+		Help:      "Number of downloads not written because their content didn't match the stored SHA-256.",
+	})
+	writeVerificationFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "write_verification_failures_total",
+		Help:      "Number of uploads whose keys, read back with --verify-writes, didn't hold what was written.",
+	})
+	rateLimited = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "api_rate_limited_total",
+		Help:      "Number of mutating API requests refused with 429 by --rate-limit.",
+	})
+)
+
+// headRevisionCacheTTL keeps the ETCD head revision for the gauges of one scrape
+const headRevisionCacheTTL = time.Second
+
+// processStart is the time sync ages are counted from before the first sync
+var processStart = time.Now()
+
+var (
+	headRevisionMu     sync.Mutex
+	headRevisionCached int64
+	lastChangeCached   int64
+	headRevisionAt     time.Time
+)
+
+// registerSyncMetrics will register the sync lag gauges of the etcdKey to fileFolder mapping, they are
+// computed when scraped
+func registerSyncMetrics(etcdKey, fileFolder string) {
+	labels := prometheus.Labels{"key": etcdKey, "folder": fileFolder}
+	gauge := func(name, help string, fn func() float64) {
+		promauto.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        name,
+			Help:        help,
+			ConstLabels: labels,
+		}, fn)
+	}
+	gauge("seconds_since_last_download", "Seconds since a file was last written from ETCD, or since start.",
+		func() float64 { return secondsSince(&lastDownloadAt) })
+	gauge("seconds_since_last_upload", "Seconds since a file was last uploaded to ETCD, or since start.",
+		func() float64 { return secondsSince(&lastUploadAt) })
+	gauge("applied_revision", "ETCD revision every change up to has been applied to the folder.",
+		func() float64 { return float64(atomic.LoadInt64(&appliedRevision)) })
+	gauge("head_revision", "Current revision of the ETCD cluster, NaN when it is unreachable.",
+		func() float64 {
+			head, _, ok := headRevision()
+			if !ok {
+				return math.NaN()
+			}
+			return float64(head)
+		})
+	gauge("revision_lag", "Revisions between the last change under the key and the applied revision, NaN when ETCD is unreachable.",
+		func() float64 {
+			_, lastChange, ok := headRevision()
+			if !ok {
+				return math.NaN()
+			}
+			if lag := lastChange - atomic.LoadInt64(&appliedRevision); lag > 0 {
+				return float64(lag)
+			}
+			return 0
+		})
+	gauge("conflicts", "Number of files with an unresolved conflict.",
+		func() float64 {
+			conflictsMu.Lock()
+			defer conflictsMu.Unlock()
+			return float64(len(conflicts))
+		})
+	gauge("pending_uploads", "Number of files waiting to be uploaded while uploads are paused.",
+		func() float64 {
+			pausedUploadsMu.Lock()
+			defer pausedUploadsMu.Unlock()
+			return float64(len(pausedUploads))
+		})
+}
+
+// secondsSince will return the seconds elapsed since the Unix time in nanoseconds at, or since the
+// process started when at is 0
+func secondsSince(at *int64) float64 {
+	since := processStart
+	if nanos := atomic.LoadInt64(at); nanos > 0 {
+		since = time.Unix(0, nanos)
+	}
+	return time.Since(since).Seconds()
+}
+
+// headRevision will return the current ETCD revision and the highest ModRevision under --key, asking ETCD at
+// most once per headRevisionCacheTTL. Writes elsewhere move the head without reaching the watch, the lag is
+// measured against the last change under --key.
+func headRevision() (head, lastChange int64, ok bool) {
+	headRevisionMu.Lock()
+	defer headRevisionMu.Unlock()
+	if time.Since(headRevisionAt) < headRevisionCacheTTL {
+		return headRevisionCached, lastChangeCached, headRevisionCached > 0
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), statusProbeTimeout)
+	defer cancel()
+	headRevisionAt, headRevisionCached, lastChangeCached = time.Now(), 0, 0
+	head, lastChange, err := kvStore.Revision(ctx, CMDArgs.ConfigKey)
+	if err != nil {
+		return 0, 0, false
+	}
+	headRevisionCached, lastChangeCached = head, lastChange
+	return headRevisionCached, lastChangeCached, true
+}
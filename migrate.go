@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// v2RequestTimeout bounds the read of the whole etcd v2 keyspace
+const v2RequestTimeout = time.Minute
+
+// MigrateV2Cmd - migrate-v2 subcommand
+type MigrateV2Cmd struct {
+	Source   string `arg:"positional,required" help:"etcd v2 endpoint, ex: http://127.0.0.1:2379, or a v2 JSON dump file, - for stdin"`
+	V2Prefix string `arg:"--v2-prefix" default:"/" help:"v2 directory to migrate, its keys are written under --key"`
+	Prune    bool   `arg:"--prune" help:"delete keys under --key that are missing from the v2 keyspace"`
+	DryRun   bool   `arg:"--dry-run" help:"print what would change without writing"`
+}
+
+// v2Node is a key or directory of the etcd v2 keyspace, as returned by GET /v2/keys/?recursive=true
+type v2Node struct {
+	Key   string    `json:"key"`
+	Value string    `json:"value"`
+	Dir   bool      `json:"dir"`
+	TTL   int64     `json:"ttl"`
+	Nodes []*v2Node `json:"nodes"`
+}
+
+// v2Response is the v2 API answer, a dump is either that or a bare node
+type v2Response struct {
+	Node *v2Node `json:"node"`
+}
+
+// runMigrateV2 will copy every key of the v2 directory cmd.V2Prefix to the same path under --key
+func runMigrateV2(ctx context.Context, cmd *MigrateV2Cmd) int {
+	root, err := readV2Keyspace(ctx, cmd.Source, cmd.V2Prefix)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"source":   cmd.Source,
+			"v2Prefix": cmd.V2Prefix,
+			"err":      err,
+		}).Error("cannot read the etcd v2 keyspace")
+		return exitConfigError
+	}
+	values := make(map[string]string)
+	dir := strings.TrimSuffix(cmd.V2Prefix, "/") + "/"
+	if err := mapV2Node(root, dir, values); err != nil {
+		log.WithFields(log.Fields{
+			"source": cmd.Source,
+			"err":    err,
+		}).Error("cannot migrate the etcd v2 keyspace")
+		return exitConfigError
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var ops []storeOp
+	for _, key := range keys {
+		if err := checkValueSize(key, len(values[key])); err != nil {
+			log.WithFields(log.Fields{
+				"etcdKey": key,
+				"err":     err,
+			}).Error("cannot migrate key")
+			return exitConfigError
+		}
+		ops = append(ops, putOp(key, []byte(values[key])))
+	}
+	if cmd.Prune {
+		var kvs []storeKV
+		err := withETCDRetry(ctx, func(ctx context.Context) (err error) {
+			kvs, _, err = kvStore.List(ctx, CMDArgs.ConfigKey)
+			return err
+		})
+		if err != nil {
+			return exitETCDUnreachable
+		}
+		for _, kv := range kvs {
+			if _, ok := values[kv.Key]; !ok && !isReservedKey(kv.Key) {
+				ops = append(ops, deleteOp(kv.Key))
+			}
+		}
+	}
+
+	if cmd.DryRun {
+		for _, op := range ops {
+			if op.Delete {
+				fmt.Printf("delete %s\n", op.Key)
+			} else {
+				fmt.Printf("put    %s (%d bytes)\n", op.Key, len(op.Value))
+			}
+		}
+		return 0
+	}
+	for i, batch := range splitOps(ops) {
+		err := withETCDRetry(ctx, func(ctx context.Context) error {
+			_, _, err := kvStore.Txn(ctx, nil, batch)
+			return err
+		})
+		if err != nil {
+			log.WithFields(log.Fields{
+				"batch": i + 1,
+				"err":   err,
+			}).Error("cannot migrate batch")
+			if isAuthError(err) {
+				return exitAuthFailure
+			}
+			return exitETCDUnreachable
+		}
+	}
+	log.WithFields(log.Fields{
+		"v2Prefix":   cmd.V2Prefix,
+		"operations": len(ops),
+	}).Info("migrated etcd v2 keys")
+	writeAudit(auditEntry{
+		Action:  auditImport,
+		ETCDKey: CMDArgs.ConfigKey,
+		Detail:  fmt.Sprintf("%d operations from etcd v2 %s of %s", len(ops), cmd.V2Prefix, redactURL(cmd.Source)),
+	})
+	return 0
+}
+
+// readV2Keyspace will return the v2 node of dir, read recursively from an http(s) endpoint or from a dump
+func readV2Keyspace(ctx context.Context, source, dir string) (*v2Node, error) {
+	var body []byte
+	switch {
+	case strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://"):
+		ctx, cancel := context.WithTimeout(ctx, v2RequestTimeout)
+		defer cancel()
+		u := strings.TrimSuffix(source, "/") + "/v2/keys" + (&url.URL{Path: "/" + strings.Trim(dir, "/")}).EscapedPath() +
+			"?recursive=true&sorted=true"
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if body, err = io.ReadAll(resp.Body); err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected answer %s: %s", resp.Status, strings.TrimSpace(string(body)))
+		}
+	case source == "-":
+		var err error
+		if body, err = io.ReadAll(os.Stdin); err != nil {
+			return nil, err
+		}
+	default:
+		var err error
+		if body, err = os.ReadFile(source); err != nil {
+			return nil, err
+		}
+	}
+
+	var resp v2Response
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	root := resp.Node
+	if root == nil {
+		root = &v2Node{}
+		if err := json.Unmarshal(body, root); err != nil {
+			return nil, err
+		}
+	}
+	if root.Key == "" {
+		root.Key, root.Dir = "/", true
+	}
+	// a whole keyspace dump holds more than the directory to migrate
+	if node := findV2Node(root, "/"+strings.Trim(dir, "/")); node != nil {
+		return node, nil
+	}
+	return nil, fmt.Errorf("no %s directory in the v2 keyspace", dir)
+}
+
+// findV2Node will return the node of key under node, nil when missing
+func findV2Node(node *v2Node, key string) *v2Node {
+	if strings.TrimSuffix(node.Key, "/") == strings.TrimSuffix(key, "/") {
+		return node
+	}
+	for _, child := range node.Nodes {
+		if child.Key == key || strings.HasPrefix(key, child.Key+"/") {
+			return findV2Node(child, key)
+		}
+	}
+	return nil
+}
+
+// mapV2Node will add the keys under node to values, a v2 key dir/a/b maps to the v3 key --key + a/b
+func mapV2Node(node *v2Node, dir string, values map[string]string) error {
+	if !node.Dir {
+		if !strings.HasPrefix(node.Key, dir) {
+			return fmt.Errorf("v2 key %s is not a directory", node.Key)
+		}
+		key := CMDArgs.ConfigKey + strings.TrimPrefix(node.Key, dir)
+		if isReservedKey(key) {
+			log.WithField("v2Key", node.Key).Warn("v2 key collides with syncer metadata, skipped")
+			return nil
+		}
+		if node.TTL > 0 {
+			log.WithFields(log.Fields{
+				"v2Key": node.Key,
+				"ttl":   node.TTL,
+			}).Warn("v2 key expires, migrated without a TTL")
+		}
+		values[key] = node.Value
+		return nil
+	}
+	if len(node.Nodes) == 0 && strings.TrimSuffix(node.Key, "/")+"/" != dir {
+		log.WithField("v2Key", node.Key).Debug("empty v2 directory, nothing to migrate")
+	}
+	for _, child := range node.Nodes {
+		if err := mapV2Node(child, dir, values); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// redactURL will drop the password of a URL with credentials
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	u.User = url.User(u.User.Username())
+	return u.String()
+}
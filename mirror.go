@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// mirrorSuffix marks the sibling key recording which source revision a mirrored key holds, ex:
+// prod/app.yaml.mirrormeta. It is written in the same transaction as the key, so both share a revision
+// until the key is changed by someone else.
+const mirrorSuffix = ".mirrormeta"
+
+// Mirror conflict policies, which side wins when a target key changed since it was mirrored
+const (
+	mirrorConflictSource = "source"
+	mirrorConflictTarget = "target"
+)
+
+// mirrorTxnAttempts bounds the retries of a mirrored write racing another writer of the target
+const mirrorTxnAttempts = 3
+
+// MirrorCmd - mirror subcommand
+type MirrorCmd struct {
+	ToETCD   []string `arg:"--to-etcd" help:"ETCD endpoints of the target cluster, the source store when unset"`
+	ToPrefix string   `arg:"--to-prefix" help:"prefix the keys under --key are mirrored to [default: --key]"`
+	Conflict string   `arg:"--conflict" default:"source" help:"source overwrites target keys changed since they were mirrored, target leaves them alone"`
+	Once     bool     `arg:"--once" help:"mirror the current keys and exit instead of following changes"`
+}
+
+// mirrorMeta is the JSON document stored under the mirrorSuffix sibling of a mirrored key
+type mirrorMeta struct {
+	Source   string `json:"source"`
+	Revision int64  `json:"revision"`
+}
+
+// errMirrorConflict is returned for a target key changed since it was mirrored, left alone by --conflict=target
+var errMirrorConflict = errors.New("target key changed since it was mirrored")
+
+// mirror copies the keys under from in source to the keys under to in target
+type mirror struct {
+	source, target store
+	from, to       string
+	conflict       string
+}
+
+// isMirrorKey reports whether etcdKey is a mirror bookkeeping key
+func isMirrorKey(etcdKey string) bool {
+	return strings.HasSuffix(etcdKey, mirrorSuffix)
+}
+
+// runMirror will mirror --key to cmd.ToPrefix of the target cluster until ctx is canceled, or once
+func runMirror(ctx context.Context, cmd *MirrorCmd) int {
+	m := &mirror{source: kvStore, target: kvStore, from: CMDArgs.ConfigKey, to: cmd.ToPrefix, conflict: cmd.Conflict}
+	if m.to == "" {
+		m.to = m.from
+	}
+	if m.conflict != mirrorConflictSource && m.conflict != mirrorConflictTarget {
+		fmt.Fprintf(os.Stderr, "--conflict must be %q or %q\n", mirrorConflictSource, mirrorConflictTarget)
+		return exitConfigError
+	}
+	if len(cmd.ToETCD) > 0 {
+		cli, err := connectETCD(ctx, cmd.ToETCD, CMDArgs.StartupRetries)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"endpoints": cmd.ToETCD,
+				"err":       err,
+			}).Error("error connecting to the target ETCD")
+			if isAuthError(err) {
+				return exitAuthFailure
+			}
+			return exitETCDUnreachable
+		}
+		m.target = &etcdStore{cli: cli}
+		defer m.target.Close()
+	} else if strings.HasPrefix(m.to, m.from) || strings.HasPrefix(m.from, m.to) {
+		fmt.Fprintln(os.Stderr, "--to-prefix cannot overlap --key when mirroring within the same store")
+		return exitConfigError
+	}
+
+	rev, err := m.reconcile(ctx)
+	if err != nil {
+		return 1
+	}
+	if cmd.Once {
+		return 0
+	}
+	for {
+		if lost := m.follow(ctx, &rev); lost {
+			// the watch lost events, compare everything again once reconcile succeeds
+			for ctx.Err() == nil {
+				if rev, err = m.reconcile(ctx); err == nil {
+					break
+				}
+				select {
+				case <-ctx.Done():
+				case <-time.After(time.Second):
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return 0
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// targetKey will return the target key of the source key
+func (m *mirror) targetKey(key string) string {
+	return m.to + strings.TrimPrefix(key, m.from)
+}
+
+// reconcile will mirror every source key, deleting the mirrored target keys whose source is gone, and
+// return the source revision the target is in sync with
+func (m *mirror) reconcile(ctx context.Context) (int64, error) {
+	var (
+		sources, targets []storeKV
+		rev              int64
+	)
+	err := withETCDRetry(ctx, func(ctx context.Context) (err error) {
+		if sources, rev, err = m.source.List(ctx, m.from); err != nil {
+			return err
+		}
+		targets, _, err = m.target.List(ctx, m.to)
+		return err
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"from": m.from,
+			"to":   m.to,
+			"err":  err,
+		}).Error("cannot list keys to mirror")
+		return 0, err
+	}
+	present := make(map[string]bool, len(sources))
+	var failed error
+	for _, kv := range sources {
+		if isMirrorKey(kv.Key) {
+			continue
+		}
+		present[m.targetKey(kv.Key)] = true
+		if err := m.apply(ctx, storeEvent{Type: storeEventPut, KV: kv}); err != nil && !errors.Is(err, errMirrorConflict) {
+			failed = err
+		}
+	}
+	for _, kv := range targets {
+		if isMirrorKey(kv.Key) || present[kv.Key] {
+			continue
+		}
+		key := m.from + strings.TrimPrefix(kv.Key, m.to)
+		err := m.apply(ctx, storeEvent{Type: storeEventDelete, KV: storeKV{Key: key, Revision: rev}})
+		if err != nil && !errors.Is(err, errMirrorConflict) {
+			failed = err
+		}
+	}
+	if failed != nil {
+		return 0, failed
+	}
+	log.WithFields(log.Fields{
+		"from":     m.from,
+		"to":       m.to,
+		"keys":     len(present),
+		"revision": rev,
+	}).Info("mirror in sync")
+	return rev, nil
+}
+
+// follow will apply the source changes after *rev to the target until the watch ends, returning whether
+// events were lost
+func (m *mirror) follow(ctx context.Context, rev *int64) (lost bool) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	rch := m.source.Watch(ctx, m.from, *rev)
+	stallTimer := time.NewTimer(CMDArgs.WatchStallTimeout)
+	defer stallTimer.Stop()
+	for {
+		select {
+		case <-stallTimer.C:
+			log.WithField("from", m.from).Warn("mirror watch stalled, re-establishing")
+			return false
+		case wresp, ok := <-rch:
+			if !ok {
+				return false
+			}
+			if !stallTimer.Stop() {
+				<-stallTimer.C
+			}
+			stallTimer.Reset(CMDArgs.WatchStallTimeout)
+			if wresp.CompactRevision != 0 || wresp.Err != nil {
+				log.WithFields(log.Fields{
+					"from":            m.from,
+					"compactRevision": wresp.CompactRevision,
+					"err":             wresp.Err,
+				}).Warn("mirror watch failed, reconciling")
+				return true
+			}
+			for _, ev := range wresp.Events {
+				if isMirrorKey(ev.KV.Key) {
+					continue
+				}
+				if err := m.apply(ctx, ev); err != nil && !errors.Is(err, errMirrorConflict) {
+					return true
+				}
+			}
+			*rev = wresp.Revision
+		}
+	}
+}
+
+// apply will mirror one source event to the target. A put is skipped when the target already holds
+// that source revision. A target key changed since it was mirrored, or not written by the mirror at
+// all, is overwritten or left alone depending on --conflict.
+func (m *mirror) apply(ctx context.Context, ev storeEvent) error {
+	key := m.targetKey(ev.KV.Key)
+	var (
+		done bool
+		err  error
+	)
+	for attempt := 0; attempt < mirrorTxnAttempts && !done && err == nil; attempt++ {
+		done, err = m.applyOnce(ctx, key, ev)
+	}
+	if err == nil && !done {
+		err = fmt.Errorf("target key kept changing after %d attempts", mirrorTxnAttempts)
+	}
+	if err == nil {
+		return nil
+	}
+	fields := log.Fields{
+		"etcdKey":   ev.KV.Key,
+		"targetKey": key,
+		"eventType": ev.Type,
+		"err":       err,
+	}
+	if errors.Is(err, errMirrorConflict) {
+		log.WithFields(fields).Warn("target key changed since it was mirrored, left alone")
+	} else {
+		log.WithFields(fields).Error("cannot mirror key")
+	}
+	return err
+}
+
+// applyOnce will try to mirror ev to key, returning false when the target changed in the meantime
+func (m *mirror) applyOnce(ctx context.Context, key string, ev storeEvent) (bool, error) {
+	var current, sibling *storeKV
+	err := withETCDRetry(ctx, func(ctx context.Context) (err error) {
+		if current, _, err = m.target.Get(ctx, key); err != nil {
+			return err
+		}
+		sibling, _, err = m.target.Get(ctx, key+mirrorSuffix)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	var meta mirrorMeta
+	if sibling != nil {
+		json.Unmarshal(sibling.Value, &meta)
+	}
+	if ev.Type == storeEventPut && current != nil && sibling != nil && meta.Revision >= ev.KV.Revision {
+		return true, nil
+	}
+	if ev.Type == storeEventDelete && current == nil && sibling == nil {
+		return true, nil
+	}
+	changed := current != nil && (sibling == nil || current.Revision != sibling.Revision)
+	if changed && m.conflict == mirrorConflictTarget {
+		return true, errMirrorConflict
+	}
+
+	cmps := []storeCmp{{Key: key}, {Key: key + mirrorSuffix}}
+	if current != nil {
+		cmps[0].Revision = current.Revision
+	}
+	if sibling != nil {
+		cmps[1].Revision = sibling.Revision
+	}
+	var ops []storeOp
+	if ev.Type == storeEventDelete {
+		ops = []storeOp{deleteOp(key), deleteOp(key + mirrorSuffix)}
+	} else {
+		doc, _ := json.Marshal(mirrorMeta{Source: ev.KV.Key, Revision: ev.KV.Revision})
+		ops = []storeOp{putOp(key, ev.KV.Value), putOp(key+mirrorSuffix, doc)}
+	}
+	var succeeded bool
+	err = withETCDRetry(ctx, func(ctx context.Context) (err error) {
+		succeeded, _, err = m.target.Txn(ctx, cmps, ops)
+		return err
+	})
+	if err != nil || !succeeded {
+		return false, err
+	}
+	log.WithFields(log.Fields{
+		"etcdKey":   ev.KV.Key,
+		"targetKey": key,
+		"eventType": ev.Type,
+		"revision":  ev.KV.Revision,
+	}).Info("mirrored key")
+	return true, nil
+}
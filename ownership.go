@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// aclXattr is the extended attribute the kernel keeps the POSIX access ACL in
+const aclXattr = "system.posix_acl_access"
+
+// ownershipOverrides are the parsed --ownership-override rules, their owner wins over metadata
+var ownershipOverrides []patternRule
+
+// defaultUID and defaultGID are the resolved --owner and --group, -1 when not given
+var defaultUID, defaultGID = -1, -1
+
+// lookupUID will resolve a user name or numeric id
+func lookupUID(name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// lookupGID will resolve a group name or numeric id
+func lookupGID(name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// parseOwnerSpec will resolve user:group, user or :group into ids, -1 meaning unchanged
+func parseOwnerSpec(spec string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	userName, groupName := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		userName, groupName = spec[:i], spec[i+1:]
+	}
+	if userName != "" {
+		if uid, err = lookupUID(userName); err != nil {
+			return -1, -1, fmt.Errorf("unknown user %q: %v", userName, err)
+		}
+	}
+	if groupName != "" {
+		if gid, err = lookupGID(groupName); err != nil {
+			return -1, -1, fmt.Errorf("unknown group %q: %v", groupName, err)
+		}
+	}
+	return uid, gid, nil
+}
+
+// userName will return the name of uid, or uid itself when it has no name on this host
+func userName(uid int) string {
+	if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+		return u.Username
+	}
+	return strconv.Itoa(uid)
+}
+
+// groupName will return the name of gid, or gid itself when it has no name on this host
+func groupName(gid int) string {
+	if g, err := user.LookupGroupId(strconv.Itoa(gid)); err == nil {
+		return g.Name
+	}
+	return strconv.Itoa(gid)
+}
+
+// etcdKeyOf will return the ETCD key of filePath inside the config folder
+func etcdKeyOf(filePath string) string {
+	if rel, err := filepath.Rel(CMDArgs.ConfigFolder, filePath); err == nil && !strings.HasPrefix(rel, "..") {
+		return filepath.ToSlash(rel)
+	}
+	return filepath.Base(filePath)
+}
+
+// applyOwnership will chown filePath to --owner and --group, to the owner recorded in meta (when
+// --preserve-ownership is set) or to the matching --ownership-override, the latter winning. meta may be
+// nil. Ownership can only be changed by root, otherwise it is skipped.
+func applyOwnership(filePath string, meta *fileMeta) error {
+	uid, gid := defaultUID, defaultGID
+	if CMDArgs.PreserveOwnership && meta != nil {
+		if meta.Owner != "" {
+			if id, err := lookupUID(meta.Owner); err == nil {
+				uid = id
+			}
+		}
+		if meta.Group != "" {
+			if id, err := lookupGID(meta.Group); err == nil {
+				gid = id
+			}
+		}
+	}
+	if spec, ok := matchRule(ownershipOverrides, etcdKeyOf(filePath)); ok {
+		overrideUID, overrideGID, err := parseOwnerSpec(spec)
+		if err != nil {
+			return err
+		}
+		if overrideUID != -1 {
+			uid = overrideUID
+		}
+		if overrideGID != -1 {
+			gid = overrideGID
+		}
+	}
+	if uid == -1 && gid == -1 {
+		return nil
+	}
+	if os.Geteuid() != 0 {
+		log.WithFields(log.Fields{
+			"filePath": filePath,
+			"uid":      uid,
+			"gid":      gid,
+		}).Debug("not running as root, skipping chown")
+		return nil
+	}
+	return os.Lchown(filePath, uid, gid)
+}
@@ -0,0 +1,8 @@
+package main
+
+import "os"
+
+// fileOwnerIDs is not supported on windows
+func fileOwnerIDs(info os.FileInfo) (uid, gid int, ok bool) {
+	return -1, -1, false
+}
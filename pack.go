@@ -0,0 +1,275 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// packSuffix is appended to a --pack directory to name its key, ex: app/rules is packed into app/rules.tar.gz
+const packSuffix = ".tar.gz"
+
+// packedDir is the last packed state of a --pack directory
+type packedDir struct {
+	// fingerprint covers the names, sizes, modes and modification times of the files
+	fingerprint string
+	// hash is the SHA-256 of the archive in ETCD
+	hash string
+}
+
+var (
+	// packedDirs maps --pack directories to their last packed state
+	packedDirs = make(map[string]packedDir)
+	packMu     sync.Mutex
+)
+
+// isPackKey reports whether etcdKey is the archive of a --pack directory, it is neither downloaded nor
+// uploaded as a file
+func isPackKey(etcdKey string) bool {
+	for _, dir := range CMDArgs.Pack {
+		if etcdKey == dir+packSuffix {
+			return true
+		}
+	}
+	return false
+}
+
+// isPackedFile reports whether etcdKey is a file of a --pack directory, only uploaded as part of its archive
+func isPackedFile(etcdKey string) bool {
+	for _, dir := range CMDArgs.Pack {
+		if strings.HasPrefix(etcdKey, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// packDirectories will upload the archive of every --pack directory under fileFolder whose files changed
+func packDirectories(ctx context.Context, fileFolder string) {
+	for _, dir := range CMDArgs.Pack {
+		packDirectory(ctx, dir, filepath.Join(fileFolder, filepath.FromSlash(dir)))
+	}
+}
+
+// packDirectory will upload the archive of dir, at dirPath, when its files changed since it was last packed.
+// A missing directory is not an error, its key is kept.
+func packDirectory(ctx context.Context, dir, dirPath string) {
+	fingerprint, err := dirFingerprint(dirPath)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.WithFields(log.Fields{
+			"dir": dirPath,
+			"err": err,
+		}).Error("cannot scan directory to pack")
+		return
+	}
+	packMu.Lock()
+	state := packedDirs[dir]
+	packMu.Unlock()
+	if fingerprint == state.fingerprint {
+		return
+	}
+	value, files, err := packDir(dirPath)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"dir": dirPath,
+			"err": err,
+		}).Error("cannot pack directory")
+		return
+	}
+	etcdKey := dir + packSuffix
+	hash := contentHash(value)
+	if state.hash == "" {
+		// first pack since start, the key may already hold the same archive
+		var kv *storeKV
+		err := withETCDRetry(ctx, func(ctx context.Context) (err error) {
+			kv, _, err = kvStore.Get(ctx, etcdKey)
+			return err
+		})
+		if err == nil && kv != nil {
+			state.hash = contentHash(kv.Value)
+		}
+	}
+	if hash != state.hash {
+		if err := putPackedDir(ctx, etcdKey, dirPath, value, files); err != nil {
+			return
+		}
+	}
+	packMu.Lock()
+	packedDirs[dir] = packedDir{fingerprint: fingerprint, hash: hash}
+	packMu.Unlock()
+}
+
+// putPackedDir will store value, the archive of files files of dirPath, in etcdKey
+func putPackedDir(ctx context.Context, etcdKey, dirPath string, value []byte, files int) error {
+	if err := checkValueSize(etcdKey, len(value)); err != nil {
+		log.WithFields(log.Fields{
+			"dir": dirPath,
+			"err": err,
+		}).Error("cannot upload packed directory")
+		failures.recordFailure(conditionUploadFailures, err)
+		return err
+	}
+	sigOps, err := signatureOps(etcdKey, value)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"dir": dirPath,
+			"err": err,
+		}).Error("cannot sign packed directory")
+		return err
+	}
+	ops := append([]storeOp{putOp(etcdKey, value)}, sigOps...)
+	var revision int64
+	err = withETCDRetry(ctx, func(ctx context.Context) (err error) {
+		_, revision, err = kvStore.Txn(ctx, nil, ops)
+		return err
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"etcdKey": etcdKey,
+			"dir":     dirPath,
+			"err":     err,
+		}).Error("error putting data to ETCD")
+		exitOnFatal(err)
+		failures.recordFailure(conditionUploadFailures, err)
+		return err
+	}
+	recordUpload(etcdKey, dirPath, contentHash(value), len(value), revision)
+	verifyUpload(ctx, etcdKey, dirPath, ops, revision)
+	log.WithFields(log.Fields{
+		"etcdKey":  etcdKey,
+		"dir":      dirPath,
+		"files":    files,
+		"bytes":    len(value),
+		"revision": revision,
+	}).Info("directory packed")
+	return nil
+}
+
+// packEntry is a file under a --pack directory
+type packEntry struct {
+	filePath string
+	info     os.FileInfo
+}
+
+// listPackEntries will return the files under dirPath sorted by path, so the same files always come in the
+// same order whatever the order the walker found them in
+func listPackEntries(dirPath string) ([]packEntry, error) {
+	var (
+		mu      sync.Mutex
+		entries []packEntry
+	)
+	err := walkFolder(dirPath, CMDArgs.ScanWorkers, func(filePath string, info os.FileInfo) error {
+		mu.Lock()
+		entries = append(entries, packEntry{filePath: filePath, info: info})
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].filePath < entries[j].filePath })
+	return entries, nil
+}
+
+// dirFingerprint will return a hash of the names, sizes, modes and modification times of the files under dirPath
+func dirFingerprint(dirPath string) (string, error) {
+	entries, err := listPackEntries(dirPath)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.New()
+	for _, entry := range entries {
+		info := entry.info
+		fmt.Fprintf(sum, "%s\x00%d\x00%d\x00%v\n", entry.filePath, info.Size(), info.ModTime().UnixNano(), info.Mode())
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// packDir will return the gzipped tarball of the files under dirPath and the directories holding them, along
+// with the number of files. Owners and modification times are left out so the same files always give the same
+// archive. Symbolic links, special files and empty directories are skipped.
+func packDir(dirPath string) (value []byte, files int, err error) {
+	entries, err := listPackEntries(dirPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	written := make(map[string]bool)
+	// writeDir will write the header of the directory rel and of its parents, once
+	var writeDir func(rel string) error
+	writeDir = func(rel string) error {
+		if rel == "." || written[rel] {
+			return nil
+		}
+		written[rel] = true
+		if err := writeDir(filepath.Dir(rel)); err != nil {
+			return err
+		}
+		info, err := os.Lstat(filepath.Join(dirPath, rel))
+		if err != nil {
+			return err
+		}
+		return tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     filepath.ToSlash(rel) + "/",
+			Mode:     int64(info.Mode().Perm()),
+			ModTime:  time.Unix(0, 0),
+		})
+	}
+	for _, entry := range entries {
+		rel, err := filepath.Rel(dirPath, entry.filePath)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !entry.info.Mode().IsRegular() {
+			log.WithFields(log.Fields{
+				"filePath": entry.filePath,
+			}).Warn("not a regular file, left out of the packed directory")
+			continue
+		}
+		content, err := os.ReadFile(entry.filePath)
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := writeDir(filepath.Dir(rel)); err != nil {
+			return nil, 0, err
+		}
+		header := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     filepath.ToSlash(rel),
+			Mode:     int64(entry.info.Mode().Perm()),
+			Size:     int64(len(content)),
+			ModTime:  time.Unix(0, 0),
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return nil, 0, err
+		}
+		if _, err := tw.Write(content); err != nil {
+			return nil, 0, err
+		}
+		files++
+	}
+	if err := tw.Close(); err != nil {
+		return nil, 0, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, 0, err
+	}
+	return buf.Bytes(), files, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// Patch content types
+const (
+	contentTypeJSONPatch  = "application/json-patch+json"
+	contentTypeMergePatch = "application/merge-patch+json"
+)
+
+// patchAttempts is how many times a patch is retried when the key changes between read and write
+const patchAttempts = 3
+
+var (
+	errKeyNotFound      = errors.New("key not found")
+	errRevisionMismatch = errors.New("key revision does not match If-Match")
+	errPatchConflict    = errors.New("key kept changing while patching")
+	errPatchFailed      = errors.New("cannot apply patch")
+)
+
+// patchKey will apply patch to the value of etcdKey with a compare-and-swap on its revision, retrying
+// when the key changed in between. When expectedRev is not 0 the key must be at that revision.
+func patchKey(ctx context.Context, etcdKey string, patch func([]byte) ([]byte, error), expectedRev int64) (revision int64, err error) {
+	for attempt := 0; attempt < patchAttempts; attempt++ {
+		var kv *storeKV
+		err = withETCDRetry(ctx, func(ctx context.Context) (err error) {
+			kv, _, err = kvStore.Get(ctx, etcdKey)
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+		if kv == nil {
+			return 0, errKeyNotFound
+		}
+		if expectedRev != 0 && kv.Revision != expectedRev {
+			return 0, errRevisionMismatch
+		}
+		patched, err := patch(kv.Value)
+		if err != nil {
+			// the stored value is not JSON or the patch doesn't apply to it
+			return 0, fmt.Errorf("%w: %v", errPatchFailed, err)
+		}
+		if err := checkValueSize(etcdKey, len(patched)); err != nil {
+			return 0, err
+		}
+		sigOps, err := signatureOps(etcdKey, patched)
+		if err != nil {
+			return 0, err
+		}
+		checksumOps, err := checksumMetaOps(ctx, etcdKey, patched)
+		if err != nil {
+			return 0, err
+		}
+		sigOps = append(sigOps, checksumOps...)
+		var succeeded bool
+		err = withETCDRetry(ctx, func(ctx context.Context) (err error) {
+			succeeded, revision, err = kvStore.Txn(ctx, []storeCmp{{Key: etcdKey, Revision: kv.Revision}},
+				append([]storeOp{putOp(etcdKey, patched)}, sigOps...))
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+		if succeeded {
+			return revision, nil
+		}
+		log.WithFields(log.Fields{
+			"etcdKey": etcdKey,
+			"attempt": attempt + 1,
+		}).Warn("key changed while patching, retrying")
+	}
+	return 0, errPatchConflict
+}
+
+// parseIfMatch will return the revision of an If-Match header: an ETag of the read endpoints, "123" or W/"123",
+// or a bare revision. An empty header and * match any revision and return 0.
+func parseIfMatch(ifMatch string) (int64, error) {
+	tag := strings.TrimSpace(ifMatch)
+	if tag == "" || tag == "*" {
+		return 0, nil
+	}
+	tag = strings.TrimPrefix(tag, "W/")
+	if len(tag) >= 2 && strings.HasPrefix(tag, `"`) && strings.HasSuffix(tag, `"`) {
+		tag = tag[1 : len(tag)-1]
+	}
+	return strconv.ParseInt(tag, 10, 64)
+}
+
+// patchHandler - PATCH /v1/file?key=, applies the RFC 6902 JSON Patch or RFC 7386 merge patch in the body,
+// chosen by Content-Type, to the value of key. An If-Match revision makes the patch conditional.
+func patchHandler(c *gin.Context) {
+	etcdKey := c.Query("key")
+	if etcdKey == "" {
+		abortWithError(c, http.StatusBadRequest, codeBadRequest, "key is required", nil)
+		return
+	}
+	expectedRev, err := parseIfMatch(c.GetHeader("If-Match"))
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, codeBadRequest, "If-Match must be a revision or the ETag of one",
+			err.Error())
+		return
+	}
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	var patch func([]byte) ([]byte, error)
+	mediaType, _, _ := mime.ParseMediaType(c.ContentType())
+	switch mediaType {
+	case contentTypeJSONPatch:
+		p, err := jsonpatch.DecodePatch(body)
+		if err != nil {
+			abortWithBadRequest(c, err)
+			return
+		}
+		patch = p.Apply
+	case contentTypeMergePatch:
+		patch = func(doc []byte) ([]byte, error) {
+			return jsonpatch.MergePatch(doc, body)
+		}
+	default:
+		abortWithError(c, http.StatusUnsupportedMediaType, codeUnsupportedMediaType, "unsupported Content-Type",
+			[]string{contentTypeJSONPatch, contentTypeMergePatch})
+		return
+	}
+
+	rev, err := patchKey(c.Request.Context(), etcdKey, patch, expectedRev)
+	if err != nil {
+		abortWithErr(c, err)
+		return
+	}
+	log.WithFields(log.Fields{
+		"etcdKey":  etcdKey,
+		"revision": rev,
+	}).Info("key patched")
+	writeAudit(auditEntry{
+		Action:  auditPatch,
+		ETCDKey: etcdKey,
+		Detail:  fmt.Sprintf("%s applied at revision %d", mediaType, rev),
+	})
+	c.JSON(http.StatusOK, OKResponse{Status: "ok", Revision: rev})
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// patternRule maps a glob pattern on ETCD keys to a per-file setting, given on the command line as
+// pattern=value. Patterns without a / match the base name, like .gitignore.
+type patternRule struct {
+	Pattern string
+	Value   string
+}
+
+// parsePatternRules will parse pattern=value arguments
+func parsePatternRules(args []string) ([]patternRule, error) {
+	rules := make([]patternRule, 0, len(args))
+	for _, a := range args {
+		i := strings.LastIndex(a, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("%q is not pattern=value", a)
+		}
+		rule := patternRule{Pattern: a[:i], Value: a[i+1:]}
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("bad pattern %q: %v", rule.Pattern, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// matchPattern reports whether etcdKey matches pattern
+func matchPattern(pattern, etcdKey string) bool {
+	name := etcdKey
+	if !strings.Contains(pattern, "/") {
+		name = path.Base(etcdKey)
+	}
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+// matchRule will return the value of the first rule matching etcdKey
+func matchRule(rules []patternRule, etcdKey string) (value string, ok bool) {
+	for _, rule := range rules {
+		if matchPattern(rule.Pattern, etcdKey) {
+			return rule.Value, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,71 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// dropPrivileges will switch the process to userName/groupName, either may be empty. Supplementary
+// groups are replaced with the target user's groups, or with none when only a group is given.
+func dropPrivileges(userName, groupName string) error {
+	uid, gid := -1, -1
+	var groups []int
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			return err
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return err
+		}
+		if gid, err = strconv.Atoi(u.Gid); err != nil {
+			return err
+		}
+		groupIDs, err := u.GroupIds()
+		if err != nil {
+			return err
+		}
+		for _, id := range groupIDs {
+			if g, err := strconv.Atoi(id); err == nil {
+				groups = append(groups, g)
+			}
+		}
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			return err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return err
+		}
+		if userName == "" {
+			groups = []int{gid}
+		}
+	}
+
+	// group first, we can't change it anymore once we are not root
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("setgroups: %v", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid %d: %v", gid, err)
+	}
+	if uid != -1 {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("setuid %d: %v", uid, err)
+		}
+	}
+	log.WithFields(log.Fields{
+		"uid": syscall.Getuid(),
+		"gid": syscall.Getgid(),
+	}).Info("dropped privileges")
+	return nil
+}
@@ -0,0 +1,8 @@
+package main
+
+import "errors"
+
+// dropPrivileges is not supported on windows
+func dropPrivileges(userName, groupName string) error {
+	return errors.New("--run-as-user and --run-as-group are not supported on windows")
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pmezard/go-difflib/difflib"
+	log "github.com/sirupsen/logrus"
+)
+
+// Promotion change actions
+const (
+	promoteCreate = "create"
+	promoteUpdate = "update"
+	promoteDelete = "delete"
+)
+
+// Promotion states
+const (
+	promotionPending  = "pending"
+	promotionApplied  = "applied"
+	promotionRejected = "rejected"
+)
+
+var (
+	// errPromotionStale is returned when approving a plan whose target keys changed since it was made
+	errPromotionStale = errors.New("target keys changed since the promotion was planned")
+	// errApprovalRequired is returned for promotions that must be approved, or approved by someone else
+	errApprovalRequired = errors.New("promotion requires approval")
+	// errPromotionNotFound is returned for unknown, decided or expired promotion IDs
+	errPromotionNotFound = errors.New("promotion not found")
+)
+
+// PromotionModel - POST /v1/promotions
+type PromotionModel struct {
+	From string `json:"from" binding:"required"`
+	To   string `json:"to" binding:"required"`
+	// Conflict is the mirror policy for target keys changed since they were mirrored, source by default
+	Conflict string `json:"conflict"`
+	// Apply skips the approval step, refused with --promotion-require-approval
+	Apply bool `json:"apply"`
+}
+
+// PromotionIDModel - POST /v1/promotions/approve and /v1/promotions/reject
+type PromotionIDModel struct {
+	ID string `json:"id" binding:"required"`
+}
+
+// promotionChange is a target key a promotion writes or deletes
+type promotionChange struct {
+	Action         string `json:"action"`
+	Key            string `json:"key"`
+	Source         string `json:"source"`
+	SourceRevision int64  `json:"sourceRevision,omitempty"`
+	TargetRevision int64  `json:"targetRevision,omitempty"`
+	// ChangedInTarget is set for target keys changed since they were last mirrored, or never mirrored
+	ChangedInTarget bool   `json:"changedInTarget,omitempty"`
+	Diff            string `json:"diff,omitempty"`
+
+	value              []byte
+	mirrorMetaRevision int64
+}
+
+// Promotion is a planned copy of the keys under From to To, applied when approved
+type Promotion struct {
+	ID          string            `json:"id"`
+	From        string            `json:"from"`
+	To          string            `json:"to"`
+	Conflict    string            `json:"conflict"`
+	Status      string            `json:"status"`
+	Revision    int64             `json:"revision"`
+	Created     time.Time         `json:"created"`
+	RequestedBy string            `json:"requestedBy,omitempty"`
+	ApprovedBy  string            `json:"approvedBy,omitempty"`
+	Changes     []promotionChange `json:"changes"`
+	// Skipped are the target keys changed since they were mirrored, left alone by the target conflict policy
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// PromotionsResponse - GET /v1/promotions
+type PromotionsResponse struct {
+	Promotions []Promotion `json:"promotions"`
+}
+
+var (
+	promotionsMu sync.Mutex
+	// promotions are the pending promotions by ID
+	promotions = make(map[string]*Promotion)
+)
+
+// validatePromotion will check the prefixes and conflict policy of a promotion request
+func validatePromotion(from, to, conflict string) error {
+	if conflict != mirrorConflictSource && conflict != mirrorConflictTarget {
+		return fmt.Errorf("conflict must be %q or %q", mirrorConflictSource, mirrorConflictTarget)
+	}
+	if !strings.HasPrefix(from, CMDArgs.ConfigKey) || !strings.HasPrefix(to, CMDArgs.ConfigKey) {
+		return fmt.Errorf("from and to must be under %s", CMDArgs.ConfigKey)
+	}
+	if strings.HasPrefix(to, from) || strings.HasPrefix(from, to) {
+		return errors.New("from and to cannot overlap")
+	}
+	return nil
+}
+
+// planPromotion will compare the keys under from with the keys under to and return the promotion
+// mirroring them
+func planPromotion(ctx context.Context, from, to, conflict string) (*Promotion, error) {
+	m := &mirror{source: kvStore, target: kvStore, from: from, to: to, conflict: conflict}
+	var (
+		sources  []storeKV
+		targets  []storeKV
+		revision int64
+	)
+	err := withETCDRetry(ctx, func(ctx context.Context) (err error) {
+		if sources, revision, err = kvStore.List(ctx, from); err != nil {
+			return err
+		}
+		targets, _, err = kvStore.List(ctx, to)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[string]storeKV, len(targets))
+	for _, kv := range targets {
+		current[kv.Key] = kv
+	}
+	p := &Promotion{From: from, To: to, Conflict: conflict, Status: promotionPending, Revision: revision, Created: time.Now().UTC(),
+		Changes: []promotionChange{}}
+	plan := func(change promotionChange) {
+		target, exists := current[change.Key]
+		meta, hasMeta := current[change.Key+mirrorSuffix]
+		if hasMeta {
+			change.mirrorMetaRevision = meta.Revision
+		}
+		if exists {
+			change.TargetRevision = target.Revision
+			change.ChangedInTarget = !hasMeta || meta.Revision != target.Revision
+		}
+		if change.ChangedInTarget && conflict == mirrorConflictTarget {
+			p.Skipped = append(p.Skipped, change.Key)
+			return
+		}
+		change.Diff = promotionDiff(change, target.Value)
+		p.Changes = append(p.Changes, change)
+	}
+	promoted := make(map[string]bool, len(sources))
+	for _, kv := range sources {
+		if isMirrorKey(kv.Key) {
+			continue
+		}
+		key := m.targetKey(kv.Key)
+		promoted[key] = true
+		change := promotionChange{Action: promoteCreate, Key: key, Source: kv.Key, SourceRevision: kv.Revision, value: kv.Value}
+		if target, exists := current[key]; exists {
+			if bytes.Equal(target.Value, kv.Value) {
+				continue
+			}
+			change.Action = promoteUpdate
+		}
+		plan(change)
+	}
+	for _, kv := range targets {
+		if !isMirrorKey(kv.Key) && !promoted[kv.Key] {
+			plan(promotionChange{Action: promoteDelete, Key: kv.Key, Source: from + strings.TrimPrefix(kv.Key, to)})
+		}
+	}
+	sort.Slice(p.Changes, func(i, j int) bool { return p.Changes[i].Key < p.Changes[j].Key })
+	return p, nil
+}
+
+// promotionDiff will return the unified diff of change from the current target value
+func promotionDiff(change promotionChange, current []byte) string {
+	if bytes.IndexByte(current, 0) >= 0 || bytes.IndexByte(change.value, 0) >= 0 {
+		return fmt.Sprintf("Binary values etcd:%s and etcd:%s differ\n", change.Key, change.Source)
+	}
+	fromFile, toFile := fmt.Sprintf("etcd:%s@%d", change.Key, change.TargetRevision), fmt.Sprintf("etcd:%s@%d", change.Source, change.SourceRevision)
+	var a, b []string
+	if change.Action == promoteCreate {
+		fromFile = "/dev/null"
+	} else {
+		a = diffLines(current)
+	}
+	if change.Action == promoteDelete {
+		toFile = "/dev/null"
+	} else {
+		b = diffLines(change.value)
+	}
+	diff, _ := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{A: a, B: b, FromFile: fromFile, ToFile: toFile, Context: 3})
+	return diff
+}
+
+// applyPromotion will write every change of p in one transaction, failing with errPromotionStale when a
+// target key changed since p was planned
+func applyPromotion(ctx context.Context, p *Promotion) (int64, error) {
+	var (
+		cmps []storeCmp
+		ops  []storeOp
+		size int
+	)
+	for _, change := range p.Changes {
+		cmps = append(cmps, storeCmp{Key: change.Key, Revision: change.TargetRevision},
+			storeCmp{Key: change.Key + mirrorSuffix, Revision: change.mirrorMetaRevision})
+		if change.Action == promoteDelete {
+			ops = append(ops, deleteOp(change.Key), deleteOp(change.Key+mirrorSuffix))
+			continue
+		}
+		doc, _ := json.Marshal(mirrorMeta{Source: change.Source, Revision: change.SourceRevision})
+		ops = append(ops, putOp(change.Key, change.value), putOp(change.Key+mirrorSuffix, doc))
+	}
+	if len(ops) == 0 {
+		return p.Revision, nil
+	}
+	for _, op := range ops {
+		size += opSize(op)
+	}
+	if len(ops) > txnMaxOps() || size > CMDArgs.TxnMaxBytes {
+		return 0, fmt.Errorf("%w: the promotion writes %d keys and %d bytes in one transaction, above --txn-max-ops or --txn-max-bytes",
+			errValueTooLarge, len(ops), size)
+	}
+	var (
+		succeeded bool
+		revision  int64
+	)
+	err := withETCDRetry(ctx, func(ctx context.Context) (err error) {
+		succeeded, revision, err = kvStore.Txn(ctx, cmps, ops)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	if !succeeded {
+		return 0, errPromotionStale
+	}
+	return revision, nil
+}
+
+// takePromotion will remove the pending promotion id and return it, leaving it pending when check fails
+func takePromotion(id string, check func(p *Promotion) error) (*Promotion, error) {
+	promotionsMu.Lock()
+	defer promotionsMu.Unlock()
+	expirePromotions()
+	p, ok := promotions[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errPromotionNotFound, id)
+	}
+	if check != nil {
+		if err := check(p); err != nil {
+			return nil, err
+		}
+	}
+	delete(promotions, id)
+	return p, nil
+}
+
+// expirePromotions will drop the pending promotions older than --promotion-ttl, promotionsMu must be held
+func expirePromotions() {
+	for id, p := range promotions {
+		if time.Since(p.Created) > CMDArgs.PromotionTTL {
+			delete(promotions, id)
+		}
+	}
+}
+
+// finishPromotion will apply p on behalf of user, logging and auditing the outcome
+func finishPromotion(ctx context.Context, p *Promotion, user string) error {
+	revision, err := applyPromotion(ctx, p)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"promotion": p.ID,
+			"from":      p.From,
+			"to":        p.To,
+			"err":       err,
+		}).Error("cannot apply promotion")
+		return err
+	}
+	p.Status, p.ApprovedBy, p.Revision = promotionApplied, user, revision
+	log.WithFields(log.Fields{
+		"promotion":  p.ID,
+		"from":       p.From,
+		"to":         p.To,
+		"changes":    len(p.Changes),
+		"approvedBy": user,
+		"revision":   revision,
+	}).Info("promotion applied")
+	writeAudit(auditEntry{
+		Action:  auditPromote,
+		ETCDKey: p.To,
+		Detail:  fmt.Sprintf("promoted %d changes from %s (promotion %s, approved by %s)", len(p.Changes), p.From, p.ID, user),
+	})
+	return nil
+}
+
+// promoteHandler - POST /v1/promotions, plans a promotion and applies it right away with apply
+func promoteHandler(c *gin.Context) {
+	var json PromotionModel
+	if err := c.ShouldBindJSON(&json); err != nil {
+		abortWithBadRequest(c, err)
+		return
+	}
+	if json.Apply && CMDArgs.PromotionRequireApproval {
+		abortWithErr(c, errApprovalRequired)
+		return
+	}
+	if json.Conflict == "" {
+		json.Conflict = mirrorConflictSource
+	}
+	if err := validatePromotion(json.From, json.To, json.Conflict); err != nil {
+		abortWithBadRequest(c, err)
+		return
+	}
+	p, err := planPromotion(c.Request.Context(), json.From, json.To, json.Conflict)
+	if err != nil {
+		abortWithErr(c, err)
+		return
+	}
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	p.ID, p.RequestedBy = hex.EncodeToString(buf), c.GetString(gin.AuthUserKey)
+	if json.Apply {
+		if err := finishPromotion(c.Request.Context(), p, p.RequestedBy); err != nil {
+			abortWithErr(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, p)
+		return
+	}
+	promotionsMu.Lock()
+	expirePromotions()
+	promotions[p.ID] = p
+	promotionsMu.Unlock()
+	log.WithFields(log.Fields{
+		"promotion": p.ID,
+		"from":      p.From,
+		"to":        p.To,
+		"changes":   len(p.Changes),
+	}).Info("promotion planned")
+	c.JSON(http.StatusOK, p)
+}
+
+// promotionsHandler - GET /v1/promotions, the pending promotions
+func promotionsHandler(c *gin.Context) {
+	promotionsMu.Lock()
+	expirePromotions()
+	pending := make([]Promotion, 0, len(promotions))
+	for _, p := range promotions {
+		pending = append(pending, *p)
+	}
+	promotionsMu.Unlock()
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Created.Before(pending[j].Created) })
+	c.JSON(http.StatusOK, PromotionsResponse{Promotions: pending})
+}
+
+// approvePromotionHandler - POST /v1/promotions/approve, applies a pending promotion
+func approvePromotionHandler(c *gin.Context) {
+	var json PromotionIDModel
+	if err := c.ShouldBindJSON(&json); err != nil {
+		abortWithBadRequest(c, err)
+		return
+	}
+	user := c.GetString(gin.AuthUserKey)
+	p, err := takePromotion(json.ID, func(p *Promotion) error {
+		if CMDArgs.PromotionRequireApproval && user != "" && user == p.RequestedBy {
+			return fmt.Errorf("%w by another user than %s", errApprovalRequired, user)
+		}
+		return nil
+	})
+	if err != nil {
+		abortWithErr(c, err)
+		return
+	}
+	if err := finishPromotion(c.Request.Context(), p, user); err != nil {
+		abortWithErr(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, p)
+}
+
+// rejectPromotionHandler - POST /v1/promotions/reject, drops a pending promotion
+func rejectPromotionHandler(c *gin.Context) {
+	var json PromotionIDModel
+	if err := c.ShouldBindJSON(&json); err != nil {
+		abortWithBadRequest(c, err)
+		return
+	}
+	p, err := takePromotion(json.ID, nil)
+	if err != nil {
+		abortWithErr(c, err)
+		return
+	}
+	p.Status = promotionRejected
+	log.WithFields(log.Fields{
+		"promotion":  p.ID,
+		"rejectedBy": c.GetString(gin.AuthUserKey),
+	}).Info("promotion rejected")
+	c.JSON(http.StatusOK, p)
+}
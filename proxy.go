@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// contextDialer is the dialer signature expected by grpc.WithContextDialer
+type contextDialer func(ctx context.Context, addr string) (net.Conn, error)
+
+// newProxyDialer will return a dialer reaching ETCD through proxyURL, which can be an
+// http://, https:// (HTTP CONNECT) or socks5:// proxy
+func newProxyDialer(proxyURL string) (contextDialer, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return func(ctx context.Context, addr string) (net.Conn, error) {
+			return dialHTTPConnect(ctx, u, addr)
+		}, nil
+	case "socks5", "socks5h":
+		d, err := proxy.FromURL(u, &net.Dialer{})
+		if err != nil {
+			return nil, err
+		}
+		cd, ok := d.(proxy.ContextDialer)
+		if !ok {
+			return nil, fmt.Errorf("proxy %s does not support contexts", u.Redacted())
+		}
+		return func(ctx context.Context, addr string) (net.Conn, error) {
+			return cd.DialContext(ctx, "tcp", addr)
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+}
+
+// dialHTTPConnect will open a tunnel to addr through the HTTP proxy u using the CONNECT method
+func dialHTTPConnect(ctx context.Context, u *url.URL, addr string) (net.Conn, error) {
+	proxyAddr := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "https" {
+			proxyAddr = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			proxyAddr = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	if u.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused CONNECT to %s: %s", u.Redacted(), addr, resp.Status)
+	}
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
+
+// bufferedConn keeps bytes the proxy may have sent right after its CONNECT response
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+// rateLimiterIdle is how long a client's limiter is kept after its last request
+const rateLimiterIdle = 10 * time.Minute
+
+// clientLimiter is the token bucket of one client
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// rateLimiter holds a token bucket per client
+type rateLimiter struct {
+	limit     rate.Limit
+	burst     int
+	mu        sync.Mutex
+	clients   map[string]*clientLimiter
+	lastPrune time.Time
+}
+
+// writeLimiter limits mutating requests to --rate-limit, it lets everything through without one
+var writeLimiter *rateLimiter
+
+// newRateLimiter will return a limiter allowing every client perSecond requests with bursts of burst, 0
+// for no limit
+func newRateLimiter(perSecond float64, burst int) *rateLimiter {
+	l := &rateLimiter{
+		clients:   make(map[string]*clientLimiter),
+		lastPrune: time.Now(),
+	}
+	l.set(perSecond, burst)
+	return l
+}
+
+// set will change the limit of l and of the clients it already saw
+func (l *rateLimiter) set(perSecond float64, burst int) {
+	limit := rate.Limit(perSecond)
+	if perSecond == 0 {
+		limit = rate.Inf
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit, l.burst = limit, burst
+	for _, c := range l.clients {
+		c.limiter.SetLimit(limit)
+		c.limiter.SetBurst(burst)
+	}
+}
+
+// reserve will take a token for client, returning how long to wait when there is none
+func (l *rateLimiter) reserve(client string) (retryAfter time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastPrune) > rateLimiterIdle {
+		for key, c := range l.clients {
+			if now.Sub(c.lastSeen) > rateLimiterIdle {
+				delete(l.clients, key)
+			}
+		}
+		l.lastPrune = now
+	}
+	c, ok := l.clients[client]
+	if !ok {
+		c = &clientLimiter{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[client] = c
+	}
+	c.lastSeen = now
+	r := c.limiter.ReserveN(now, 1)
+	if delay := r.DelayFrom(now); delay > 0 {
+		r.CancelAt(now)
+		return delay
+	}
+	return 0
+}
+
+// rateLimitClient will identify the client of c: the user it authenticated as with --basic-auth-file, so
+// users sharing an address are limited apart, otherwise its IP. Unverified headers are not trusted, a client
+// sending a different one with every request would never be limited.
+func rateLimitClient(c *gin.Context) string {
+	if user := c.GetString(gin.AuthUserKey); user != "" {
+		return "user:" + user
+	}
+	return "ip:" + remoteIP(c)
+}
+
+// rateLimit will answer 429 to clients going over the limit
+func rateLimit(l *rateLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client := rateLimitClient(c)
+		retryAfter := l.reserve(client)
+		if retryAfter == 0 {
+			c.Next()
+			return
+		}
+		rateLimited.Inc()
+		log.WithFields(log.Fields{
+			"path":       c.FullPath(),
+			"clientIP":   remoteIP(c),
+			"retryAfter": retryAfter,
+		}).Warn("API client rate limited")
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		abortWithError(c, http.StatusTooManyRequests, codeTooManyRequests, "rate limit exceeded", nil)
+	}
+}
+
+// isMutating reports whether requests to route change ETCD or the folder, those are rate limited
+func isMutating(route apiRoute) bool {
+	return route.Method != http.MethodGet
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// deepReconcile will hash every managed file and compare it with ETCD as of a single pinned revision,
+// using the last synced version of each file to tell which side changed. It catches what the fast scan
+// and the watch can miss: local edits that kept their modified time and remote changes made while the
+// watch was down. Files changed on both sides become conflicts.
+func deepReconcile(ctx context.Context, etcdKey, fileFolder string) {
+	kvs, pinnedRev, err := listKeys(ctx, etcdKey)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"etcdKey": etcdKey,
+			"err":     err,
+		}).Error("cannot read keys for deep reconciliation")
+		return
+	}
+	trackExpiries(kvs, nil)
+	remote := make(map[string]storeKV, len(kvs))
+	for _, kv := range kvs {
+		if !isReservedKey(kv.Key) {
+			remote[kv.Key] = kv
+		}
+	}
+
+	var (
+		drifts    []fileDrift
+		downloads []storeKV
+		uploads   = make(map[string]storeKV)
+	)
+	// the walker calls back concurrently
+	var mu sync.Mutex
+	err = walkFolder(fileFolder, CMDArgs.ScanWorkers, func(filePath string, info os.FileInfo) error {
+		key, err := filepath.Rel(fileFolder, filePath)
+		if err != nil {
+			return err
+		}
+		key = filepath.ToSlash(key)
+		if !strings.HasPrefix(key, etcdKey) || isReservedKey(key) || !inManifest(key) {
+			return nil
+		}
+		mu.Lock()
+		kv, ok := remote[key]
+		delete(remote, key)
+		mu.Unlock()
+		if isConflicted(filePath) || !isUploadable(filePath) {
+			return nil
+		}
+		if !ok {
+			mu.Lock()
+			drifts = append(drifts, fileDrift{ETCDKey: key, FilePath: filePath, Kind: driftMissingRemote})
+			mu.Unlock()
+			return nil
+		}
+
+		localHash, err := localFileHash(key, filePath, info)
+		if err != nil {
+			return err
+		}
+		remoteHash := syncHash(key, kv.Value)
+		synced, known := lastSynced(filePath)
+		switch {
+		case localHash == remoteHash:
+			recordSynced(filePath, localHash, kv.Revision)
+			setFileChangeTime(filePath, info.ModTime())
+		case known && synced.Hash == remoteHash:
+			// only the local file changed
+			mu.Lock()
+			uploads[key] = kv
+			mu.Unlock()
+		case known && synced.Hash == localHash:
+			// only ETCD changed
+			mu.Lock()
+			downloads = append(downloads, kv)
+			mu.Unlock()
+		default:
+			markConflict(key, filePath, kv.Value, kv.Revision)
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		log.WithFields(log.Fields{
+			"fileFolder": fileFolder,
+			"err":        err,
+		}).Error("deep reconciliation walker error")
+		return
+	}
+	for key, kv := range remote {
+		filePath := filepath.Join(fileFolder, key)
+		if _, known := lastSynced(filePath); known {
+			// deleted locally after being synced
+			drifts = append(drifts, fileDrift{
+				ETCDKey:  key,
+				FilePath: filePath,
+				Kind:     driftMissingLocal,
+				Value:    kv.Value,
+				Revision: kv.Revision,
+			})
+			continue
+		}
+		downloads = append(downloads, kv)
+	}
+
+	downloaded := 0
+	for _, kv := range downloads {
+		if verifyDownload(ctx, kv.Key, kv.Value, kv.Revision) != nil {
+			continue
+		}
+		filePath := filepath.Join(fileFolder, kv.Key)
+		if saveKeyToFolder(kv.Key, filePath, kv.Value, kv.Revision) != nil {
+			continue
+		}
+		downloaded++
+	}
+	uploaded := 0
+	for key, kv := range uploads {
+		if uploadIfUnchanged(ctx, key, filepath.Join(fileFolder, key), kv.Revision) {
+			uploaded++
+		}
+	}
+	log.WithFields(log.Fields{
+		"etcdKey":    etcdKey,
+		"revision":   pinnedRev,
+		"downloaded": downloaded,
+		"uploaded":   uploaded,
+		"drifted":    len(drifts),
+	}).Info("deep reconciliation done")
+	handleDrifts(ctx, drifts)
+}
+
+// uploadIfUnchanged will upload filePath to etcdKey only if the key is still at modRevision, so a
+// change made in ETCD after the pinned revision is never overwritten
+func uploadIfUnchanged(ctx context.Context, etcdKey, filePath string, modRevision int64) bool {
+	ops, _, hash, err := fileUploadOps(etcdKey, filePath)
+	if err != nil {
+		return false
+	}
+	var (
+		succeeded bool
+		revision  int64
+	)
+	err = withETCDRetry(ctx, func(ctx context.Context) (err error) {
+		succeeded, revision, err = kvStore.Txn(ctx, []storeCmp{{Key: etcdKey, Revision: modRevision}}, ops)
+		return err
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"etcdKey":  etcdKey,
+			"filePath": filePath,
+			"err":      err,
+		}).Error("error putting data to ETCD")
+		exitOnFatal(err)
+		failures.recordFailure(conditionUploadFailures, err)
+		return false
+	}
+	if !succeeded {
+		if kv, ok := alreadyUploaded(ctx, etcdKey, hash); ok {
+			// an earlier attempt was applied but its response lost
+			recordUpload(etcdKey, filePath, hash, len(ops[0].Value), kv.Revision)
+			return true
+		}
+		log.WithFields(log.Fields{
+			"etcdKey":     etcdKey,
+			"modRevision": modRevision,
+		}).Info("key changed in ETCD, skipping upload")
+		return false
+	}
+	recordUpload(etcdKey, filePath, hash, len(ops[0].Value), revision)
+	verifyUpload(ctx, etcdKey, filePath, ops, revision)
+	return true
+}
+
+// alreadyUploaded will return etcdKey when it holds the content of hash, written by an upload whose
+// acknowledgement was lost
+func alreadyUploaded(ctx context.Context, etcdKey, hash string) (*storeKV, bool) {
+	var kv *storeKV
+	err := withETCDRetry(ctx, func(ctx context.Context) (err error) {
+		kv, _, err = kvStore.Get(ctx, etcdKey)
+		return err
+	})
+	if err != nil || kv == nil || syncHash(etcdKey, kv.Value) != hash {
+		return nil, false
+	}
+	return kv, true
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisError is an error reply of the Redis server, its message starts with the error kind, ex: NOAUTH
+type redisError struct {
+	Message string
+}
+
+func (e *redisError) Error() string {
+	return "redis: " + e.Message
+}
+
+// Kind will return the error kind of the reply, ex: WRONGPASS
+func (e *redisError) Kind() string {
+	return strings.SplitN(e.Message, " ", 2)[0]
+}
+
+// redisConn is a connection to a Redis server speaking RESP2. It is not safe for concurrent use.
+type redisConn struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	w      *bufio.Writer
+	broken bool
+}
+
+// dialRedis will connect to addr, a host:port or a unix socket path, authenticate and select db
+func dialRedis(ctx context.Context, addr, username, password string, db int) (*redisConn, error) {
+	network := "tcp"
+	if strings.HasPrefix(addr, "unix://") || strings.HasPrefix(addr, "/") {
+		network, addr = "unix", strings.TrimPrefix(addr, "unix://")
+	}
+	dialer := net.Dialer{Timeout: dialTimeout}
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+	if password != "" {
+		args := []interface{}{"AUTH", password}
+		if username != "" {
+			args = []interface{}{"AUTH", username, password}
+		}
+		if _, err := c.do(ctx, args...); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if db != 0 {
+		if _, err := c.do(ctx, "SELECT", db); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if _, err := c.do(ctx, "PING"); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// do will send a command and read its reply: a string, int64, []byte, nil or []interface{} of those.
+// Error replies are returned as *redisError, the connection stays usable. The command is aborted when
+// ctx is done, the connection is then broken.
+func (c *redisConn) do(ctx context.Context, args ...interface{}) (interface{}, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.conn.SetDeadline(deadline)
+	} else {
+		c.conn.SetDeadline(time.Time{})
+	}
+	done, stopped := make(chan struct{}), make(chan struct{})
+	defer func() {
+		// the watcher must not move the deadline once the connection is back in the pool
+		close(done)
+		<-stopped
+	}()
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			c.conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	reply, err := c.roundTrip(args)
+	if err != nil {
+		var redisErr *redisError
+		if !errors.As(err, &redisErr) {
+			c.broken = true
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return reply, nil
+}
+
+// roundTrip will write args as an array of bulk strings and read the reply
+func (c *redisConn) roundTrip(args []interface{}) (interface{}, error) {
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		var b []byte
+		switch v := arg.(type) {
+		case []byte:
+			b = v
+		case string:
+			b = []byte(v)
+		case int:
+			b = strconv.AppendInt(nil, int64(v), 10)
+		case int64:
+			b = strconv.AppendInt(nil, v, 10)
+		default:
+			b = []byte(fmt.Sprint(v))
+		}
+		fmt.Fprintf(c.w, "$%d\r\n", len(b))
+		c.w.Write(b)
+		c.w.WriteString("\r\n")
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	reply, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+	if redisErr, ok := reply.(*redisError); ok {
+		return nil, redisErr
+	}
+	return reply, nil
+}
+
+// read will read one reply, error replies nested in arrays are returned as *redisError values
+func (c *redisConn) read() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return &redisError{Message: body}, nil
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+}
+
+// Close will close the connection
+func (c *redisConn) Close() error {
+	return c.conn.Close()
+}
+
+// redisInt will convert an integer or bulk string reply to an int64, 0 for nil
+func redisInt(reply interface{}) int64 {
+	switch v := reply.(type) {
+	case int64:
+		return v
+	case []byte:
+		n, _ := strconv.ParseInt(string(v), 10, 64)
+		return n
+	case string:
+		n, _ := strconv.ParseInt(v, 10, 64)
+		return n
+	}
+	return 0
+}
+
+// redisBytes will convert a bulk or simple string reply to bytes, nil for a nil reply
+func redisBytes(reply interface{}) []byte {
+	switch v := reply.(type) {
+	case []byte:
+		return v
+	case string:
+		return []byte(v)
+	}
+	return nil
+}
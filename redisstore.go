@@ -0,0 +1,503 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/doody/etcd_file_syncer/backend"
+)
+
+const (
+	// redisMaxValueSize is Redis' default proto-max-bulk-len
+	redisMaxValueSize = 512 * 1024 * 1024
+	// redisMaxBlock is the longest a watch blocks on the change stream without a progress notification
+	redisMaxBlock = 5 * time.Minute
+	// redisReadCount is the most changes a watch reads from the stream at once
+	redisReadCount = 1000
+	// redisIdleConns is the number of connections kept open between commands
+	redisIdleConns = 4
+)
+
+func init() {
+	backend.Register(backend.Backend{
+		Name: backendRedis,
+		Open: func(ctx context.Context, opts backend.Options) (store, error) {
+			return connectRedis(ctx, CMDArgs.RedisAddr, opts.StartupRetries)
+		},
+		Classify: classifyRedisError,
+	})
+}
+
+// classifyRedisError will classify redisErrors by kind
+func classifyRedisError(err error) backend.ErrorClass {
+	var redisErr *redisError
+	if !errors.As(err, &redisErr) {
+		return backend.ErrorOther
+	}
+	switch redisErr.Kind() {
+	case "NOAUTH", "WRONGPASS", "NOPERM":
+		return backend.ErrorAuth
+	case "LOADING", "BUSY", "TRYAGAIN", "MASTERDOWN", "CLUSTERDOWN":
+		return backend.ErrorTransient
+	}
+	return backend.ErrorFailed
+}
+
+// The scripts below run atomically on the server. KEYS[1] is the revision counter, KEYS[2] the hash of
+// the revision of every key and KEYS[3] the change stream.
+
+// redisGetScript returns the store revision, then the value and revision of ARGV[1] when it exists
+const redisGetScript = `-- get
+local out = {redis.call('GET', KEYS[1]) or '0'}
+local rev = redis.call('HGET', KEYS[2], ARGV[1])
+local value = redis.call('GET', ARGV[1])
+if rev and value then
+	table.insert(out, value)
+	table.insert(out, rev)
+end
+return out`
+
+// redisListScript returns the store revision, then the key, value and revision of every key under ARGV[1]
+const redisListScript = `-- list
+local out = {redis.call('GET', KEYS[1]) or '0'}
+local revs = redis.call('HGETALL', KEYS[2])
+for i = 1, #revs, 2 do
+	if string.sub(revs[i], 1, #ARGV[1]) == ARGV[1] then
+		local value = redis.call('GET', revs[i])
+		if value then
+			table.insert(out, revs[i])
+			table.insert(out, value)
+			table.insert(out, revs[i + 1])
+		end
+	end
+end
+return out`
+
+// redisRevisionScript returns the store revision and the last revision of a key under ARGV[1]
+const redisRevisionScript = `-- revision
+local last = 0
+local revs = redis.call('HGETALL', KEYS[2])
+for i = 1, #revs, 2 do
+	if string.sub(revs[i], 1, #ARGV[1]) == ARGV[1] and tonumber(revs[i + 1]) > last then
+		last = tonumber(revs[i + 1])
+	end
+end
+return {tonumber(redis.call('GET', KEYS[1]) or '0'), last}`
+
+// redisValuesScript returns the value and revision of every key of ARGV, false for missing ones
+const redisValuesScript = `-- values
+local out = {}
+for _, key in ipairs(ARGV) do
+	table.insert(out, redis.call('GET', key))
+	table.insert(out, redis.call('HGET', KEYS[2], key))
+end
+return out`
+
+// redisTxnScript checks the ARGV[2] key/revision pairs following it, then applies the op/key/value
+// triples after them at a new revision, each logged to the stream capped to ARGV[1] entries. It returns
+// whether the checks held and the revision of the write.
+const redisTxnScript = `-- txn
+local i = 3
+for _ = 1, tonumber(ARGV[2]) do
+	if tonumber(redis.call('HGET', KEYS[2], ARGV[i]) or '0') ~= tonumber(ARGV[i + 1]) then
+		return {0, 0}
+	end
+	i = i + 2
+end
+if i > #ARGV then
+	return {1, tonumber(redis.call('GET', KEYS[1]) or '0')}
+end
+local rev = redis.call('INCR', KEYS[1])
+local seq = 0
+while i <= #ARGV do
+	local op, key = ARGV[i], ARGV[i + 1]
+	redis.call('XADD', KEYS[3], 'MAXLEN', '~', ARGV[1], rev .. '-' .. seq, 'type', op, 'key', key)
+	if op == 'put' then
+		redis.call('SET', key, ARGV[i + 2])
+		redis.call('HSET', KEYS[2], key, rev)
+	else
+		redis.call('DEL', key)
+		redis.call('HDEL', KEYS[2], key)
+	end
+	seq = seq + 1
+	i = i + 3
+end
+return {1, rev}`
+
+// redisStore is the store of a Redis server. Values are plain string keys, so they can be read with any
+// client, but only the keys written through the syncer are part of the store: a counter provides the
+// revisions, a hash the revision of every key and a stream logs every change at an ID made of its
+// revision, which watches follow.
+type redisStore struct {
+	addr     string
+	username string
+	password string
+	db       int
+	// keys of the revision counter, the revision hash and the change stream
+	counterKey   string
+	revisionsKey string
+	streamKey    string
+
+	idle chan *redisConn
+}
+
+// connectRedis will create the Redis store and make sure the server answers, retrying up to retries
+// times with exponential backoff
+func connectRedis(ctx context.Context, addr string, retries int) (store, error) {
+	namespace := CMDArgs.RedisNamespace
+	s := &redisStore{
+		addr:         addr,
+		username:     CMDArgs.RedisUsername,
+		password:     CMDArgs.RedisPassword,
+		db:           CMDArgs.RedisDB,
+		counterKey:   namespace + ":revision",
+		revisionsKey: namespace + ":revisions",
+		streamKey:    namespace + ":changes",
+		idle:         make(chan *redisConn, redisIdleConns),
+	}
+	err := retryStartup(ctx, retries, "Redis", func() error {
+		c, err := s.dial(ctx)
+		if err != nil {
+			return err
+		}
+		s.release(c)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// dial will open a new connection to the server
+func (s *redisStore) dial(ctx context.Context) (*redisConn, error) {
+	return dialRedis(ctx, s.addr, s.username, s.password, s.db)
+}
+
+// acquire will return an idle connection, or a new one when there is none
+func (s *redisStore) acquire(ctx context.Context) (*redisConn, error) {
+	select {
+	case c := <-s.idle:
+		return c, nil
+	default:
+		return s.dial(ctx)
+	}
+}
+
+// release will keep c for the next command, closing it when it is broken or enough are idle
+func (s *redisStore) release(c *redisConn) {
+	if !c.broken {
+		select {
+		case s.idle <- c:
+			return
+		default:
+		}
+	}
+	c.Close()
+}
+
+// do will run one command on an idle connection
+func (s *redisStore) do(ctx context.Context, args ...interface{}) (interface{}, error) {
+	c, err := s.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer s.release(c)
+	return c.do(ctx, args...)
+}
+
+// eval will run script with the store keys and args, on c when it is set
+func (s *redisStore) eval(ctx context.Context, c *redisConn, script string, args ...interface{}) ([]interface{}, error) {
+	cmd := append([]interface{}{"EVAL", script, 3, s.counterKey, s.revisionsKey, s.streamKey}, args...)
+	var (
+		reply interface{}
+		err   error
+	)
+	if c != nil {
+		reply, err = c.do(ctx, cmd...)
+	} else {
+		reply, err = s.do(ctx, cmd...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	items, ok := reply.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("redis: unexpected script reply %T", reply)
+	}
+	return items, nil
+}
+
+// Get - store
+func (s *redisStore) Get(ctx context.Context, key string) (*storeKV, int64, error) {
+	items, err := s.eval(ctx, nil, redisGetScript, key)
+	if err != nil || len(items) == 0 {
+		return nil, 0, err
+	}
+	revision := redisInt(items[0])
+	if len(items) < 3 {
+		return nil, revision, nil
+	}
+	return &storeKV{Key: key, Value: redisBytes(items[1]), Revision: redisInt(items[2])}, revision, nil
+}
+
+// List - store
+func (s *redisStore) List(ctx context.Context, prefix string) ([]storeKV, int64, error) {
+	items, err := s.eval(ctx, nil, redisListScript, prefix)
+	if err != nil || len(items) == 0 {
+		return nil, 0, err
+	}
+	kvs := make([]storeKV, 0, len(items)/3)
+	for i := 1; i+2 < len(items); i += 3 {
+		kvs = append(kvs, storeKV{
+			Key:      string(redisBytes(items[i])),
+			Value:    redisBytes(items[i+1]),
+			Revision: redisInt(items[i+2]),
+		})
+	}
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+	return kvs, redisInt(items[0]), nil
+}
+
+// Txn - store
+func (s *redisStore) Txn(ctx context.Context, cmps []storeCmp, ops []storeOp) (bool, int64, error) {
+	args := make([]interface{}, 0, 2+2*len(cmps)+3*len(ops))
+	args = append(args, CMDArgs.RedisStreamLength, len(cmps))
+	for _, cmp := range cmps {
+		args = append(args, cmp.Key, cmp.Revision)
+	}
+	for _, op := range ops {
+		if op.Delete {
+			args = append(args, storeEventDelete, op.Key, "")
+		} else {
+			args = append(args, storeEventPut, op.Key, op.Value)
+		}
+	}
+	items, err := s.eval(ctx, nil, redisTxnScript, args...)
+	if err != nil {
+		return false, 0, err
+	}
+	if len(items) != 2 {
+		return false, 0, fmt.Errorf("redis: unexpected txn reply of %d items", len(items))
+	}
+	return redisInt(items[0]) == 1, redisInt(items[1]), nil
+}
+
+// streamRevision will return the revision of the stream entry ID id, <revision>-<seq>
+func streamRevision(id string) int64 {
+	rev, _ := strconv.ParseInt(strings.SplitN(id, "-", 2)[0], 10, 64)
+	return rev
+}
+
+// Watch - store. Changes are read from the stream with a blocking XREAD on a connection of its own, a
+// read timing out is the progress notification. The stream only names the changed keys, values are read
+// afterwards and a put superseded in the meantime is skipped, the later change follows.
+func (s *redisStore) Watch(ctx context.Context, prefix string, revision int64) <-chan storeWatchResponse {
+	out := make(chan storeWatchResponse)
+	block := CMDArgs.WatchStallTimeout / 2
+	if block > redisMaxBlock || block < time.Second {
+		block = redisMaxBlock
+	}
+	go func() {
+		defer close(out)
+		send := func(resp storeWatchResponse) bool {
+			select {
+			case out <- resp:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		c, err := s.dial(ctx)
+		if err != nil {
+			send(storeWatchResponse{Err: err})
+			return
+		}
+		defer c.Close()
+		head, err := c.do(ctx, "GET", s.counterKey)
+		if err != nil {
+			send(storeWatchResponse{Err: err})
+			return
+		}
+		headRev := redisInt(head)
+		if revision == 0 {
+			revision = headRev
+		}
+		if revision < headRev {
+			// the changes after revision must still be in the stream
+			first, err := c.do(ctx, "XRANGE", s.streamKey, "-", "+", "COUNT", 1)
+			if err != nil {
+				send(storeWatchResponse{Err: err})
+				return
+			}
+			entries, _ := first.([]interface{})
+			if len(entries) == 0 {
+				send(storeWatchResponse{Revision: headRev, CompactRevision: headRev})
+				return
+			}
+			entry, _ := entries[0].([]interface{})
+			if len(entry) > 0 {
+				if firstRev := streamRevision(string(redisBytes(entry[0]))); firstRev > revision+1 {
+					send(storeWatchResponse{Revision: headRev, CompactRevision: firstRev - 1})
+					return
+				}
+			}
+		}
+		if revision > headRev {
+			// the counter went backwards, the server lost its data since revision
+			send(storeWatchResponse{Revision: headRev, CompactRevision: headRev})
+			return
+		}
+		if !send(storeWatchResponse{Revision: revision}) {
+			return
+		}
+		last := fmt.Sprintf("%d-%d", revision, uint64(math.MaxUint64))
+		for {
+			reply, err := c.do(ctx, "XREAD", "COUNT", redisReadCount, "BLOCK", block.Milliseconds(), "STREAMS", s.streamKey, last)
+			if err != nil {
+				if ctx.Err() == nil {
+					send(storeWatchResponse{Err: err})
+				}
+				return
+			}
+			resp, next, err := s.readChanges(ctx, c, prefix, reply)
+			if err != nil {
+				send(storeWatchResponse{Err: err})
+				return
+			}
+			if next != "" {
+				last, revision = next, resp.Revision
+			}
+			resp.Revision = revision
+			if !send(resp) {
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// readChanges will turn an XREAD reply into the events under prefix, returning the ID of the last entry
+// read, empty when there was none
+func (s *redisStore) readChanges(ctx context.Context, c *redisConn, prefix string, reply interface{}) (storeWatchResponse, string, error) {
+	var resp storeWatchResponse
+	streams, _ := reply.([]interface{})
+	if len(streams) == 0 {
+		return resp, "", nil
+	}
+	stream, _ := streams[0].([]interface{})
+	if len(stream) < 2 {
+		return resp, "", nil
+	}
+	entries, _ := stream[1].([]interface{})
+	var (
+		last string
+		puts []interface{}
+	)
+	for _, e := range entries {
+		entry, _ := e.([]interface{})
+		if len(entry) < 2 {
+			continue
+		}
+		last = string(redisBytes(entry[0]))
+		rev := streamRevision(last)
+		resp.Revision = rev
+		fields, _ := entry[1].([]interface{})
+		var op, key string
+		for i := 0; i+1 < len(fields); i += 2 {
+			switch string(redisBytes(fields[i])) {
+			case "type":
+				op = string(redisBytes(fields[i+1]))
+			case "key":
+				key = string(redisBytes(fields[i+1]))
+			}
+		}
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		eventType := storeEventPut
+		if op == storeEventDelete {
+			eventType = storeEventDelete
+		} else {
+			puts = append(puts, key)
+		}
+		resp.Events = append(resp.Events, storeEvent{Type: eventType, KV: storeKV{Key: key, Revision: rev}})
+	}
+	if len(entries) == redisReadCount {
+		// the entries of the last revision may go on in the next read
+		resp.Revision--
+	}
+	if len(puts) == 0 {
+		return resp, last, nil
+	}
+	values, err := s.eval(ctx, c, redisValuesScript, puts...)
+	if err != nil {
+		return resp, "", err
+	}
+	current := make(map[string]storeKV, len(puts))
+	for i := 0; i+1 < len(values) && i/2 < len(puts); i += 2 {
+		key := puts[i/2].(string)
+		if values[i] != nil && values[i+1] != nil {
+			current[key] = storeKV{Key: key, Value: redisBytes(values[i]), Revision: redisInt(values[i+1])}
+		}
+	}
+	events := resp.Events[:0]
+	for _, ev := range resp.Events {
+		if ev.Type == storeEventPut {
+			kv, ok := current[ev.KV.Key]
+			if !ok || kv.Revision != ev.KV.Revision {
+				continue
+			}
+			ev.KV = kv
+		}
+		events = append(events, ev)
+	}
+	resp.Events = events
+	return resp, last, nil
+}
+
+// Revision - store
+func (s *redisStore) Revision(ctx context.Context, prefix string) (int64, int64, error) {
+	items, err := s.eval(ctx, nil, redisRevisionScript, prefix)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(items) != 2 {
+		return 0, 0, fmt.Errorf("redis: unexpected revision reply of %d items", len(items))
+	}
+	return redisInt(items[0]), redisInt(items[1]), nil
+}
+
+// Compact - compactor, drops the stream entries older than revision
+func (s *redisStore) Compact(ctx context.Context, revision int64) error {
+	_, err := s.do(ctx, "XTRIM", s.streamKey, "MINID", revision)
+	return err
+}
+
+// MaxValueSize - store
+func (s *redisStore) MaxValueSize() int {
+	return redisMaxValueSize
+}
+
+// MaxTxnOps - store
+func (s *redisStore) MaxTxnOps() int {
+	return 0
+}
+
+// Close - store
+func (s *redisStore) Close() error {
+	for {
+		select {
+		case c := <-s.idle:
+			c.Close()
+		default:
+			return nil
+		}
+	}
+}
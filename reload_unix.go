@@ -0,0 +1,67 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// signalNames are the signals --reload-signal accepts
+var signalNames = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"TERM": syscall.SIGTERM,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+// reloadSignal is the parsed --reload-signal
+var reloadSignal os.Signal
+
+// parseSignal will return the signal named name, with or without its SIG prefix
+func parseSignal(name string) (os.Signal, error) {
+	sig, ok := signalNames[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	if !ok {
+		return nil, fmt.Errorf("unknown signal %q", name)
+	}
+	return sig, nil
+}
+
+// signalProcesses will send sig to every process whose command name or executable base name is name,
+// returning how many were signaled. Processes are found in /proc, other containers' are only visible
+// when the pod shares its process namespace.
+func signalProcesses(name string, sig os.Signal) (int, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		comm, _ := os.ReadFile(filepath.Join("/proc", entry.Name(), "comm"))
+		cmdline, _ := os.ReadFile(filepath.Join("/proc", entry.Name(), "cmdline"))
+		argv0 := strings.SplitN(string(cmdline), "\x00", 2)[0]
+		if strings.TrimSpace(string(comm)) != name && (argv0 == "" || filepath.Base(argv0) != name) {
+			continue
+		}
+		process, err := os.FindProcess(pid)
+		if err != nil {
+			continue
+		}
+		if err := process.Signal(sig); err != nil {
+			return count, fmt.Errorf("pid %d: %v", pid, err)
+		}
+		count++
+	}
+	return count, nil
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// reloadSignal is the parsed --reload-signal
+var reloadSignal os.Signal
+
+// parseSignal is not supported on windows
+func parseSignal(name string) (os.Signal, error) {
+	return nil, errors.New("--reload-signal is not supported on windows")
+}
+
+// signalProcesses is not supported on windows
+func signalProcesses(name string, sig os.Signal) (int, error) {
+	return 0, errors.New("--reload-process is not supported on windows")
+}
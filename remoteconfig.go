@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// remoteConfigDir is the directory under --key whose keys override settings of every syncer of the key, a
+// key per setting named after its flag
+const remoteConfigDir = ".syncer-config/"
+
+// remoteSetting is a setting that can be changed under remoteConfigDir while the syncer runs
+type remoteSetting struct {
+	// apply will parse and apply value, leaving the current setting on error
+	apply func(value string) error
+	// flag will return the value given on the command line, applied again when the key is deleted
+	flag func() string
+}
+
+var (
+	// remoteOverrides are the values of the keys under remoteConfigDir applied, by setting
+	remoteOverrides = make(map[string]string)
+
+	// settingsMu guards the settings below, onlyExtensions and onlyMIMETypes
+	settingsMu     sync.Mutex
+	maxFiles       int
+	maxTotalBytes  int64
+	rateLimitRate  float64
+	rateLimitBurst int
+	// scanIntervalNanos is the interval of the folder scan
+	scanIntervalNanos int64
+)
+
+// remoteSettings are the settings that can be changed under remoteConfigDir
+var remoteSettings = map[string]remoteSetting{
+	"scan-interval": {
+		apply: func(value string) error {
+			d, err := time.ParseDuration(value)
+			if err != nil || d < time.Second {
+				return fmt.Errorf("%q is not a duration of at least 1s", value)
+			}
+			atomic.StoreInt64(&scanIntervalNanos, int64(d))
+			return nil
+		},
+		flag: func() string { return CMDArgs.ScanInterval.String() },
+	},
+	"log-level": {
+		apply: func(value string) error {
+			level, err := log.ParseLevel(value)
+			if err != nil {
+				return err
+			}
+			log.SetLevel(level)
+			return nil
+		},
+		flag: func() string { return log.InfoLevel.String() },
+	},
+	"only-ext": {
+		apply: func(value string) error {
+			exts := parseExtensions([]string{value})
+			settingsMu.Lock()
+			onlyExtensions = exts
+			settingsMu.Unlock()
+			return nil
+		},
+		flag: func() string { return strings.Join(CMDArgs.OnlyExtensions, ",") },
+	},
+	"only-mime": {
+		apply: func(value string) error {
+			patterns, err := parseMIMETypes([]string{value})
+			if err != nil {
+				return err
+			}
+			settingsMu.Lock()
+			onlyMIMETypes = patterns
+			settingsMu.Unlock()
+			return nil
+		},
+		flag: func() string { return strings.Join(CMDArgs.OnlyMIMETypes, ",") },
+	},
+	"max-files": {
+		apply: func(value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return fmt.Errorf("%q is not a file count", value)
+			}
+			settingsMu.Lock()
+			maxFiles = n
+			settingsMu.Unlock()
+			return nil
+		},
+		flag: func() string { return strconv.Itoa(CMDArgs.MaxFiles) },
+	},
+	"max-total-bytes": {
+		apply: func(value string) error {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 0 {
+				return fmt.Errorf("%q is not a byte count", value)
+			}
+			settingsMu.Lock()
+			maxTotalBytes = n
+			settingsMu.Unlock()
+			return nil
+		},
+		flag: func() string { return strconv.FormatInt(CMDArgs.MaxTotalBytes, 10) },
+	},
+	"rate-limit": {
+		apply: func(value string) error {
+			n, err := strconv.ParseFloat(value, 64)
+			if err != nil || n < 0 {
+				return fmt.Errorf("%q is not a positive number of requests per second", value)
+			}
+			settingsMu.Lock()
+			rateLimitRate = n
+			settingsMu.Unlock()
+			updateRateLimit()
+			return nil
+		},
+		flag: func() string { return strconv.FormatFloat(CMDArgs.RateLimit, 'f', -1, 64) },
+	},
+	"rate-limit-burst": {
+		apply: func(value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return fmt.Errorf("%q is not a burst of at least 1", value)
+			}
+			settingsMu.Lock()
+			rateLimitBurst = n
+			settingsMu.Unlock()
+			updateRateLimit()
+			return nil
+		},
+		flag: func() string { return strconv.Itoa(CMDArgs.RateLimitBurst) },
+	},
+}
+
+// initSettings will set the live settings from the command line
+func initSettings() {
+	settingsMu.Lock()
+	maxFiles, maxTotalBytes = CMDArgs.MaxFiles, CMDArgs.MaxTotalBytes
+	rateLimitRate, rateLimitBurst = CMDArgs.RateLimit, CMDArgs.RateLimitBurst
+	settingsMu.Unlock()
+	atomic.StoreInt64(&scanIntervalNanos, int64(CMDArgs.ScanInterval))
+}
+
+// guardLimits will return the current --max-files and --max-total-bytes
+func guardLimits() (int, int64) {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	return maxFiles, maxTotalBytes
+}
+
+// scanInterval will return the current --scan-interval
+func scanInterval() time.Duration {
+	return time.Duration(atomic.LoadInt64(&scanIntervalNanos))
+}
+
+// updateRateLimit will apply the current --rate-limit and --rate-limit-burst to the API
+func updateRateLimit() {
+	settingsMu.Lock()
+	perSecond, burst := rateLimitRate, rateLimitBurst
+	settingsMu.Unlock()
+	writeLimiter.set(perSecond, burst)
+}
+
+// isRemoteConfigKey reports whether etcdKey is under the remote configuration directory of --key
+func isRemoteConfigKey(etcdKey string) bool {
+	return strings.HasPrefix(etcdKey, CMDArgs.ConfigKey+remoteConfigDir)
+}
+
+// loadRemoteConfig will apply the settings stored under the remote configuration directory at startup
+func loadRemoteConfig(ctx context.Context) {
+	var kvs []storeKV
+	err := withETCDRetry(ctx, func(ctx context.Context) (err error) {
+		kvs, _, err = kvStore.List(ctx, CMDArgs.ConfigKey+remoteConfigDir)
+		return err
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"prefix": CMDArgs.ConfigKey + remoteConfigDir,
+			"err":    err,
+		}).Error("cannot read remote configuration, using the flags")
+		return
+	}
+	for _, kv := range kvs {
+		applyRemoteSetting(kv.Key, kv.Value, false)
+	}
+}
+
+// applyRemoteSetting will apply value of the setting stored in etcdKey, or the flag again when deleted
+func applyRemoteSetting(etcdKey string, value []byte, deleted bool) {
+	name := strings.TrimPrefix(etcdKey, CMDArgs.ConfigKey+remoteConfigDir)
+	setting, ok := remoteSettings[name]
+	if !ok {
+		log.WithFields(log.Fields{
+			"etcdKey": etcdKey,
+			"known":   strings.Join(remoteSettingNames(), ", "),
+		}).Warn("unknown remote setting, ignored")
+		return
+	}
+	v := strings.TrimSpace(string(value))
+	if deleted {
+		v = setting.flag()
+	}
+	if err := setting.apply(v); err != nil {
+		log.WithFields(log.Fields{
+			"setting": name,
+			"value":   v,
+			"err":     err,
+		}).Error("invalid remote setting, keeping the current value")
+		return
+	}
+	settingsMu.Lock()
+	if deleted {
+		delete(remoteOverrides, name)
+	} else {
+		remoteOverrides[name] = v
+	}
+	settingsMu.Unlock()
+	log.WithFields(log.Fields{
+		"setting":  name,
+		"value":    v,
+		"fromFlag": deleted,
+	}).Info("remote setting applied")
+}
+
+// listRemoteOverrides will return the settings currently overridden under the remote configuration directory
+func listRemoteOverrides() map[string]string {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	if len(remoteOverrides) == 0 {
+		return nil
+	}
+	overrides := make(map[string]string, len(remoteOverrides))
+	for name, value := range remoteOverrides {
+		overrides[name] = value
+	}
+	return overrides
+}
+
+// remoteSettingNames will return the names of the settings that can be overridden, sorted
+func remoteSettingNames() []string {
+	names := make([]string, 0, len(remoteSettings))
+	for name := range remoteSettings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// reportMaxErrors is the number of recent errors kept for the report
+const reportMaxErrors = 100
+
+// syncReport is the document written to --report-file
+type syncReport struct {
+	GeneratedAt     time.Time      `json:"generatedAt"`
+	Instance        string         `json:"instance"`
+	ETCDKey         string         `json:"etcdKey"`
+	FileFolder      string         `json:"fileFolder"`
+	AppliedRevision int64          `json:"appliedRevision"`
+	UploadsPaused   bool           `json:"uploadsPaused"`
+	Files           []reportFile   `json:"files"`
+	Conflicts       []fileConflict `json:"conflicts"`
+	Errors          []reportError  `json:"errors"`
+}
+
+// reportFile is a synced file of the report
+type reportFile struct {
+	ETCDKey  string    `json:"etcdKey"`
+	FilePath string    `json:"filePath"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"modTime"`
+	// SHA256 is the checksum of the local content, InSync whether it is the content last synced at Revision
+	SHA256   string `json:"sha256"`
+	Revision int64  `json:"revision"`
+	InSync   bool   `json:"inSync"`
+	// Verification is the read back of the last upload, with --verify-writes
+	Verification *writeVerification `json:"verification,omitempty"`
+}
+
+// reportError is an error logged by the syncer
+type reportError struct {
+	Time    time.Time         `json:"time"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// errorRecorder is a logrus hook keeping the most recent errors
+type errorRecorder struct {
+	mu     sync.Mutex
+	errors []reportError
+}
+
+// recentErrors is registered as a logrus hook when --report-file is given
+var recentErrors = &errorRecorder{}
+
+// Levels - logrus.Hook
+func (r *errorRecorder) Levels() []log.Level {
+	return []log.Level{log.PanicLevel, log.FatalLevel, log.ErrorLevel}
+}
+
+// Fire - logrus.Hook
+func (r *errorRecorder) Fire(entry *log.Entry) error {
+	e := reportError{Time: entry.Time, Message: entry.Message, Fields: make(map[string]string, len(entry.Data))}
+	for key, value := range entry.Data {
+		e.Fields[key] = fmt.Sprint(value)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.errors = append(r.errors, e)
+	if len(r.errors) > reportMaxErrors {
+		r.errors = r.errors[len(r.errors)-reportMaxErrors:]
+	}
+	return nil
+}
+
+// list will return a copy of the recorded errors, oldest first
+func (r *errorRecorder) list() []reportError {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]reportError{}, r.errors...)
+}
+
+// buildReport will collect the syncer's view of fileFolder: every synced file with its local checksum,
+// conflicts and recent errors
+func buildReport(etcdKey, fileFolder string) syncReport {
+	fileChangeMu.Lock()
+	synced := make(map[string]syncedVersion, len(syncedState))
+	for filePath, version := range syncedState {
+		synced[filePath] = version
+	}
+	fileChangeMu.Unlock()
+
+	report := syncReport{
+		GeneratedAt:     time.Now().UTC(),
+		Instance:        instanceName,
+		ETCDKey:         etcdKey,
+		FileFolder:      fileFolder,
+		AppliedRevision: atomic.LoadInt64(&appliedRevision),
+		Files:           make([]reportFile, 0, len(synced)),
+		Conflicts:       listConflicts(),
+		Errors:          recentErrors.list(),
+	}
+	pausedUploadsMu.Lock()
+	report.UploadsPaused = len(pausedUploads) > 0
+	pausedUploadsMu.Unlock()
+	for filePath, version := range synced {
+		key, err := filepath.Rel(fileFolder, filePath)
+		if err != nil || strings.HasPrefix(key, "..") {
+			// downloaded elsewhere through the API
+			continue
+		}
+		info, err := os.Stat(filePath)
+		if err != nil {
+			continue
+		}
+		content, err := os.ReadFile(filePath)
+		if err != nil {
+			continue
+		}
+		key = filepath.ToSlash(key)
+		hash := fileSyncHash(key, content)
+		file := reportFile{
+			ETCDKey:  key,
+			FilePath: filePath,
+			Size:     info.Size(),
+			ModTime:  info.ModTime().UTC(),
+			SHA256:   hash,
+			Revision: version.Revision,
+			InSync:   hash == version.Hash,
+		}
+		if verification, ok := lastVerification(filePath); ok {
+			file.Verification = &verification
+		}
+		report.Files = append(report.Files, file)
+	}
+	sort.Slice(report.Files, func(i, j int) bool { return report.Files[i].ETCDKey < report.Files[j].ETCDKey })
+	return report
+}
+
+// writeReport will write the report of fileFolder to reportPath, replacing the previous one atomically so
+// readers never see a partial document
+func writeReport(reportPath, etcdKey, fileFolder string) error {
+	content, err := json.MarshalIndent(buildReport(etcdKey, fileFolder), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := reportPath + ".tmp"
+	if err := os.WriteFile(tmp, append(content, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, reportPath)
+}
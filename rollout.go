@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// errRolloutCancelled is returned when saving a revision of a key whose rollout was cancelled on this node
+var errRolloutCancelled = errors.New("rollout cancelled on this node")
+
+// errRolloutPending is returned when saving a revision of a key whose change is held, until it is due
+var errRolloutPending = errors.New("change held until due")
+
+// RolloutChange is a change of ETCD held back by --apply-delay or --sync-window
+type RolloutChange struct {
+	Key      string    `json:"key"`
+	Action   string    `json:"action"`
+	Revision int64     `json:"revision"`
+	Received time.Time `json:"received"`
+	Due      time.Time `json:"due"`
+
+	event storeEvent
+}
+
+// RolloutResponse - GET /v1/rollout
+type RolloutResponse struct {
+	Cohort  string   `json:"cohort,omitempty"`
+	Delay   string   `json:"delay"`
+	Windows []string `json:"windows,omitempty"`
+	// NextWindow is when changes may next be applied, now while a window is open
+	NextWindow *time.Time      `json:"nextWindow,omitempty"`
+	Pending    []RolloutChange `json:"pending"`
+}
+
+// RolloutCancelModel - POST /v1/rollout/cancel
+type RolloutCancelModel struct {
+	// Prefix limits the cancel to the keys starting with it, every pending change without it
+	Prefix string `json:"prefix"`
+}
+
+// RolloutCancelResponse - POST /v1/rollout/cancel
+type RolloutCancelResponse struct {
+	Cancelled []RolloutChange `json:"cancelled"`
+}
+
+var (
+	// applyDelay is how long changes of ETCD are held before being applied on this node, from --apply-delay
+	applyDelay time.Duration
+
+	// pendingRollout maps keys to their latest change not applied yet
+	pendingRollout = make(map[string]*RolloutChange)
+	// cancelledRollout maps keys to the last revision cancelled, it is not applied on this node
+	cancelledRollout = make(map[string]int64)
+	rolloutMu        sync.Mutex
+)
+
+// parseApplyDelay will return the --apply-delay of cohort from args, each a duration applying to every
+// cohort or a cohort=duration overriding it
+func parseApplyDelay(args []string, cohort string) (time.Duration, error) {
+	var delay, cohortDelay time.Duration
+	found := false
+	for _, a := range args {
+		name, value := "", a
+		if i := strings.Index(a, "="); i >= 0 {
+			name, value = a[:i], a[i+1:]
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return 0, fmt.Errorf("%q is not duration or cohort=duration", a)
+		}
+		switch {
+		case name == "":
+			delay = d
+		case name == cohort:
+			cohortDelay, found = d, true
+		}
+	}
+	if found {
+		return cohortDelay, nil
+	}
+	return delay, nil
+}
+
+// holdingChanges reports whether changes of ETCD are held before being applied
+func holdingChanges() bool {
+	return applyDelay > 0 || len(syncWindows) > 0
+}
+
+// holdEvents will queue events to be applied once --apply-delay has passed, in the next --sync-window. A
+// newer change of a key replaces the pending one, so reverting a key in ETCD also reverts its rollout.
+func holdEvents(events []storeEvent) {
+	now := time.Now()
+	due := nextSyncWindow(now.Add(applyDelay))
+	rolloutMu.Lock()
+	defer rolloutMu.Unlock()
+	for _, ev := range events {
+		action := eventDownload
+		if ev.Type == storeEventDelete {
+			action = eventDelete
+		}
+		pendingRollout[ev.KV.Key] = &RolloutChange{
+			Key:      ev.KV.Key,
+			Action:   action,
+			Revision: ev.KV.Revision,
+			Received: now,
+			Due:      due,
+			event:    ev,
+		}
+		log.WithFields(log.Fields{
+			"etcdKey":  ev.KV.Key,
+			"revision": ev.KV.Revision,
+			"due":      due.Format(time.RFC3339),
+		}).Info("change held until due")
+	}
+}
+
+// runRollout will apply the held changes of etcdKey to fileFolder as they become due, until ctx is canceled
+func runRollout(ctx context.Context, etcdKey, fileFolder string) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			applyDueChanges(ctx, etcdKey, fileFolder)
+		}
+	}
+}
+
+// applyDueChanges will apply the held changes that are due, in revision and --apply-order order, while a
+// --sync-window is open
+func applyDueChanges(ctx context.Context, etcdKey, fileFolder string) {
+	now := time.Now()
+	if !inSyncWindow(now) {
+		// changes due when the window closed wait for the next one
+		return
+	}
+	var events []storeEvent
+	rolloutMu.Lock()
+	for key, change := range pendingRollout {
+		if !change.Due.After(now) {
+			events = append(events, change.event)
+			delete(pendingRollout, key)
+		}
+	}
+	rolloutMu.Unlock()
+	if len(events) == 0 {
+		return
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].KV.Revision < events[j].KV.Revision })
+	applyEvents(ctx, events, etcdKey, fileFolder)
+	recordAppliedRevision(events[len(events)-1].KV.Revision)
+}
+
+// rolloutHeld will return an error when revision of etcdKey is not to be applied yet, or ever on this
+// node, resyncs and reconciliations leave those keys alone
+func rolloutHeld(etcdKey string, revision int64) error {
+	rolloutMu.Lock()
+	defer rolloutMu.Unlock()
+	if cancelled, ok := cancelledRollout[etcdKey]; ok && revision <= cancelled {
+		return errRolloutCancelled
+	}
+	if change, ok := pendingRollout[etcdKey]; ok && revision <= change.Revision {
+		return errRolloutPending
+	}
+	return nil
+}
+
+// cancelRollout will drop the held changes of the keys starting with prefix and return them, the files
+// stay as they are until a newer change of their key
+func cancelRollout(prefix, user string) []RolloutChange {
+	rolloutMu.Lock()
+	cancelled := make([]RolloutChange, 0)
+	for key, change := range pendingRollout {
+		if strings.HasPrefix(key, prefix) {
+			cancelled = append(cancelled, *change)
+			cancelledRollout[key] = change.Revision
+			delete(pendingRollout, key)
+		}
+	}
+	rolloutMu.Unlock()
+	sort.Slice(cancelled, func(i, j int) bool { return cancelled[i].Key < cancelled[j].Key })
+	for _, change := range cancelled {
+		log.WithFields(log.Fields{
+			"etcdKey":     change.Key,
+			"revision":    change.Revision,
+			"cancelledBy": user,
+		}).Warn("rollout cancelled")
+		writeAudit(auditEntry{
+			Action:  auditRolloutCancel,
+			ETCDKey: change.Key,
+			Detail:  fmt.Sprintf("revision %d not applied on this node", change.Revision),
+		})
+	}
+	return cancelled
+}
+
+// rolloutHandler - GET /v1/rollout, the changes held by --apply-delay and --sync-window
+func rolloutHandler(c *gin.Context) {
+	rolloutMu.Lock()
+	pending := make([]RolloutChange, 0, len(pendingRollout))
+	for _, change := range pendingRollout {
+		pending = append(pending, *change)
+	}
+	rolloutMu.Unlock()
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Revision < pending[j].Revision })
+	response := RolloutResponse{Cohort: CMDArgs.Cohort, Delay: applyDelay.String(), Pending: pending}
+	if len(syncWindows) > 0 {
+		next := nextSyncWindow(time.Now())
+		response.Windows, response.NextWindow = CMDArgs.SyncWindows, &next
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// cancelRolloutHandler - POST /v1/rollout/cancel, drops the held changes
+func cancelRolloutHandler(c *gin.Context) {
+	var json RolloutCancelModel
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&json); err != nil {
+			abortWithBadRequest(c, err)
+			return
+		}
+	}
+	c.JSON(http.StatusOK, RolloutCancelResponse{Cancelled: cancelRollout(json.Prefix, c.GetString(gin.AuthUserKey))})
+}
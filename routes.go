@@ -0,0 +1,435 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiPrefix is the path every versioned endpoint is served under
+const apiPrefix = "/v1"
+
+// apiParam is a query or header parameter of an endpoint
+type apiParam struct {
+	Name        string
+	In          string
+	Description string
+	Required    bool
+}
+
+// apiRoute describes an endpoint, it is used both to register the handler and to generate the OpenAPI spec
+type apiRoute struct {
+	Method  string
+	Path    string
+	Summary string
+	Handler gin.HandlerFunc
+	Params  []apiParam
+	// Body is a sample of the JSON request body, nil without one. Bodies replace it for other content types.
+	Body   interface{}
+	Bodies map[string]interface{}
+	// Response is a sample of the JSON 200 response, nil without one. ResponseTypes are other representations,
+	// without schema.
+	Response      interface{}
+	ResponseTypes []string
+	// Errors are the status codes of the APIError responses
+	Errors []int
+}
+
+// apiRoutes are all endpoints served under apiPrefix
+var apiRoutes = []apiRoute{
+	{
+		Method:   http.MethodGet,
+		Path:     "/status",
+		Summary:  "Sync state of the folder and unresolved conflicts",
+		Handler:  statusHandler,
+		Response: StatusResponse{},
+	},
+	{
+		Method:   http.MethodGet,
+		Path:     "/drift",
+		Summary:  "Files of the folder that differ from ETCD",
+		Handler:  driftHandler,
+		Response: DriftResponse{},
+		Errors:   []int{http.StatusBadGateway},
+	},
+	{
+		Method:        http.MethodGet,
+		Path:          "/events",
+		Summary:       "Stream the changes applied by this syncer as server-sent events",
+		Handler:       eventsHandler,
+		ResponseTypes: []string{mimeEventStream},
+	},
+	{
+		Method:  http.MethodGet,
+		Path:    "/getFile",
+		Summary: "Read a key, raw or wrapped depending on the Accept header",
+		Handler: getFileHandler,
+		Params: []apiParam{
+			{Name: "key", In: "query", Description: "key to read", Required: true},
+		},
+		Response:      FileView{},
+		ResponseTypes: []string{mimeOctetStream, mimeYAML},
+		Errors: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusNotAcceptable,
+			http.StatusBadGateway},
+	},
+	{
+		Method:  http.MethodGet,
+		Path:    "/kv/*key",
+		Summary: "Read a key under --key from the store, the raw value with its revisions in X-Etcd-* headers",
+		Handler: kvHandler,
+		Params: []apiParam{
+			{Name: "key", In: "path", Description: "key to read, starting with --key", Required: true},
+			{Name: "rev", In: "query", Description: "read the key as of this revision"},
+			{Name: "If-None-Match", In: "header", Description: "ETag of the revision the client has, answered with 304"},
+		},
+		ResponseTypes: []string{mimeOctetStream},
+		Errors: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusGone,
+			http.StatusNotImplemented, http.StatusBadGateway},
+	},
+	{
+		Method:  http.MethodGet,
+		Path:    "/files",
+		Summary: "List the keys under a prefix with their metadata",
+		Handler: filesHandler,
+		Params: []apiParam{
+			{Name: "prefix", In: "query", Description: "prefix to list, starting with --key, --key by default"},
+		},
+		Response:      FilesResponse{},
+		ResponseTypes: []string{mimeYAML},
+		Errors:        []int{http.StatusForbidden, http.StatusNotAcceptable, http.StatusBadGateway},
+	},
+	{
+		Method:   http.MethodPost,
+		Path:     "/putFile",
+		Summary:  "Upload a local file to a key",
+		Handler:  putFileHandler,
+		Body:     FileModel{},
+		Response: OKResponse{},
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusRequestEntityTooLarge,
+			http.StatusUnprocessableEntity, http.StatusBadGateway},
+	},
+	{
+		Method:   http.MethodPost,
+		Path:     "/downloadFile",
+		Summary:  "Download every key under a prefix into a folder",
+		Handler:  downloadFileHandler,
+		Body:     FileModel{},
+		Response: OKResponse{},
+		Errors:   []int{http.StatusBadRequest, http.StatusBadGateway},
+	},
+	{
+		Method:  http.MethodPatch,
+		Path:    "/file",
+		Summary: "Apply a JSON Patch or merge patch to a key",
+		Handler: patchHandler,
+		Params: []apiParam{
+			{Name: "key", In: "query", Description: "key to patch", Required: true},
+			{Name: "If-Match", In: "header", Description: "only patch the key at this revision, a bare revision or the ETag of the read endpoints"},
+		},
+		Bodies: map[string]interface{}{
+			contentTypeJSONPatch:  []map[string]interface{}{},
+			contentTypeMergePatch: map[string]interface{}{},
+		},
+		Response: OKResponse{},
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusPreconditionFailed,
+			http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType, http.StatusUnprocessableEntity,
+			http.StatusBadGateway},
+	},
+	{
+		Method:   http.MethodPost,
+		Path:     "/compact",
+		Summary:  "Compact the ETCD history older than a retention",
+		Handler:  compactHandler,
+		Body:     CompactModel{},
+		Response: OKResponse{},
+		Errors:   []int{http.StatusBadRequest, http.StatusConflict, http.StatusNotImplemented, http.StatusBadGateway},
+	},
+	{
+		Method:   http.MethodPost,
+		Path:     "/conflicts/resolve",
+		Summary:  "Resolve a file changed both locally and in ETCD",
+		Handler:  resolveHandler,
+		Body:     ResolveModel{},
+		Response: OKResponse{},
+		Errors:   []int{http.StatusBadRequest, http.StatusNotFound, http.StatusUnprocessableEntity, http.StatusBadGateway},
+	},
+	{
+		Method:   http.MethodGet,
+		Path:     "/promotions",
+		Summary:  "Promotions planned and waiting for approval",
+		Handler:  promotionsHandler,
+		Response: PromotionsResponse{},
+	},
+	{
+		Method:   http.MethodPost,
+		Path:     "/promotions",
+		Summary:  "Plan the mirroring of a prefix to another, applied right away with apply",
+		Handler:  promoteHandler,
+		Body:     PromotionModel{},
+		Response: Promotion{},
+		Errors: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusConflict, http.StatusRequestEntityTooLarge,
+			http.StatusBadGateway},
+	},
+	{
+		Method:   http.MethodPost,
+		Path:     "/promotions/approve",
+		Summary:  "Apply a planned promotion",
+		Handler:  approvePromotionHandler,
+		Body:     PromotionIDModel{},
+		Response: Promotion{},
+		Errors: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusConflict,
+			http.StatusRequestEntityTooLarge, http.StatusBadGateway},
+	},
+	{
+		Method:   http.MethodPost,
+		Path:     "/promotions/reject",
+		Summary:  "Drop a planned promotion",
+		Handler:  rejectPromotionHandler,
+		Body:     PromotionIDModel{},
+		Response: Promotion{},
+		Errors:   []int{http.StatusBadRequest, http.StatusNotFound},
+	},
+	{
+		Method:   http.MethodGet,
+		Path:     "/rollout",
+		Summary:  "Changes of ETCD held by --apply-delay and --sync-window",
+		Handler:  rolloutHandler,
+		Response: RolloutResponse{},
+	},
+	{
+		Method:   http.MethodPost,
+		Path:     "/rollout/cancel",
+		Summary:  "Drop the held changes, of the keys under prefix only with one",
+		Handler:  cancelRolloutHandler,
+		Body:     RolloutCancelModel{},
+		Response: RolloutCancelResponse{},
+		Errors:   []int{http.StatusBadRequest},
+	},
+	{
+		Method:  http.MethodGet,
+		Path:    "/history",
+		Summary: "Versions of a key kept by --history, newest first",
+		Handler: historyHandler,
+		Params: []apiParam{
+			{Name: "key", In: "query", Description: "key to list the versions of", Required: true},
+		},
+		Response: HistoryResponse{},
+		Errors:   []int{http.StatusBadRequest, http.StatusForbidden, http.StatusBadGateway},
+	},
+	{
+		Method:   http.MethodPost,
+		Path:     "/rollback",
+		Summary:  "Write back a version of a key kept by --history, the previous one without a revision",
+		Handler:  rollbackHandler,
+		Body:     RollbackModel{},
+		Response: OKResponse{},
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusGone,
+			http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity, http.StatusBadGateway},
+	},
+}
+
+// registerRoutes will register every apiRoutes handler on group, mutating ones behind --rate-limit
+func registerRoutes(group *gin.RouterGroup) {
+	for _, route := range apiRoutes {
+		if isMutating(route) {
+			group.Handle(route.Method, route.Path, rateLimit(writeLimiter), route.Handler)
+			continue
+		}
+		group.Handle(route.Method, route.Path, route.Handler)
+	}
+}
+
+var (
+	openAPIOnce sync.Once
+	openAPIDoc  map[string]interface{}
+)
+
+// openAPIHandler - GET /openapi.json, the OpenAPI 3 description generated from apiRoutes
+func openAPIHandler(c *gin.Context) {
+	openAPIOnce.Do(func() { openAPIDoc = openAPISpec(apiRoutes) })
+	c.JSON(http.StatusOK, openAPIDoc)
+}
+
+// swaggerUIPage loads Swagger UI from a CDN and points it to /openapi.json
+const swaggerUIPage = `<!DOCTYPE html>
+<html>
+<head>
+<title>etcd_file_syncer API</title>
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@4/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist@4/swagger-ui-bundle.js"></script>
+<script>SwaggerUIBundle({url: "/openapi.json", dom_id: "#swagger-ui"});</script>
+</body>
+</html>
+`
+
+// swaggerUIHandler - GET /docs, Swagger UI for /openapi.json
+func swaggerUIHandler(c *gin.Context) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(swaggerUIPage))
+}
+
+// openAPISpec will build the OpenAPI 3 document of routes
+func openAPISpec(routes []apiRoute) map[string]interface{} {
+	schemas := map[string]interface{}{
+		"APIError": schemaOf(reflect.TypeOf(APIError{}), nil),
+	}
+	paths := make(map[string]interface{})
+	for _, route := range routes {
+		operation := map[string]interface{}{
+			"summary":     route.Summary,
+			"operationId": operationID(route),
+		}
+		if len(route.Params) > 0 {
+			params := make([]interface{}, 0, len(route.Params))
+			for _, p := range route.Params {
+				params = append(params, map[string]interface{}{
+					"name":        p.Name,
+					"in":          p.In,
+					"description": p.Description,
+					"required":    p.Required,
+					"schema":      map[string]interface{}{"type": "string"},
+				})
+			}
+			operation["parameters"] = params
+		}
+		bodies := route.Bodies
+		if route.Body != nil {
+			bodies = map[string]interface{}{gin.MIMEJSON: route.Body}
+		}
+		if len(bodies) > 0 {
+			content := make(map[string]interface{})
+			for t, body := range bodies {
+				content[t] = map[string]interface{}{"schema": schemaOf(reflect.TypeOf(body), schemas)}
+			}
+			operation["requestBody"] = map[string]interface{}{"required": true, "content": content}
+		}
+
+		responses := make(map[string]interface{})
+		okContent := make(map[string]interface{})
+		if route.Response != nil {
+			okContent[gin.MIMEJSON] = map[string]interface{}{"schema": schemaOf(reflect.TypeOf(route.Response), schemas)}
+		}
+		for _, t := range route.ResponseTypes {
+			okContent[t] = map[string]interface{}{}
+		}
+		responses["200"] = map[string]interface{}{"description": "OK", "content": okContent}
+		errorCodes := append(route.Errors[:len(route.Errors):len(route.Errors)], http.StatusServiceUnavailable)
+		if isMutating(route) {
+			errorCodes = append(errorCodes, http.StatusTooManyRequests)
+		}
+		for _, code := range errorCodes {
+			responses[fmt.Sprint(code)] = map[string]interface{}{
+				"description": http.StatusText(code),
+				"content": map[string]interface{}{
+					gin.MIMEJSON: map[string]interface{}{
+						"schema": map[string]interface{}{"$ref": "#/components/schemas/APIError"},
+					},
+				},
+			}
+		}
+		operation["responses"] = responses
+
+		path := apiPrefix + openAPIPath(route.Path)
+		item, ok := paths[path].(map[string]interface{})
+		if !ok {
+			item = make(map[string]interface{})
+			paths[path] = item
+		}
+		item[strings.ToLower(route.Method)] = operation
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "etcd_file_syncer",
+			"version": "v1",
+		},
+		"paths":      paths,
+		"components": map[string]interface{}{"schemas": schemas},
+	}
+}
+
+// operationID will derive a unique operation ID from the route, ex: patchFile
+func operationID(route apiRoute) string {
+	name := strings.ToLower(route.Method)
+	for _, part := range strings.Split(route.Path, "/") {
+		if part = strings.TrimLeft(part, ":*"); part != "" {
+			name += strings.ToUpper(part[:1]) + part[1:]
+		}
+	}
+	return name
+}
+
+// openAPIPath will return the OpenAPI template of a gin path, its :name and *name parameters as {name}
+func openAPIPath(ginPath string) string {
+	parts := strings.Split(ginPath, "/")
+	for i, part := range parts {
+		if strings.HasPrefix(part, ":") || strings.HasPrefix(part, "*") {
+			parts[i] = "{" + part[1:] + "}"
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// schemaOf will return the JSON schema of t. Named structs are added to schemas and referenced, unless
+// schemas is nil.
+func schemaOf(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == reflect.TypeOf(time.Time{}):
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Struct:
+		name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+		if _, ok := schemas[name]; ok {
+			return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+		}
+		properties := make(map[string]interface{})
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := strings.Split(field.Tag.Get("json"), ",")[0]
+			if tag == "-" || field.PkgPath != "" {
+				continue
+			}
+			if tag == "" {
+				tag = field.Name
+			}
+			properties[tag] = schemaOf(field.Type, schemas)
+			if strings.Contains(field.Tag.Get("binding"), "required") {
+				required = append(required, tag)
+			}
+		}
+		schema := map[string]interface{}{"type": "object", "properties": properties}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		if schemas == nil {
+			return schema
+		}
+		schemas[name] = schema
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		return map[string]interface{}{"type": "string", "format": "byte"}
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem(), schemas)}
+	case t.Kind() == reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem(), schemas)}
+	case t.Kind() == reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case t.Kind() == reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	}
+	return map[string]interface{}{}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/activation"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+const unixListenPrefix = "unix://"
+
+// unixListener is set when the API listens on a unix socket, from --listen or passed by systemd
+var unixListener bool
+
+// newListener will open the API listener. A socket passed by systemd socket activation (LISTEN_FDS)
+// always wins, otherwise listen is either host:port or unix:///path/to.sock and an empty listen
+// falls back to all interfaces on port.
+func newListener(listen string, port int) (net.Listener, error) {
+	listeners, err := activation.Listeners()
+	if err != nil {
+		return nil, err
+	}
+	if len(listeners) > 0 {
+		for _, extra := range listeners[1:] {
+			if extra != nil {
+				log.WithFields(log.Fields{
+					"addr": extra.Addr().String(),
+				}).Warn("ignoring extra systemd socket")
+				extra.Close()
+			}
+		}
+		if listeners[0] == nil {
+			return nil, fmt.Errorf("systemd socket is not a stream socket")
+		}
+		return listeners[0], nil
+	}
+	if listen == "" {
+		listen = fmt.Sprintf(":%d", port)
+	}
+	if !strings.HasPrefix(listen, unixListenPrefix) {
+		return net.Listen("tcp", listen)
+	}
+	mode, err := strconv.ParseUint(CMDArgs.ListenMode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --listen-mode %q: %v", CMDArgs.ListenMode, err)
+	}
+	socketPath := strings.TrimPrefix(listen, unixListenPrefix)
+	// remove a socket left behind by a previous run
+	if info, err := os.Stat(socketPath); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(socketPath); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socketPath, os.FileMode(mode)); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// shuttingDown is set to 1 once the API starts draining
+var shuttingDown int32
+
+// refuseDuringShutdown will answer 503 to requests arriving on kept-alive connections while draining
+func refuseDuringShutdown() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if atomic.LoadInt32(&shuttingDown) == 1 {
+			c.Header("Connection", "close")
+			abortWithError(c, http.StatusServiceUnavailable, codeUnavailable, "shutting down", nil)
+			return
+		}
+		c.Next()
+	}
+}
+
+// serveAPI will serve handler on listener until ctx is canceled, then stop accepting connections and
+// give in-flight requests up to shutdownTimeout to complete. Requests keep their own context during
+// the drain so their ETCD calls aren't canceled along with the root context, it is canceled once the
+// drain is over.
+func serveAPI(ctx context.Context, listener net.Listener, handler http.Handler, shutdownTimeout time.Duration) error {
+	requestCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+	srv := &http.Server{
+		Handler:     handler,
+		BaseContext: func(net.Listener) context.Context { return requestCtx },
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(listener)
+	}()
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	atomic.StoreInt32(&shuttingDown, 1)
+	closeEventStreams()
+	log.WithFields(log.Fields{
+		"timeout": shutdownTimeout,
+	}).Info("draining API requests")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		// timeout: whatever is left gets canceled
+		srv.Close()
+		return err
+	}
+	return nil
+}
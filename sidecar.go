@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PodInfo is the pod the sidecar runs in, as exposed by the downward API to --sidecar-key-template
+type PodInfo struct {
+	Namespace   string
+	Name        string
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+// loadPodInfo will read the pod's downward API volume at dir, falling back to the POD_NAMESPACE and
+// POD_NAME environment variables and to the service account namespace
+func loadPodInfo(dir string) (*PodInfo, error) {
+	pod := &PodInfo{
+		Namespace: os.Getenv("POD_NAMESPACE"),
+		Name:      os.Getenv("POD_NAME"),
+	}
+	for name, field := range map[string]*string{"namespace": &pod.Namespace, "name": &pod.Name} {
+		if value, err := os.ReadFile(filepath.Join(dir, name)); err == nil {
+			*field = strings.TrimSpace(string(value))
+		}
+	}
+	if pod.Namespace == "" {
+		pod.Namespace = kubeNamespace()
+	}
+	var err error
+	if pod.Labels, err = readDownwardMap(filepath.Join(dir, "labels")); err != nil {
+		return nil, err
+	}
+	if pod.Annotations, err = readDownwardMap(filepath.Join(dir, "annotations")); err != nil {
+		return nil, err
+	}
+	return pod, nil
+}
+
+// readDownwardMap will parse a downward API labels or annotations file of name="value" lines, a missing
+// file is an empty map
+func readDownwardMap(fileName string) (map[string]string, error) {
+	values := make(map[string]string)
+	content, err := os.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return values, nil
+	} else if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s: malformed line %q", fileName, line)
+		}
+		value, err := strconv.Unquote(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s: malformed value of %s: %v", fileName, parts[0], err)
+		}
+		values[parts[0]] = value
+	}
+	return values, scanner.Err()
+}
+
+// sidecarKey will render --sidecar-key-template with the pod the syncer runs in
+func sidecarKey() (string, error) {
+	tmpl, err := template.New("key").Option("missingkey=error").Parse(CMDArgs.SidecarKeyTemplate)
+	if err != nil {
+		return "", err
+	}
+	pod, err := loadPodInfo(CMDArgs.PodInfoDir)
+	if err != nil {
+		return "", err
+	}
+	var key strings.Builder
+	if err := tmpl.Execute(&key, pod); err != nil {
+		return "", err
+	}
+	if strings.Contains(key.String(), "//") || key.Len() == 0 {
+		return "", fmt.Errorf("empty segment in key %q, is the pod namespace or a label missing?", key.String())
+	}
+	return key.String(), nil
+}
+
+// runReloader will send --reload-signal to the processes named --reload-process once downloads settle
+// for --reload-delay, until ctx is canceled
+func runReloader(ctx context.Context) {
+	onFilesChanged(ctx, CMDArgs.ReloadDelay, func() {
+		count, err := signalProcesses(CMDArgs.ReloadProcess, reloadSignal)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"process": CMDArgs.ReloadProcess,
+				"err":     err,
+			}).Error("cannot signal process")
+			return
+		}
+		if count == 0 {
+			log.WithFields(log.Fields{
+				"process": CMDArgs.ReloadProcess,
+			}).Warn("no process to reload, is the process namespace shared?")
+			return
+		}
+		log.WithFields(log.Fields{
+			"process":   CMDArgs.ReloadProcess,
+			"signal":    CMDArgs.ReloadSignal,
+			"processes": count,
+		}).Info("signaled process to reload")
+	})
+}
+
+// onFilesChanged will call fn once no file was downloaded or deleted for delay after a change, until ctx
+// is canceled or the API drains
+func onFilesChanged(ctx context.Context, delay time.Duration, fn func()) {
+	ch, ok := subscribeEvents()
+	if !ok {
+		return
+	}
+	defer unsubscribeEvents(ch)
+	timer := time.NewTimer(delay)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			if ev.Action != eventDownload && ev.Action != eventDelete {
+				continue
+			}
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(delay)
+		case <-timer.C:
+			fn()
+		}
+	}
+}
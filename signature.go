@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/openpgp"
+)
+
+// sigSuffix is appended to a key to store the detached signature of its value
+const sigSuffix = ".sig"
+
+var (
+	// signatureKeyring holds the public keys downloads are verified against
+	signatureKeyring openpgp.EntityList
+	// signingEntity is the private key uploads are signed with
+	signingEntity *openpgp.Entity
+)
+
+var (
+	errSignatureMissing = errors.New("signature missing")
+	errSignatureInvalid = errors.New("signature does not verify against the keyring")
+)
+
+// sigKey will return the signature key of etcdKey
+func sigKey(etcdKey string) string {
+	return etcdKey + sigSuffix
+}
+
+// signaturesEnabled reports whether <key>.sig keys hold signatures rather than files
+func signaturesEnabled() bool {
+	return CMDArgs.RequireSignature || CMDArgs.SigningKey != ""
+}
+
+// isSignatureKey reports whether etcdKey holds the signature of another key
+func isSignatureKey(etcdKey string) bool {
+	return signaturesEnabled() && strings.HasSuffix(etcdKey, sigSuffix)
+}
+
+// loadKeyring will read the armored or binary OpenPGP public keys in paths
+func loadKeyring(paths []string) (keyring openpgp.EntityList, err error) {
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		var entities openpgp.EntityList
+		if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN")) {
+			entities, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+		} else {
+			entities, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", p, err)
+		}
+		keyring = append(keyring, entities...)
+	}
+	return keyring, nil
+}
+
+// loadSigningKey will read the armored or binary OpenPGP private key in keyPath, decrypting it with
+// the passphrase in passphrasePath when given
+func loadSigningKey(keyPath, passphrasePath string) (*openpgp.Entity, error) {
+	entities, err := loadKeyring([]string{keyPath})
+	if err != nil {
+		return nil, err
+	}
+	if len(entities) != 1 || entities[0].PrivateKey == nil {
+		return nil, fmt.Errorf("%s must hold exactly one private key", keyPath)
+	}
+	entity := entities[0]
+	if entity.PrivateKey.Encrypted {
+		if passphrasePath == "" {
+			return nil, fmt.Errorf("%s is encrypted, a passphrase file is required", keyPath)
+		}
+		passphrase, err := os.ReadFile(passphrasePath)
+		if err != nil {
+			return nil, err
+		}
+		if err := entity.PrivateKey.Decrypt(bytes.TrimRight(passphrase, "\r\n")); err != nil {
+			return nil, fmt.Errorf("%s: %v", keyPath, err)
+		}
+	}
+	return entity, nil
+}
+
+// signatureOps will return the ETCD operation storing the detached signature of value under the
+// signature key of etcdKey, or nothing when no --signing-key is configured
+func signatureOps(etcdKey string, value []byte) ([]storeOp, error) {
+	if signingEntity == nil {
+		return nil, nil
+	}
+	var sig bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&sig, signingEntity, bytes.NewReader(value), nil); err != nil {
+		return nil, err
+	}
+	return []storeOp{putOp(sigKey(etcdKey), sig.Bytes())}, nil
+}
+
+// signedPutOps will return the operation putting value in etcdKey followed by the one storing its signature
+func signedPutOps(etcdKey string, value []byte) ([]storeOp, error) {
+	sigOps, err := signatureOps(etcdKey, value)
+	if err != nil {
+		return nil, err
+	}
+	return append([]storeOp{putOp(etcdKey, value)}, sigOps...), nil
+}
+
+// checkSignature will verify the armored or binary detached signature sig of value
+func checkSignature(value, sig []byte) error {
+	var err error
+	if bytes.HasPrefix(bytes.TrimSpace(sig), []byte("-----BEGIN")) {
+		_, err = openpgp.CheckArmoredDetachedSignature(signatureKeyring, bytes.NewReader(value), bytes.NewReader(sig))
+	} else {
+		_, err = openpgp.CheckDetachedSignature(signatureKeyring, bytes.NewReader(value), bytes.NewReader(sig))
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", errSignatureInvalid, err)
+	}
+	return nil
+}
+
+// verifySignature will make sure value, downloaded from etcdKey, is signed by the keyring when
+// --require-signature is set. Rejections are logged, the caller must not write value to disk.
+func verifySignature(ctx context.Context, etcdKey string, value []byte) error {
+	if !CMDArgs.RequireSignature {
+		return nil
+	}
+	var kv *storeKV
+	err := withETCDRetry(ctx, func(ctx context.Context) (err error) {
+		kv, _, err = kvStore.Get(ctx, sigKey(etcdKey))
+		return err
+	})
+	if err == nil {
+		if kv == nil {
+			err = errSignatureMissing
+		} else {
+			err = checkSignature(value, kv.Value)
+		}
+	}
+	if err != nil {
+		signatureRejections.Inc()
+		log.WithFields(log.Fields{
+			"etcdKey": etcdKey,
+			"err":     err,
+		}).Error("refusing unsigned download")
+	}
+	return err
+}
+
+// applySignatureKey will apply the key, or the metadata key, signed by signature key etcdKey, the signature
+// may have been written after the value it signs
+func applySignatureKey(ctx context.Context, etcdKey, fileFolder string) {
+	signedKey := strings.TrimSuffix(etcdKey, sigSuffix)
+	isMeta := strings.HasSuffix(signedKey, metaSuffix)
+	if isReservedKey(signedKey) && !isMeta {
+		return
+	}
+	var kv *storeKV
+	err := withETCDRetry(ctx, func(ctx context.Context) (err error) {
+		kv, _, err = kvStore.Get(ctx, signedKey)
+		return err
+	})
+	if err != nil || kv == nil {
+		return
+	}
+	if isMeta {
+		applyMetaKey(ctx, signedKey, kv.Value, kv.Revision, fileFolder)
+		return
+	}
+	applyRemoteContent(ctx, signedKey, filepath.Join(fileFolder, signedKey), kv.Value, kv.Revision)
+}
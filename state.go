@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// hashBufferSize is the read size of files hashed streaming
+const hashBufferSize = 1 << 20
+
+// syncedVersion is the content a local file had when it was last synced with ETCD
+type syncedVersion struct {
+	// Hash is the SHA-256 of the content, as the value of the key (see syncHash)
+	Hash string
+	// Revision is the ModRevision of the key holding that content (or the revision of the upload)
+	Revision int64
+}
+
+// syncedState maps file paths to their last synced version, guarded by fileChangeMu
+var syncedState = make(map[string]syncedVersion)
+
+// hashedFile is the hash of a large file as of its size and modified time
+type hashedFile struct {
+	Size    int64
+	ModTime time.Time
+	Hash    string
+}
+
+// hashCache maps the paths of large files to their last computed hash, guarded by fileChangeMu
+var hashCache = make(map[string]hashedFile)
+
+// contentHash will return the hex encoded SHA-256 of content
+func contentHash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// localFileHash will return the sync hash of filePath, the file of etcdKey described by info. Files of at least
+// --large-file-size bytes whose content is their value as is (no --encoding, --line-endings or --banner applies)
+// are hashed streaming instead of being read in memory, and not read again while their size and modified time
+// stay the same.
+func localFileHash(etcdKey, filePath string, info os.FileInfo) (string, error) {
+	if CMDArgs.LargeFileSize <= 0 || info.Size() < CMDArgs.LargeFileSize || !hashedAsIs(etcdKey) {
+		content, err := os.ReadFile(filePath)
+		if err != nil {
+			return "", err
+		}
+		return fileSyncHash(etcdKey, content), nil
+	}
+	fileChangeMu.Lock()
+	cached, ok := hashCache[filePath]
+	fileChangeMu.Unlock()
+	if ok && cached.Size == info.Size() && cached.ModTime.Equal(info.ModTime()) {
+		return cached.Hash, nil
+	}
+	hash, err := streamHash(filePath)
+	if err != nil {
+		return "", err
+	}
+	// a file changed while it was read has a hash matching neither version, it is not cached
+	if after, err := os.Stat(filePath); err == nil && after.Size() == info.Size() && after.ModTime().Equal(info.ModTime()) {
+		fileChangeMu.Lock()
+		hashCache[filePath] = hashedFile{Size: info.Size(), ModTime: info.ModTime(), Hash: hash}
+		fileChangeMu.Unlock()
+	}
+	return hash, nil
+}
+
+// hashedAsIs reports whether the file content of etcdKey is hashed without being converted first
+func hashedAsIs(etcdKey string) bool {
+	if _, ok := matchEncoding(etcdKey); ok {
+		return false
+	}
+	if _, ok := matchRule(lineEndingRules, etcdKey); ok {
+		return false
+	}
+	return !CMDArgs.Banner
+}
+
+// streamHash will return the contentHash of the file at filePath, read hashBufferSize bytes at a time
+func streamHash(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.CopyBuffer(h, f, make([]byte, hashBufferSize)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// recordSynced will remember hash as the content of filePath in sync with ETCD at revision
+func recordSynced(filePath, hash string, revision int64) {
+	fileChangeMu.Lock()
+	syncedState[filePath] = syncedVersion{Hash: hash, Revision: revision}
+	fileChangeMu.Unlock()
+}
+
+// lastSynced will return the last synced version of filePath
+func lastSynced(filePath string) (version syncedVersion, ok bool) {
+	fileChangeMu.Lock()
+	defer fileChangeMu.Unlock()
+	version, ok = syncedState[filePath]
+	return version, ok
+}
+
+var (
+	// lastDownloadAt and lastUploadAt are the Unix time in nanoseconds of the last file written from ETCD
+	// and of the last file uploaded
+	lastDownloadAt int64
+	lastUploadAt   int64
+	// appliedRevision is the ETCD revision every change up to has been applied to the folder
+	appliedRevision int64
+)
+
+// recordDownload will record a file just written from a key at revision, hash is the synced content
+func recordDownload(filePath string, fileInfo os.FileInfo, hash string, revision int64) {
+	setFileChangeTime(filePath, fileInfo.ModTime())
+	recordSynced(filePath, hash, revision)
+	atomic.StoreInt64(&lastDownloadAt, time.Now().UnixNano())
+	failures.recordSuccess(conditionDownloadFailures)
+}
+
+// recordFailedDownload will record what a write of etcdKey at revision that failed halfway left in filePath
+// as its last synced content, so the partial file is neither uploaded by the scan nor taken for a local edit
+// and the next deep reconciliation downloads the key again
+func recordFailedDownload(etcdKey, filePath string, revision int64) {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return
+	}
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return
+	}
+	setFileChangeTime(filePath, fileInfo.ModTime())
+	recordSynced(filePath, fileSyncHash(etcdKey, content), revision)
+}
+
+// recordUpload will record filePath, of size bytes, just uploaded to etcdKey at revision
+func recordUpload(etcdKey, filePath, hash string, size int, revision int64) {
+	recordSynced(filePath, hash, revision)
+	atomic.StoreInt64(&lastUploadAt, time.Now().UnixNano())
+	failures.recordSuccess(conditionUploadFailures)
+	publishEvent(eventUpload, etcdKey, filePath, size, revision)
+}
+
+// recordAppliedRevision will advance appliedRevision to revision
+func recordAppliedRevision(revision int64) {
+	for {
+		current := atomic.LoadInt64(&appliedRevision)
+		if revision <= current || atomic.CompareAndSwapInt64(&appliedRevision, current, revision) {
+			return
+		}
+	}
+}
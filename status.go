@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// statusProbeTimeout bounds the ETCD request made to report connectivity
+const statusProbeTimeout = 2 * time.Second
+
+var (
+	// watchRevision is the last revision received on the ETCD watch
+	watchRevision int64
+	// watchLastResponseAt is the Unix time in nanoseconds of the last watch response
+	watchLastResponseAt int64
+)
+
+// StatusResponse - GET /v1/status
+type StatusResponse struct {
+	ETCDKey    string `json:"etcdKey"`
+	FileFolder string `json:"fileFolder"`
+	// Connected reports whether ETCD answered, Revision is its current revision
+	Connected bool   `json:"connected"`
+	ETCDError string `json:"etcdError,omitempty"`
+	Revision  int64  `json:"revision,omitempty"`
+	// WatchRevision is the last revision delivered by the watch, WatchLastResponse when it was received
+	WatchRevision     int64      `json:"watchRevision"`
+	WatchLastResponse *time.Time `json:"watchLastResponse,omitempty"`
+	Pending           int        `json:"pending"`
+	UploadsPaused     bool       `json:"uploadsPaused"`
+	// Paused is the value of the paused control key while it is set
+	Paused *string `json:"paused,omitempty"`
+	// RemoteConfig are the settings overridden under <key>.syncer-config/
+	RemoteConfig map[string]string `json:"remoteConfig,omitempty"`
+	// UnverifiedWrites is the number of files whose last upload failed --verify-writes
+	UnverifiedWrites int            `json:"unverifiedWrites,omitempty"`
+	Conflicts        []fileConflict `json:"conflicts"`
+}
+
+// statusHandler - GET /v1/status, reports the sync state of the folder
+func statusHandler(c *gin.Context) {
+	status := StatusResponse{
+		ETCDKey:       CMDArgs.ConfigKey,
+		FileFolder:    CMDArgs.ConfigFolder,
+		WatchRevision: atomic.LoadInt64(&watchRevision),
+		Conflicts:     listConflicts(),
+	}
+	status.UnverifiedWrites = unverifiedWrites()
+	if nanos := atomic.LoadInt64(&watchLastResponseAt); nanos > 0 {
+		t := time.Unix(0, nanos)
+		status.WatchLastResponse = &t
+	}
+	pausedUploadsMu.Lock()
+	status.Pending = len(pausedUploads)
+	pausedUploadsMu.Unlock()
+	status.UploadsPaused = status.Pending > 0
+	controlMu.Lock()
+	if paused {
+		reason := pausedBy
+		status.Paused = &reason
+	}
+	controlMu.Unlock()
+	status.RemoteConfig = listRemoteOverrides()
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), statusProbeTimeout)
+	defer cancel()
+	if head, _, err := kvStore.Revision(ctx, CMDArgs.ConfigKey); err != nil {
+		status.ETCDError = err.Error()
+	} else {
+		status.Connected, status.Revision = true, head
+	}
+	c.JSON(http.StatusOK, status)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/doody/etcd_file_syncer/backend"
+)
+
+// Backends
+const (
+	backendETCD      = "etcd"
+	backendConsul    = "consul"
+	backendZooKeeper = "zookeeper"
+	backendRedis     = "redis"
+)
+
+// Store event types
+const (
+	storeEventPut    = backend.EventPut
+	storeEventDelete = backend.EventDelete
+)
+
+// errNotSupported is returned for operations the configured backend has no equivalent of
+var errNotSupported = backend.ErrNotSupported
+
+// errCompacted and errFutureRevision are returned when reading a revision out of the store history
+var (
+	errCompacted      = backend.ErrCompacted
+	errFutureRevision = backend.ErrFutureRevision
+)
+
+// The store types are those of the backend package, which third party stores implement
+type (
+	storeKV            = backend.KV
+	storeOp            = backend.Op
+	storeCmp           = backend.Cmp
+	storeEvent         = backend.Event
+	storeWatchResponse = backend.WatchResponse
+	store              = backend.Store
+	compactor          = backend.Compactor
+	revisionReader     = backend.RevisionReader
+)
+
+// kvStore is the store of --backend, set by mustConnectStore
+var kvStore store
+
+// putOp will return the storeOp putting value in key
+func putOp(key string, value []byte) storeOp {
+	return storeOp{Key: key, Value: value}
+}
+
+// deleteOp will return the storeOp deleting key
+func deleteOp(key string) storeOp {
+	return storeOp{Key: key, Delete: true}
+}
+
+// opSize will return the number of bytes op carries
+func opSize(op storeOp) int {
+	return len(op.Key) + len(op.Value)
+}
+
+// txnMaxOps will return the most operations one upload transaction may hold
+func txnMaxOps() int {
+	if limit := kvStore.MaxTxnOps(); limit > 0 && limit < CMDArgs.TxnMaxOps {
+		return limit
+	}
+	return CMDArgs.TxnMaxOps
+}
+
+// backendOptions will return the options stores are opened with
+func backendOptions() backend.Options {
+	params := make(map[string]string, len(CMDArgs.BackendOptions))
+	for _, option := range CMDArgs.BackendOptions {
+		name, value := option, ""
+		if i := strings.Index(option, "="); i >= 0 {
+			name, value = option[:i], option[i+1:]
+		}
+		params[name] = value
+	}
+	return backend.Options{
+		Prefix:         CMDArgs.ConfigKey,
+		StartupRetries: CMDArgs.StartupRetries,
+		Params:         params,
+	}
+}
+
+// connectStore will connect to the store registered as name
+func connectStore(ctx context.Context, name string) (store, error) {
+	b, ok := backend.Lookup(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown backend %q", name)
+	}
+	return b.Open(ctx, backendOptions())
+}
+
+// classifyError will return the class of err for --backend
+func classifyError(err error) backend.ErrorClass {
+	return backend.Classify(CMDArgs.Backend, err)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// execRestart is the --exec-reload value restarting the process instead of signaling it
+const execRestart = "restart"
+
+// execReloadSignal is the parsed --exec-reload, nil to restart the process
+var execReloadSignal os.Signal
+
+var (
+	// folderHydrated is closed once the folder is first fully downloaded, after the paused control key
+	// cleared when it was set at startup
+	folderHydrated     = make(chan struct{})
+	folderHydratedOnce sync.Once
+)
+
+// markHydrated will record that the folder was fully downloaded
+func markHydrated() {
+	folderHydratedOnce.Do(func() { close(folderHydrated) })
+}
+
+// supervised is the process started by --exec
+type supervised struct {
+	cmd    *exec.Cmd
+	exited chan error
+}
+
+// runExec will start --exec once the folder is hydrated and reload it when downloaded files change,
+// restarting it or sending it --exec-reload. When it exits on its own the syncer is shut down through
+// cancel. The exit status of the process is returned, once it is stopped too when ctx is canceled.
+func runExec(ctx context.Context, cancel context.CancelFunc) int {
+	select {
+	case <-ctx.Done():
+		return 0
+	case <-folderHydrated:
+	}
+	reload := make(chan struct{}, 1)
+	go onFilesChanged(ctx, CMDArgs.ReloadDelay, func() {
+		select {
+		case reload <- struct{}{}:
+		default:
+		}
+	})
+	p, err := startSupervised(CMDArgs.Exec)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"command": CMDArgs.Exec,
+			"err":     err,
+		}).Error("cannot start the supervised process")
+		cancel()
+		return exitConfigError
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return p.stop()
+		case err := <-p.exited:
+			code := exitStatus(err)
+			log.WithFields(log.Fields{
+				"command":  CMDArgs.Exec,
+				"exitCode": code,
+			}).Warn("supervised process exited, shutting down")
+			cancel()
+			return code
+		case <-reload:
+			if execReloadSignal != nil {
+				if err := signalGroup(p.cmd, execReloadSignal); err != nil {
+					log.WithFields(log.Fields{
+						"command": CMDArgs.Exec,
+						"err":     err,
+					}).Error("cannot signal the supervised process")
+				} else {
+					log.WithFields(log.Fields{
+						"command": CMDArgs.Exec,
+						"signal":  CMDArgs.ExecReload,
+					}).Info("files changed, signaled the supervised process")
+				}
+				continue
+			}
+			log.WithFields(log.Fields{
+				"command": CMDArgs.Exec,
+			}).Info("files changed, restarting the supervised process")
+			p.stop()
+			if p, err = startSupervised(CMDArgs.Exec); err != nil {
+				log.WithFields(log.Fields{
+					"command": CMDArgs.Exec,
+					"err":     err,
+				}).Error("cannot restart the supervised process")
+				cancel()
+				return exitConfigError
+			}
+		}
+	}
+}
+
+// startSupervised will start command with the shell, in its own process group, sharing our output
+func startSupervised(command string) (*supervised, error) {
+	cmd := shellCommand(command)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	log.WithFields(log.Fields{
+		"command": command,
+		"pid":     cmd.Process.Pid,
+	}).Info("started the supervised process")
+	p := &supervised{cmd: cmd, exited: make(chan error, 1)}
+	go func() { p.exited <- cmd.Wait() }()
+	return p, nil
+}
+
+// stop will terminate the process group, killing it when it is still running after --shutdown-timeout,
+// and return its exit status
+func (p *supervised) stop() int {
+	if err := signalGroup(p.cmd, terminateSignal); err != nil {
+		p.cmd.Process.Kill()
+	}
+	select {
+	case err := <-p.exited:
+		return exitStatus(err)
+	case <-time.After(CMDArgs.ShutdownTimeout):
+		log.WithFields(log.Fields{
+			"pid": p.cmd.Process.Pid,
+		}).Warn("supervised process still running, killing it")
+		killGroup(p.cmd)
+		return exitStatus(<-p.exited)
+	}
+}
@@ -0,0 +1,47 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// terminateSignal asks the supervised process to exit
+var terminateSignal os.Signal = syscall.SIGTERM
+
+// shellCommand will return command run by sh in a new process group, so signals reach its children too
+func shellCommand(command string) *exec.Cmd {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return cmd
+}
+
+// signalGroup will send sig to the process group of cmd
+func signalGroup(cmd *exec.Cmd, sig os.Signal) error {
+	return syscall.Kill(-cmd.Process.Pid, sig.(syscall.Signal))
+}
+
+// killGroup will kill the process group of cmd
+func killGroup(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// exitStatus will return the exit code of a process from its Wait error, 128 + the signal number when it
+// was killed by a signal like shells do
+func exitStatus(err error) int {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		if err != nil {
+			return 1
+		}
+		return 0
+	}
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return exitErr.ExitCode()
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+// terminateSignal asks the supervised process to exit, windows can only kill it
+var terminateSignal os.Signal = os.Kill
+
+// shellCommand will return command run by cmd.exe
+func shellCommand(command string) *exec.Cmd {
+	return exec.Command("cmd", "/C", command)
+}
+
+// signalGroup will send sig to the process of cmd, only os.Kill is supported on windows
+func signalGroup(cmd *exec.Cmd, sig os.Signal) error {
+	return cmd.Process.Signal(sig)
+}
+
+// killGroup will kill the process of cmd
+func killGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
+
+// exitStatus will return the exit code of a process from its Wait error
+func exitStatus(err error) int {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	if err != nil {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// templateSuffix marks keys rendered with --render-templates, ex: nginx/site.conf.tmpl renders nginx/site.conf
+const templateSuffix = ".tmpl"
+
+var (
+	// templateOutputs are the keys of the files rendered from a template, they are not uploaded
+	templateOutputs   = make(map[string]bool)
+	templateOutputsMu sync.Mutex
+)
+
+// templateKV is a key and value returned by the gets template function
+type templateKV struct {
+	Key   string
+	Value string
+}
+
+// isTemplateKey reports whether etcdKey is a template rendered into another file
+func isTemplateKey(etcdKey string) bool {
+	return CMDArgs.RenderTemplates && strings.HasSuffix(etcdKey, templateSuffix)
+}
+
+// isTemplateOutput reports whether etcdKey is the file rendered from a template
+func isTemplateOutput(etcdKey string) bool {
+	templateOutputsMu.Lock()
+	defer templateOutputsMu.Unlock()
+	return templateOutputs[etcdKey]
+}
+
+// removeTemplateOutput will delete the file rendered from the deleted template etcdKey
+func removeTemplateOutput(etcdKey, fileFolder string, revision int64) {
+	output := strings.TrimSuffix(etcdKey, templateSuffix)
+	templateOutputsMu.Lock()
+	delete(templateOutputs, output)
+	templateOutputsMu.Unlock()
+	filePath := filepath.Join(fileFolder, output)
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		log.WithFields(log.Fields{
+			"filePath": filePath,
+			"err":      err,
+		}).Error("cannot delete rendered file")
+		return
+	}
+	publishEvent(eventDelete, output, filePath, 0, revision)
+}
+
+// renderTemplates will render every template under prefix with the current keys, only files whose
+// content changed are written. A template failing to render keeps its previous file.
+func renderTemplates(ctx context.Context, prefix, fileFolder string) {
+	var (
+		kvs      []storeKV
+		revision int64
+	)
+	err := withETCDRetry(ctx, func(ctx context.Context) (err error) {
+		kvs, revision, err = kvStore.List(ctx, prefix)
+		return err
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"etcdKey": prefix,
+			"err":     err,
+		}).Error("cannot read keys to render templates")
+		return
+	}
+	values := make(map[string]string, len(kvs))
+	for _, kv := range verifiedKVs(ctx, kvs) {
+		values[kv.Key] = string(kv.Value)
+	}
+	for _, kv := range kvs {
+		if !isTemplateKey(kv.Key) || !inManifest(kv.Key) || verifyDownload(ctx, kv.Key, kv.Value, kv.Revision) != nil {
+			continue
+		}
+		output := strings.TrimSuffix(kv.Key, templateSuffix)
+		templateOutputsMu.Lock()
+		templateOutputs[output] = true
+		templateOutputsMu.Unlock()
+		content, err := renderTemplate(kv.Key, string(kv.Value), prefix, values)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"etcdKey": kv.Key,
+				"err":     err,
+			}).Error("cannot render template, keeping the previous file")
+			continue
+		}
+		writeRendered(output, filepath.Join(fileFolder, output), content, revision)
+	}
+}
+
+// renderTemplate will execute the template text of etcdKey, lookups read values, keys relative to prefix
+func renderTemplate(etcdKey, text, prefix string, values map[string]string) ([]byte, error) {
+	tmpl, err := template.New(etcdKey).Funcs(templateFuncs(prefix, values)).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, nil); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// writeRendered will save content to filePath unless the file already holds it
+func writeRendered(etcdKey, filePath string, content []byte, revision int64) {
+	if current, err := os.ReadFile(filePath); err == nil && bytes.Equal(current, content) {
+		return
+	}
+	fileInfo, err := saveToFolder(filePath, content)
+	if err != nil {
+		return
+	}
+	recordDownload(filePath, fileInfo, contentHash(content), revision)
+	publishEvent(eventDownload, etcdKey, filePath, len(content), revision)
+	log.WithFields(log.Fields{
+		"etcdKey":  etcdKey,
+		"filePath": filePath,
+		"revision": revision,
+	}).Info("template rendered")
+}
+
+// sortedKeys will return the keys of values under dir, sorted
+func sortedKeys(values map[string]string, dir string) []string {
+	var keys []string
+	for key := range values {
+		if strings.HasPrefix(key, dir) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
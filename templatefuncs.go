@@ -0,0 +1,317 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+)
+
+// templateFuncs will return the functions of --render-templates, named after their sprig and confd
+// counterparts. Key lookups take keys relative to prefix, or full keys under it.
+func templateFuncs(prefix string, values map[string]string) template.FuncMap {
+	fullKey := func(key string) string {
+		if strings.HasPrefix(key, prefix) {
+			return key
+		}
+		return prefix + strings.TrimPrefix(key, "/")
+	}
+	relKey := func(key string) string {
+		return strings.TrimPrefix(key, prefix)
+	}
+	return template.FuncMap{
+		// Key lookups
+		"getv": func(key string, defaultValue ...string) (string, error) {
+			if value, ok := values[fullKey(key)]; ok {
+				return value, nil
+			}
+			if len(defaultValue) > 0 {
+				return defaultValue[0], nil
+			}
+			return "", fmt.Errorf("key %q does not exist", fullKey(key))
+		},
+		"exists": func(key string) bool {
+			_, ok := values[fullKey(key)]
+			return ok
+		},
+		"gets": func(pattern string) ([]templateKV, error) {
+			var kvs []templateKV
+			for _, key := range sortedKeys(values, prefix) {
+				ok, err := path.Match(strings.TrimPrefix(pattern, "/"), relKey(key))
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					kvs = append(kvs, templateKV{Key: relKey(key), Value: values[key]})
+				}
+			}
+			return kvs, nil
+		},
+		"getvs": func(pattern string) ([]string, error) {
+			var vs []string
+			for _, key := range sortedKeys(values, prefix) {
+				ok, err := path.Match(strings.TrimPrefix(pattern, "/"), relKey(key))
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					vs = append(vs, values[key])
+				}
+			}
+			return vs, nil
+		},
+		"ls": func(dir string) []string {
+			return listChildren(values, fullKey(strings.TrimSuffix(dir, "/")+"/"), false)
+		},
+		"lsdir": func(dir string) []string {
+			return listChildren(values, fullKey(strings.TrimSuffix(dir, "/")+"/"), true)
+		},
+		"env":      os.Getenv,
+		"hostname": os.Hostname,
+
+		// Strings
+		"upper":      strings.ToUpper,
+		"lower":      strings.ToLower,
+		"title":      strings.Title,
+		"trim":       strings.TrimSpace,
+		"trimAll":    func(cutset, s string) string { return strings.Trim(s, cutset) },
+		"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+		"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+		"replace":    func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+		"contains":   func(substr, s string) bool { return strings.Contains(s, substr) },
+		"hasPrefix":  func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+		"hasSuffix":  func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+		"split":      strings.Split,
+		"splitList":  func(sep, s string) []string { return strings.Split(s, sep) },
+		"join":       func(sep string, list interface{}) string { return strings.Join(toStrings(list), sep) },
+		"repeat":     func(count int, s string) string { return strings.Repeat(s, count) },
+		"quote":      func(s interface{}) string { return strconv.Quote(fmt.Sprint(s)) },
+		"squote":     func(s interface{}) string { return "'" + fmt.Sprint(s) + "'" },
+		"indent":     func(spaces int, s string) string { return indent(spaces, s) },
+		"nindent":    func(spaces int, s string) string { return "\n" + indent(spaces, s) },
+		"base":       path.Base,
+		"dir":        path.Dir,
+
+		// Defaults and logic
+		"default": func(defaultValue, value interface{}) interface{} {
+			if isEmpty(value) {
+				return defaultValue
+			}
+			return value
+		},
+		"empty": isEmpty,
+		"coalesce": func(values ...interface{}) interface{} {
+			for _, value := range values {
+				if !isEmpty(value) {
+					return value
+				}
+			}
+			return nil
+		},
+		"ternary": func(yes, no interface{}, condition bool) interface{} {
+			if condition {
+				return yes
+			}
+			return no
+		},
+
+		// Lists and dicts
+		"list": func(items ...interface{}) []interface{} { return items },
+		"dict": func(pairs ...interface{}) (map[string]interface{}, error) {
+			if len(pairs)%2 != 0 {
+				return nil, fmt.Errorf("dict takes key and value pairs")
+			}
+			d := make(map[string]interface{}, len(pairs)/2)
+			for i := 0; i < len(pairs); i += 2 {
+				d[fmt.Sprint(pairs[i])] = pairs[i+1]
+			}
+			return d, nil
+		},
+		"keys": func(d map[string]interface{}) []string {
+			keys := make([]string, 0, len(d))
+			for key := range d {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			return keys
+		},
+		"hasKey": func(d map[string]interface{}, key string) bool {
+			_, ok := d[key]
+			return ok
+		},
+		"seq": func(n int) []int {
+			s := make([]int, n)
+			for i := range s {
+				s[i] = i
+			}
+			return s
+		},
+
+		// Math
+		"add":  func(a, b interface{}) int64 { return toInt(a) + toInt(b) },
+		"sub":  func(a, b interface{}) int64 { return toInt(a) - toInt(b) },
+		"mul":  func(a, b interface{}) int64 { return toInt(a) * toInt(b) },
+		"div":  func(a, b interface{}) (int64, error) { return divide(a, b, false) },
+		"mod":  func(a, b interface{}) (int64, error) { return divide(a, b, true) },
+		"max":  func(a, b interface{}) int64 { return maxInt(toInt(a), toInt(b)) },
+		"min":  func(a, b interface{}) int64 { return -maxInt(-toInt(a), -toInt(b)) },
+		"int":  toInt,
+		"atoi": func(s string) (int, error) { return strconv.Atoi(strings.TrimSpace(s)) },
+
+		// Encodings
+		"b64enc":    func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+		"b64dec":    func(s string) (string, error) { b, err := base64.StdEncoding.DecodeString(s); return string(b), err },
+		"sha256sum": func(s string) string { sum := sha256.Sum256([]byte(s)); return hex.EncodeToString(sum[:]) },
+		"toJson": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+		"toPrettyJson": func(v interface{}) (string, error) {
+			b, err := json.MarshalIndent(v, "", "  ")
+			return string(b), err
+		},
+		"fromJson": func(s string) (interface{}, error) {
+			var v interface{}
+			err := json.Unmarshal([]byte(s), &v)
+			return v, err
+		},
+		"toYaml": func(v interface{}) (string, error) {
+			b, err := yaml.Marshal(v)
+			return strings.TrimSuffix(string(b), "\n"), err
+		},
+
+		// Network
+		"lookupIP": func(host string) ([]string, error) {
+			ips, err := net.LookupIP(host)
+			if err != nil {
+				return nil, err
+			}
+			addrs := make([]string, len(ips))
+			for i, ip := range ips {
+				addrs[i] = ip.String()
+			}
+			sort.Strings(addrs)
+			return addrs, nil
+		},
+		"lookupSRV": func(service, proto, name string) ([]*net.SRV, error) {
+			_, srvs, err := net.LookupSRV(service, proto, name)
+			return srvs, err
+		},
+		"joinHostPort": func(host string, port interface{}) string { return net.JoinHostPort(host, fmt.Sprint(port)) },
+		"cidrContains": func(cidr, ip string) (bool, error) {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return false, err
+			}
+			return network.Contains(net.ParseIP(ip)), nil
+		},
+	}
+}
+
+// listChildren will return the names of the keys or, with dirsOnly, the directories right under dir
+func listChildren(values map[string]string, dir string, dirsOnly bool) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, key := range sortedKeys(values, dir) {
+		rest := strings.TrimPrefix(key, dir)
+		name := strings.SplitN(rest, "/", 2)[0]
+		isDir := strings.Contains(rest, "/")
+		if name == "" || seen[name] || dirsOnly && !isDir {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names
+}
+
+// indent will prefix every line of s with spaces
+func indent(spaces int, s string) string {
+	pad := strings.Repeat(" ", spaces)
+	return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+}
+
+// isEmpty reports whether v is nil or the zero value of its type, an empty string, list or map
+func isEmpty(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return rv.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return rv.IsNil()
+	}
+	return rv.IsZero()
+}
+
+// toStrings will convert a list of any type to strings
+func toStrings(list interface{}) []string {
+	if s, ok := list.([]string); ok {
+		return s
+	}
+	rv := reflect.ValueOf(list)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return []string{fmt.Sprint(list)}
+	}
+	s := make([]string, rv.Len())
+	for i := range s {
+		s[i] = fmt.Sprint(rv.Index(i).Interface())
+	}
+	return s
+}
+
+// toInt will convert a number or numeric string to an int64, 0 when it is neither
+func toInt(v interface{}) int64 {
+	switch n := v.(type) {
+	case int:
+		return int64(n)
+	case int64:
+		return n
+	case float64:
+		return int64(n)
+	case string:
+		i, _ := strconv.ParseInt(strings.TrimSpace(n), 10, 64)
+		return i
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rv.Uint())
+	}
+	return 0
+}
+
+// divide will return a / b or a % b, failing on a zero divisor
+func divide(a, b interface{}, remainder bool) (int64, error) {
+	d := toInt(b)
+	if d == 0 {
+		return 0, fmt.Errorf("division by zero")
+	}
+	if remainder {
+		return toInt(a) % d, nil
+	}
+	return toInt(a) / d, nil
+}
+
+// maxInt will return the larger of a and b
+func maxInt(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// errKeyExpired is returned when saving a key past its expiry
+var errKeyExpired = errors.New("key expired")
+
+// keyExpiry is when a key expires: at the expiry of its metadata, or --ttl after its value was first seen
+type keyExpiry struct {
+	// MetaExpires is the expiry stored in the metadata of the key, zero without one
+	MetaExpires time.Time
+	// Revision is the revision of the value, first seen at Seen
+	Revision int64
+	Seen     time.Time
+}
+
+var (
+	// ttlRules are the parsed --ttl rules
+	ttlRules []patternRule
+
+	// expiries maps the keys that expire to their expiry
+	expiries   = make(map[string]*keyExpiry)
+	expiriesMu sync.Mutex
+)
+
+// parseTTLRules will parse --ttl pattern=duration rules
+func parseTTLRules(args []string) ([]patternRule, error) {
+	rules, err := parsePatternRules(args)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		if d, err := time.ParseDuration(rule.Value); err != nil || d <= 0 {
+			return nil, fmt.Errorf("%q is not a positive duration", rule.Value)
+		}
+	}
+	return rules, nil
+}
+
+// keyTTL will return the --ttl of etcdKey, 0 when it matches no rule
+func keyTTL(etcdKey string) time.Duration {
+	value, ok := matchRule(ttlRules, etcdKey)
+	if !ok {
+		return 0
+	}
+	d, _ := time.ParseDuration(value)
+	return d
+}
+
+// expires will return when etcdKey expires, the zero time when it does not
+func (e *keyExpiry) expires(etcdKey string) time.Time {
+	if !e.MetaExpires.IsZero() {
+		return e.MetaExpires
+	}
+	if ttl := keyTTL(etcdKey); ttl > 0 && !e.Seen.IsZero() {
+		return e.Seen.Add(ttl)
+	}
+	return time.Time{}
+}
+
+// updateExpiry will note the value of etcdKey at revision, 0 when it is unknown, and the value of its
+// metadata key, nil without one, and return when it expires. expiriesMu must be held.
+func updateExpiry(etcdKey string, revision int64, meta *storeKV, now time.Time) time.Time {
+	e, ok := expiries[etcdKey]
+	if !ok {
+		e = &keyExpiry{}
+	}
+	if revision != 0 && revision != e.Revision {
+		e.Revision, e.Seen = revision, now
+	}
+	if meta != nil {
+		e.MetaExpires = time.Time{}
+		if m := decodeMeta(meta.Value); m != nil && m.Expires != nil {
+			e.MetaExpires = *m.Expires
+		}
+	}
+	expires := e.expires(etcdKey)
+	if expires.IsZero() && keyTTL(etcdKey) == 0 {
+		delete(expiries, etcdKey)
+	} else {
+		expiries[etcdKey] = e
+	}
+	return expires
+}
+
+// trackExpiries will note the expiry of the keys put, metadata keys included, and forget the deleted
+// ones, before they are applied so expired values are not written
+func trackExpiries(puts []storeKV, deleted []string) {
+	now := time.Now()
+	expiriesMu.Lock()
+	defer expiriesMu.Unlock()
+	for _, kv := range puts {
+		switch {
+		case strings.HasSuffix(kv.Key, metaSuffix):
+			kv := kv
+			updateExpiry(strings.TrimSuffix(kv.Key, metaSuffix), 0, &kv, now)
+		case !isReservedKey(kv.Key):
+			updateExpiry(kv.Key, kv.Revision, nil, now)
+		}
+	}
+	for _, key := range deleted {
+		if subject := strings.TrimSuffix(key, metaSuffix); subject != key {
+			updateExpiry(subject, 0, &storeKV{Key: key}, now)
+		} else {
+			delete(expiries, key)
+		}
+	}
+}
+
+// trackEventExpiries will note the expiries of the keys changed by events
+func trackEventExpiries(events []storeEvent) {
+	puts := make([]storeKV, 0, len(events))
+	var deleted []string
+	for _, ev := range events {
+		if ev.Type == storeEventDelete {
+			deleted = append(deleted, ev.KV.Key)
+		} else {
+			puts = append(puts, ev.KV)
+		}
+	}
+	trackExpiries(puts, deleted)
+}
+
+// keyExpired reports whether etcdKey is past its expiry
+func keyExpired(etcdKey string) bool {
+	expiriesMu.Lock()
+	defer expiriesMu.Unlock()
+	e, ok := expiries[etcdKey]
+	if !ok {
+		return false
+	}
+	expires := e.expires(etcdKey)
+	return !expires.IsZero() && !time.Now().Before(expires)
+}
+
+// sweepExpiredKeys will remove the files of the keys past their expiry, then the keys from ETCD unless
+// they were rewritten meanwhile
+func sweepExpiredKeys(ctx context.Context, fileFolder string) {
+	if remotePaused() {
+		return
+	}
+	var due []string
+	expiriesMu.Lock()
+	for key := range expiries {
+		due = append(due, key)
+	}
+	expiriesMu.Unlock()
+	expired := 0
+	for _, key := range due {
+		if keyExpired(key) {
+			expireKey(ctx, key, filepath.Join(fileFolder, key))
+			expired++
+		}
+	}
+	if expired > 0 {
+		runChangeHooks(ctx)
+	}
+}
+
+// expireKey will read etcdKey again and, when it is still expired, remove its file filePath and delete
+// the key with its metadata and signature keys as of the revisions read
+func expireKey(ctx context.Context, etcdKey, filePath string) {
+	var kv, meta *storeKV
+	err := withETCDRetry(ctx, func(ctx context.Context) (err error) {
+		if kv, _, err = kvStore.Get(ctx, etcdKey); err != nil {
+			return err
+		}
+		meta, _, err = kvStore.Get(ctx, metaKey(etcdKey))
+		return err
+	})
+	switch {
+	case err != nil:
+		// keys that must not linger go even while ETCD is unreachable
+		removeExpiredFile(etcdKey, filePath)
+		log.WithFields(log.Fields{
+			"etcdKey": etcdKey,
+			"err":     err,
+		}).Error("cannot delete expired key, will retry")
+		return
+	case kv == nil:
+		// already deleted, its watch event removes the file
+		expiriesMu.Lock()
+		delete(expiries, etcdKey)
+		expiriesMu.Unlock()
+		return
+	}
+	if meta == nil {
+		meta = &storeKV{Key: metaKey(etcdKey)}
+	}
+	expiriesMu.Lock()
+	expires := updateExpiry(etcdKey, kv.Revision, meta, time.Now())
+	expiriesMu.Unlock()
+	if expires.IsZero() || time.Now().Before(expires) {
+		// rewritten with a later expiry
+		return
+	}
+	removeExpiredFile(etcdKey, filePath)
+	cmps := []storeCmp{{Key: etcdKey, Revision: kv.Revision}, {Key: metaKey(etcdKey), Revision: meta.Revision}}
+	ops := []storeOp{deleteOp(etcdKey), deleteOp(metaKey(etcdKey)), deleteOp(sigKey(etcdKey)),
+		deleteOp(sigKey(metaKey(etcdKey)))}
+	var succeeded bool
+	err = withETCDRetry(ctx, func(ctx context.Context) (err error) {
+		succeeded, _, err = kvStore.Txn(ctx, cmps, ops)
+		return err
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"etcdKey": etcdKey,
+			"err":     err,
+		}).Error("cannot delete expired key, will retry")
+		return
+	}
+	if succeeded {
+		expiriesMu.Lock()
+		delete(expiries, etcdKey)
+		expiriesMu.Unlock()
+		log.WithFields(log.Fields{
+			"etcdKey":  etcdKey,
+			"revision": kv.Revision,
+		}).Info("expired key deleted")
+	}
+}
+
+// removeExpiredFile will remove filePath, the file of the expired etcdKey, unless it changed locally
+func removeExpiredFile(etcdKey, filePath string) {
+	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		return
+	}
+	if localChangedSinceSync(etcdKey, filePath) {
+		log.WithFields(log.Fields{
+			"filePath": filePath,
+		}).Warn("key expired but file changed locally, keeping it")
+		return
+	}
+	if err := os.Remove(filePath); err != nil {
+		log.WithFields(log.Fields{
+			"filePath": filePath,
+			"err":      err,
+		}).Error("cannot delete expired file")
+		return
+	}
+	publishEvent(eventDelete, etcdKey, filePath, 0, 0)
+	log.WithFields(log.Fields{
+		"etcdKey":  etcdKey,
+		"filePath": filePath,
+	}).Info("key expired, file removed")
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// errWriteMismatch is returned when a key read back after an upload doesn't hold what was written
+var errWriteMismatch = errors.New("key read back differs from the value written")
+
+// writeVerification is the outcome of reading back the last upload of a file, with --verify-writes
+type writeVerification struct {
+	Revision int64     `json:"revision"`
+	Time     time.Time `json:"time"`
+	Verified bool      `json:"verified"`
+	Error    string    `json:"error,omitempty"`
+}
+
+var (
+	// writeVerifications maps file paths to the verification of their last upload
+	writeVerifications   = make(map[string]writeVerification)
+	writeVerificationsMu sync.Mutex
+)
+
+// verifyUpload will read back the keys ops wrote at revision when uploading filePath to etcdKey and
+// record whether they hold what was written. Failures are logged, audited and count as upload failures.
+func verifyUpload(ctx context.Context, etcdKey, filePath string, ops []storeOp, revision int64) {
+	if !CMDArgs.VerifyWrites {
+		return
+	}
+	err := readBack(ctx, ops, revision)
+	verification := writeVerification{Revision: revision, Time: time.Now().UTC(), Verified: err == nil}
+	if err != nil {
+		verification.Error = err.Error()
+	}
+	writeVerificationsMu.Lock()
+	writeVerifications[filePath] = verification
+	writeVerificationsMu.Unlock()
+	if err == nil {
+		log.WithFields(log.Fields{
+			"etcdKey":  etcdKey,
+			"revision": revision,
+		}).Debug("write verified")
+		return
+	}
+	log.WithFields(log.Fields{
+		"etcdKey":  etcdKey,
+		"filePath": filePath,
+		"revision": revision,
+		"err":      err,
+	}).Error("write verification failed")
+	writeVerificationFailures.Inc()
+	writeAudit(auditEntry{Action: auditVerify, ETCDKey: etcdKey, FilePath: filePath, Detail: err.Error()})
+	failures.recordFailure(conditionUploadFailures, err)
+}
+
+// readBack will read every key ops wrote, as of revision once it was written over, and compare it with the
+// value written. The reads are linearizable, they see every write acknowledged before them.
+func readBack(ctx context.Context, ops []storeOp, revision int64) error {
+	reader, canPin := kvStore.(revisionReader)
+	for _, op := range ops {
+		var kv *storeKV
+		err := withETCDRetry(ctx, func(ctx context.Context) (err error) {
+			kv, _, err = kvStore.Get(ctx, op.Key)
+			if err != nil || (kv != nil && kv.Revision == revision) || !canPin {
+				return err
+			}
+			// written over since, or deleted
+			kv, err = reader.GetAt(ctx, op.Key, revision)
+			return err
+		})
+		switch {
+		case err != nil:
+			return fmt.Errorf("cannot read back %s: %w", op.Key, err)
+		case op.Delete && kv != nil && kv.Revision <= revision:
+			return fmt.Errorf("%w: %s still exists", errWriteMismatch, op.Key)
+		case op.Delete:
+		case kv == nil:
+			return fmt.Errorf("%w: %s is missing", errWriteMismatch, op.Key)
+		case kv.Revision != revision:
+			return fmt.Errorf("%w: %s is at revision %d rather than %d", errWriteMismatch, op.Key, kv.Revision, revision)
+		case contentHash(kv.Value) != contentHash(op.Value):
+			return fmt.Errorf("%w: %s has SHA-256 %s rather than %s", errWriteMismatch, op.Key, contentHash(kv.Value),
+				contentHash(op.Value))
+		}
+	}
+	return nil
+}
+
+// lastVerification will return the verification of the last upload of filePath
+func lastVerification(filePath string) (verification writeVerification, ok bool) {
+	writeVerificationsMu.Lock()
+	defer writeVerificationsMu.Unlock()
+	verification, ok = writeVerifications[filePath]
+	return verification, ok
+}
+
+// unverifiedWrites will return the number of files whose last upload failed verification
+func unverifiedWrites() int {
+	writeVerificationsMu.Lock()
+	defer writeVerificationsMu.Unlock()
+	n := 0
+	for _, verification := range writeVerifications {
+		if !verification.Verified {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// walkBatchSize is the number of directory entries read at once, so huge directories are never held in memory
+const walkBatchSize = 1024
+
+// walkFolder will call fn for every file under root, reading up to workers directories at once. Like
+// filepath.Walk, symbolic links are reported but not followed. fn is called concurrently and in no particular
+// order. Entries removed while the walk runs are skipped, the first other error stops the walk and is returned.
+func walkFolder(root string, workers int, fn func(filePath string, info os.FileInfo) error) error {
+	info, err := os.Lstat(root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fn(root, info)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+		stop     = make(chan struct{})
+		// the walking goroutines besides the caller
+		slots = make(chan struct{}, workers-1)
+	)
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			close(stop)
+		})
+	}
+	var walkDir func(dir string)
+	walkDir = func(dir string) {
+		// subdirectories are walked once dir is closed, so a deep tree does not hold a descriptor per level
+		var subdirs []string
+		if err := readDirEntries(dir, stop, func(entry os.DirEntry) error {
+			filePath := filepath.Join(dir, entry.Name())
+			if entry.IsDir() {
+				subdirs = append(subdirs, filePath)
+				return nil
+			}
+			info, err := entry.Info()
+			if os.IsNotExist(err) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			return fn(filePath, info)
+		}); err != nil {
+			fail(err)
+			return
+		}
+		for _, subdir := range subdirs {
+			select {
+			case slots <- struct{}{}:
+				wg.Add(1)
+				go func(subdir string) {
+					defer wg.Done()
+					defer func() { <-slots }()
+					walkDir(subdir)
+				}(subdir)
+			default:
+				// every worker is busy, walk it from here
+				walkDir(subdir)
+			}
+		}
+	}
+	walkDir(root)
+	wg.Wait()
+	return firstErr
+}
+
+// readDirEntries will call fn for the entries of dir, walkBatchSize at a time, until stop is closed. A directory
+// removed in the meantime has no entries.
+func readDirEntries(dir string, stop <-chan struct{}, fn func(entry os.DirEntry) error) error {
+	f, err := os.Open(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		entries, err := f.ReadDir(walkBatchSize)
+		for _, entry := range entries {
+			if err := fn(entry); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
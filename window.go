@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronField is the set of values a field of a cron expression matches, and whether it was *
+type cronField struct {
+	values map[int]bool
+	any    bool
+}
+
+// cronSchedule is a parsed minute hour day-of-month month day-of-week expression
+type cronSchedule struct {
+	minute, hour, dom, month, dow cronField
+}
+
+// syncWindow is a parsed --sync-window: it opens at every time matching Schedule and stays open for Duration
+type syncWindow struct {
+	Spec     string
+	Schedule cronSchedule
+	Duration time.Duration
+}
+
+// maxWindowSearch bounds the search for the next opening of the sync windows
+const maxWindowSearch = 366 * 24 * time.Hour
+
+// syncWindows are the parsed --sync-window entries, changes of ETCD are only applied while one is open
+var syncWindows []syncWindow
+
+// parseSyncWindows will parse --sync-window entries, five cron fields followed by a duration
+func parseSyncWindows(args []string) ([]syncWindow, error) {
+	windows := make([]syncWindow, 0, len(args))
+	for _, a := range args {
+		fields := strings.Fields(a)
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("%q is not minute hour day-of-month month day-of-week duration", a)
+		}
+		schedule, err := parseCron(fields[:5])
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", a, err)
+		}
+		duration, err := time.ParseDuration(fields[5])
+		if err != nil || duration < time.Minute {
+			return nil, fmt.Errorf("%q: duration must be at least 1m", a)
+		}
+		windows = append(windows, syncWindow{Spec: a, Schedule: schedule, Duration: duration})
+	}
+	return windows, nil
+}
+
+// parseCron will parse the five fields of a cron expression
+func parseCron(fields []string) (s cronSchedule, err error) {
+	bounds := []struct {
+		field    *cronField
+		min, max int
+	}{{&s.minute, 0, 59}, {&s.hour, 0, 23}, {&s.dom, 1, 31}, {&s.month, 1, 12}, {&s.dow, 0, 7}}
+	for i, b := range bounds {
+		if *b.field, err = parseCronField(fields[i], b.min, b.max); err != nil {
+			return s, err
+		}
+	}
+	if s.dow.values[7] {
+		// 7 is Sunday too
+		s.dow.values[0] = true
+	}
+	return s, nil
+}
+
+// parseCronField will parse a comma separated list of *, n, a-b, */step or a-b/step between min and max
+func parseCronField(field string, min, max int) (cronField, error) {
+	f := cronField{values: make(map[int]bool), any: field == "*"}
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return f, fmt.Errorf("bad step in %q", part)
+			}
+			rangePart, step = part[:i], n
+		}
+		lo, hi := min, max
+		if rangePart != "*" {
+			var err error
+			bounds := strings.SplitN(rangePart, "-", 2)
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return f, fmt.Errorf("bad value %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return f, fmt.Errorf("bad range %q", part)
+				}
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return f, fmt.Errorf("%q is out of %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			f.values[v] = true
+		}
+	}
+	return f, nil
+}
+
+// matches reports whether the minute of t matches the schedule. As in cron, when both days are restricted
+// either of them matching is enough.
+func (s cronSchedule) matches(t time.Time) bool {
+	if !s.minute.values[t.Minute()] || !s.hour.values[t.Hour()] || !s.month.values[int(t.Month())] {
+		return false
+	}
+	dom, dow := s.dom.values[t.Day()], s.dow.values[int(t.Weekday())]
+	if s.dom.any || s.dow.any {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// open reports whether the window is open at t
+func (w syncWindow) open(t time.Time) bool {
+	start := t.Truncate(time.Minute)
+	for opened := start; t.Sub(opened) < w.Duration; opened = opened.Add(-time.Minute) {
+		if w.Schedule.matches(opened) {
+			return true
+		}
+	}
+	return false
+}
+
+// inSyncWindow reports whether changes may be applied at t, always without --sync-window
+func inSyncWindow(t time.Time) bool {
+	if len(syncWindows) == 0 {
+		return true
+	}
+	for _, w := range syncWindows {
+		if w.open(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextSyncWindow will return t when a window is open then, or when the next one opens, the zero time when
+// none opens within a year
+func nextSyncWindow(t time.Time) time.Time {
+	if inSyncWindow(t) {
+		return t
+	}
+	for next := t.Truncate(time.Minute).Add(time.Minute); next.Sub(t) < maxWindowSearch; next = next.Add(time.Minute) {
+		for _, w := range syncWindows {
+			if w.Schedule.matches(next) {
+				return next
+			}
+		}
+	}
+	return time.Time{}
+}
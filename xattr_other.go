@@ -0,0 +1,18 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import "errors"
+
+var errXattrUnsupported = errors.New("extended attributes are not supported on this platform")
+
+// readXattrs is not supported on this platform
+func readXattrs(filePath string, prefixes []string) (map[string][]byte, error) {
+	return nil, errXattrUnsupported
+}
+
+// writeXattrs is not supported on this platform
+func writeXattrs(filePath string, xattrs map[string][]byte) error {
+	return errXattrUnsupported
+}
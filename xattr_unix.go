@@ -0,0 +1,59 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+import (
+	"bytes"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// readXattrs will return the extended attributes of filePath whose name starts with one of prefixes
+func readXattrs(filePath string, prefixes []string) (map[string][]byte, error) {
+	size, err := unix.Llistxattr(filePath, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(filePath, buf); err != nil {
+		return nil, err
+	}
+	xattrs := make(map[string][]byte)
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) == 0 || !hasAnyPrefix(string(name), prefixes) {
+			continue
+		}
+		valueSize, err := unix.Lgetxattr(filePath, string(name), nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, valueSize)
+		if valueSize, err = unix.Lgetxattr(filePath, string(name), value); err != nil {
+			return nil, err
+		}
+		xattrs[string(name)] = value[:valueSize]
+	}
+	return xattrs, nil
+}
+
+// writeXattrs will set every attribute of xattrs on filePath
+func writeXattrs(filePath string, xattrs map[string][]byte) error {
+	for name, value := range xattrs {
+		if err := unix.Lsetxattr(filePath, name, value, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasAnyPrefix reports whether s starts with one of prefixes
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
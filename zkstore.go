@@ -0,0 +1,511 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/doody/etcd_file_syncer/backend"
+)
+
+// zkMaxValueSize is ZooKeeper's default jute.maxbuffer, the largest node it accepts
+const zkMaxValueSize = 0xfffff
+
+func init() {
+	backend.Register(backend.Backend{
+		Name: backendZooKeeper,
+		Open: func(ctx context.Context, opts backend.Options) (store, error) {
+			return connectZooKeeper(ctx, CMDArgs.ZooKeeperServers, opts.StartupRetries)
+		},
+		Classify: classifyZKError,
+	})
+}
+
+// classifyZKError will classify zkErrors by code
+func classifyZKError(err error) backend.ErrorClass {
+	var zkErr *zkError
+	if !errors.As(err, &zkErr) {
+		return backend.ErrorOther
+	}
+	switch zkErr.Code {
+	case zkErrNoAuth, zkErrAuthFailed:
+		return backend.ErrorAuth
+	case zkErrConnectionLoss, zkErrOperationTimeout, zkErrSessionExpired:
+		return backend.ErrorTransient
+	}
+	return backend.ErrorFailed
+}
+
+// zkStore is the store of a ZooKeeper ensemble, a node per key under --zk-root. The zxid plays the part
+// of the ETCD revision, a key's revision is the zxid of its last modification. Parent nodes created for
+// a key hold no data, a null value, they are not keys themselves.
+type zkStore struct {
+	servers []string
+	root    string
+	auth    string
+	// leadingSlash is set when keys start with a slash, like --key, node paths always do
+	leadingSlash bool
+
+	mu   sync.Mutex
+	conn *zkConn
+}
+
+// connectZooKeeper will create the ZooKeeper store and open its session, retrying up to retries times
+// with exponential backoff
+func connectZooKeeper(ctx context.Context, servers []string, retries int) (store, error) {
+	s := &zkStore{
+		servers:      servers,
+		root:         strings.TrimSuffix(CMDArgs.ZooKeeperRoot, "/"),
+		auth:         CMDArgs.ZooKeeperAuth,
+		leadingSlash: strings.HasPrefix(CMDArgs.ConfigKey, "/"),
+	}
+	err := retryStartup(ctx, retries, "ZooKeeper", func() error {
+		_, err := s.session(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// session will return the current session, opening a new one when it was lost
+func (s *zkStore) session(ctx context.Context) (*zkConn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil && s.conn.alive() {
+		return s.conn, nil
+	}
+	conn, err := dialZooKeeper(ctx, s.servers, CMDArgs.ZooKeeperSessionTimeout, s.auth)
+	if err != nil {
+		return nil, err
+	}
+	s.conn = conn
+	return conn, nil
+}
+
+// nodePath will return the node of key
+func (s *zkStore) nodePath(key string) string {
+	return s.root + "/" + strings.TrimPrefix(key, "/")
+}
+
+// nodeKey will return the key of node p
+func (s *zkStore) nodeKey(p string) string {
+	key := strings.TrimPrefix(p, s.root+"/")
+	if s.leadingSlash {
+		return "/" + key
+	}
+	return key
+}
+
+// getData will read node p, setting a data watch on it when watch is set
+func (s *zkStore) getData(ctx context.Context, c *zkConn, p string, watch bool) ([]byte, zkStat, int64, error) {
+	var req zkEncoder
+	req.string(p)
+	req.bool(watch)
+	reply, err := c.request(ctx, zkOpGetData, req.Bytes())
+	if err != nil {
+		return nil, zkStat{}, 0, err
+	}
+	d := zkDecoder{buf: reply.Body}
+	data, stat := d.buffer(), d.stat()
+	return data, stat, reply.Zxid, d.err
+}
+
+// children will list the children of node p, setting a child watch on it when watch is set
+func (s *zkStore) children(ctx context.Context, c *zkConn, p string, watch bool) ([]string, int64, error) {
+	var req zkEncoder
+	req.string(p)
+	req.bool(watch)
+	reply, err := c.request(ctx, zkOpGetChildren2, req.Bytes())
+	if err != nil {
+		return nil, 0, err
+	}
+	d := zkDecoder{buf: reply.Body}
+	names := make([]string, d.int32())
+	for i := range names {
+		names[i] = d.string()
+	}
+	return names, reply.Zxid, d.err
+}
+
+// exists will return the stat of node p, nil when it doesn't exist, and the zxid of the read
+func (s *zkStore) exists(ctx context.Context, c *zkConn, p string) (*zkStat, int64, error) {
+	var req zkEncoder
+	req.string(p)
+	req.bool(false)
+	reply, err := c.request(ctx, zkOpExists, req.Bytes())
+	if isZKError(err, zkErrNoNode) {
+		return nil, reply.Zxid, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	d := zkDecoder{buf: reply.Body}
+	stat := d.stat()
+	return &stat, reply.Zxid, d.err
+}
+
+// writeACL will write the ACL of the nodes created by the syncer, restricted to --zk-auth when set
+func (s *zkStore) writeACL(e *zkEncoder) {
+	if s.auth != "" {
+		e.acl("auth", "")
+	} else {
+		e.acl("world", "anyone")
+	}
+}
+
+// ensureParents will create the missing ancestors of node p without data
+func (s *zkStore) ensureParents(ctx context.Context, c *zkConn, p string) error {
+	var missing []string
+	for dir := path.Dir(p); dir != "/" && dir != s.root; dir = path.Dir(dir) {
+		stat, _, err := s.exists(ctx, c, dir)
+		if err != nil {
+			return err
+		}
+		if stat != nil {
+			break
+		}
+		missing = append(missing, dir)
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		var req zkEncoder
+		req.string(missing[i])
+		req.buffer(nil)
+		s.writeACL(&req)
+		req.int32(0) // persistent
+		if _, err := c.request(ctx, zkOpCreate, req.Bytes()); err != nil && !isZKError(err, zkErrNodeExists) {
+			return err
+		}
+	}
+	return nil
+}
+
+// isZKError reports whether err is the ZooKeeper error code
+func isZKError(err error, code int32) bool {
+	var zkErr *zkError
+	return errors.As(err, &zkErr) && zkErr.Code == code
+}
+
+// list will read every key under prefix, setting watches on the nodes read when watch is set. ZooKeeper
+// has no snapshot reads, the revision is the zxid of the first read: every key is at least that recent.
+func (s *zkStore) list(ctx context.Context, prefix string, watch bool) ([]storeKV, int64, error) {
+	c, err := s.session(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	prefixPath := s.nodePath(prefix)
+	dir := path.Dir(prefixPath)
+	if strings.HasSuffix(prefixPath, "/") {
+		dir = path.Clean(prefixPath)
+	}
+	var (
+		kvs      []storeKV
+		revision int64
+	)
+	var walk func(p string) error
+	walk = func(p string) error {
+		names, zxid, err := s.children(ctx, c, p, watch)
+		if isZKError(err, zkErrNoNode) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if revision == 0 {
+			revision = zxid
+		}
+		for _, name := range names {
+			child := path.Join(p, name)
+			if child == "/zookeeper" || !(strings.HasPrefix(child, prefixPath) || strings.HasPrefix(prefixPath, child+"/")) {
+				continue
+			}
+			data, stat, _, err := s.getData(ctx, c, child, watch)
+			if isZKError(err, zkErrNoNode) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if data != nil && strings.HasPrefix(child, prefixPath) {
+				kvs = append(kvs, storeKV{Key: s.nodeKey(child), Value: data, Revision: stat.Mzxid, Version: int64(stat.Version) + 1})
+			}
+			if stat.NumChildren > 0 {
+				if err := walk(child); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := walk(dir); err != nil {
+		return nil, 0, err
+	}
+	if revision == 0 {
+		// the prefix doesn't exist yet
+		if _, revision, err = s.exists(ctx, c, "/"); err != nil {
+			return nil, 0, err
+		}
+	}
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+	return kvs, revision, nil
+}
+
+// Get - store
+func (s *zkStore) Get(ctx context.Context, key string) (*storeKV, int64, error) {
+	c, err := s.session(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	data, stat, zxid, err := s.getData(ctx, c, s.nodePath(key), false)
+	if isZKError(err, zkErrNoNode) {
+		_, zxid, err = s.exists(ctx, c, "/")
+		return nil, zxid, err
+	}
+	if err != nil || data == nil {
+		return nil, zxid, err
+	}
+	return &storeKV{Key: key, Value: data, Revision: stat.Mzxid, Version: int64(stat.Version) + 1}, zxid, nil
+}
+
+// List - store
+func (s *zkStore) List(ctx context.Context, prefix string) ([]storeKV, int64, error) {
+	return s.list(ctx, prefix, false)
+}
+
+// Txn - store. cmps are checked on the node versions read before the multi request, a node changing in
+// between fails the version check of the multi.
+func (s *zkStore) Txn(ctx context.Context, cmps []storeCmp, ops []storeOp) (bool, int64, error) {
+	c, err := s.session(ctx)
+	if err != nil {
+		return false, 0, err
+	}
+	var (
+		multi zkEncoder
+		count int
+	)
+	header := func(op int32) {
+		multi.int32(op)
+		multi.bool(false)
+		multi.int32(-1)
+		count++
+	}
+	for _, cmp := range cmps {
+		stat, _, err := s.exists(ctx, c, s.nodePath(cmp.Key))
+		switch {
+		case err != nil:
+			return false, 0, err
+		case cmp.Revision == 0 && stat == nil:
+			// creating the node below fails if it appears meanwhile
+		case stat == nil || stat.Mzxid != cmp.Revision:
+			return false, 0, nil
+		default:
+			header(zkOpCheck)
+			multi.string(s.nodePath(cmp.Key))
+			multi.int32(stat.Version)
+		}
+	}
+	for _, op := range ops {
+		p := s.nodePath(op.Key)
+		stat, _, err := s.exists(ctx, c, p)
+		if err != nil {
+			return false, 0, err
+		}
+		switch {
+		case op.Delete && stat == nil:
+		case op.Delete:
+			header(zkOpDelete)
+			multi.string(p)
+			multi.int32(-1)
+		case stat == nil:
+			if err := s.ensureParents(ctx, c, p); err != nil {
+				return false, 0, err
+			}
+			header(zkOpCreate)
+			multi.string(p)
+			multi.buffer(append([]byte{}, op.Value...))
+			s.writeACL(&multi)
+			multi.int32(0)
+		default:
+			header(zkOpSetData)
+			multi.string(p)
+			multi.buffer(append([]byte{}, op.Value...))
+			multi.int32(-1)
+		}
+	}
+	if count == 0 {
+		_, zxid, err := s.exists(ctx, c, "/")
+		return err == nil, zxid, err
+	}
+	multi.int32(-1)
+	multi.bool(true)
+	multi.int32(-1)
+
+	reply, err := c.request(ctx, zkOpMulti, multi.Bytes())
+	code := multiError(reply.Body)
+	var zkErr *zkError
+	if code == 0 && errors.As(err, &zkErr) {
+		code = zkErr.Code
+	}
+	switch {
+	case code == 0 && err == nil:
+		return true, reply.Zxid, nil
+	case len(cmps) > 0 && (code == zkErrBadVersion || code == zkErrNoNode || code == zkErrNodeExists):
+		return false, 0, nil
+	case err != nil:
+		return false, 0, err
+	}
+	return false, 0, &zkError{Code: code}
+}
+
+// multiError will return the error code of the operation that failed a multi response, 0 when none did
+func multiError(body []byte) int32 {
+	d := zkDecoder{buf: body}
+	for d.err == nil {
+		op, done, code := d.int32(), d.bool(), d.int32()
+		if done || d.err != nil {
+			return 0
+		}
+		switch op {
+		case zkOpError:
+			if code = d.int32(); code != 0 && code != zkErrRuntimeInconsistency {
+				return code
+			}
+		case zkOpCreate:
+			d.string()
+		case zkOpSetData:
+			d.stat()
+		}
+	}
+	return 0
+}
+
+// Watch - store. ZooKeeper watches fire once and carry no data: on every notification under prefix,
+// and at least every half --watch-stall-timeout as progress, the keys are read again with new watches
+// and compared with the previous read.
+func (s *zkStore) Watch(ctx context.Context, prefix string, revision int64) <-chan storeWatchResponse {
+	out := make(chan storeWatchResponse)
+	interval := CMDArgs.WatchStallTimeout / 2
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	go func() {
+		defer close(out)
+		send := func(resp storeWatchResponse) bool {
+			select {
+			case out <- resp:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		c, err := s.session(ctx)
+		if err != nil {
+			send(storeWatchResponse{Err: err})
+			return
+		}
+		notifications := c.subscribe()
+		defer c.unsubscribe(notifications)
+		dir := path.Dir(s.nodePath(prefix) + "x")
+
+		var known map[string]int64
+		for {
+			kvs, index, err := s.list(ctx, prefix, true)
+			if err != nil {
+				if ctx.Err() == nil {
+					send(storeWatchResponse{Err: err})
+				}
+				return
+			}
+			resp := storeWatchResponse{Revision: index}
+			current := make(map[string]int64, len(kvs))
+			for _, kv := range kvs {
+				current[kv.Key] = kv.Revision
+				rev, ok := known[kv.Key]
+				if (known == nil && revision > 0 && kv.Revision > revision) || (known != nil && (!ok || kv.Revision > rev)) {
+					resp.Events = append(resp.Events, storeEvent{Type: storeEventPut, KV: kv})
+				}
+			}
+			for key := range known {
+				if _, ok := current[key]; !ok {
+					resp.Events = append(resp.Events, storeEvent{Type: storeEventDelete, KV: storeKV{Key: key, Revision: index}})
+				}
+			}
+			sort.SliceStable(resp.Events, func(i, j int) bool { return resp.Events[i].KV.Revision < resp.Events[j].KV.Revision })
+			known = current
+			if !send(resp) {
+				return
+			}
+
+			timer := time.NewTimer(interval)
+		wait:
+			for {
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return
+				case <-timer.C:
+					break wait
+				case ev, ok := <-notifications:
+					if !ok {
+						timer.Stop()
+						send(storeWatchResponse{Err: &zkError{Code: zkErrSessionExpired}})
+						return
+					}
+					if strings.HasPrefix(ev.Path, dir) {
+						timer.Stop()
+						break wait
+					}
+				}
+			}
+		}
+	}()
+	return out
+}
+
+// Revision - store
+func (s *zkStore) Revision(ctx context.Context, prefix string) (int64, int64, error) {
+	kvs, _, err := s.list(ctx, prefix, false)
+	if err != nil {
+		return 0, 0, err
+	}
+	c, err := s.session(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	_, head, err := s.exists(ctx, c, "/")
+	if err != nil {
+		return 0, 0, err
+	}
+	var lastChange int64
+	for _, kv := range kvs {
+		if kv.Revision > lastChange {
+			lastChange = kv.Revision
+		}
+	}
+	return head, lastChange, nil
+}
+
+// MaxValueSize - store
+func (s *zkStore) MaxValueSize() int {
+	return zkMaxValueSize - requestOverhead
+}
+
+// MaxTxnOps - store, a multi request is only bounded by jute.maxbuffer
+func (s *zkStore) MaxTxnOps() int {
+	return 0
+}
+
+// Close - store
+func (s *zkStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		return s.conn.Close()
+	}
+	return nil
+}
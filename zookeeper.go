@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// ZooKeeper request types
+const (
+	zkOpCreate       = 1
+	zkOpDelete       = 2
+	zkOpExists       = 3
+	zkOpGetData      = 4
+	zkOpSetData      = 5
+	zkOpPing         = 11
+	zkOpGetChildren2 = 12
+	zkOpCheck        = 13
+	zkOpMulti        = 14
+	zkOpAuth         = 100
+	zkOpClose        = -11
+	// zkOpError is the type of a failed operation in a multi response
+	zkOpError = -1
+)
+
+// Reserved xids
+const (
+	zkXidNotification = -1
+	zkXidPing         = -2
+	zkXidAuth         = -4
+)
+
+// ZooKeeper error codes
+const (
+	zkErrRuntimeInconsistency = -2
+	zkErrConnectionLoss       = -4
+	zkErrOperationTimeout     = -7
+	zkErrNoNode               = -101
+	zkErrNoAuth               = -102
+	zkErrBadVersion           = -103
+	zkErrNodeExists           = -110
+	zkErrSessionExpired       = -112
+	zkErrAuthFailed           = -115
+)
+
+// zkPerms are the permissions of the nodes created by the syncer: read, write, create, delete and admin
+const zkPerms = 31
+
+// zkMaxPacket bounds the packets read from the server, above its default jute.maxbuffer
+const zkMaxPacket = 16 * 1024 * 1024
+
+var zkErrorNames = map[int32]string{
+	zkErrRuntimeInconsistency: "runtime inconsistency",
+	zkErrConnectionLoss:       "connection loss",
+	zkErrOperationTimeout:     "operation timeout",
+	zkErrNoNode:               "node does not exist",
+	zkErrNoAuth:               "not authenticated",
+	zkErrBadVersion:           "version conflict",
+	zkErrNodeExists:           "node already exists",
+	zkErrSessionExpired:       "session expired",
+	zkErrAuthFailed:           "authentication failed",
+}
+
+// zkError is an error code returned by ZooKeeper
+type zkError struct {
+	Code int32
+}
+
+func (e *zkError) Error() string {
+	if name, ok := zkErrorNames[e.Code]; ok {
+		return "zookeeper: " + name
+	}
+	return fmt.Sprintf("zookeeper: error %d", e.Code)
+}
+
+// zkStat is the metadata ZooKeeper keeps for a node
+type zkStat struct {
+	Czxid, Mzxid, Ctime, Mtime  int64
+	Version, Cversion, Aversion int32
+	EphemeralOwner              int64
+	DataLength, NumChildren     int32
+	Pzxid                       int64
+}
+
+// zkWatchEvent is a watch notification, sent once when the watched node or its children change
+type zkWatchEvent struct {
+	Type  int32
+	State int32
+	Path  string
+}
+
+// zkEncoder writes the jute encoding of requests
+type zkEncoder struct {
+	bytes.Buffer
+}
+
+func (e *zkEncoder) int32(v int32) { binary.Write(e, binary.BigEndian, v) }
+func (e *zkEncoder) int64(v int64) { binary.Write(e, binary.BigEndian, v) }
+
+func (e *zkEncoder) bool(v bool) {
+	if v {
+		e.WriteByte(1)
+	} else {
+		e.WriteByte(0)
+	}
+}
+
+func (e *zkEncoder) string(v string) {
+	e.int32(int32(len(v)))
+	e.WriteString(v)
+}
+
+// buffer will write v, nil being encoded as a null buffer
+func (e *zkEncoder) buffer(v []byte) {
+	if v == nil {
+		e.int32(-1)
+		return
+	}
+	e.int32(int32(len(v)))
+	e.Write(v)
+}
+
+// acl will write a single ACL entry granting zkPerms to scheme:id
+func (e *zkEncoder) acl(scheme, id string) {
+	e.int32(1)
+	e.int32(zkPerms)
+	e.string(scheme)
+	e.string(id)
+}
+
+// zkDecoder reads the jute encoding of responses, the first error sticks
+type zkDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *zkDecoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.buf) {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	v := d.buf[:n]
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *zkDecoder) int32() int32 {
+	if b := d.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *zkDecoder) int64() int64 {
+	if b := d.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *zkDecoder) bool() bool {
+	b := d.take(1)
+	return b != nil && b[0] != 0
+}
+
+// buffer will read a buffer, nil for a null one
+func (d *zkDecoder) buffer() []byte {
+	n := d.int32()
+	if n < 0 || d.err != nil {
+		return nil
+	}
+	return append([]byte{}, d.take(int(n))...)
+}
+
+func (d *zkDecoder) string() string {
+	return string(d.buffer())
+}
+
+func (d *zkDecoder) stat() (s zkStat) {
+	s.Czxid, s.Mzxid, s.Ctime, s.Mtime = d.int64(), d.int64(), d.int64(), d.int64()
+	s.Version, s.Cversion, s.Aversion = d.int32(), d.int32(), d.int32()
+	s.EphemeralOwner = d.int64()
+	s.DataLength, s.NumChildren = d.int32(), d.int32()
+	s.Pzxid = d.int64()
+	return s
+}
+
+// zkReply is the answer to a request, Zxid is the last transaction the server had applied
+type zkReply struct {
+	Zxid int64
+	Body []byte
+	err  int32
+}
+
+// zkConn is a ZooKeeper session over a single connection. Requests are pipelined and matched to their
+// reply by xid, watch notifications are fanned out to every subscriber. The session ends with the
+// connection, its watches with it.
+type zkConn struct {
+	conn    net.Conn
+	timeout time.Duration
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	xid      int32
+	pending  map[int32]chan zkReply
+	watchers map[chan zkWatchEvent]bool
+	closed   chan struct{}
+	err      error
+}
+
+// dialZooKeeper will open a session on the first of servers that accepts one, authenticating with
+// digest credentials user:password when auth is set
+func dialZooKeeper(ctx context.Context, servers []string, timeout time.Duration, auth string) (*zkConn, error) {
+	if len(servers) == 0 {
+		return nil, errors.New("no ZooKeeper server configured")
+	}
+	var err error
+	for _, server := range servers {
+		var c *zkConn
+		if c, err = openZKSession(ctx, server, timeout); err != nil {
+			continue
+		}
+		if auth != "" {
+			var req zkEncoder
+			req.int32(0)
+			req.string("digest")
+			req.buffer([]byte(auth))
+			if _, err = c.request(ctx, zkOpAuth, req.Bytes()); err != nil {
+				c.Close()
+				return nil, err
+			}
+		}
+		return c, nil
+	}
+	return nil, err
+}
+
+// openZKSession will connect to server and negotiate a new session
+func openZKSession(ctx context.Context, server string, timeout time.Duration) (*zkConn, error) {
+	dialer := net.Dialer{Timeout: dialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	var req zkEncoder
+	req.int32(0) // protocol version
+	req.int64(0) // last zxid seen
+	req.int32(int32(timeout / time.Millisecond))
+	req.int64(0) // session id
+	req.buffer(make([]byte, 16))
+	req.bool(false) // read only
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	if err := writeZKPacket(conn, req.Bytes()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	packet, err := readZKPacket(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	resp := zkDecoder{buf: packet}
+	resp.int32() // protocol version
+	negotiated := time.Duration(resp.int32()) * time.Millisecond
+	if resp.err != nil || negotiated <= 0 {
+		conn.Close()
+		return nil, &zkError{Code: zkErrSessionExpired}
+	}
+	c := &zkConn{
+		conn:     conn,
+		timeout:  negotiated,
+		pending:  make(map[int32]chan zkReply),
+		watchers: make(map[chan zkWatchEvent]bool),
+		closed:   make(chan struct{}),
+	}
+	go c.recvLoop()
+	go c.pingLoop()
+	return c, nil
+}
+
+// writeZKPacket will write payload with its length prefix
+func writeZKPacket(w io.Writer, payload []byte) error {
+	packet := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(packet, uint32(len(payload)))
+	copy(packet[4:], payload)
+	_, err := w.Write(packet)
+	return err
+}
+
+// readZKPacket will read one length prefixed packet
+func readZKPacket(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > zkMaxPacket {
+		return nil, fmt.Errorf("zookeeper packet of %d bytes", n)
+	}
+	packet := make([]byte, n)
+	_, err := io.ReadFull(r, packet)
+	return packet, err
+}
+
+// send will write a request with its header
+func (c *zkConn) send(xid, op int32, body []byte) error {
+	var packet zkEncoder
+	packet.int32(xid)
+	packet.int32(op)
+	packet.Write(body)
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	return writeZKPacket(c.conn, packet.Bytes())
+}
+
+// request will send op and wait for its reply. A non zero error code in the reply is returned as a
+// zkError along with the reply, the body of multi responses holds the error of each operation.
+func (c *zkConn) request(ctx context.Context, op int32, body []byte) (zkReply, error) {
+	ch := make(chan zkReply, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return zkReply{}, c.err
+	}
+	xid := int32(zkXidAuth)
+	if op != zkOpAuth {
+		c.xid++
+		xid = c.xid
+	}
+	c.pending[xid] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, xid)
+		c.mu.Unlock()
+	}()
+
+	if err := c.send(xid, op, body); err != nil {
+		c.fail(err)
+		return zkReply{}, err
+	}
+	select {
+	case reply := <-ch:
+		if reply.err != 0 {
+			return reply, &zkError{Code: reply.err}
+		}
+		return reply, nil
+	case <-c.closed:
+		return zkReply{}, c.err
+	case <-ctx.Done():
+		return zkReply{}, ctx.Err()
+	}
+}
+
+// recvLoop will dispatch replies and watch notifications until the connection fails
+func (c *zkConn) recvLoop() {
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+		packet, err := readZKPacket(c.conn)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		d := zkDecoder{buf: packet}
+		xid, zxid, code := d.int32(), d.int64(), d.int32()
+		if d.err != nil {
+			c.fail(d.err)
+			return
+		}
+		switch xid {
+		case zkXidPing:
+		case zkXidNotification:
+			ev := zkWatchEvent{Type: d.int32(), State: d.int32(), Path: d.string()}
+			c.mu.Lock()
+			for ch := range c.watchers {
+				select {
+				case ch <- ev:
+				default:
+					// the subscriber has changes to catch up with already
+				}
+			}
+			c.mu.Unlock()
+		default:
+			c.mu.Lock()
+			ch, ok := c.pending[xid]
+			c.mu.Unlock()
+			if ok {
+				ch <- zkReply{Zxid: zxid, Body: d.buf, err: code}
+			}
+		}
+	}
+}
+
+// pingLoop will keep the session alive while the connection is idle
+func (c *zkConn) pingLoop() {
+	ticker := time.NewTicker(c.timeout / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+			if err := c.send(zkXidPing, zkOpPing, nil); err != nil {
+				c.fail(err)
+				return
+			}
+		}
+	}
+}
+
+// fail will end the session with err, failing pending requests and closing subscriptions
+func (c *zkConn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = fmt.Errorf("%w: %v", &zkError{Code: zkErrConnectionLoss}, err)
+	close(c.closed)
+	c.conn.Close()
+	for ch := range c.watchers {
+		close(ch)
+	}
+	c.watchers = nil
+}
+
+// alive reports whether the session is still usable
+func (c *zkConn) alive() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err == nil
+}
+
+// subscribe will return a channel receiving the watch notifications of the session, closed when the
+// session ends
+func (c *zkConn) subscribe() chan zkWatchEvent {
+	ch := make(chan zkWatchEvent, 64)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		close(ch)
+		return ch
+	}
+	c.watchers[ch] = true
+	return ch
+}
+
+// unsubscribe will stop notifications to ch
+func (c *zkConn) unsubscribe(ch chan zkWatchEvent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.watchers[ch] {
+		delete(c.watchers, ch)
+		close(ch)
+	}
+}
+
+// Close will end the session, removing its watches on the server
+func (c *zkConn) Close() error {
+	if c.alive() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		c.request(ctx, zkOpClose, nil)
+		cancel()
+	}
+	c.fail(errors.New("session closed"))
+	return nil
+}